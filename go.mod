@@ -13,9 +13,12 @@ require (
 	github.com/klauspost/compress v1.18.6
 	github.com/nats-io/nats-server/v2 v2.14.0
 	github.com/nats-io/nats.go v1.52.0
+	github.com/pkg/sftp v1.13.10
 	github.com/richardlehane/mscfb v1.0.6
 	go-simpler.org/env v0.12.0
+	golang.org/x/crypto v0.51.0
 	golang.org/x/text v0.37.0
+	golang.org/x/time v0.15.0
 )
 
 require (
@@ -24,14 +27,13 @@ require (
 	github.com/google/go-tpm v0.9.8 // indirect
 	github.com/hhrutter/lzw v1.0.0 // indirect
 	github.com/hhrutter/tiff v1.0.3 // indirect
+	github.com/kr/fs v0.1.0 // indirect
 	github.com/mattn/go-runewidth v0.0.23 // indirect
 	github.com/minio/highwayhash v1.0.4 // indirect
 	github.com/nats-io/jwt/v2 v2.8.1 // indirect
 	github.com/nats-io/nkeys v0.4.15 // indirect
 	github.com/nats-io/nuid v1.0.1 // indirect
 	github.com/richardlehane/msoleps v1.0.6 // indirect
-	golang.org/x/crypto v0.51.0 // indirect
 	golang.org/x/image v0.40.0 // indirect
 	golang.org/x/sys v0.44.0 // indirect
-	golang.org/x/time v0.15.0 // indirect
 )
@@ -0,0 +1,150 @@
+// Package admission limits the number of documents extracted concurrently, in total and per document type,
+// and the memory they take up. Documents exceeding the limits wait in a bounded queue.
+package admission
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var (
+	// ErrQueueFull is returned if the queue of waiting documents is full
+	ErrQueueFull = errors.New("too many documents waiting for extraction")
+	// ErrTimeout is returned if a document waited for admission until its context's deadline
+	ErrTimeout = errors.New("timed out waiting for extraction")
+)
+
+// Limits of a [Limiter]. Zero values disable the respective limit, except for QueueSize.
+type Limits struct {
+	// Concurrent is the number of documents extracted concurrently
+	Concurrent int
+	// PerType is the number of documents of a type extracted concurrently
+	PerType map[string]int
+	// Memory is the sum of the sizes of documents extracted concurrently
+	Memory int64
+	// QueueSize is the number of documents waiting for admission
+	QueueSize int
+}
+
+// Limiter admits documents for extraction as long as the limits are not exceeded.
+// Waiting documents are admitted in order, but a document that fits is not held up by one waiting for
+// a slot of its type or for memory.
+type Limiter struct {
+	limits  Limits
+	mu      sync.Mutex
+	running int
+	perType map[string]int
+	memory  int64
+	queue   []*waiter
+}
+
+type waiter struct {
+	docType  string
+	size     int64
+	admitted chan struct{}
+}
+
+// New returns a Limiter enforcing limits
+func New(limits Limits) *Limiter {
+	return &Limiter{limits: limits, perType: make(map[string]int)}
+}
+
+// Acquire waits until a document of the given type and size may be extracted and returns a func releasing its slot,
+// which must be called once the document is done. Documents larger than the memory limit are admitted when
+// nothing else takes up memory. It fails with [ErrQueueFull], [ErrTimeout] or the error of ctx.
+func (l *Limiter) Acquire(ctx context.Context, docType string, size int64) (release func(), err error) {
+	if l.limits.Memory > 0 {
+		size = min(max(size, 0), l.limits.Memory)
+	} else {
+		size = 0
+	}
+	w := &waiter{docType: docType, size: size}
+	release = func() { l.release(w) }
+	l.mu.Lock()
+	if len(l.queue) == 0 && l.fits(w) {
+		l.admit(w)
+		l.mu.Unlock()
+		return release, nil
+	}
+	if len(l.queue) >= l.limits.QueueSize {
+		l.mu.Unlock()
+		return nil, ErrQueueFull
+	}
+	w.admitted = make(chan struct{})
+	l.queue = append(l.queue, w)
+	l.mu.Unlock()
+	select {
+	case <-w.admitted:
+		return release, nil
+	case <-ctx.Done():
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-w.admitted:
+		// admitted while giving up
+		return release, nil
+	default:
+	}
+	for i, queued := range l.queue {
+		if queued == w {
+			l.queue = append(l.queue[:i], l.queue[i+1:]...)
+			break
+		}
+	}
+	// documents behind w may fit now
+	l.dispatch()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return nil, ErrTimeout
+	}
+	return nil, ctx.Err()
+}
+
+// Stats returns the number of documents extracted and waiting
+func (l *Limiter) Stats() (running, waiting int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.running, len(l.queue)
+}
+
+// fits reports whether w can be admitted now
+func (l *Limiter) fits(w *waiter) bool {
+	if l.limits.Concurrent > 0 && l.running >= l.limits.Concurrent {
+		return false
+	}
+	if limit := l.limits.PerType[w.docType]; limit > 0 && l.perType[w.docType] >= limit {
+		return false
+	}
+	return l.limits.Memory <= 0 || l.memory+w.size <= l.limits.Memory
+}
+
+func (l *Limiter) admit(w *waiter) {
+	l.running++
+	l.perType[w.docType]++
+	l.memory += w.size
+}
+
+func (l *Limiter) release(w *waiter) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.running--
+	l.perType[w.docType]--
+	l.memory -= w.size
+	l.dispatch()
+}
+
+// dispatch admits the waiting documents that fit, in order
+func (l *Limiter) dispatch() {
+	waiting := l.queue[:0]
+	for _, w := range l.queue {
+		if l.fits(w) {
+			l.admit(w)
+			close(w.admitted)
+		} else {
+			waiting = append(waiting, w)
+		}
+	}
+	clear(l.queue[len(waiting):])
+	l.queue = waiting
+}
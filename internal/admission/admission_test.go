@@ -0,0 +1,88 @@
+package admission
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	l := New(Limits{Concurrent: 3, PerType: map[string]int{"pdf": 1}, Memory: 100, QueueSize: 2})
+	ctx := context.Background()
+	timeout := func() context.Context {
+		ctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+		t.Cleanup(cancel)
+		return ctx
+	}
+
+	releasePdf, err := l.Acquire(ctx, "pdf", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Acquire(timeout(), "pdf", 10); !errors.Is(err, ErrTimeout) {
+		t.Errorf("second pdf: %v", err)
+	}
+	// other types are not held up by the limit of pdfs
+	releaseDocx, err := l.Acquire(ctx, "docx", 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the memory limit is exceeded
+	if _, err := l.Acquire(timeout(), "rtf", 40); !errors.Is(err, ErrTimeout) {
+		t.Errorf("rtf exceeding memory: %v", err)
+	}
+
+	// queue a pdf and a large document, then overflow the queue
+	admitted := make(chan string, 2)
+	for _, docType := range []string{"pdf", "image"} {
+		go func() {
+			release, err := l.Acquire(ctx, docType, 1000)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			admitted <- docType
+			release()
+		}()
+	}
+	for {
+		if _, waiting := l.Stats(); waiting == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := l.Acquire(ctx, "rtf", 0); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("full queue: %v", err)
+	}
+
+	// the large documents are admitted one after another, when the memory is free
+	releasePdf()
+	select {
+	case docType := <-admitted:
+		t.Errorf("%s admitted before memory was freed", docType)
+	case <-time.After(10 * time.Millisecond):
+	}
+	releaseDocx()
+	for range 2 {
+		select {
+		case <-admitted:
+		case <-time.After(time.Second):
+			t.Fatal("queued documents not admitted")
+		}
+	}
+	for {
+		if running, waiting := l.Stats(); running == 0 && waiting == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	release, err := l.Acquire(ctx, "pdf", 10)
+	if err != nil {
+		t.Fatalf("free limiter: %v", err)
+	}
+	release()
+}
@@ -0,0 +1,385 @@
+// Package auth authenticates clients of the HTTP API by API key or JSON Web Token
+// and enforces their rate limits, quotas and allowed features.
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"encoding/json/v2"
+
+	"github.com/dustin/go-humanize"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/httplog/v2"
+	"golang.org/x/time/rate"
+)
+
+// Features clients may be allowed to use. Clients without a list of features may use all of them.
+const (
+	// FeatureExtract allows extracting text from URLs and request bodies
+	FeatureExtract = "extract"
+	// FeatureLayout, FeatureTables and FeatureWords allow the respective modes
+	FeatureLayout = "layout"
+	FeatureTables = "tables"
+	FeatureWords  = "words"
+	// FeatureOcr allows OCR. Requests of other clients are extracted with ocr=never.
+	FeatureOcr = "ocr"
+	// FeatureJobs allows asynchronous jobs
+	FeatureJobs = "jobs"
+	// FeatureCallback allows the callback param
+	FeatureCallback = "callback"
+	// FeaturePurge allows deleting cache entries
+	FeaturePurge = "purge"
+	// FeatureMetrics allows reading the metrics
+	FeatureMetrics = "metrics"
+)
+
+// AnyClient is the ID of the entry in the clients file whose limits and features apply to
+// token subjects without an entry of their own
+const AnyClient = "*"
+
+// SubjectPrefix precedes the subject of a token in its client ID, so that token subjects and
+// clients with an API key never share an ID, along with its usage and jobs
+const SubjectPrefix = "jwt:"
+
+// defaultQuotaPeriod is the period of quotas that don't have one
+const defaultQuotaPeriod = 24 * time.Hour
+
+// metrics holds the usage of every client, published at /debug/vars
+var metrics = expvar.NewMap("tes_clients")
+
+var errUnauthenticated = errors.New("missing or invalid API key or token")
+
+// Client is an entry of the clients file
+type Client struct {
+	ID string `json:"id"`
+	// KeySha256 is the hex encoded SHA-256 hash of the client's API key. Token subjects, whose IDs
+	// start with [SubjectPrefix], don't have one.
+	KeySha256 string `json:"keySha256,omitempty"`
+	// Rate is the number of requests per second, Burst the number of requests above it. 0 means unlimited.
+	Rate  float64 `json:"rate,omitempty"`
+	Burst int     `json:"burst,omitempty"`
+	Quota Quota   `json:"quota,omitzero"`
+	// Features the client may use. All features are allowed, if there are none.
+	Features []string `json:"features,omitempty"`
+}
+
+// Quota limits the usage of a client per period. Zero values mean unlimited.
+type Quota struct {
+	// Period is a duration like "24h", the default
+	Period   string `json:"period,omitempty"`
+	Requests int64  `json:"requests,omitempty"`
+	// Bytes of request and response bodies, e.g. "10GB"
+	Bytes    string `json:"bytes,omitempty"`
+	OcrPages int64  `json:"ocrPages,omitempty"`
+}
+
+// Authenticator is a middleware authenticating clients by the API key in the header X-Api-Key or
+// the bearer token in the Authorization header, which is either an API key or a JSON Web Token.
+type Authenticator struct {
+	log *slog.Logger
+	// byKey holds the clients by the hash of their key
+	byKey map[string]*client
+	// byId holds the clients in the file by ID and token subjects seen before
+	byId     sync.Map
+	template *Client
+	verifier *verifier
+}
+
+// client is the state of a client
+type client struct {
+	*Client
+	limiter  *rate.Limiter
+	period   time.Duration
+	maxBytes int64
+	metrics  *expvar.Map
+
+	mu       sync.Mutex
+	start    time.Time
+	requests int64
+	bytes    int64
+	ocrPages int64
+}
+
+// New reads the clients file and the JWKS file, either of which may be empty. Tokens are accepted only if issued
+// by issuer and for audience, unless these are empty.
+func New(clientsFile, jwksFile, issuer, audience string, log *slog.Logger) (*Authenticator, error) {
+	if log == nil {
+		log = slog.New(slog.DiscardHandler)
+	}
+	a := &Authenticator{log: log, byKey: make(map[string]*client)}
+	if clientsFile != "" {
+		data, err := os.ReadFile(clientsFile)
+		if err != nil {
+			return nil, err
+		}
+		var file struct {
+			Clients []Client `json:"clients"`
+		}
+		if err := json.Unmarshal(data, &file); err != nil {
+			return nil, fmt.Errorf("parsing clients file: %w", err)
+		}
+		for _, c := range file.Clients {
+			if c.ID == AnyClient {
+				a.template = &c
+				continue
+			}
+			if strings.HasPrefix(c.ID, SubjectPrefix) && c.KeySha256 != "" {
+				return nil, fmt.Errorf("client %s: token subjects don't have an API key", c.ID)
+			}
+			state, err := newClient(&c)
+			if err != nil {
+				return nil, fmt.Errorf("client %s: %w", c.ID, err)
+			}
+			if _, loaded := a.byId.LoadOrStore(c.ID, state); loaded {
+				return nil, fmt.Errorf("client %s: duplicate ID", c.ID)
+			}
+			if c.KeySha256 != "" {
+				a.byKey[strings.ToLower(c.KeySha256)] = state
+			}
+		}
+		if a.template != nil {
+			// the limits of the template are checked, though it is used for token subjects only
+			if _, err := newClient(a.template); err != nil {
+				return nil, fmt.Errorf("client %s: %w", AnyClient, err)
+			}
+		}
+	}
+	if jwksFile != "" {
+		var err error
+		if a.verifier, err = newVerifier(jwksFile, issuer, audience); err != nil {
+			return nil, fmt.Errorf("reading JWKS file: %w", err)
+		}
+	}
+	return a, nil
+}
+
+func newClient(c *Client) (*client, error) {
+	period := defaultQuotaPeriod
+	if c.Quota.Period != "" {
+		var err error
+		if period, err = time.ParseDuration(c.Quota.Period); err != nil || period <= 0 {
+			return nil, fmt.Errorf("invalid quota period %q", c.Quota.Period)
+		}
+	}
+	var maxBytes uint64
+	if c.Quota.Bytes != "" {
+		var err error
+		if maxBytes, err = humanize.ParseBytes(c.Quota.Bytes); err != nil {
+			return nil, fmt.Errorf("invalid quota of bytes: %w", err)
+		}
+	}
+	limit := rate.Inf
+	if c.Rate > 0 {
+		limit = rate.Limit(c.Rate)
+	}
+	m := new(expvar.Map).Init()
+	metrics.Set(c.ID, m)
+	return &client{
+		Client:   c,
+		limiter:  rate.NewLimiter(limit, max(c.Burst, 1)),
+		period:   period,
+		maxBytes: int64(min(maxBytes, math.MaxInt64)),
+		metrics:  m,
+		start:    time.Now(),
+	}, nil
+}
+
+type clientKey struct{}
+
+// ClientID returns the ID of the client that sent the request with the context ctx, if it was authenticated
+func ClientID(ctx context.Context) string {
+	if c, ok := ctx.Value(clientKey{}).(*client); ok {
+		return c.ID
+	}
+	return ""
+}
+
+// Authenticate rejects requests of unknown clients with 401, of clients exceeding their rate limit or quota with 429
+// and of clients using modes, callbacks or OCR they are not allowed to use with 403.
+// The ID of the client is added to the request log.
+func (a *Authenticator) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := a.client(r)
+		if err != nil {
+			a.log.Warn("Authentication failed", "remote", r.RemoteAddr, "err", err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="tes"`)
+			http.Error(w, errUnauthenticated.Error(), http.StatusUnauthorized)
+			return
+		}
+		httplog.LogEntrySetField(r.Context(), "client", slog.StringValue(c.ID))
+		// forbidden requests don't use up the rate limit or quota
+		if err := c.checkParams(r); err != nil {
+			c.metrics.Add("rejected", 1)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if retryAfter, err := c.admit(); err != nil {
+			c.metrics.Add("rejected", 1)
+			a.log.Warn("Request rejected", "client", c.ID, "err", err)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r.WithContext(context.WithValue(r.Context(), clientKey{}, c)))
+		c.charge(body.n+int64(ww.BytesWritten()), OcrPages(ww.Header()))
+	})
+}
+
+// Require rejects requests of clients that may not use feature with 403
+func (a *Authenticator) Require(feature string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if c, ok := r.Context().Value(clientKey{}).(*client); ok && !c.allowed(feature) {
+				c.metrics.Add("rejected", 1)
+				http.Error(w, "not allowed to use "+feature, http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// client returns the client identified by the request's API key or token
+func (a *Authenticator) client(r *http.Request) (*client, error) {
+	key := r.Header.Get("X-Api-Key")
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && key == "" {
+		key = strings.TrimSpace(bearer)
+	}
+	if key == "" {
+		return nil, errUnauthenticated
+	}
+	if a.verifier != nil && strings.Count(key, ".") == 2 {
+		subject, err := a.verifier.subject(key)
+		if err != nil {
+			return nil, err
+		}
+		id := SubjectPrefix + subject
+		if c, ok := a.byId.Load(id); ok {
+			return c.(*client), nil
+		}
+		template := Client{ID: id}
+		if a.template != nil {
+			template = *a.template
+			template.ID = id
+		}
+		// the template's limits have been checked
+		c, _ := newClient(&template)
+		actual, _ := a.byId.LoadOrStore(id, c)
+		return actual.(*client), nil
+	}
+	hash := sha256.Sum256([]byte(key))
+	if c, ok := a.byKey[hex.EncodeToString(hash[:])]; ok {
+		return c, nil
+	}
+	return nil, errUnauthenticated
+}
+
+func (c *client) allowed(feature string) bool {
+	return len(c.Features) == 0 || slices.Contains(c.Features, feature)
+}
+
+// checkParams checks the features used by the query params. Requests of clients that may not use OCR are
+// extracted with ocr=never.
+func (c *client) checkParams(r *http.Request) error {
+	q := r.URL.Query()
+	if mode := q.Get("mode"); mode != "" && mode != "text" && !c.allowed(mode) {
+		return errors.New("not allowed to use mode " + mode)
+	}
+	if q.Get("callback") != "" && !c.allowed(FeatureCallback) {
+		return errors.New("not allowed to use " + FeatureCallback)
+	}
+	if !c.allowed(FeatureOcr) {
+		if ocr := q.Get("ocr"); ocr != "" && ocr != "never" {
+			return errors.New("not allowed to use " + FeatureOcr)
+		}
+		q.Set("ocr", "never")
+		r.URL.RawQuery = q.Encode()
+	}
+	return nil
+}
+
+// admit counts a request, unless the client exceeds its rate limit or quota.
+// In that case it returns the time after which the client may try again.
+func (c *client) admit() (time.Duration, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if elapsed := now.Sub(c.start); elapsed >= c.period {
+		// a new period begins
+		c.start = now.Add(-(elapsed % c.period))
+		c.requests, c.bytes, c.ocrPages = 0, 0, 0
+	}
+	q := c.Quota
+	if (q.Requests > 0 && c.requests >= q.Requests) || (c.maxBytes > 0 && c.bytes >= c.maxBytes) || (q.OcrPages > 0 && c.ocrPages >= q.OcrPages) {
+		return c.start.Add(c.period).Sub(now), errors.New("quota exceeded")
+	}
+	reservation := c.limiter.ReserveN(now, 1)
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return delay, errors.New("rate limit exceeded")
+	}
+	c.requests++
+	c.metrics.Add("requests", 1)
+	return 0, nil
+}
+
+// charge adds the bytes of a request and the pages OCRed to the usage of the client
+func (c *client) charge(bytes, ocrPages int64) {
+	c.mu.Lock()
+	c.bytes += bytes
+	c.ocrPages += ocrPages
+	c.mu.Unlock()
+	c.metrics.Add("bytes", bytes)
+	c.metrics.Add("ocrPages", ocrPages)
+}
+
+// ChargeOcrPages adds the pages OCRed in the background, e.g. by a job, to the usage of the client with the given ID
+func (a *Authenticator) ChargeOcrPages(clientID string, pages int64) {
+	if c, ok := a.byId.Load(clientID); ok && pages > 0 {
+		c.(*client).charge(0, pages)
+	}
+}
+
+// OcrPages returns the number of pages OCRed according to the response headers or trailers.
+// Text served from the cache has not been OCRed again.
+func OcrPages(header http.Header) int64 {
+	if header.Get("X-Cache-Status") != "" {
+		return 0
+	}
+	pages := header.Get("X-Ocr-Pages")
+	if trailer := header[http.TrailerPrefix+"x-ocr-pages"]; len(trailer) > 0 {
+		pages = trailer[0]
+	}
+	n, _ := strconv.ParseInt(pages, 10, 64)
+	return n
+}
+
+// countingReader counts the bytes read from a request body
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
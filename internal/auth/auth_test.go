@@ -0,0 +1,252 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"encoding/json/v2"
+)
+
+var b64 = base64.RawURLEncoding.EncodeToString
+
+// sign returns a token with claims signed by key
+func sign(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]any) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+	var signature []byte
+	var err error
+	switch key := key.(type) {
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(key, []byte(signed))
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key, digest[:])
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + b64(signature)
+}
+
+func writeFile(t *testing.T, name string, v any) string {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func keyHash(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+func TestVerifier(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	ecPoint, _ := ecKey.PublicKey.Bytes()
+	jwks := writeFile(t, "jwks.json", map[string]any{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(ecPoint[1:33]), "y": b64(ecPoint[33:])},
+		{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": b64(edKey.Public().(ed25519.PublicKey))},
+	}})
+	v, err := newVerifier(jwks, "issuer", "tes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := time.Now().Add(time.Hour).Unix()
+	valid := map[string]any{"sub": "alice", "iss": "issuer", "aud": []string{"other", "tes"}, "exp": exp}
+	for _, tc := range []struct {
+		alg, kid string
+		key      crypto.Signer
+	}{{"RS256", "rsa", rsaKey}, {"ES256", "ec", ecKey}, {"EdDSA", "ed", edKey}} {
+		subject, err := v.subject(sign(t, tc.alg, tc.kid, tc.key, valid))
+		if err != nil || subject != "alice" {
+			t.Errorf("%s: got %q, %v", tc.alg, subject, err)
+		}
+	}
+
+	with := func(k string, value any) map[string]any {
+		claims := map[string]any{}
+		for k, v := range valid {
+			claims[k] = v
+		}
+		claims[k] = value
+		return claims
+	}
+	for name, token := range map[string]string{
+		"expired":        sign(t, "RS256", "rsa", rsaKey, with("exp", time.Now().Add(-time.Hour).Unix())),
+		"no expiry":      sign(t, "RS256", "rsa", rsaKey, with("exp", 0)),
+		"not yet valid":  sign(t, "RS256", "rsa", rsaKey, with("nbf", exp)),
+		"wrong issuer":   sign(t, "RS256", "rsa", rsaKey, with("iss", "someone")),
+		"wrong audience": sign(t, "RS256", "rsa", rsaKey, with("aud", "other")),
+		"no subject":     sign(t, "RS256", "rsa", rsaKey, with("sub", "")),
+		"unknown key":    sign(t, "RS256", "unknown", rsaKey, valid),
+		"wrong alg":      sign(t, "EdDSA", "rsa", edKey, valid),
+		"wrong key":      sign(t, "ES256", "ec", must(ecdsa.GenerateKey(elliptic.P256(), rand.Reader)), valid),
+		"tampered":       strings.Replace(sign(t, "EdDSA", "ed", edKey, valid), ".", ".e30", 1),
+	} {
+		if subject, err := v.subject(token); err == nil {
+			t.Errorf("%s: accepted token of %q", name, subject)
+		}
+	}
+}
+
+func must[T any](v T, err error) T {
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+func TestAuthenticate(t *testing.T) {
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	jwks := writeFile(t, "jwks.json", map[string]any{"keys": []map[string]string{
+		{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": b64(edKey.Public().(ed25519.PublicKey))},
+	}})
+	clients := writeFile(t, "clients.json", map[string]any{"clients": []Client{
+		{ID: "full", KeySha256: keyHash("full-key")},
+		{ID: "limited", KeySha256: keyHash("limited-key"), Rate: 0.001, Burst: 5, Features: []string{FeatureExtract, FeatureLayout}},
+		{ID: "quota", KeySha256: keyHash("quota-key"), Quota: Quota{Period: "1h", Bytes: "10B", OcrPages: 3}},
+		{ID: SubjectPrefix + "carol", Features: []string{FeatureExtract, FeatureJobs}},
+		{ID: AnyClient, Features: []string{FeatureExtract}},
+	}})
+	a, err := New(clients, jwks, "", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var seen *http.Request
+	mux := http.NewServeMux()
+	mux.Handle("/", a.Require(FeatureExtract)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("X-Ocr-Pages", r.URL.Query().Get("pages"))
+		io.WriteString(w, "text")
+	})))
+	mux.Handle("/jobs", a.Require(FeatureJobs)(http.NotFoundHandler()))
+	handler := a.Authenticate(mux)
+	do := func(target, header, value string, body io.Reader) *httptest.ResponseRecorder {
+		t.Helper()
+		method := http.MethodGet
+		if body != nil {
+			method = http.MethodPost
+		}
+		r := httptest.NewRequest(method, target, body)
+		if header != "" {
+			r.Header.Set(header, value)
+		}
+		w := httptest.NewRecorder()
+		seen = nil
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	for name, w := range map[string]*httptest.ResponseRecorder{
+		"no key":      do("/", "", "", nil),
+		"unknown key": do("/", "X-Api-Key", "unknown", nil),
+		"bad token":   do("/", "Authorization", "Bearer a.b.c", nil),
+	} {
+		if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: got %d", name, w.Code)
+		}
+	}
+	if w := do("/?ocr=always&mode=words", "Authorization", "Bearer full-key", nil); w.Code != http.StatusOK || ClientID(seen.Context()) != "full" {
+		t.Errorf("full: got %d", w.Code)
+	}
+
+	// limited clients may only use their features and are extracted without OCR
+	if w := do("/?mode=layout", "X-Api-Key", "limited-key", nil); w.Code != http.StatusOK || seen.URL.Query().Get("ocr") != "never" {
+		t.Errorf("limited: got %d", w.Code)
+	}
+	for _, target := range []string{"/?mode=words", "/?ocr=always", "/?callback=http://example.com", "/jobs"} {
+		if w := do(target, "X-Api-Key", "limited-key", nil); w.Code != http.StatusForbidden {
+			t.Errorf("limited %s: got %d", target, w.Code)
+		}
+	}
+	// forbidden params don't count, the burst of the limited client is used up by the other requests
+	for range 3 {
+		if w := do("/", "X-Api-Key", "limited-key", nil); w.Code != http.StatusOK {
+			t.Errorf("limited within burst: got %d", w.Code)
+		}
+	}
+	if w := do("/", "X-Api-Key", "limited-key", nil); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("rate limit: got %d", w.Code)
+	}
+
+	// token subjects get the limits and features of client *
+	token := sign(t, "EdDSA", "ed", edKey, map[string]any{"sub": "bob", "exp": time.Now().Add(time.Minute).Unix()})
+	if w := do("/", "Authorization", "Bearer "+token, nil); w.Code != http.StatusOK || ClientID(seen.Context()) != "jwt:bob" {
+		t.Errorf("token: got %d", w.Code)
+	}
+	if w := do("/jobs", "Authorization", "Bearer "+token, nil); w.Code != http.StatusForbidden {
+		t.Errorf("token /jobs: got %d", w.Code)
+	}
+	// subjects don't share the ID of a client with an API key, but may have an entry of their own
+	token = sign(t, "EdDSA", "ed", edKey, map[string]any{"sub": "full", "exp": time.Now().Add(time.Minute).Unix()})
+	if w := do("/?ocr=always", "Authorization", "Bearer "+token, nil); w.Code != http.StatusForbidden {
+		t.Errorf("token of subject full: got %d", w.Code)
+	}
+	token = sign(t, "EdDSA", "ed", edKey, map[string]any{"sub": "carol", "exp": time.Now().Add(time.Minute).Unix()})
+	if w := do("/jobs", "Authorization", "Bearer "+token, nil); w.Code != http.StatusNotFound {
+		t.Errorf("token of subject carol /jobs: got %d", w.Code)
+	}
+
+	// 4 bytes of text and 2 pages OCRed
+	if w := do("/?pages=2", "X-Api-Key", "quota-key", nil); w.Code != http.StatusOK {
+		t.Errorf("quota: got %d", w.Code)
+	}
+	// 10 bytes in total, 4 pages
+	if w := do("/?pages=2", "X-Api-Key", "quota-key", strings.NewReader("ab")); w.Code != http.StatusOK {
+		t.Errorf("quota: got %d", w.Code)
+	}
+	if w := do("/", "X-Api-Key", "quota-key", nil); w.Code != http.StatusTooManyRequests {
+		t.Errorf("quota exceeded: got %d", w.Code)
+	}
+	if got := metrics.Get("quota").String(); got != `{"bytes": 10, "ocrPages": 4, "rejected": 1, "requests": 2}` {
+		t.Errorf("metrics: %s", got)
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	for name, clients := range map[string][]Client{
+		"duplicate": {{ID: "a"}, {ID: "a"}},
+		"period":    {{ID: "a", Quota: Quota{Period: "daily"}}},
+		"bytes":     {{ID: "a", Quota: Quota{Bytes: "lots"}}},
+		"template":  {{ID: AnyClient, Quota: Quota{Period: "-1h"}}},
+		"subject":   {{ID: SubjectPrefix + "a", KeySha256: keyHash("a")}},
+	} {
+		if _, err := New(writeFile(t, "clients.json", map[string]any{"clients": clients}), "", "", "", nil); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
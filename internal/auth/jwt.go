@@ -0,0 +1,220 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"encoding/json/v2"
+)
+
+// leeway is the clock skew tolerated when checking the expiry and start of tokens
+const leeway = time.Minute
+
+var errInvalidToken = errors.New("invalid token")
+
+// jwk is a public key of a JSON Web Key Set
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// verifier checks the signature and claims of JSON Web Tokens
+type verifier struct {
+	// keys by ID
+	keys     map[string]crypto.PublicKey
+	issuer   string
+	audience string
+}
+
+// newVerifier reads the RSA, EC and Ed25519 keys of the JWKS file at path
+func newVerifier(path, issuer, audience string) (*verifier, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("parsing JWKS: %w", err)
+	}
+	v := &verifier{keys: make(map[string]crypto.PublicKey), issuer: issuer, audience: audience}
+	for _, k := range set.Keys {
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", k.Kid, err)
+		}
+		v.keys[k.Kid] = key
+	}
+	if len(v.keys) == 0 {
+		return nil, errors.New("JWKS has no keys")
+	}
+	return v, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return ecdsa.ParseUncompressedPublicKey(curve, append(append([]byte{4}, x...), y...))
+	case "OKP":
+		x, err := decode(k.X)
+		if k.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+// subject verifies the token and returns the subject it was issued to
+func (v *verifier) subject(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errInvalidToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return "", err
+	}
+	key, ok := v.keys[header.Kid]
+	if !ok {
+		return "", fmt.Errorf("%w: unknown key %q", errInvalidToken, header.Kid)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", errInvalidToken
+	}
+	if err := verify(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return "", err
+	}
+	var claims struct {
+		Sub string  `json:"sub"`
+		Iss string  `json:"iss"`
+		Aud any     `json:"aud"`
+		Exp float64 `json:"exp"`
+		Nbf float64 `json:"nbf"`
+	}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	switch {
+	case claims.Exp == 0 || now.After(time.Unix(int64(claims.Exp), 0).Add(leeway)):
+		return "", fmt.Errorf("%w: expired", errInvalidToken)
+	case claims.Nbf != 0 && now.Add(leeway).Before(time.Unix(int64(claims.Nbf), 0)):
+		return "", fmt.Errorf("%w: not valid yet", errInvalidToken)
+	case v.issuer != "" && claims.Iss != v.issuer:
+		return "", fmt.Errorf("%w: wrong issuer", errInvalidToken)
+	case v.audience != "" && !hasAudience(claims.Aud, v.audience):
+		return "", fmt.Errorf("%w: wrong audience", errInvalidToken)
+	case claims.Sub == "":
+		return "", fmt.Errorf("%w: no subject", errInvalidToken)
+	}
+	return claims.Sub, nil
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err == nil {
+		err = json.Unmarshal(data, v)
+	}
+	if err != nil {
+		return errInvalidToken
+	}
+	return nil
+}
+
+// hasAudience reports whether the aud claim, a string or an array of strings, contains audience
+func hasAudience(aud any, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []any:
+		return slices.Contains(aud, any(audience))
+	}
+	return false
+}
+
+// verify checks the signature of signed using the algorithm alg, which must match the type of key
+func verify(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	hashes := map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}
+	hash, ok := hashes[strings.TrimLeft(alg, "RSPE")]
+	var digest []byte
+	if ok {
+		h := hash.New()
+		h.Write([]byte(signed))
+		digest = h.Sum(nil)
+	}
+	var valid bool
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		switch {
+		case ok && strings.HasPrefix(alg, "RS"):
+			valid = rsa.VerifyPKCS1v15(key, hash, digest, signature) == nil
+		case ok && strings.HasPrefix(alg, "PS"):
+			valid = rsa.VerifyPSS(key, hash, digest, signature, nil) == nil
+		}
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if ok && strings.HasPrefix(alg, "ES") && len(signature) == 2*size {
+			r, s := new(big.Int).SetBytes(signature[:size]), new(big.Int).SetBytes(signature[size:])
+			valid = ecdsa.Verify(key, digest, r, s)
+		}
+	case ed25519.PublicKey:
+		valid = alg == "EdDSA" && ed25519.Verify(key, []byte(signed), signature)
+	}
+	if !valid {
+		return fmt.Errorf("%w: bad signature or algorithm %s", errInvalidToken, alg)
+	}
+	return nil
+}
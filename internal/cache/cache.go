@@ -1,9 +1,13 @@
 package cache
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"image"
 	"io"
 
-	"github.com/nats-io/nats.go/jetstream"
+	"github.com/johbar/text-extraction-service/v4/pkg/layout"
+	"github.com/johbar/text-extraction-service/v4/pkg/tesswrap"
 )
 
 // Document represents any kind of document this service can convert to plain text
@@ -26,20 +30,91 @@ type Document interface {
 	Close()
 }
 
+// LayoutDocument is implemented by documents that know the position of the text on their pages
+type LayoutDocument interface {
+	// PageLayout returns page i's words and their bounding boxes.
+	// Returns an error wrapping [errors.ErrUnsupported] if the document can't tell.
+	PageLayout(i int) (*layout.Page, error)
+}
+
+// RenderDocument is implemented by documents whose pages can be rasterized, e.g. for OCR
+type RenderDocument interface {
+	// RenderPage renders page i at the given resolution in dots per inch.
+	// Returns an error wrapping [errors.ErrUnsupported] if the document can't be rendered.
+	RenderPage(i int, dpi float64) (*image.Gray, error)
+}
+
+// ImageCoverageDocument is implemented by documents that know where their pages' images are
+type ImageCoverageDocument interface {
+	// ImageCoverage returns the fraction (0 to 1) of page i's area covered by images.
+	// Returns an error wrapping [errors.ErrUnsupported] if the document can't tell.
+	ImageCoverage(i int) (float64, error)
+}
+
+// TableDocument is implemented by documents whose markup contains tables, e.g. DOCX and ODT
+type TableDocument interface {
+	// Tables returns the document's tables in document order.
+	// Returns an error wrapping [errors.ErrUnsupported] if the document can't tell.
+	Tables() ([]layout.Table, error)
+}
+
+// OcrDocument is implemented by documents whose text is recognized by OCR page by page, e.g. images
+type OcrDocument interface {
+	// Recognize runs OCR on page i, 0 for documents without pages, with the given options
+	// and returns the recognized words in pixels along with the text.
+	Recognize(i int, opts tesswrap.Options) (*layout.Page, tesswrap.Result, error)
+}
+
 type DocumentMetadata = map[string]string
 
+// DigestKey is the metadata key of the hex encoded SHA-256 digest of a document's content
+const DigestKey = "x-document-sha256"
+
+// ContentKey returns the prefix of the keys of the variants cached for the content with the given digest, see [VariantKey].
+// Entries keyed by URL are aliases: their metadata holds the digest along with the HTTP headers needed for revalidation.
+func ContentKey(digest string) string {
+	return "sha256:" + digest
+}
+
+// VariantKey returns the key of the entry holding the text and metadata extracted from the content with the given digest
+// using the options identified by variant.
+func VariantKey(digest, variant string) string {
+	return ContentKey(digest) + "/" + variant
+}
+
 // ExtractedDocument contains pointers to metadata, textual content and URL of origin
 type ExtractedDocument struct {
-	Doc      Document
+	// Doc is nil for documents revalidated with the origin, which were not parsed
+	Doc Document
+	// Url is nil for documents sent in a request body
 	Url      *string
 	Metadata *map[string]string
 	Text     []byte
+	// Digest is the hex encoded SHA-256 digest of the document's content; empty if unknown
+	Digest string
+	// Variant is the fingerprint of the options the text was extracted with
+	Variant string
+	// ContentCached means the text was served from the cache entry of the variant, so only the URL's alias is saved
+	ContentCached bool
 }
 
+// Cache stores the text and metadata of documents by their URL
 type Cache interface {
+	// GetMetadata returns the metadata saved for url or nil, if there is no entry
 	GetMetadata(url string) (DocumentMetadata, error)
+	// StreamText writes the text saved for url to w
 	StreamText(url string, w io.Writer) error
-	Save(doc ExtractedDocument) (*jetstream.ObjectInfo, error)
+	// Save stores the text and metadata of doc under its URL
+	Save(doc ExtractedDocument) error
+	// Delete removes the entry saved under url. Deleting a missing entry is no error.
+	Delete(url string) error
+}
+
+// KeyLister is implemented by caches that can enumerate their entries, e.g. to purge all URLs with a common prefix
+type KeyLister interface {
+	// Keys returns the keys of all entries starting with prefix.
+	// Returns an error wrapping [errors.ErrUnsupported] if the cache can't tell.
+	Keys(prefix string) ([]string, error)
 }
 
 type NopCache struct{}
@@ -52,6 +127,16 @@ func (c *NopCache) StreamText(url string, w io.Writer) error {
 	return nil
 }
 
-func (c *NopCache) Save(doc ExtractedDocument) (*jetstream.ObjectInfo, error) {
-	return &jetstream.ObjectInfo{}, nil
+func (c *NopCache) Save(doc ExtractedDocument) error {
+	return nil
+}
+
+func (c *NopCache) Delete(url string) error {
+	return nil
+}
+
+// key returns the name of the entry for url in caches that don't accept arbitrary names, e.g. files
+func key(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return hex.EncodeToString(sum[:])
 }
@@ -0,0 +1,257 @@
+package cache
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"encoding/json/v2"
+)
+
+// FsCache stores text and metadata as files in a local directory.
+// The least recently used entries are deleted when their total size exceeds the limit.
+// It is safe for concurrent use, but not for use by several processes sharing the directory.
+type FsCache struct {
+	dir     string
+	maxSize int64
+	log     *slog.Logger
+
+	mtx sync.Mutex
+	// lru holds the keys of the entries, the most recently used first
+	lru     *list.List
+	entries map[string]*list.Element
+	size    int64
+}
+
+// fsEntry is an entry of [FsCache]
+type fsEntry struct {
+	// key is the hash of name, which is used for the file names
+	key  string
+	name string
+	// size is the total size of the text and metadata files
+	size int64
+}
+
+// fsRecord is the content of a metadata file. It holds the entry's name, which can't be recovered from the file name.
+type fsRecord struct {
+	Name     string           `json:"name"`
+	Metadata DocumentMetadata `json:"metadata"`
+}
+
+// NewFsCache opens or creates the cache in dir. Existing entries are ordered by their last access.
+func NewFsCache(dir string, maxSize int64, log *slog.Logger) (*FsCache, error) {
+	if log == nil {
+		log = slog.New(slog.DiscardHandler)
+	}
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("creating cache directory: %w", err)
+	}
+	c := &FsCache{dir: dir, maxSize: maxSize, log: log, lru: list.New(), entries: make(map[string]*list.Element)}
+	type found struct {
+		key, name string
+		size      int64
+		accessed  time.Time
+	}
+	var existing []found
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".tmp-") {
+			// left behind by an interrupted write
+			os.Remove(path)
+			return nil
+		}
+		key, ok := strings.CutSuffix(d.Name(), ".json")
+		if !ok || len(key) < 2 {
+			return nil
+		}
+		meta, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		text, err := os.Stat(c.path(key, ".txt"))
+		if err != nil {
+			// the text file is written first, so this is a leftover
+			os.Remove(path)
+			return nil
+		}
+		record, err := readRecord(path)
+		if err != nil {
+			log.Warn("Removing unreadable cache entry", "path", path, "err", err)
+			os.Remove(path)
+			return nil
+		}
+		existing = append(existing, found{key, record.Name, meta.Size() + text.Size(), meta.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("scanning cache directory: %w", err)
+	}
+	slices.SortFunc(existing, func(a, b found) int { return b.accessed.Compare(a.accessed) })
+	for _, f := range existing {
+		c.entries[f.key] = c.lru.PushBack(&fsEntry{f.key, f.name, f.size})
+		c.size += f.size
+	}
+	c.mtx.Lock()
+	c.evict()
+	c.mtx.Unlock()
+	log.Info("File system cache initialized.", "dir", dir, "entries", len(c.entries), "size", c.size, "maxSize", maxSize)
+	return c, nil
+}
+
+// path returns the path of an entry's file. Entries are spread across subdirectories by the first two characters of their key.
+func (c *FsCache) path(key, ext string) string {
+	return filepath.Join(c.dir, key[:2], key+ext)
+}
+
+func readRecord(path string) (fsRecord, error) {
+	var record fsRecord
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return record, err
+	}
+	return record, json.Unmarshal(data, &record)
+}
+
+func (c *FsCache) GetMetadata(url string) (DocumentMetadata, error) {
+	k := key(url)
+	record, err := readRecord(c.path(k, ".json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading cached metadata for %s: %w", url, err)
+	}
+	c.touch(k)
+	return record.Metadata, nil
+}
+
+func (c *FsCache) StreamText(url string, w io.Writer) error {
+	k := key(url)
+	f, err := os.Open(c.path(k, ".txt"))
+	if err != nil {
+		return fmt.Errorf("reading cached text for %s: %w", url, err)
+	}
+	defer f.Close()
+	c.touch(k)
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// Save writes the text, then the metadata, so that an entry with metadata always has its text.
+func (c *FsCache) Save(doc ExtractedDocument) error {
+	k := key(*doc.Url)
+	metadata, err := json.Marshal(fsRecord{*doc.Url, *doc.Metadata})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path(k, "")), 0o750); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(c.path(k, ".txt"), doc.Text); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(c.path(k, ".json"), metadata); err != nil {
+		return err
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	size := int64(len(doc.Text) + len(metadata))
+	if el, ok := c.entries[k]; ok {
+		entry := el.Value.(*fsEntry)
+		c.size += size - entry.size
+		entry.size = size
+		c.lru.MoveToFront(el)
+	} else {
+		c.entries[k] = c.lru.PushFront(&fsEntry{k, *doc.Url, size})
+		c.size += size
+	}
+	c.evict()
+	return nil
+}
+
+func (c *FsCache) Delete(url string) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	k := key(url)
+	if el, ok := c.entries[k]; ok {
+		c.remove(el)
+	}
+	return nil
+}
+
+func (c *FsCache) Keys(prefix string) ([]string, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	var keys []string
+	for _, el := range c.entries {
+		if name := el.Value.(*fsEntry).name; strings.HasPrefix(name, prefix) {
+			keys = append(keys, name)
+		}
+	}
+	return keys, nil
+}
+
+// touch marks the entry as used. The modification time of the metadata file keeps the order across restarts.
+func (c *FsCache) touch(k string) {
+	c.mtx.Lock()
+	if el, ok := c.entries[k]; ok {
+		c.lru.MoveToFront(el)
+	}
+	c.mtx.Unlock()
+	now := time.Now()
+	os.Chtimes(c.path(k, ".json"), now, now)
+}
+
+// evict deletes the least recently used entries until the cache fits its size limit.
+// The caller must hold the lock.
+func (c *FsCache) evict() {
+	for c.size > c.maxSize && c.lru.Len() > 0 {
+		entry := c.remove(c.lru.Back())
+		c.log.Debug("Evicted cache entry", "key", entry.name, "size", entry.size)
+	}
+}
+
+// remove deletes the entry and its files. The caller must hold the lock.
+func (c *FsCache) remove(el *list.Element) *fsEntry {
+	entry := c.lru.Remove(el).(*fsEntry)
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+	// the metadata goes first, as it marks the entry as present
+	for _, ext := range []string{".json", ".txt"} {
+		if err := os.Remove(c.path(entry.key, ext)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			c.log.Warn("Could not delete cache file", "err", err, "key", entry.name)
+		}
+	}
+	return entry
+}
+
+// writeFileAtomic writes data to a temporary file that replaces the file at path,
+// so that readers never see partial content.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
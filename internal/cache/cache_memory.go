@@ -0,0 +1,133 @@
+package cache
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"sync"
+)
+
+// MemoryCache keeps the most recently used entries of another cache in memory.
+// Entries are added when saved or read from the backend and dropped when their total size exceeds the limit.
+type MemoryCache struct {
+	backend Cache
+	maxSize int64
+
+	mtx sync.Mutex
+	// lru holds the entries, the most recently used first
+	lru     *list.List
+	entries map[string]*list.Element
+	size    int64
+}
+
+// memoryEntry is an entry of [MemoryCache]
+type memoryEntry struct {
+	url      string
+	metadata DocumentMetadata
+	text     []byte
+}
+
+func (e *memoryEntry) size() int64 {
+	size := len(e.url) + len(e.text)
+	for k, v := range e.metadata {
+		size += len(k) + len(v)
+	}
+	return int64(size)
+}
+
+// NewMemoryCache returns a cache holding up to maxSize bytes of text and metadata in front of backend.
+func NewMemoryCache(backend Cache, maxSize int64) *MemoryCache {
+	return &MemoryCache{backend: backend, maxSize: maxSize, lru: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// get returns the entry for url and marks it as used, nil if there is none
+func (c *MemoryCache) get(url string) *memoryEntry {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	el, ok := c.entries[url]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	return el.Value.(*memoryEntry)
+}
+
+// put adds or replaces the entry for its URL, unless it exceeds the size limit on its own.
+func (c *MemoryCache) put(entry *memoryEntry) {
+	size := entry.size()
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.drop(entry.url)
+	if size > c.maxSize {
+		return
+	}
+	c.entries[entry.url] = c.lru.PushFront(entry)
+	c.size += size
+	for c.size > c.maxSize {
+		c.drop(c.lru.Back().Value.(*memoryEntry).url)
+	}
+}
+
+// drop removes the entry for url, if there is one. The caller must hold the lock.
+func (c *MemoryCache) drop(url string) {
+	if el, ok := c.entries[url]; ok {
+		c.size -= el.Value.(*memoryEntry).size()
+		c.lru.Remove(el)
+		delete(c.entries, url)
+	}
+}
+
+func (c *MemoryCache) GetMetadata(url string) (DocumentMetadata, error) {
+	if entry := c.get(url); entry != nil {
+		return maps.Clone(entry.metadata), nil
+	}
+	return c.backend.GetMetadata(url)
+}
+
+// StreamText writes the text from memory or, if missing, from the backend.
+// Text read from the backend is kept in memory along with its metadata.
+func (c *MemoryCache) StreamText(url string, w io.Writer) error {
+	if entry := c.get(url); entry != nil {
+		_, err := w.Write(entry.text)
+		return err
+	}
+	var buf bytes.Buffer
+	if err := c.backend.StreamText(url, &buf); err != nil {
+		return err
+	}
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if metadata, err := c.backend.GetMetadata(url); err == nil && metadata != nil {
+		c.put(&memoryEntry{url, metadata, buf.Bytes()})
+	}
+	return nil
+}
+
+// Save stores doc in the backend and, if that succeeds, in memory.
+func (c *MemoryCache) Save(doc ExtractedDocument) error {
+	if err := c.backend.Save(doc); err != nil {
+		return err
+	}
+	c.put(&memoryEntry{*doc.Url, maps.Clone(*doc.Metadata), bytes.Clone(doc.Text)})
+	return nil
+}
+
+// Delete removes the entry from memory and the backend.
+func (c *MemoryCache) Delete(url string) error {
+	c.mtx.Lock()
+	c.drop(url)
+	c.mtx.Unlock()
+	return c.backend.Delete(url)
+}
+
+// Keys lists the entries of the backend, as memory holds a subset of them.
+func (c *MemoryCache) Keys(prefix string) ([]string, error) {
+	if lister, ok := c.backend.(KeyLister); ok {
+		return lister.Keys(prefix)
+	}
+	return nil, fmt.Errorf("listing cache entries: %w", errors.ErrUnsupported)
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"strings"
 	"time"
 
 	config "github.com/johbar/text-extraction-service/v4/internal/config"
@@ -38,6 +39,7 @@ func New(conf config.TesConfig, log *slog.Logger, nc *nats.Conn) (*ObjectStoreCa
 		Bucket:      conf.Bucket,
 		Compression: true,
 		Replicas:    conf.Replicas,
+		TTL:         conf.CacheTtl,
 	})
 	if err != nil {
 		log.Error("Creating NATS object store failed", "err", err)
@@ -100,11 +102,40 @@ func (store ObjectStoreCache) StreamText(url string, w io.Writer) error {
 	return err
 }
 
-func (store ObjectStoreCache) Save(doc ExtractedDocument) (*jetstream.ObjectInfo, error) {
+func (store ObjectStoreCache) Save(doc ExtractedDocument) error {
 	m := jetstream.ObjectMeta{Metadata: *doc.Metadata, Name: *doc.Url}
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 	r := bytes.NewReader(doc.Text)
-	info, err := store.ObjectStore.Put(ctx, m, r)
-	return info, err
+	_, err := store.ObjectStore.Put(ctx, m, r)
+	return err
+}
+
+func (store ObjectStoreCache) Delete(url string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := store.ObjectStore.Delete(ctx, url)
+	if errors.Is(err, jetstream.ErrObjectNotFound) {
+		return nil
+	}
+	return err
+}
+
+func (store ObjectStoreCache) Keys(prefix string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	infos, err := store.ObjectStore.List(ctx)
+	if errors.Is(err, jetstream.ErrNoObjectsFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("listing objects: %w", err)
+	}
+	var keys []string
+	for _, info := range infos {
+		if strings.HasPrefix(info.Name, prefix) {
+			keys = append(keys, info.Name)
+		}
+	}
+	return keys, nil
 }
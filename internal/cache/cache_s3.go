@@ -0,0 +1,257 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"encoding/json/v2"
+
+	"github.com/johbar/text-extraction-service/v4/internal/awssig"
+)
+
+// emptyPayloadHash is the SHA-256 of an empty request body
+const emptyPayloadHash = awssig.EmptyPayloadHash
+
+// S3Config locates the bucket of an [S3Cache] and holds the credentials
+type S3Config struct {
+	// Endpoint is the base URL of the service, e.g. https://s3.eu-central-1.amazonaws.com or http://localhost:9000
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// Prefix is prepended to the names of the objects
+	Prefix string
+	// PathStyle puts the bucket into the path instead of the host name, as required by MinIO and most other implementations
+	PathStyle bool
+}
+
+// S3Cache stores text and metadata as objects in an S3-compatible object store.
+// Requests are signed with AWS Signature Version 4.
+type S3Cache struct {
+	conf     S3Config
+	endpoint *url.URL
+	client   *http.Client
+	log      *slog.Logger
+}
+
+// NewS3Cache returns a cache using the bucket described by conf. The bucket must exist.
+func NewS3Cache(conf S3Config, client *http.Client, log *slog.Logger) (*S3Cache, error) {
+	if log == nil {
+		log = slog.New(slog.DiscardHandler)
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	endpoint, err := url.Parse(conf.Endpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint: %q", conf.Endpoint)
+	}
+	if conf.Bucket == "" {
+		return nil, errors.New("no S3 bucket configured")
+	}
+	if conf.Region == "" {
+		conf.Region = "us-east-1"
+	}
+	log.Info("S3 cache initialized.", "endpoint", conf.Endpoint, "bucket", conf.Bucket, "prefix", conf.Prefix)
+	return &S3Cache{conf: conf, endpoint: endpoint, client: client, log: log}, nil
+}
+
+// bucketUrl returns the URL of the bucket
+func (c *S3Cache) bucketUrl() *url.URL {
+	u := *c.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	if c.conf.PathStyle {
+		u.Path += "/" + c.conf.Bucket
+	} else {
+		u.Host = c.conf.Bucket + "." + u.Host
+	}
+	return &u
+}
+
+// objectUrl returns the URL of the object with the given name
+func (c *S3Cache) objectUrl(name string) *url.URL {
+	u := c.bucketUrl()
+	u.Path += "/" + c.conf.Prefix + name
+	return u
+}
+
+// objectName returns the name of the objects of the entry k without extension. The keys of the variants of a content
+// are safe object names and kept, so that they can be listed, see [S3Cache.Keys]. Other keys are hashed.
+func objectName(k string) string {
+	if strings.HasPrefix(k, ContentKey("")) {
+		return k
+	}
+	return key(k)
+}
+
+// do sends a signed request for the named object. Responses with other status codes than 2xx are returned as error,
+// except for 404, which is returned as response.
+func (c *S3Cache) do(ctx context.Context, method, name string, body []byte, header http.Header) (*http.Response, error) {
+	return c.doUrl(ctx, method, c.objectUrl(name), body, header)
+}
+
+// doUrl sends a signed request to u like [S3Cache.do]
+func (c *S3Cache) doUrl(ctx context.Context, method string, u *url.URL, body []byte, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	payloadHash := emptyPayloadHash
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	c.sign(req, payloadHash, time.Now())
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotFound {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("S3 %s %s: %s: %s", method, u.Path, resp.Status, msg)
+	}
+	return resp, nil
+}
+
+// sign adds the headers of AWS Signature Version 4 to req, signing all headers already set.
+func (c *S3Cache) sign(req *http.Request, payloadHash string, now time.Time) {
+	awssig.Sign(req, c.conf.Region, c.conf.AccessKey, c.conf.SecretKey, payloadHash, now)
+}
+
+func (c *S3Cache) GetMetadata(url string) (DocumentMetadata, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	resp, err := c.do(ctx, http.MethodGet, objectName(url)+".json", nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving metadata for %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	var metadata DocumentMetadata
+	if err := json.UnmarshalRead(resp.Body, &metadata); err != nil {
+		return nil, fmt.Errorf("parsing metadata for %s: %w", url, err)
+	}
+	return metadata, nil
+}
+
+func (c *S3Cache) StreamText(url string, w io.Writer) error {
+	// the timeout covers the whole transfer
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	resp, err := c.do(ctx, http.MethodGet, objectName(url)+".txt", nil, nil)
+	if err != nil {
+		return fmt.Errorf("retrieving text for %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("retrieving text for %s: object not found", url)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// Save uploads the text, then the metadata, so that an entry with metadata always has its text.
+func (c *S3Cache) Save(doc ExtractedDocument) error {
+	metadata, err := json.Marshal(*doc.Metadata)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	k := objectName(*doc.Url)
+	for _, object := range []struct {
+		name, contentType string
+		data              []byte
+	}{
+		{k + ".txt", "text/plain; charset=utf-8", doc.Text},
+		{k + ".json", "application/json", metadata},
+	} {
+		resp, err := c.do(ctx, http.MethodPut, object.name, object.data, http.Header{"Content-Type": {object.contentType}})
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return fmt.Errorf("S3 bucket %s not found", c.conf.Bucket)
+		}
+	}
+	return nil
+}
+
+// Delete removes the metadata, then the text, so that an entry with metadata always has its text.
+func (c *S3Cache) Delete(url string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	k := objectName(url)
+	for _, name := range []string{k + ".json", k + ".txt"} {
+		resp, err := c.do(ctx, http.MethodDelete, name, nil, nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+	return nil
+}
+
+// Keys lists the variants of a content, i.e. the keys starting with [ContentKey], using ListObjectsV2.
+// Other keys are hashed, so listing them returns an error wrapping [errors.ErrUnsupported].
+func (c *S3Cache) Keys(prefix string) ([]string, error) {
+	if !strings.HasPrefix(prefix, ContentKey("")) {
+		return nil, fmt.Errorf("listing cache entries other than variants: %w", errors.ErrUnsupported)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var keys []string
+	query := url.Values{"list-type": {"2"}, "prefix": {c.conf.Prefix + prefix}}
+	for {
+		u := c.bucketUrl()
+		u.RawQuery = query.Encode()
+		resp, err := c.doUrl(ctx, http.MethodGet, u, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("S3 bucket %s not found", c.conf.Bucket)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parsing object list: %w", err)
+		}
+		for _, object := range result.Contents {
+			// every entry has a metadata object
+			if name, ok := strings.CutSuffix(strings.TrimPrefix(object.Key, c.conf.Prefix), ".json"); ok {
+				keys = append(keys, name)
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return keys, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
@@ -3,6 +3,11 @@ package config
 import (
 	"fmt"
 	"log/slog"
+	"math"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/dustin/go-humanize"
@@ -16,6 +21,49 @@ type TesConfig struct {
 	// Name of the object store or key-value bucket in NATS to use
 	// Default: TES_PLAINTEXTS
 	Bucket string `env:"TES_BUCKET" default:"TES_PLAINTEXTS"`
+	// Cache backend: "nats" (object store), "fs" (local directory), "s3" (S3-compatible object store) or "none"
+	Cache string `env:"TES_CACHE" default:"nats"`
+	// Directory of the file system cache
+	CacheDir string `env:"TES_CACHE_DIR" default:"/tmp/tes-cache"`
+	// Maximum total size of the file system cache. The least recently used entries are deleted when it is exceeded.
+	CacheMaxSize      string `env:"TES_CACHE_MAX_SIZE" default:"1GiB"`
+	CacheMaxSizeBytes uint64
+	// Maximum age of cache entries, after which documents are extracted again. Default: 0 = unlimited
+	CacheTtl time.Duration `env:"TES_CACHE_TTL" default:"0"`
+	// How long documents are served from the cache without contacting the origin, if it sends neither
+	// Cache-Control nor Expires headers. Default: 0 = always revalidate
+	CacheMaxAge time.Duration `env:"TES_CACHE_MAX_AGE" default:"0"`
+	// Freshness per host overriding the origin's headers, e.g. "example.com=24h,static.example.org=immutable".
+	// A host's entry applies to its subdomains, too.
+	CacheHostMaxAge  string `env:"TES_CACHE_HOST_MAX_AGE"`
+	CacheHostMaxAges map[string]time.Duration
+	// Serve cached text, marked as stale, if the origin can't be reached or responds with a server error
+	CacheStaleIfError bool `env:"TES_CACHE_STALE_IF_ERROR" default:"true"`
+	// Serve cached text up to this long after it became stale right away and revalidate it in the background.
+	// Default: 0 = disabled
+	CacheStaleWhileRevalidate time.Duration `env:"TES_CACHE_STALE_WHILE_REVALIDATE" default:"0"`
+	// Size of the in-memory cache in front of the backend. Default: 0 = disabled
+	CacheMemorySize      string `env:"TES_CACHE_MEMORY_SIZE" default:"0"`
+	CacheMemorySizeBytes uint64
+	// Name of the NATS key-value bucket and object store holding the state and results of jobs
+	JobsBucket string `env:"TES_JOBS_BUCKET" default:"TES_JOBS"`
+	// How long jobs and their results are kept after their last update
+	JobsTtl time.Duration `env:"TES_JOBS_TTL" default:"24h"`
+	// Key of the HMAC-SHA256 signature of callbacks. Callbacks are not signed if empty.
+	CallbackSecret string `env:"TES_CALLBACK_SECRET"`
+	// Number of times a failed callback is retried
+	CallbackRetries int `env:"TES_CALLBACK_RETRIES" default:"5"`
+	// Delay before the first retry of a callback, doubled for every further one
+	CallbackRetryDelay time.Duration `env:"TES_CALLBACK_RETRY_DELAY" default:"1s"`
+	// JSON file listing the clients with their API key hashes, rate limits, quotas and features.
+	// Authentication is required if this or TES_AUTH_JWKS_FILE is set.
+	AuthClientsFile string `env:"TES_AUTH_CLIENTS_FILE"`
+	// JSON Web Key Set file with the public keys bearer tokens are verified with
+	AuthJwksFile string `env:"TES_AUTH_JWKS_FILE"`
+	// Issuer (iss claim) bearer tokens must have. Default: any
+	AuthJwtIssuer string `env:"TES_AUTH_JWT_ISSUER"`
+	// Audience (aud claim) bearer tokens must have. Default: any
+	AuthJwtAudience string `env:"TES_AUTH_JWT_AUDIENCE"`
 	// wether to expose embedded NATS server to other clients. Default: false
 	ExposeNats bool `env:"TES_EXPOSE_NATS" default:"false"`
 	// Add source info to log statement. Default: false
@@ -27,6 +75,28 @@ type TesConfig struct {
 	ForkThreshold int64 `env:"TES_FORK_THRESHOLD" default:"2097152"`
 	// Disable Accept-Encoding=gzip header in outgoing HTTP Requests
 	HttpClientDisableCompression bool `env:"TES_HTTP_CLIENT_DISABLE_COMPRESSION" default:"false"`
+	// Time to wait for the response headers of a web server. Default: 60s, 0 = unlimited
+	HttpClientResponseTimeout time.Duration `env:"TES_HTTP_CLIENT_RESPONSE_TIMEOUT" default:"60s"`
+	// Time to wait for a connection to a web server. Default: 30s, 0 = unlimited
+	HttpClientConnectTimeout time.Duration `env:"TES_HTTP_CLIENT_CONNECT_TIMEOUT" default:"30s"`
+	// Time to read the response body of a web server. Default: 0 = unlimited
+	HttpClientBodyTimeout time.Duration `env:"TES_HTTP_CLIENT_BODY_TIMEOUT" default:"0"`
+	// Number of times a request is retried if a web server responds with status 429 or 503
+	HttpClientRetries int `env:"TES_HTTP_CLIENT_RETRIES" default:"2"`
+	// Delay before the first retry, doubled for every further one, unless the web server sends Retry-After
+	HttpClientRetryDelay time.Duration `env:"TES_HTTP_CLIENT_RETRY_DELAY" default:"1s"`
+	// JSON file with the credentials, headers, TLS settings, proxies and timeouts used for fetching from some hosts
+	FetchProfilesFile string `env:"TES_FETCH_PROFILES_FILE"`
+	// Comma separated directories file:// URLs may point into, e.g. SMB or NFS mounts. file:// URLs are not supported if empty.
+	FileRoots string `env:"TES_FILE_ROOTS"`
+	// Comma separated hosts, "*.domain"s, IP addresses and CIDR ranges documents may be fetched from exclusively. Default: any
+	FetchAllow string `env:"TES_FETCH_ALLOW"`
+	// Comma separated hosts, "*.domain"s, IP addresses and CIDR ranges documents may never be fetched from
+	FetchDeny string `env:"TES_FETCH_DENY"`
+	// Fetch documents from loopback, private, link-local and other internal addresses, too. Default: false
+	FetchAllowPrivate bool `env:"TES_FETCH_ALLOW_PRIVATE" default:"false"`
+	// Maximum number of redirects followed when fetching a document
+	FetchMaxRedirects int `env:"TES_FETCH_MAX_REDIRECTS" default:"10"`
 	// Log level (DEBUG, INFO, WARN, ERROR)
 	LogLevelStr string `env:"TES_LOG_LEVEL" default:"INFO"`
 	LogLevel    slog.Level
@@ -36,6 +106,20 @@ type TesConfig struct {
 	// maximum size of a file fetched from a web server to be processed solely in-memory instead of being downloaded
 	MaxInMemory      string `env:"TES_MAX_IN_MEMORY" default:"2MiB"`
 	MaxInMemoryBytes uint64
+	// Maximum number of documents extracted concurrently. Default: 0 = 4 times the number of CPUs
+	MaxConcurrent int `env:"TES_MAX_CONCURRENT" default:"0"`
+	// Maximum number of documents of a type extracted concurrently, as comma separated type=number pairs,
+	// e.g. "pdf=4,forked=2"
+	MaxConcurrentPerType  string `env:"TES_MAX_CONCURRENT_PER_TYPE"`
+	MaxConcurrentPerTypes map[string]int
+	// Maximum sum of the sizes of documents extracted concurrently in-process.
+	// Default: 0 = half of GOMEMLIMIT, unlimited if that is not set
+	MemoryBudget      string `env:"TES_MEMORY_BUDGET" default:"0"`
+	MemoryBudgetBytes uint64
+	// Maximum number of documents waiting for extraction. Requests are answered with 429 if it is exceeded.
+	QueueSize int `env:"TES_QUEUE_SIZE" default:"100"`
+	// Maximum time a document waits for extraction. Requests are answered with 503 after this time.
+	QueueTimeout time.Duration `env:"TES_QUEUE_TIMEOUT" default:"30s"`
 	// NATS max msg size (embedded server only)
 	NatsMaxPayload int32 `env:"TES_MAX_PAYLOAD" default:"8388608"`
 	// embedded NATS server storage location. Default: /tmp/nats
@@ -65,6 +149,126 @@ type TesConfig struct {
 	// List of 3-letter language codes, separated by `+` to be passed to Tesseract
 	// when doing OCR. Default: eng. NOTE: The languages need to be installed.
 	TesseractLangs string `env:"TES_TESSERACT_LANGS" default:"Latin"`
+	// Resolution PDF pages are rendered at for OCR, if no usable image can be extracted from them.
+	// Zero or less disables rendering.
+	OcrDpi int `env:"TES_OCR_DPI" default:"300"`
+	// Default OCR mode: "auto" (OCR pages according to OcrPolicy), "always" or "never"
+	Ocr string `env:"TES_OCR" default:"auto"`
+	// Maximum number of images OCRed concurrently by this process. Default: 0 = number of CPUs
+	OcrWorkers int `env:"TES_OCR_WORKERS" default:"0"`
+	// Maximum number of pages of a single document OCRed concurrently. Default: 0 = OcrWorkers
+	OcrWorkersPerRequest int `env:"TES_OCR_WORKERS_PER_REQUEST" default:"0"`
+	// Recognized words with a lower confidence (0 to 100) are dropped. Default: 0 = keep all words
+	OcrMinConfidence float64 `env:"TES_OCR_MIN_CONFIDENCE" default:"0"`
+	OcrPolicy
+	OcrPreprocessing
+	S3Config
+	SourceS3Config
+	WorkQueueConfig
+}
+
+// Cache backends
+const (
+	// CacheNats stores entries in a NATS object store bucket
+	CacheNats = "nats"
+	// CacheFs stores entries as files in a local directory
+	CacheFs = "fs"
+	// CacheS3 stores entries as objects in an S3-compatible object store
+	CacheS3 = "s3"
+	// CacheNone disables caching
+	CacheNone = "none"
+)
+
+// MaxAgeImmutable is the freshness of documents that never change
+const MaxAgeImmutable time.Duration = math.MaxInt64
+
+// S3Config locates the bucket of the S3 cache
+type S3Config struct {
+	// Base URL of the service, e.g. https://s3.eu-central-1.amazonaws.com or http://localhost:9000
+	S3Endpoint  string `env:"TES_S3_ENDPOINT"`
+	S3Region    string `env:"TES_S3_REGION" default:"us-east-1"`
+	S3Bucket    string `env:"TES_S3_BUCKET"`
+	S3AccessKey string `env:"TES_S3_ACCESS_KEY"`
+	S3SecretKey string `env:"TES_S3_SECRET_KEY"`
+	// Prefix of the object names, e.g. "tes/"
+	S3Prefix string `env:"TES_S3_PREFIX"`
+	// Put the bucket into the path instead of the host name, as required by MinIO
+	S3PathStyle bool `env:"TES_S3_PATH_STYLE" default:"false"`
+}
+
+// SourceS3Config locates the S3-compatible object store s3://bucket/key URLs are fetched from
+type SourceS3Config struct {
+	// Base URL of the service. s3:// URLs are not supported if empty.
+	SourceS3Endpoint  string `env:"TES_SOURCE_S3_ENDPOINT"`
+	SourceS3Region    string `env:"TES_SOURCE_S3_REGION" default:"us-east-1"`
+	SourceS3AccessKey string `env:"TES_SOURCE_S3_ACCESS_KEY"`
+	SourceS3SecretKey string `env:"TES_SOURCE_S3_SECRET_KEY"`
+	// Comma separated buckets objects may be fetched from. Required if the endpoint is set.
+	SourceS3Buckets string `env:"TES_SOURCE_S3_BUCKETS"`
+	// Put the bucket into the path instead of the host name, as required by MinIO
+	SourceS3PathStyle bool `env:"TES_SOURCE_S3_PATH_STYLE" default:"false"`
+}
+
+// WorkQueueConfig sets up consuming extraction requests from a JetStream work-queue stream
+type WorkQueueConfig struct {
+	// Name of the stream. Consuming is disabled if empty. The stream is created with work-queue retention, if it doesn't exist.
+	WorkQueueStream string `env:"TES_WORK_QUEUE_STREAM"`
+	// Subject of the requests, each the JSON encoded params of a request to the NATS microservice
+	WorkQueueSubject string `env:"TES_WORK_QUEUE_SUBJECT" default:"tes.extract"`
+	// Name of the durable consumer shared by all instances
+	WorkQueueConsumer string `env:"TES_WORK_QUEUE_CONSUMER" default:"tes"`
+	// Subject the results are published to
+	WorkQueueResultSubject string `env:"TES_WORK_QUEUE_RESULT_SUBJECT" default:"tes.results"`
+	// Object store bucket the text is saved in instead of the result message, if not empty
+	WorkQueueResultBucket string `env:"TES_WORK_QUEUE_RESULT_BUCKET"`
+	// Subject requests are published to, if they are invalid or failed on their last delivery
+	WorkQueueDeadLetterSubject string `env:"TES_WORK_QUEUE_DEAD_LETTER_SUBJECT" default:"tes.dead"`
+	// Number of deliveries of a request before it is dead-lettered
+	WorkQueueMaxDeliver int `env:"TES_WORK_QUEUE_MAX_DELIVER" default:"5"`
+	// Time after which unacknowledged requests are redelivered. It is extended while a request is processed.
+	WorkQueueAckWait time.Duration `env:"TES_WORK_QUEUE_ACK_WAIT" default:"1m"`
+	// Number of requests processed concurrently by this instance. Default: 0 = number of CPUs
+	WorkQueueWorkers int `env:"TES_WORK_QUEUE_WORKERS" default:"0"`
+}
+
+const (
+	// OcrAuto runs OCR on the pages that need it according to [OcrPolicy]
+	OcrAuto = "auto"
+	// OcrAlways runs OCR on every page
+	OcrAlways = "always"
+	// OcrNever disables OCR
+	OcrNever = "never"
+)
+
+// OcrPolicy decides which pages of a PDF are OCRed in mode "auto"
+type OcrPolicy struct {
+	// Pages with less characters of text are OCRed, if their images cover at least MinImageCoverage of the page
+	MinTextLength int `env:"TES_OCR_MIN_TEXT_LENGTH" default:"200"`
+	// Minimum fraction of a short page covered by images, which keeps small logos from being OCRed
+	MinImageCoverage float64 `env:"TES_OCR_MIN_IMAGE_COVERAGE" default:"0.1"`
+	// Pages are OCRed regardless of their text, if images cover at least this fraction, e.g. a scan with a text header
+	ScanCoverage float64 `env:"TES_OCR_SCAN_COVERAGE" default:"0.5"`
+	// Pages whose text has a higher fraction of characters without Unicode mapping are OCRed
+	MaxGlyphFailures float64 `env:"TES_OCR_MAX_GLYPH_FAILURES" default:"0.1"`
+	// Pages whose text has a lower fraction of printable characters are OCRed
+	MinPrintable float64 `env:"TES_OCR_MIN_PRINTABLE" default:"0.9"`
+	// Pages whose doubtful text has a lower fraction of words found in the built-in list of frequent words are OCRed
+	MinDictionaryHits float64 `env:"TES_OCR_MIN_DICTIONARY_HITS" default:"0.05"`
+}
+
+// OcrPreprocessing selects the steps applied to images before OCR
+type OcrPreprocessing struct {
+	// Detect the orientation with Tesseract's OSD and turn pages upright. Requires the 'osd' model.
+	OcrRotate bool `env:"TES_OCR_ROTATE" default:"false"`
+	// Straighten text lines rotated by up to 10 degrees
+	OcrDeskew bool `env:"TES_OCR_DESKEW" default:"true"`
+	// Convert images to black and white using Otsu's threshold
+	OcrBinarize bool `env:"TES_OCR_BINARIZE" default:"false"`
+	// Stretch images with different horizontal and vertical resolution, e.g. faxes, to square pixels
+	OcrNormalizeDpi bool `env:"TES_OCR_NORMALIZE_DPI" default:"true"`
+	// Images with a lower resolution are upscaled to OcrDpi (at most 4x). Zero disables upscaling.
+	// The resolution of images lacking this information is estimated assuming they show an A4 or Letter page.
+	OcrMinDpi int `env:"TES_OCR_MIN_DPI" default:"200"`
 }
 
 // NewTesConfigFromEnv returns a service config object
@@ -88,5 +292,97 @@ func NewTesConfigFromEnv() (*TesConfig, error) {
 		return nil, fmt.Errorf("parsing max file size from env: %w", err)
 	}
 	cfg.MaxFileSizeBytes = maxSize
+	if cfg.MemoryBudgetBytes, err = humanize.ParseBytes(cfg.MemoryBudget); err != nil {
+		return nil, fmt.Errorf("parsing memory budget from env: %w", err)
+	}
+	if limit := debug.SetMemoryLimit(-1); cfg.MemoryBudgetBytes == 0 && limit != math.MaxInt64 {
+		cfg.MemoryBudgetBytes = uint64(limit / 2)
+	}
+	if cfg.MaxConcurrent <= 0 {
+		cfg.MaxConcurrent = 4 * runtime.NumCPU()
+	}
+	if cfg.MaxConcurrentPerTypes, err = parseConcurrencyPerType(cfg.MaxConcurrentPerType); err != nil {
+		return nil, fmt.Errorf("parsing max concurrency per document type from env: %w", err)
+	}
+	switch cfg.Cache {
+	case CacheNats, CacheFs, CacheS3, CacheNone:
+	default:
+		return nil, fmt.Errorf("unknown cache backend: %s", cfg.Cache)
+	}
+	if cfg.CacheMaxSizeBytes, err = humanize.ParseBytes(cfg.CacheMaxSize); err != nil {
+		return nil, fmt.Errorf("parsing max cache size from env: %w", err)
+	}
+	if cfg.CacheMemorySizeBytes, err = humanize.ParseBytes(cfg.CacheMemorySize); err != nil {
+		return nil, fmt.Errorf("parsing memory cache size from env: %w", err)
+	}
+	if cfg.CacheHostMaxAges, err = parseHostMaxAges(cfg.CacheHostMaxAge); err != nil {
+		return nil, fmt.Errorf("parsing cache max age per host from env: %w", err)
+	}
+	if cfg.OcrWorkers <= 0 {
+		cfg.OcrWorkers = runtime.NumCPU()
+	}
+	if cfg.OcrWorkersPerRequest <= 0 || cfg.OcrWorkersPerRequest > cfg.OcrWorkers {
+		cfg.OcrWorkersPerRequest = cfg.OcrWorkers
+	}
+	if cfg.WorkQueueWorkers <= 0 {
+		cfg.WorkQueueWorkers = runtime.NumCPU()
+	}
+	if cfg.WorkQueueMaxDeliver < 1 {
+		return nil, fmt.Errorf("work queue max deliveries must be at least 1: %d", cfg.WorkQueueMaxDeliver)
+	}
+	if cfg.FetchMaxRedirects < 0 {
+		return nil, fmt.Errorf("max redirects must not be negative: %d", cfg.FetchMaxRedirects)
+	}
+	switch cfg.Ocr {
+	case OcrAuto, OcrAlways, OcrNever:
+	default:
+		return nil, fmt.Errorf("unknown OCR mode: %s", cfg.Ocr)
+	}
+	if cfg.OcrMinConfidence < 0 || cfg.OcrMinConfidence > 100 {
+		return nil, fmt.Errorf("OCR confidence threshold out of range 0 to 100: %v", cfg.OcrMinConfidence)
+	}
 	return &cfg, nil
 }
+
+// parseConcurrencyPerType parses a comma separated list of type=number pairs
+func parseConcurrencyPerType(s string) (map[string]int, error) {
+	limits := make(map[string]int)
+	for entry := range strings.SplitSeq(s, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		docType, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("missing '=' in %q", entry)
+		}
+		limit, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || limit < 1 {
+			return nil, fmt.Errorf("invalid number in %q", entry)
+		}
+		limits[strings.ToLower(strings.TrimSpace(docType))] = limit
+	}
+	return limits, nil
+}
+
+// parseHostMaxAges parses a comma separated list of host=duration pairs, where the duration may be "immutable"
+func parseHostMaxAges(s string) (map[string]time.Duration, error) {
+	maxAges := make(map[string]time.Duration)
+	for entry := range strings.SplitSeq(s, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		host, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("missing '=' in %q", entry)
+		}
+		maxAge := MaxAgeImmutable
+		if value != "immutable" {
+			var err error
+			if maxAge, err = time.ParseDuration(value); err != nil {
+				return nil, fmt.Errorf("max age of host %s: %w", host, err)
+			}
+		}
+		maxAges[strings.ToLower(strings.TrimSpace(host))] = maxAge
+	}
+	return maxAges, nil
+}
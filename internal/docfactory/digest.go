@@ -0,0 +1,30 @@
+package docfactory
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+)
+
+// DigestReader computes the SHA-256 digest of a document while it streams into the docfactory
+type DigestReader struct {
+	r io.Reader
+	h hash.Hash
+}
+
+func NewDigestReader(r io.Reader) *DigestReader {
+	return &DigestReader{r: r, h: sha256.New()}
+}
+
+func (d *DigestReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.h.Write(p[:n])
+	return n, err
+}
+
+// Digest returns the hex encoded digest of the data read so far.
+// It is the document's digest once the docfactory (or a forked subprocess) has consumed the stream.
+func (d *DigestReader) Digest() string {
+	return hex.EncodeToString(d.h.Sum(nil))
+}
@@ -3,6 +3,7 @@ package docfactory
 import (
 	"errors"
 	"fmt"
+	"image"
 	"io"
 	"log/slog"
 	"net/url"
@@ -17,10 +18,10 @@ import (
 	"github.com/johbar/text-extraction-service/v4/internal/config"
 	"github.com/johbar/text-extraction-service/v4/internal/imageparser"
 	"github.com/johbar/text-extraction-service/v4/pkg/docparser"
+	"github.com/johbar/text-extraction-service/v4/pkg/layout"
 	"github.com/johbar/text-extraction-service/v4/pkg/mmappool"
 	"github.com/johbar/text-extraction-service/v4/pkg/officexmlparser"
 	"github.com/johbar/text-extraction-service/v4/pkg/rtfparser"
-	"github.com/johbar/text-extraction-service/v4/pkg/tesswrap"
 )
 
 var (
@@ -29,6 +30,36 @@ var (
 	errTooLarge     = errors.New("file too large")
 )
 
+// Types of documents, whose concurrent extraction is limited
+const (
+	TypePdf    = "pdf"
+	TypeImage  = "image"
+	TypeOffice = "office"
+	TypeRtf    = "rtf"
+	TypeOther  = "other"
+	// TypeForked is any document extracted by a subprocess
+	TypeForked = "forked"
+)
+
+// SniffLen is the number of bytes at the beginning of a document [DocType] needs
+const SniffLen = 3072
+
+// DocType returns the type of the document starting with head
+func DocType(head []byte) string {
+	mtype := mimetype.Detect(head)
+	switch ext := mtype.Extension(); {
+	case ext == ".pdf":
+		return TypePdf
+	case ext == ".rtf":
+		return TypeRtf
+	case slices.Contains(xmlBasedFormats, ext), mtype.Is("application/msword"), mtype.Is("application/x-ole-storage"):
+		return TypeOffice
+	case strings.HasPrefix(mtype.String(), "image/"):
+		return TypeImage
+	}
+	return TypeOther
+}
+
 type DocFactory struct {
 	log              *slog.Logger
 	pool             *mmappool.Mempool
@@ -53,6 +84,65 @@ func (d *PooledDoc) HasNewlines() bool {
 	return d.Document.HasNewlines()
 }
 
+// pooledOcrDoc is a PooledDoc whose text is recognized by OCR page by page, e.g. an image.
+// PooledDoc can't delegate Recognize, as every document would claim to need OCR then.
+type pooledOcrDoc struct {
+	*PooledDoc
+	cache.OcrDocument
+}
+
+// newPooledDoc wraps d, whose data is held in buf, which is returned to the pool when d is closed
+func (df *DocFactory) newPooledDoc(d cache.Document, buf []byte) cache.Document {
+	pd := &PooledDoc{d, df, buf}
+	if od, ok := d.(cache.OcrDocument); ok {
+		return &pooledOcrDoc{pd, od}
+	}
+	return pd
+}
+
+// newPooledDocFromBytes returns the document held in the first n bytes of buf, which is returned to the pool
+// when the document is closed or right away, if it can't be parsed
+func (df *DocFactory) newPooledDocFromBytes(buf []byte, n int, origin string) (cache.Document, error) {
+	d, err := df.NewFromBytes(buf[:n], origin)
+	if err != nil {
+		df.pool.Put(buf)
+		return nil, err
+	}
+	return df.newPooledDoc(d, buf), nil
+}
+
+// PageLayout delegates to the wrapped document, if it knows the position of its text
+func (d *PooledDoc) PageLayout(i int) (*layout.Page, error) {
+	if ld, ok := d.Document.(cache.LayoutDocument); ok {
+		return ld.PageLayout(i)
+	}
+	return nil, fmt.Errorf("page layout: %w", errors.ErrUnsupported)
+}
+
+// Tables delegates to the wrapped document, if it has tables in its markup
+func (d *PooledDoc) Tables() ([]layout.Table, error) {
+	if td, ok := d.Document.(cache.TableDocument); ok {
+		return td.Tables()
+	}
+	return nil, fmt.Errorf("tables: %w", errors.ErrUnsupported)
+}
+
+// RenderPage delegates to the wrapped document, if its pages can be rendered
+func (d *PooledDoc) RenderPage(i int, dpi float64) (*image.Gray, error) {
+	if rd, ok := d.Document.(cache.RenderDocument); ok {
+		return rd.RenderPage(i, dpi)
+	}
+	return nil, fmt.Errorf("rendering: %w", errors.ErrUnsupported)
+}
+
+// ImageCoverage delegates to the wrapped document, if it knows where its images are
+func (d *PooledDoc) ImageCoverage(i int) (float64, error) {
+	if cd, ok := d.Document.(cache.ImageCoverageDocument); ok {
+		return cd.ImageCoverage(i)
+	}
+	return 0, fmt.Errorf("image coverage: %w", errors.ErrUnsupported)
+}
+
 func New(tesconfig *config.TesConfig, logger *slog.Logger) *DocFactory {
 	exe, _ := os.Executable()
 	if logger == nil {
@@ -63,7 +153,9 @@ func New(tesconfig *config.TesConfig, logger *slog.Logger) *DocFactory {
 		MaxFileSizeBytes: tesconfig.MaxFileSizeBytes,
 		log:              logger,
 		executable:       exe,
-		pool:             mmappool.New(int(tesconfig.MaxInMemoryBytes), 8, logger.With("mod", "docfactory mempool")),
+		// at most one buffer is used for every document admitted for extraction. The extractor closes
+		// a document, which returns its buffer, before releasing its admission slot.
+		pool: mmappool.NewBounded(int(tesconfig.MaxInMemoryBytes), tesconfig.MaxConcurrent, logger.With("mod", "docfactory mempool")),
 	}
 
 	err := df.loadPdfLib(tesconfig.PdfLibName, tesconfig.PdfLibPath)
@@ -109,6 +201,8 @@ func (df *DocFactory) handleUnknownSize(r io.Reader, origin string) (cache.Docum
 	df.log.Debug("Finished reading first chunk from stream of unknown size", "bytes", n, "err", err)
 	if bytesRead >= int(df.MaxInMemoryBytes) && (isNotEvenAll) {
 		// file is too large for holding it in memory
+		// the buffer is not needed any more after writing it to the file
+		defer df.pool.Put(buf)
 		f, err := newTempFile(origin)
 		if err != nil {
 			return nil, fmt.Errorf("creating tempfile for origin %s: %w", origin, err)
@@ -124,14 +218,13 @@ func (df *DocFactory) handleUnknownSize(r io.Reader, origin string) (cache.Docum
 		} else {
 			df.log.Debug("Finished reading remaining chunks from stream of unknown size", "bytes", n, "path", f.Name())
 		}
-		df.pool.Put(buf)
 		return df.NewFromPath(f.Name(), origin)
 	}
 	if isAll {
 		// no error, file read was smaller than buf
-		d, err := df.NewFromBytes(buf[:bytesRead], origin)
-		return &PooledDoc{d, df, buf}, err
+		return df.newPooledDocFromBytes(buf, bytesRead, origin)
 	}
+	df.pool.Put(buf)
 	return nil, err
 }
 
@@ -148,15 +241,16 @@ func (df *DocFactory) handleMediumSize(r io.Reader, size int64, origin string) (
 func (df *DocFactory) handleSmallSize(r io.Reader, size int64, origin string) (cache.Document, error) {
 	buf, err := df.pool.Get()
 	if err != nil {
+		df.pool.Put(buf)
 		return nil, err
 	}
 
 	n, err := io.ReadFull(r, buf[:size])
 	if err != nil {
+		df.pool.Put(buf)
 		return nil, err
 	}
-	d, err := df.NewFromBytes(buf[:n], origin)
-	return &PooledDoc{d, df, buf}, err
+	return df.newPooledDocFromBytes(buf, n, origin)
 }
 
 func (df *DocFactory) NewDocFromStream(r io.Reader, size int64, origin string) (cache.Document, error) {
@@ -198,7 +292,8 @@ func (df *DocFactory) NewFromBytes(data []byte, origin string) (cache.Document,
 	case "application/x-ole-storage":
 		return docparser.NewFromBytes(data)
 	}
-	if tesswrap.Initialized && strings.HasPrefix(mtype.String(), "image/") {
+	// images are accepted without OCR, too, for their metadata
+	if strings.HasPrefix(mtype.String(), "image/") {
 		return imageparser.NewFromBytes(data, mtype.Extension()), nil
 	}
 	// returning a part of the content in case of errors helps with debugging webservers that return 2xx with an error message in the body
@@ -229,7 +324,7 @@ func (df *DocFactory) NewFromPath(path, origin string) (cache.Document, error) {
 	case "application/x-ole-storage":
 		return docparser.Open(path)
 	}
-	if tesswrap.Initialized && strings.HasPrefix(mtype.String(), "image/") {
+	if strings.HasPrefix(mtype.String(), "image/") {
 		return imageparser.Open(path, mtype.Extension()), nil
 	}
 	// returning a part of the content in case of errors helps with debugging webservers that return 2xx with an error message in the body
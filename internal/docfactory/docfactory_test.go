@@ -1,10 +1,15 @@
 package docfactory
 
 import (
+	"bytes"
+	"image"
+	"image/png"
 	"os"
 	"reflect"
 	"testing"
+	"time"
 
+	"github.com/johbar/text-extraction-service/v4/internal/cache"
 	"github.com/johbar/text-extraction-service/v4/internal/config"
 	"github.com/johbar/text-extraction-service/v4/pkg/docparser"
 	"github.com/johbar/text-extraction-service/v4/pkg/officexmlparser"
@@ -126,3 +131,74 @@ func TestUnknownSizedStreamEmitsFile(t *testing.T) {
 		t.Errorf("temp file not the same size as original file %d != %d", stat2.Size(), stat.Size())
 	}
 }
+
+func TestPooledImageIsOcrDocument(t *testing.T) {
+	conf, err := config.NewTesConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	df := New(conf, nil)
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewGray(image.Rect(0, 0, 10, 10)))
+	d, err := df.NewDocFromStream(&buf, int64(buf.Len()), "image.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if _, ok := d.(cache.OcrDocument); !ok {
+		t.Errorf("pooled image of type %T is no OcrDocument", d)
+	}
+}
+
+func TestDocType(t *testing.T) {
+	for path, want := range map[string]string{
+		readmeOcrPath: TypePdf,
+		"../../pkg/rtfparser/testdata/readme.rtf":        TypeRtf,
+		"../../pkg/docparser/testdata/readme.doc":        TypeOffice,
+		"../../pkg/officexmlparser/testdata/readme.docx": TypeOffice,
+		"../../pkg/officexmlparser/testdata/readme.odt":  TypeOffice,
+		"../../pkg/tesswrap/testdata/readme.png":         TypeImage,
+	} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := DocType(data[:min(len(data), SniffLen)]); got != want {
+			t.Errorf("%s: got %s, want %s", path, got, want)
+		}
+	}
+	if got := DocType([]byte("plain text")); got != TypeOther {
+		t.Errorf("text: got %s", got)
+	}
+}
+
+func TestPoolBufferReturnedOnError(t *testing.T) {
+	conf, err := config.NewTesConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// with a single buffer, Get blocks if a failed document kept it
+	conf.MaxConcurrent = 1
+	df := New(conf, nil)
+	garbage := bytes.Repeat([]byte{0}, 100)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 3 {
+			if _, err := df.NewDocFromStream(bytes.NewReader(garbage), int64(len(garbage)), "garbage"); err == nil {
+				t.Error("want error for unknown format")
+			}
+			if _, err := df.NewDocFromStream(bytes.NewReader(garbage), -1, "garbage"); err == nil {
+				t.Error("want error for unknown format of unknown size")
+			}
+			if _, err := df.NewDocFromStream(bytes.NewReader(garbage[:10]), int64(len(garbage)), "truncated"); err == nil {
+				t.Error("want error for truncated body")
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("buffer of a failed document was not returned to the pool")
+	}
+}
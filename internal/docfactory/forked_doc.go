@@ -29,12 +29,14 @@ type ForkedDoc struct {
 	path       string
 }
 
-func (df *DocFactory) NewDocFromForkedProcessPath(path, origin string) (*ForkedDoc, error) {
+// NewDocFromForkedProcessPath creates a Document whose content and metadata is being extracted by a forked subprocess
+// reading the file at path. Additional args (e.g. "-mode=layout") are passed to the subprocess.
+func (df *DocFactory) NewDocFromForkedProcessPath(path, origin string, args ...string) (*ForkedDoc, error) {
 	if len(df.executable) == 0 {
 		return nil, AlienationErr
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
-	cmd := exec.CommandContext(ctx, df.executable, path)
+	cmd := exec.CommandContext(ctx, df.executable, append(args, path)...)
 	cmd.Stderr = os.Stderr
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
@@ -63,13 +65,14 @@ func (df *DocFactory) NewDocFromForkedProcessPath(path, origin string) (*ForkedD
 	return doc, err
 }
 
-// NewDocFromForkedProcess creates a Document whose content and metadata is being extracted by a forked subprocess
-func (df *DocFactory) NewDocFromForkedProcess(r io.Reader, origin string) (*ForkedDoc, error) {
+// NewDocFromForkedProcess creates a Document whose content and metadata is being extracted by a forked subprocess.
+// Additional args (e.g. "-mode=layout") are passed to the subprocess.
+func (df *DocFactory) NewDocFromForkedProcess(r io.Reader, origin string, args ...string) (*ForkedDoc, error) {
 	if len(df.executable) == 0 {
 		return nil, AlienationErr
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
-	cmd := exec.CommandContext(ctx, df.executable, "-")
+	cmd := exec.CommandContext(ctx, df.executable, append(args, "-")...)
 	cmd.Stdin = r
 	cmd.Stderr = os.Stderr
 	stdout, err := cmd.StdoutPipe()
@@ -0,0 +1,52 @@
+package extractor
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/johbar/text-extraction-service/v4/internal/admission"
+	"github.com/johbar/text-extraction-service/v4/internal/docfactory"
+)
+
+// admit waits until the document read from r may be extracted. Its type is sniffed from its beginning,
+// unless it is extracted by a subprocess, and its size is contentLength, -1 if unknown.
+// It returns a reader replacing r and a func releasing the slot of the document.
+// Jobs and work-queue requests wait as long as it takes, other requests up to TES_QUEUE_TIMEOUT.
+func (e *Extractor) admit(r io.Reader, contentLength int64, params RequestParams) (io.Reader, func(), error) {
+	br := bufio.NewReaderSize(r, docfactory.SniffLen)
+	// subprocesses don't take up memory of this process
+	docType, size := docfactory.TypeForked, int64(0)
+	if !e.forks(contentLength) {
+		head, _ := br.Peek(docfactory.SniffLen)
+		docType, size = docfactory.DocType(head), contentLength
+		if size < 0 {
+			size = int64(e.tesConfig.MaxInMemoryBytes)
+		}
+	}
+	ctx := context.Background()
+	if !params.background {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.tesConfig.QueueTimeout)
+		defer cancel()
+	}
+	release, err := e.limiter.Acquire(ctx, docType, size)
+	if err != nil {
+		running, waiting := e.limiter.Stats()
+		e.log.Warn("Document not admitted for extraction", "type", docType, "size", contentLength, "running", running, "waiting", waiting, "err", err)
+	}
+	return br, release, err
+}
+
+// busy sets the Retry-After header of the response to a request, whose document was not admitted, and returns its status:
+// 429 if the queue is full, 503 if the document waited too long
+func (e *Extractor) busy(header http.Header, err error) int {
+	header.Set("Retry-After", strconv.Itoa(max(int(e.tesConfig.QueueTimeout.Seconds()), 1)))
+	if errors.Is(err, admission.ErrQueueFull) {
+		return http.StatusTooManyRequests
+	}
+	return http.StatusServiceUnavailable
+}
@@ -0,0 +1,119 @@
+package extractor
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/johbar/text-extraction-service/v4/internal/admission"
+	"github.com/johbar/text-extraction-service/v4/internal/cache"
+	"github.com/johbar/text-extraction-service/v4/internal/config"
+	"github.com/johbar/text-extraction-service/v4/internal/docfactory"
+)
+
+func TestAdmission(t *testing.T) {
+	proceed := make(chan struct{})
+	var rtf []byte
+	f := newFixture(t, &cache.NopCache{}, func(conf *config.TesConfig) {
+		conf.QueueTimeout = 50 * time.Millisecond
+	}, func(w http.ResponseWriter, r *http.Request) bool {
+		w.Header().Set("Content-Length", strconv.Itoa(len(rtf)))
+		if r.URL.Path == "/slow" {
+			// the beginning is enough to admit the document, the rest is sent later
+			w.Write(rtf[:docfactory.SniffLen])
+			w.(http.Flusher).Flush()
+			<-proceed
+			w.Write(rtf[docfactory.SniffLen:])
+			return true
+		}
+		w.Write(rtf)
+		return true
+	})
+	extract, origin := f.extract, f.origin
+	rtf = f.rtf
+	extract.limiter = admission.New(admission.Limits{Concurrent: 1, QueueSize: 0})
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		extract.ExtractRemote(w, httptest.NewRequest(http.MethodGet, "/?url="+url.QueryEscape(origin.URL+path), nil))
+		return w
+	}
+
+	slow := make(chan *httptest.ResponseRecorder)
+	go func() { slow <- get("/slow") }()
+	for {
+		if running, _ := extract.limiter.Stats(); running == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if w := get("/fast"); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("full queue: status %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	w := httptest.NewRecorder()
+	extract.ExtractBody(w, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(rtf)))
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("full queue, body: status %d", w.Code)
+	}
+	extract.limiter = admission.New(admission.Limits{Concurrent: 1, QueueSize: 1})
+	go func() { slow <- get("/slow") }()
+	for {
+		if running, _ := extract.limiter.Stats(); running == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if w := get("/fast"); w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("queue timeout: status %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	close(proceed)
+	for range 2 {
+		if w := <-slow; w.Code != http.StatusOK || w.Body.Len() == 0 {
+			t.Errorf("admitted document: status %d", w.Code)
+		}
+	}
+	if w := get("/fast"); w.Code != http.StatusOK {
+		t.Errorf("after release: status %d", w.Code)
+	}
+}
+
+// blockingCache is a cache whose saves block until proceed is closed
+type blockingCache struct {
+	cache.NopCache
+	proceed chan struct{}
+}
+
+func (c *blockingCache) Save(cache.ExtractedDocument) error {
+	<-c.proceed
+	return nil
+}
+
+func TestPoolBufferReturnedBeforeRelease(t *testing.T) {
+	c := &blockingCache{proceed: make(chan struct{})}
+	f := newFixture(t, c, func(conf *config.TesConfig) {
+		// one pooled buffer, as many as documents admitted
+		conf.MaxConcurrent = 1
+	}, nil)
+	defer close(c.proceed)
+	// while saving to the cache is stuck, documents must not wait for the buffers of extracted ones
+	for i := range 3 {
+		done := make(chan int)
+		go func() {
+			w := httptest.NewRecorder()
+			f.extract.ExtractBody(w, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(f.rtf)))
+			done <- w.Code
+		}()
+		select {
+		case code := <-done:
+			if code != http.StatusOK {
+				t.Errorf("document %d: status %d", i, code)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("document %d waits for a buffer", i)
+		}
+	}
+}
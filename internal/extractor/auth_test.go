@@ -0,0 +1,140 @@
+package extractor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"encoding/json/v2"
+
+	"github.com/johbar/text-extraction-service/v4/internal/auth"
+	"github.com/johbar/text-extraction-service/v4/internal/cache"
+	"github.com/johbar/text-extraction-service/v4/internal/jobs"
+)
+
+// newAuthenticator returns an authenticator of the clients, whose API keys are their IDs
+func newAuthenticator(t *testing.T, clients ...auth.Client) *auth.Authenticator {
+	t.Helper()
+	for i, c := range clients {
+		hash := sha256.Sum256([]byte(c.ID))
+		clients[i].KeySha256 = hex.EncodeToString(hash[:])
+	}
+	data, err := json.Marshal(map[string]any{"clients": clients})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "clients.json")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := auth.New(path, "", "", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestOcrQuotaOfCachedText(t *testing.T) {
+	f := newFixture(t, nil, nil, nil)
+	a := newAuthenticator(t, auth.Client{ID: "client", Quota: auth.Quota{OcrPages: 2}})
+	handler := a.Authenticate(http.HandlerFunc(f.extract.ExtractRemote))
+	get := func() *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodGet, "/?url="+url.QueryEscape(f.origin.URL), nil)
+		r.Header.Set("X-Api-Key", "client")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := get(); w.Code != http.StatusOK || w.Header().Get(hitKey) != "" {
+		t.Fatalf("status %d, headers %v", w.Code, w.Header())
+	}
+	// the cached text was OCRed when it was extracted
+	_, variant := f.extract.variant(RequestParams{})
+	key := cache.VariantKey(f.digest, variant)
+	content := waitForEntry(t, f.cache, key)
+	content["x-ocr-pages"] = "5"
+	f.cache.Save(cache.ExtractedDocument{Url: &key, Metadata: &content, Text: []byte("cached")})
+	waitForEntry(t, f.cache, f.origin.URL)
+
+	for range 3 {
+		w := get()
+		if w.Code != http.StatusOK || w.Body.String() != "cached" {
+			t.Fatalf("cached text: status %d %s", w.Code, w.Body)
+		}
+		if w.Header().Get(hitKey) != "hit" || w.Header().Get("X-Ocr-Pages") != "5" {
+			t.Errorf("headers %v", w.Header())
+		}
+	}
+}
+
+func TestJobsOfClients(t *testing.T) {
+	f := newFixture(t, &cache.NopCache{}, nil, nil)
+	extract := f.extract
+	a := newAuthenticator(t, auth.Client{ID: "a", Quota: auth.Quota{OcrPages: 2}}, auth.Client{ID: "b"})
+	extract.SetChargeOcrPages(a.ChargeOcrPages)
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /jobs", extract.CreateJob)
+	mux.HandleFunc("GET /jobs/{id}", extract.GetJob)
+	mux.HandleFunc("GET /jobs/{id}/result", extract.GetJobResult)
+	handler := a.Authenticate(mux)
+	do := func(method, target, client string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(method, target, nil)
+		r.Header.Set("X-Api-Key", client)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	// done waits for the job to be finished
+	done := func(id string) jobs.Job {
+		t.Helper()
+		for range 200 {
+			if job, err := extract.jobs.Get(id); err == nil && job.Finished() {
+				return job
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("job %s not finished", id)
+		return jobs.Job{}
+	}
+
+	w := do(http.MethodPost, "/jobs?url="+url.QueryEscape(f.origin.URL), "a")
+	var job jobs.Job
+	if err := json.Unmarshal(w.Body.Bytes(), &job); err != nil || w.Code != http.StatusAccepted || job.Client != "a" {
+		t.Fatalf("status %d, body %s", w.Code, w.Body)
+	}
+	done(job.ID)
+	for _, target := range []string{"/jobs/" + job.ID, "/jobs/" + job.ID + "/result"} {
+		if w := do(http.MethodGet, target, "a"); w.Code != http.StatusOK {
+			t.Errorf("%s of own job: status %d", target, w.Code)
+		}
+		if w := do(http.MethodGet, target, "b"); w.Code != http.StatusNotFound {
+			t.Errorf("%s of other client's job: status %d", target, w.Code)
+		}
+	}
+
+	// the pages OCRed by a job are charged when it is done
+	job, err := extract.startJob(RequestParams{}, "a", func(params RequestParams, w io.Writer, header http.Header) error {
+		addMetadataAsTrailers(header, cache.DocumentMetadata{"x-ocr-pages": "3"})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done(job.ID)
+	if w := do(http.MethodGet, "/jobs/"+job.ID, "a"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("OCR quota used up by job: status %d", w.Code)
+	}
+	if w := do(http.MethodGet, "/jobs/"+job.ID, "b"); w.Code != http.StatusNotFound {
+		t.Errorf("other client: status %d", w.Code)
+	}
+}
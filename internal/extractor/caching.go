@@ -0,0 +1,344 @@
+package extractor
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"encoding/json/v2"
+
+	"github.com/johbar/text-extraction-service/v4/internal/cache"
+	"github.com/johbar/text-extraction-service/v4/internal/config"
+	"github.com/johbar/text-extraction-service/v4/pkg/tesswrap"
+)
+
+// Metadata keys of cache entries
+const (
+	// versionKey holds the cache version the entry was saved with, see [cacheVersion]
+	versionKey = "x-cache-version"
+	// createdKey holds the time the text was extracted
+	createdKey = "x-cache-created"
+	// optionsKey holds the canonical options the text was extracted with, see [RequestParams.options]
+	optionsKey = "x-cache-options"
+)
+
+// hitKey is the header of responses served from the cache, whose text was not extracted again
+const hitKey = "x-cache-status"
+
+// httpMetadataKeys are the metadata keys taken from the HTTP response, which belong to the URL, not the content
+var httpMetadataKeys = []string{"etag", "http-last-modified", "http-content-length",
+	"http-cache-control", "http-expires", "http-date", "http-age", fetchedKey}
+
+// aliasMetadataKeys are the metadata keys saved in the alias of a URL
+var aliasMetadataKeys = append([]string{cache.DigestKey, versionKey, createdKey}, httpMetadataKeys...)
+
+var errNoPurgeParams = errors.New("one of url, prefix or digest is required")
+
+// cacheVersion describes what shapes the cached text besides the document and the request's options:
+// the build of TES and the PDF implementation. Entries saved with another version are extracted again.
+func cacheVersion(pdfLib string) string {
+	version := "unknown"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		version = info.Main.Version
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				version += "+" + setting.Value
+			}
+		}
+	}
+	return fmt.Sprintf("tes/%s pdf/%s", version, pdfLib)
+}
+
+// options returns the canonical form of the settings shaping the output for p: mode and format, the text options
+// and, unless OCR is unavailable or disabled, the OCR settings, each filled in with the configured defaults.
+// Silent and NoCache are left out, as they don't change the text.
+func (p RequestParams) options(conf *config.TesConfig) string {
+	v := url.Values{}
+	mode := cmp.Or(p.Mode, ModeText)
+	v.Set("mode", mode)
+	switch mode {
+	case ModeText:
+		v.Set("removeNewlines", strconv.FormatBool(conf.RemoveNewlines))
+	case ModeTables, ModeWords:
+		v.Set("format", cmp.Or(p.Format, FormatJSON))
+	}
+	if mode == ModeTables {
+		// tables are not OCRed
+		return v.Encode()
+	}
+	ocr := cmp.Or(p.Ocr, conf.Ocr)
+	if !tesswrap.Initialized {
+		ocr = "unavailable"
+	}
+	v.Set("ocr", ocr)
+	if ocr != config.OcrAuto && ocr != config.OcrAlways {
+		return v.Encode()
+	}
+	formatFloat := func(f float64) string { return strconv.FormatFloat(f, 'g', -1, 64) }
+	v.Set("lang", cmp.Or(p.OcrLang, conf.TesseractLangs))
+	v.Set("minConfidence", formatFloat(cmp.Or(p.OcrMinConfidence, conf.OcrMinConfidence)))
+	v.Set("dpi", strconv.Itoa(conf.OcrDpi))
+	v.Set("minDpi", strconv.Itoa(conf.OcrMinDpi))
+	v.Set("rotate", strconv.FormatBool(conf.OcrRotate))
+	v.Set("deskew", strconv.FormatBool(conf.OcrDeskew))
+	v.Set("binarize", strconv.FormatBool(conf.OcrBinarize))
+	v.Set("normalizeDpi", strconv.FormatBool(conf.OcrNormalizeDpi))
+	if ocr == config.OcrAuto {
+		v.Set("minTextLength", strconv.Itoa(conf.MinTextLength))
+		v.Set("minImageCoverage", formatFloat(conf.MinImageCoverage))
+		v.Set("scanCoverage", formatFloat(conf.ScanCoverage))
+		v.Set("maxGlyphFailures", formatFloat(conf.MaxGlyphFailures))
+		v.Set("minPrintable", formatFloat(conf.MinPrintable))
+		v.Set("minDictionaryHits", formatFloat(conf.MinDictionaryHits))
+	}
+	return v.Encode()
+}
+
+// fingerprint returns the short hash of canonical options identifying a cached variant
+func fingerprint(options string) string {
+	sum := sha256.Sum256([]byte(options))
+	return hex.EncodeToString(sum[:8])
+}
+
+// variant returns the canonical options of p and their fingerprint
+func (e *Extractor) variant(p RequestParams) (options, variant string) {
+	options = p.options(e.tesConfig)
+	return options, fingerprint(options)
+}
+
+// usable reports whether a cache entry was saved with the current cache version and hasn't expired
+func (e *Extractor) usable(key string, metadata cache.DocumentMetadata) bool {
+	if metadata[versionKey] != e.cacheVersion {
+		e.log.Debug("Cache entry saved by another version", "key", key, "version", metadata[versionKey])
+		return false
+	}
+	if e.tesConfig.CacheTtl > 0 {
+		created, err := time.Parse(time.RFC3339, metadata[createdKey])
+		if err != nil || time.Since(created) > e.tesConfig.CacheTtl {
+			e.log.Debug("Cache entry expired", "key", key, "created", metadata[createdKey])
+			return false
+		}
+	}
+	return true
+}
+
+// cacheEntries returns the entries to save for doc: the text and metadata keyed by the content's digest and variant,
+// the content's index listing its variants and an alias for its URL, if it has one, holding the digest and the headers
+// needed for revalidation. Documents with unknown digest are not saved.
+func (e *Extractor) cacheEntries(doc cache.ExtractedDocument) []cache.ExtractedDocument {
+	if doc.Digest == "" {
+		return nil
+	}
+	(*doc.Metadata)[versionKey] = e.cacheVersion
+	if _, ok := (*doc.Metadata)[createdKey]; !ok {
+		// text served from the cache keeps its age
+		(*doc.Metadata)[createdKey] = time.Now().UTC().Format(time.RFC3339)
+	}
+	var entries []cache.ExtractedDocument
+	if !doc.ContentCached {
+		key := cache.VariantKey(doc.Digest, doc.Variant)
+		metadata := maps.Clone(*doc.Metadata)
+		for _, k := range httpMetadataKeys {
+			delete(metadata, k)
+		}
+		entries = append(entries, cache.ExtractedDocument{Url: &key, Metadata: &metadata, Text: doc.Text, Digest: doc.Digest, Variant: doc.Variant})
+	}
+	if doc.Url != nil {
+		metadata := make(cache.DocumentMetadata)
+		for _, k := range aliasMetadataKeys {
+			if v, ok := (*doc.Metadata)[k]; ok {
+				metadata[k] = v
+			}
+		}
+		entries = append(entries, cache.ExtractedDocument{Url: doc.Url, Metadata: &metadata, Digest: doc.Digest})
+	}
+	return entries
+}
+
+// cachedVariants returns the variants cached for the content with the given digest. They are listed by the cache
+// rather than kept in an entry of their own, which concurrent saves of several replicas would overwrite.
+func (e *Extractor) cachedVariants(digest string) ([]string, error) {
+	lister, ok := e.tesCache.(cache.KeyLister)
+	if !ok {
+		return nil, fmt.Errorf("listing cache entries: %w", errors.ErrUnsupported)
+	}
+	prefix := cache.VariantKey(digest, "")
+	keys, err := lister.Keys(prefix)
+	if err != nil {
+		return nil, err
+	}
+	variants := make([]string, 0, len(keys))
+	for _, key := range keys {
+		variants = append(variants, strings.TrimPrefix(key, prefix))
+	}
+	slices.Sort(variants)
+	return variants, nil
+}
+
+// cachedContent returns the cached metadata of the given variant of the content with the given digest,
+// nil if there is no usable entry
+func (e *Extractor) cachedContent(digest, variant string) cache.DocumentMetadata {
+	key := cache.VariantKey(digest, variant)
+	metadata, err := e.tesCache.GetMetadata(key)
+	if err != nil {
+		e.log.Error("Could not get metadata from cache", "key", key, "err", err)
+		return nil
+	}
+	if metadata == nil || !e.usable(key, metadata) {
+		return nil
+	}
+	return metadata
+}
+
+// cachedUrl returns the cached metadata of the given variant of the content url had when it was fetched last,
+// along with the headers needed for revalidation, nil if there is no usable entry
+func (e *Extractor) cachedUrl(url, variant string) cache.DocumentMetadata {
+	alias, err := e.tesCache.GetMetadata(url)
+	if err != nil {
+		e.log.Error("Could not get metadata from cache", "url", url, "err", err)
+		return nil
+	}
+	if alias == nil || alias[cache.DigestKey] == "" || !e.usable(url, alias) {
+		return nil
+	}
+	metadata := e.cachedContent(alias[cache.DigestKey], variant)
+	if metadata == nil {
+		return nil
+	}
+	for _, k := range httpMetadataKeys {
+		if v, ok := alias[k]; ok {
+			metadata[k] = v
+		}
+	}
+	return metadata
+}
+
+// streamCached writes the text cached under key to w after adding metadata to header.
+// The headers are removed again if the text can't be read.
+func (e *Extractor) streamCached(key string, metadata cache.DocumentMetadata, w io.Writer, header http.Header, silent bool) bool {
+	addMetadataAsHeaders(header, metadata)
+	header.Set(hitKey, "hit")
+	if silent {
+		return true
+	}
+	err := e.tesCache.StreamText(key, w)
+	if err == nil {
+		return true
+	}
+	e.log.Error("Could not receive text from cache or write to output stream", "key", key, "err", err)
+	for k := range metadata {
+		header.Del(k)
+	}
+	header.Del(hitKey)
+	return false
+}
+
+// PurgeParams select the cache entries to delete
+type PurgeParams struct {
+	// Url deletes the URL's entry and the text it refers to, which other URLs with the same content share
+	Url string `json:"url"`
+	// Prefix deletes the entries of all URLs starting with it, like Url
+	Prefix string `json:"prefix"`
+	// Digest deletes all variants of the text of the content with the given SHA-256 digest
+	Digest string `json:"digest"`
+}
+
+// PurgeResult lists the keys of the deleted cache entries
+type PurgeResult struct {
+	Deleted []string `json:"deleted"`
+}
+
+// purge deletes the cache entries selected by p, so that the documents are extracted again when requested.
+func (e *Extractor) purge(p PurgeParams) (PurgeResult, error) {
+	var result PurgeResult
+	if p.Url == "" && p.Prefix == "" && p.Digest == "" {
+		return result, errNoPurgeParams
+	}
+	var urls, digests []string
+	if p.Url != "" {
+		urls = append(urls, p.Url)
+	}
+	if p.Prefix != "" {
+		lister, ok := e.tesCache.(cache.KeyLister)
+		if !ok {
+			return result, fmt.Errorf("listing cache entries: %w", errors.ErrUnsupported)
+		}
+		keys, err := lister.Keys(p.Prefix)
+		if err != nil {
+			return result, err
+		}
+		for _, key := range keys {
+			if !strings.HasPrefix(key, cache.ContentKey("")) {
+				urls = append(urls, key)
+			}
+		}
+	}
+	if p.Digest != "" {
+		digests = append(digests, p.Digest)
+	}
+	del := func(key string) (cache.DocumentMetadata, error) {
+		metadata, err := e.tesCache.GetMetadata(key)
+		if err != nil || metadata == nil {
+			return nil, err
+		}
+		if err := e.tesCache.Delete(key); err != nil {
+			return nil, fmt.Errorf("deleting cache entry %s: %w", key, err)
+		}
+		result.Deleted = append(result.Deleted, key)
+		return metadata, nil
+	}
+	for _, url := range urls {
+		metadata, err := del(url)
+		if err != nil {
+			return result, err
+		}
+		// the text is deleted, too, as the document would be served by its digest otherwise
+		if digest := metadata[cache.DigestKey]; digest != "" && !slices.Contains(digests, digest) {
+			digests = append(digests, digest)
+		}
+	}
+	for _, digest := range digests {
+		variants, err := e.cachedVariants(digest)
+		if err != nil {
+			return result, err
+		}
+		for _, variant := range variants {
+			if _, err := del(cache.VariantKey(digest, variant)); err != nil {
+				return result, err
+			}
+		}
+	}
+	return result, nil
+}
+
+// Purge deletes the cache entries selected by the query params url, prefix or digest
+// and responds with the JSON encoded keys of the deleted entries.
+func (e *Extractor) Purge(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	result, err := e.purge(PurgeParams{Url: q.Get("url"), Prefix: q.Get("prefix"), Digest: q.Get("digest")})
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, errNoPurgeParams):
+			status = http.StatusBadRequest
+		case errors.Is(err, errors.ErrUnsupported):
+			status = http.StatusNotImplemented
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	e.log.Info("Cache entries deleted", "params", q, "count", len(result.Deleted))
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.MarshalWrite(w, result)
+}
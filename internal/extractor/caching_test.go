@@ -0,0 +1,279 @@
+package extractor
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"encoding/json/v2"
+
+	"github.com/johbar/text-extraction-service/v4/internal/cache"
+)
+
+func TestContentDigestCache(t *testing.T) {
+	f := newFixture(t, nil, nil, nil)
+	extract, srv := f.extract, f.origin
+	get := func(path string) string {
+		t.Helper()
+		var sb strings.Builder
+		header := http.Header{}
+		status, err := extract.DocFromUrl(RequestParams{Url: srv.URL + path}, &sb, header)
+		if err != nil || status != http.StatusOK {
+			t.Fatalf("GET %s: status %d, err %v", path, status, err)
+		}
+		if got := header.Get(cache.DigestKey); got != f.digest {
+			t.Errorf("GET %s: digest %s, want %s", path, got, f.digest)
+		}
+		return sb.String()
+	}
+
+	if text := get("/a"); len(text) < 100 {
+		t.Fatalf("extracted text too short: %q", text)
+	}
+	alias := waitForEntry(t, f.cache, srv.URL+"/a")
+	if alias[cache.DigestKey] != f.digest || alias["etag"] != `"v1"` {
+		t.Errorf("alias lacks digest or etag: %v", alias)
+	}
+	_, variant := extract.variant(RequestParams{})
+	key := cache.VariantKey(f.digest, variant)
+	content := waitForEntry(t, f.cache, key)
+	if _, ok := content["etag"]; ok {
+		t.Errorf("content entry holds headers of the URL: %v", content)
+	}
+	// replace the cached text to tell it from extracted text
+	f.cache.Save(cache.ExtractedDocument{Url: &key, Metadata: &content, Text: []byte("cached")})
+
+	if text := get("/b"); text != "cached" {
+		t.Errorf("same content from another URL was extracted again: %q", text)
+	}
+	waitForEntry(t, f.cache, srv.URL+"/b")
+	if text := get("/a"); text != "cached" {
+		t.Errorf("revalidated URL was extracted again: %q", text)
+	}
+
+	post := func(body []byte) string {
+		rec := httptest.NewRecorder()
+		extract.ExtractBody(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+		return rec.Body.String()
+	}
+	if text := post(f.rtf); text != "cached" {
+		t.Errorf("POSTed content was extracted again: %q", text)
+	}
+	changed := append(bytes.Clone(f.rtf), '\n')
+	if text := post(changed); len(text) < 100 {
+		t.Fatalf("extracted text too short: %q", text)
+	}
+	sum := sha256.Sum256(changed)
+	waitForEntry(t, f.cache, cache.VariantKey(hex.EncodeToString(sum[:]), variant))
+}
+
+func TestCacheInvalidation(t *testing.T) {
+	var fetched atomic.Int32
+	f := newFixture(t, nil, nil, func(w http.ResponseWriter, r *http.Request) bool {
+		fetched.Add(1)
+		return false
+	})
+	extract, srv := f.extract, f.origin
+	_, variant := extract.variant(RequestParams{})
+	contentKey := cache.VariantKey(f.digest, variant)
+	get := func(path string) string {
+		t.Helper()
+		var sb strings.Builder
+		status, err := extract.DocFromUrl(RequestParams{Url: srv.URL + path}, &sb, http.Header{})
+		if err != nil || status != http.StatusOK {
+			t.Fatalf("GET %s: status %d, err %v", path, status, err)
+		}
+		return sb.String()
+	}
+	// marks the cached text to tell it from extracted text
+	markCached := func() {
+		t.Helper()
+		content := waitForEntry(t, f.cache, contentKey)
+		f.cache.Save(cache.ExtractedDocument{Url: &contentKey, Metadata: &content, Text: []byte("cached")})
+	}
+	purge := func(query string) PurgeResult {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		extract.Purge(rec, httptest.NewRequest(http.MethodDelete, "/?"+query, nil))
+		var result PurgeResult
+		if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+			t.Fatalf("%d %s", rec.Code, rec.Body)
+		}
+		return result
+	}
+
+	get("/a")
+	get("/b")
+	waitForEntry(t, f.cache, srv.URL+"/b")
+	markCached()
+	result := purge("url=" + srv.URL + "/a")
+	if !slices.Equal(result.Deleted, []string{srv.URL + "/a", contentKey}) {
+		t.Errorf("deleted %v", result.Deleted)
+	}
+	// the alias of b refers to the deleted text, so the document is fetched again
+	if text := get("/b"); text == "cached" || len(text) < 100 {
+		t.Errorf("purged text was served: %q", text)
+	}
+	markCached()
+	if text := get("/b"); text != "cached" {
+		t.Errorf("text was not served from cache: %q", text)
+	}
+	if result := purge("prefix=" + srv.URL); len(result.Deleted) != 2 {
+		t.Errorf("deleted %v", result.Deleted)
+	}
+	rec := httptest.NewRecorder()
+	extract.Purge(rec, httptest.NewRequest(http.MethodDelete, "/", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("purge without params: status %d", rec.Code)
+	}
+
+	get("/a")
+	markCached()
+	// entries of other versions or older than the TTL are not used
+	extract.cacheVersion = "other"
+	n := fetched.Load()
+	if text := get("/a"); text == "cached" {
+		t.Error("entry of another version was used")
+	}
+	if fetched.Load() != n+1 {
+		t.Error("document was not fetched once")
+	}
+	markCached()
+	extract.tesConfig.CacheTtl = time.Nanosecond
+	if text := get("/a"); text == "cached" {
+		t.Error("expired entry was used")
+	}
+}
+
+func TestCacheVariants(t *testing.T) {
+	f := newFixture(t, nil, nil, nil)
+	extract, conf := f.extract, f.extract.tesConfig
+	// a replica with another config sharing the cache
+	otherConf := *conf
+	otherConf.RemoveNewlines = !conf.RemoveNewlines
+	other := New(&otherConf, extract.df, f.cache, nil, nil)
+	t.Cleanup(func() { waitForSaves(other) })
+
+	options, variant := extract.variant(RequestParams{})
+	explicit, _ := extract.variant(RequestParams{Mode: ModeText, Ocr: conf.Ocr, OcrLang: conf.TesseractLangs, Silent: true})
+	if explicit != options {
+		t.Errorf("options given explicitly differ from defaults: %s, want %s", explicit, options)
+	}
+	_, otherVariant := other.variant(RequestParams{})
+	_, wordsVariant := extract.variant(RequestParams{Mode: ModeWords})
+	if otherVariant == variant || wordsVariant == variant {
+		t.Errorf("variants of different options match: %s, %s, %s", variant, otherVariant, wordsVariant)
+	}
+
+	get := func(e *Extractor) string {
+		t.Helper()
+		var sb strings.Builder
+		header := http.Header{}
+		status, err := e.DocFromUrl(RequestParams{Url: f.origin.URL}, &sb, header)
+		if err != nil || status != http.StatusOK {
+			t.Fatalf("status %d, err %v", status, err)
+		}
+		if header.Get(optionsKey) == "" {
+			t.Error("options missing")
+		}
+		return sb.String()
+	}
+
+	get(extract)
+	key := cache.VariantKey(f.digest, variant)
+	content := waitForEntry(t, f.cache, key)
+	if content[optionsKey] != options {
+		t.Errorf("entry saved with options %q, want %q", content[optionsKey], options)
+	}
+	f.cache.Save(cache.ExtractedDocument{Url: &key, Metadata: &content, Text: []byte("cached")})
+	if text := get(other); text == "cached" {
+		t.Error("variant of other options was served")
+	}
+	waitForEntry(t, f.cache, cache.VariantKey(f.digest, otherVariant))
+	if text := get(extract); text != "cached" {
+		t.Errorf("variant was replaced by the other: %q", text)
+	}
+	// the variants are listed by the cache, so replicas saving them concurrently can't lose any
+	want := []string{variant, otherVariant}
+	slices.Sort(want)
+	if variants, err := extract.cachedVariants(f.digest); err != nil || !slices.Equal(variants, want) {
+		t.Errorf("variants %v, err %v", variants, err)
+	}
+	result, err := extract.purge(PurgeParams{Digest: f.digest})
+	if err != nil || len(result.Deleted) != 2 {
+		t.Errorf("deleted %v, err %v", result.Deleted, err)
+	}
+}
+
+// lostTextCache is a cache whose texts can't be read
+type lostTextCache struct {
+	cache.Cache
+}
+
+func (c lostTextCache) StreamText(string, io.Writer) error {
+	return errors.New("text lost")
+}
+
+// countingBody counts how often it is closed
+type countingBody struct {
+	io.ReadCloser
+	closed atomic.Int32
+}
+
+func (b *countingBody) Close() error {
+	b.closed.Add(1)
+	return b.ReadCloser.Close()
+}
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestRefetchAfterNotModified(t *testing.T) {
+	fs, err := cache.NewFsCache(t.TempDir(), 1<<20, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := newFixture(t, fs, nil, nil)
+	get := func() {
+		t.Helper()
+		status, err := f.extract.DocFromUrl(RequestParams{Url: f.origin.URL}, io.Discard, http.Header{})
+		if err != nil || status != http.StatusOK {
+			t.Fatalf("status %d, err %v", status, err)
+		}
+	}
+	get()
+	waitForEntry(t, fs, f.origin.URL)
+	waitForSaves(f.extract)
+
+	// the origin answers 304, but the cached text can't be read, so the document is fetched again
+	f.extract.tesCache = lostTextCache{fs}
+	var bodies []*countingBody
+	f.extract.httpClient = &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		response, err := http.DefaultTransport.RoundTrip(req)
+		if err == nil {
+			body := &countingBody{ReadCloser: response.Body}
+			bodies = append(bodies, body)
+			response.Body = body
+		}
+		return response, err
+	})}
+	get()
+	if len(bodies) != 2 {
+		t.Fatalf("%d requests sent, want 2", len(bodies))
+	}
+	for i, body := range bodies {
+		if n := body.closed.Load(); n != 1 {
+			t.Errorf("body %d closed %d times", i+1, n)
+		}
+	}
+}
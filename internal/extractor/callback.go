@@ -0,0 +1,107 @@
+package extractor
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"encoding/json/v2"
+
+	"github.com/johbar/text-extraction-service/v4/internal/fetcher"
+	"github.com/johbar/text-extraction-service/v4/internal/jobs"
+)
+
+// Headers of callbacks, which let receivers verify that TES sent the payload
+const (
+	// timestampHeader holds the Unix time the callback was sent
+	timestampHeader = "X-Tes-Timestamp"
+	// signatureHeader holds "sha256=" and the hex encoded HMAC-SHA256 of the timestamp, a dot and the body
+	signatureHeader = "X-Tes-Signature"
+)
+
+// maxCallbackRetryAfter limits the delay receivers may request with a Retry-After header
+const maxCallbackRetryAfter = 10 * time.Minute
+
+// callbackPayload is posted to the callback of a finished job
+type callbackPayload struct {
+	jobs.Job
+	// Result is the output of a job that is done
+	Result string `json:"result,omitempty"`
+}
+
+// notify posts the finished job and its result to its callback URL, retrying with exponential backoff
+// on network errors, server errors and status 408 or 429. The outcome is saved with the job.
+func (e *Extractor) notify(job *jobs.Job, result []byte) {
+	if job.Callback == "" {
+		return
+	}
+	body, err := json.Marshal(callbackPayload{Job: *job, Result: string(result)})
+	if err != nil {
+		e.log.Error("Could not encode job", "id", job.ID, "err", err)
+		return
+	}
+	delay := e.tesConfig.CallbackRetryDelay
+	for attempt := 0; ; attempt++ {
+		status, retry, retryAfter, err := e.postCallback(job.Callback, body)
+		job.CallbackStatus = status
+		if err == nil {
+			job.CallbackError = ""
+			e.log.Info("Job callback delivered", "id", job.ID, "callback", job.Callback, "attempts", attempt+1)
+			break
+		}
+		job.CallbackError = err.Error()
+		if !retry || attempt >= e.tesConfig.CallbackRetries {
+			e.log.Error("Job callback failed", "id", job.ID, "callback", job.Callback, "attempts", attempt+1, "err", err)
+			break
+		}
+		e.log.Warn("Job callback failed. Retrying", "id", job.ID, "callback", job.Callback, "attempt", attempt+1, "err", err)
+		time.Sleep(max(delay, retryAfter))
+		delay *= 2
+	}
+	e.saveJob(job)
+}
+
+// postCallback sends the signed body once. It reports whether a failure is worth retrying
+// and the delay requested by the receiver.
+func (e *Extractor) postCallback(url string, body []byte) (status int, retry bool, retryAfter time.Duration, err error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, false, 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret := e.tesConfig.CallbackSecret; secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(timestampHeader, timestamp)
+		req.Header.Set(signatureHeader, "sha256="+sign(secret, timestamp, body))
+	}
+	response, err := e.callbackClient.Do(req)
+	if err != nil {
+		return 0, true, 0, err
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(response.Body, 4096))
+	response.Body.Close()
+	status = response.StatusCode
+	if status < 300 {
+		return status, false, 0, nil
+	}
+	if delay, ok := fetcher.ParseRetryAfter(response.Header.Get("Retry-After"), time.Now()); ok {
+		retryAfter = min(delay, maxCallbackRetryAfter)
+	}
+	retry = status >= 500 || status == http.StatusRequestTimeout || status == http.StatusTooManyRequests
+	return status, retry, retryAfter, fmt.Errorf("callback responded with status %s", response.Status)
+}
+
+// sign returns the hex encoded HMAC-SHA256 of the timestamp, a dot and the body
+func sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte{'.'})
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,127 @@
+package extractor
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"encoding/json/v2"
+
+	"github.com/johbar/text-extraction-service/v4/internal/cache"
+	"github.com/johbar/text-extraction-service/v4/internal/config"
+	"github.com/johbar/text-extraction-service/v4/internal/fetcher"
+	"github.com/johbar/text-extraction-service/v4/internal/jobs"
+)
+
+func TestCallback(t *testing.T) {
+	f := newFixture(t, &cache.NopCache{}, func(conf *config.TesConfig) {
+		conf.CallbackSecret = "s3cret"
+		conf.CallbackRetries = 2
+		conf.CallbackRetryDelay = 10 * time.Millisecond
+	}, nil)
+	extract, origin := f.extract, f.origin
+	// the credentials and retries of fetch profiles don't apply to callbacks
+	profiles := filepath.Join(t.TempDir(), "profiles.json")
+	os.WriteFile(profiles, []byte(`{"profiles": [{"hosts": ["*"], "username": "user", "password": "secret", "retries": 3}]}`), 0o600)
+	httpClient, err := fetcher.NewClient(profiles, fetcher.Options{RetryDelay: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	extract.httpClient = httpClient
+	callbackClient, _ := fetcher.NewGuardedClient(fetcher.Options{})
+	extract.SetCallbackClient(callbackClient)
+	var want strings.Builder
+	if _, err := extract.DocFromUrl(RequestParams{Url: origin.URL}, &want, http.Header{}); err != nil {
+		t.Fatal(err)
+	}
+	var attempts atomic.Int32
+	delivered := make(chan map[string]any, 1)
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		timestamp := r.Header.Get(timestampHeader)
+		if r.Header.Get(signatureHeader) != "sha256="+sign("s3cret", timestamp, body) || timestamp == "" {
+			t.Errorf("invalid signature %s of %s", r.Header.Get(signatureHeader), timestamp)
+		}
+		if _, _, ok := r.BasicAuth(); ok {
+			t.Error("credentials of fetch profile sent with callback")
+		}
+		switch {
+		case r.URL.Path == "/reject":
+			w.WriteHeader(http.StatusBadRequest)
+		case r.URL.Path == "/flaky" && attempts.Load() == 1:
+			w.Header().Set("Retry-After", time.Now().UTC().Format(http.TimeFormat))
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			var payload map[string]any
+			if err := json.Unmarshal(body, &payload); err != nil {
+				t.Error(err)
+			}
+			delivered <- payload
+		}
+	}))
+	defer callback.Close()
+	// finished waits for the outcome of the callback to be saved with the job
+	finished := func(id string) jobs.Job {
+		t.Helper()
+		for range 200 {
+			if job, err := extract.jobs.Get(id); err == nil && job.CallbackStatus != 0 {
+				return job
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatal("callback outcome not saved")
+		return jobs.Job{}
+	}
+	// accepted checks the response to a request with a callback and returns the job
+	accepted := func(w *httptest.ResponseRecorder) jobs.Job {
+		t.Helper()
+		var job jobs.Job
+		if err := json.Unmarshal(w.Body.Bytes(), &job); err != nil || w.Code != http.StatusAccepted || job.Status != jobs.Queued {
+			t.Fatalf("status %d, body %s", w.Code, w.Body)
+		}
+		return job
+	}
+
+	w := httptest.NewRecorder()
+	extract.ExtractRemote(w, httptest.NewRequest(http.MethodGet, "/?url="+url.QueryEscape(origin.URL)+"&callback="+url.QueryEscape(callback.URL+"/flaky"), nil))
+	job := accepted(w)
+	payload := <-delivered
+	if payload["id"] != job.ID || payload["status"] != jobs.Done || payload["result"] != want.String() {
+		t.Errorf("payload %v", payload)
+	}
+	if metadata, _ := payload["metadata"].(map[string]any); metadata[cache.DigestKey] == nil {
+		t.Errorf("metadata %v", payload["metadata"])
+	}
+	if job = finished(job.ID); attempts.Load() != 2 || job.CallbackStatus != http.StatusOK || job.CallbackError != "" {
+		t.Errorf("attempts %d, job %+v", attempts.Load(), job)
+	}
+
+	w = httptest.NewRecorder()
+	extract.ExtractBody(w, httptest.NewRequest(http.MethodPost, "/?callback="+url.QueryEscape(callback.URL), bytes.NewReader(f.rtf)))
+	job = accepted(w)
+	if payload = <-delivered; payload["id"] != job.ID || payload["result"] != want.String() {
+		t.Errorf("payload of body %v", payload)
+	}
+
+	attempts.Store(0)
+	w = httptest.NewRecorder()
+	extract.ExtractRemote(w, httptest.NewRequest(http.MethodGet, "/?url="+url.QueryEscape(origin.URL)+"&callback="+url.QueryEscape(callback.URL+"/reject"), nil))
+	if job = finished(accepted(w).ID); attempts.Load() != 1 || job.CallbackStatus != http.StatusBadRequest || job.CallbackError == "" {
+		t.Errorf("rejected callback: attempts %d, job %+v", attempts.Load(), job)
+	}
+
+	w = httptest.NewRecorder()
+	extract.ExtractRemote(w, httptest.NewRequest(http.MethodGet, "/?url="+url.QueryEscape(origin.URL)+"&callback=ftp://example.com", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("invalid callback: status %d", w.Code)
+	}
+}
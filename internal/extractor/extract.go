@@ -6,32 +6,225 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"maps"
+	"math"
 	"net/http"
+	"net/url"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/johbar/text-extraction-service/v4/internal/admission"
 	"github.com/johbar/text-extraction-service/v4/internal/cache"
 	"github.com/johbar/text-extraction-service/v4/internal/config"
 	"github.com/johbar/text-extraction-service/v4/internal/docfactory"
+	"github.com/johbar/text-extraction-service/v4/internal/fetcher"
+	"github.com/johbar/text-extraction-service/v4/internal/jobs"
 	"github.com/johbar/text-extraction-service/v4/pkg/dehyphenator"
+	"github.com/johbar/text-extraction-service/v4/pkg/tesswrap"
 )
 
 type RequestParams struct {
 	Url string `form:"url" json:"url"`
 	//Ignore cached record
 	NoCache bool `form:"noCache" json:"noCache"`
+	//Serve cached text up to this age in seconds without contacting the origin; 0 always revalidates.
+	//Default: the freshness announced by the origin or configured for its host
+	MaxAge *int `form:"maxAge" json:"maxAge"`
 	//Send Metadata only, ignoring content
 	Silent bool `form:"silent" json:"silent"`
+	//Output mode: "text" (default), "layout", "tables" or "words"
+	Mode string `form:"mode" json:"mode"`
+	//Output format of mode "tables": "json" (default), "csv" or "markdown",
+	//of mode "words": "json" (default), "hocr" or "alto"
+	Format string `form:"format" json:"format"`
+	//OCR mode: "auto", "always" or "never". Default: TES_OCR
+	Ocr string `form:"ocr" json:"ocr"`
+	//Tesseract languages separated by '+' or "auto" to choose them by the detected script. Default: TES_TESSERACT_LANGS
+	OcrLang string `form:"ocrLang" json:"ocrLang"`
+	//Recognized words with a lower confidence (0 to 100) are dropped. Default: TES_OCR_MIN_CONFIDENCE
+	OcrMinConfidence float64 `form:"ocrMinConfidence" json:"ocrMinConfidence"`
+	//Extract the document in the background and POST the result to this URL. The request is answered with the job
+	Callback string `form:"callback" json:"callback"`
+	// progress counts the pages written for jobs, if it is not nil
+	progress *Progress
+	// background requests wait for admission as long as it takes
+	background bool
+}
+
+const (
+	// ModeText returns the text in reading order
+	ModeText = "text"
+	// ModeLayout keeps the spatial alignment of the text, like pdftotext -layout
+	ModeLayout = "layout"
+	// ModeTables returns the tables found in the document
+	ModeTables = "tables"
+	// ModeWords returns the words and their bounding boxes
+	ModeWords = "words"
+
+	FormatJSON     = "json"
+	FormatCSV      = "csv"
+	FormatMarkdown = "markdown"
+	FormatHOCR     = "hocr"
+	FormatALTO     = "alto"
+)
+
+// paramsFromQuery returns the request options given as query params
+func paramsFromQuery(q url.Values) RequestParams {
+	minConfidence := 0.0
+	if q.Has("ocrMinConfidence") {
+		var err error
+		if minConfidence, err = strconv.ParseFloat(q.Get("ocrMinConfidence"), 64); err != nil {
+			// rejected by validate
+			minConfidence = math.NaN()
+		}
+	}
+	var maxAge *int
+	if q.Has("maxAge") {
+		n, err := strconv.Atoi(q.Get("maxAge"))
+		if err != nil {
+			// rejected by validate
+			n = -1
+		}
+		maxAge = &n
+	}
+	return RequestParams{
+		Url:              q.Get("url"),
+		NoCache:          q.Has("noCache") || q.Has("nocache"),
+		MaxAge:           maxAge,
+		Silent:           q.Has("silent"),
+		Mode:             q.Get("mode"),
+		Format:           q.Get("format"),
+		Ocr:              q.Get("ocr"),
+		OcrLang:          q.Get("ocrLang"),
+		OcrMinConfidence: minConfidence,
+		Callback:         q.Get("callback"),
+	}
+}
+
+// validate returns an error if mode, format or OCR mode are unknown, OCR languages are not installed, maxAge is negative
+// or the callback is no HTTP(S) URL
+func (p RequestParams) validate() error {
+	if p.MaxAge != nil && *p.MaxAge < 0 {
+		return errors.New("maxAge is not a number of seconds")
+	}
+	if p.Callback != "" && !isHttpUrl(p.Callback) {
+		return fmt.Errorf("not a valid HTTP(S) callback URL: %s", p.Callback)
+	}
+	switch p.Ocr {
+	case "", config.OcrAuto, config.OcrAlways, config.OcrNever:
+	default:
+		return fmt.Errorf("unknown OCR mode: %s", p.Ocr)
+	}
+	if !(p.OcrMinConfidence >= 0 && p.OcrMinConfidence <= 100) {
+		return fmt.Errorf("OCR confidence threshold out of range 0 to 100: %v", p.OcrMinConfidence)
+	}
+	if p.OcrLang != "" && tesswrap.Initialized {
+		if err := tesswrap.CheckLangs(p.OcrLang); err != nil {
+			return fmt.Errorf("invalid OCR language: %w", err)
+		}
+	}
+	var formats []string
+	switch p.Mode {
+	case "", ModeText, ModeLayout:
+	case ModeTables:
+		formats = []string{FormatJSON, FormatCSV, FormatMarkdown}
+	case ModeWords:
+		formats = []string{FormatJSON, FormatHOCR, FormatALTO}
+	default:
+		return fmt.Errorf("unknown mode: %s", p.Mode)
+	}
+	if p.Format != "" && !slices.Contains(formats, p.Format) {
+		return fmt.Errorf("unknown format for mode %s: %s", p.Mode, p.Format)
+	}
+	return nil
+}
+
+// plainText reports whether the text is requested in reading order, which is the only output
+// that is dehyphenated.
+func (p RequestParams) plainText() bool {
+	return p.Mode == "" || p.Mode == ModeText
+}
+
+// ocrOptions returns the request's OCR settings, collecting the results in stats, which may be nil
+func (p RequestParams) ocrOptions(stats *OcrStats) OcrOptions {
+	return OcrOptions{Mode: p.Ocr, Lang: p.OcrLang, MinConfidence: p.OcrMinConfidence, Stats: stats, Progress: p.progress}
+}
+
+// forkArgs returns the command line args passing mode, format and OCR settings to a subprocess
+func (p RequestParams) forkArgs() []string {
+	var args []string
+	if !p.plainText() {
+		args = append(args, "-mode="+p.Mode)
+	}
+	if p.Format != "" {
+		args = append(args, "-format="+p.Format)
+	}
+	if p.Ocr != "" {
+		args = append(args, "-ocr="+p.Ocr)
+	}
+	if p.OcrLang != "" {
+		args = append(args, "-ocrLang="+p.OcrLang)
+	}
+	if p.OcrMinConfidence != 0 {
+		args = append(args, "-ocrMinConfidence="+strconv.FormatFloat(p.OcrMinConfidence, 'f', -1, 64))
+	}
+	return args
+}
+
+// contentType returns the media type of the output, if it is not plain text
+func (p RequestParams) contentType() string {
+	if p.Mode != ModeTables && p.Mode != ModeWords {
+		return ""
+	}
+	switch p.Format {
+	case FormatCSV:
+		return "text/csv; charset=utf-8"
+	case FormatMarkdown:
+		return "text/markdown; charset=utf-8"
+	case FormatHOCR:
+		return "application/xhtml+xml; charset=utf-8"
+	case FormatALTO:
+		return "application/xml; charset=utf-8"
+	}
+	return "application/json"
+}
+
+// writeOutput writes the document's content in the requested mode. The results of OCR are collected in stats, which may be nil.
+func (e *Extractor) writeOutput(d cache.Document, w io.Writer, params RequestParams, stats *OcrStats, origin string) error {
+	ocr := params.ocrOptions(stats)
+	switch params.Mode {
+	case ModeLayout:
+		return e.WriteLayoutText(d, w, ocr, origin)
+	case ModeTables:
+		return e.WriteTables(d, w, params.Format, origin)
+	case ModeWords:
+		return e.WriteWords(d, w, params.Format, ocr, origin)
+	}
+	return e.WriteTextOrRunOcr(d, w, ocr, origin)
 }
 
 type Extractor struct {
-	tesCache            cache.Cache
-	df                  *docfactory.DocFactory
-	log                 *slog.Logger
-	httpClient          *http.Client
+	tesCache   cache.Cache
+	df         *docfactory.DocFactory
+	log        *slog.Logger
+	httpClient *http.Client
+	// callbackClient posts callbacks without the credentials of fetch profiles
+	callbackClient      *http.Client
 	postprocessDocsChan chan cache.ExtractedDocument
 	tesConfig           *config.TesConfig
 	cacheNop            bool
+	// cacheVersion is saved with cache entries, which are not used by other versions
+	cacheVersion string
+	// revalidating holds the URLs and variants revalidated in the background
+	revalidating sync.Map
+	jobs         jobs.Store
+	limiter      *admission.Limiter
+	// chargeOcrPages charges the pages OCRed by a job to the client that created it, if set
+	chargeOcrPages func(clientID string, pages int64)
 }
 
 const lastModified string = "last-modified"
@@ -45,42 +238,61 @@ func New(config *config.TesConfig, df *docfactory.DocFactory, tesCache cache.Cac
 		postprocessDocsChan: postprocessDocsChan,
 		tesConfig:           config,
 		httpClient:          httpClient,
+		jobs:                jobs.NewMemoryStore(config.JobsTtl),
+		limiter: admission.New(admission.Limits{
+			Concurrent: config.MaxConcurrent,
+			PerType:    config.MaxConcurrentPerTypes,
+			Memory:     int64(config.MemoryBudgetBytes),
+			QueueSize:  config.QueueSize,
+		}),
 	}
 
 	if httpClient == nil {
 		extract.httpClient = http.DefaultClient
 	}
+	extract.callbackClient = http.DefaultClient
 	if logger == nil {
 		extract.log = slog.New(slog.DiscardHandler)
 	}
 	_, extract.cacheNop = tesCache.(*cache.NopCache)
+	extract.cacheVersion = cacheVersion(df.PdfImpl().LibShort)
 	go extract.saveCloseAndDeleteExtractedDocs()
 	return extract
 }
 
+// closeDoc closes an extracted document and removes its temporary file. Documents are closed before their
+// admission slot is released, as closing returns their buffer to the pool of the doc factory.
+func (e *Extractor) closeDoc(doc cache.Document) {
+	doc.Close()
+	e.log.Debug("Document closed.")
+	if len(doc.Path()) > 0 {
+		// we can assume every file is a temporary file created by ourself
+		if err := os.Remove(doc.Path()); err != nil {
+			e.log.Error("could not remove temporary file", "err", err)
+		} else {
+			e.log.Debug("temporary file removed", "path", doc.Path())
+		}
+	}
+}
+
 func (e *Extractor) saveCloseAndDeleteExtractedDocs() {
 	for doc := range e.postprocessDocsChan {
-		doc.Doc.Close()
-		e.log.Debug("Document closed.", "url", doc.Url)
-		if len(doc.Doc.Path()) > 0 {
-			// we can assume every file in this channel is a temporary file
-			// created by ourself
-			if err := os.Remove(doc.Doc.Path()); err != nil {
-				e.log.Error("could not remove temporary file", "err", err)
-			} else {
-				e.log.Debug("temporary file removed", "path", doc.Doc.Path())
-			}
+		// extracted documents are usually closed before they are sent
+		if doc.Doc != nil {
+			e.closeDoc(doc.Doc)
 		}
 		if e.cacheNop {
 			continue
 		}
-		for i := 0; i <= 5; i++ {
-			info, err := e.tesCache.Save(doc)
-			if err == nil {
-				e.log.Info("Saved text and metadata in NATS object store bucket", "url", *doc.Url, "chunks", info.Chunks, "size", info.Size)
-				break
+		for _, entry := range e.cacheEntries(doc) {
+			for i := 0; i <= 5; i++ {
+				err := e.tesCache.Save(entry)
+				if err == nil {
+					e.log.Info("Saved text and metadata in cache", "key", *entry.Url, "size", len(entry.Text))
+					break
+				}
+				e.log.Warn("Could not save text to cache", "err", err, "retries", i, "key", *entry.Url)
 			}
-			e.log.Warn("Could not save text to cache", "retries", i, "url", doc.Url)
 		}
 	}
 }
@@ -89,77 +301,224 @@ func (e *Extractor) saveCloseAndDeleteExtractedDocs() {
 // Returns a JSON encoded error message if the body is not parsable.
 func (e *Extractor) ExtractBody(w http.ResponseWriter, r *http.Request) {
 	origin := "POST request"
-	doc, err := e.df.NewDocFromStream(r.Body, r.ContentLength, origin)
+	params := paramsFromQuery(r.URL.Query())
+	if err := params.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if params.Callback != "" {
+		// the document is in the body, even if a URL is given
+		params.Url = ""
+		e.createJob(w, r, params)
+		return
+	}
+	body := docfactory.NewDigestReader(r.Body)
+	admitted, release, err := e.admit(body, r.ContentLength, params)
+	if err != nil {
+		http.Error(w, err.Error(), e.busy(w.Header(), err))
+		return
+	}
+	defer release()
+	doc, err := e.df.NewDocFromStream(admitted, r.ContentLength, origin)
 	if err != nil {
 		e.log.Error("Error parsing response body", "err", err)
 		w.WriteHeader(http.StatusUnprocessableEntity)
 		w.Write([]byte(err.Error()))
 		return
 	}
-	defer doc.Close()
+	// the body has been read completely
+	_ = e.extractDoc(doc, body.Digest(), params, w, w.Header())
+}
+
+// extractDoc writes the output of a document sent in a request body, whose content has the given digest,
+// after adding its metadata to header. It is served from the cache, if it was extracted with the same options before.
+func (e *Extractor) extractDoc(doc cache.Document, digest string, params RequestParams, w io.Writer, header http.Header) error {
+	options, variant := e.variant(params)
+	if ct := params.contentType(); ct != "" {
+		header.Set("Content-Type", ct)
+	}
+	if !params.NoCache && !e.cacheNop {
+		if cached := e.cachedContent(digest, variant); cached != nil && e.streamCached(cache.VariantKey(digest, variant), cached, w, header, false) {
+			e.log.Debug("Content found in cache", "digest", digest, "variant", variant)
+			e.closeDoc(doc)
+			e.postprocessDocsChan <- cache.ExtractedDocument{Metadata: &cached, Digest: digest, Variant: variant, ContentCached: true}
+			return nil
+		}
+	}
 	metadata := doc.MetadataMap()
-	addMetadataAsHeaders(w.Header(), metadata)
-	dw := dehyphenator.New(w, e.tesConfig.RemoveNewlines)
-	_ = e.WriteTextOrRunOcr(doc, dw, "<POST req>")
-	dw.Close()
+	metadata[cache.DigestKey] = digest
+	metadata[optionsKey] = options
+	addMetadataAsHeaders(header, metadata)
+	var stats OcrStats
+	// the headers have been sent when OCR is done
+	defer func() { addMetadataAsTrailers(header, stats.Metadata()) }()
+	var text bytes.Buffer
+	out := io.MultiWriter(w, &text)
+	var err error
+	if params.plainText() {
+		dw := dehyphenator.New(out, e.tesConfig.RemoveNewlines)
+		err = e.WriteTextOrRunOcr(doc, dw, params.ocrOptions(&stats), "<POST req>")
+		dw.Close()
+	} else {
+		err = e.writeOutput(doc, out, params, &stats, "<POST req>")
+	}
+	e.closeDoc(doc)
+	if err != nil {
+		return err
+	}
+	maps.Copy(metadata, stats.Metadata())
+	e.postprocessDocsChan <- cache.ExtractedDocument{
+		Metadata: &metadata,
+		Text:     text.Bytes(),
+		Digest:   digest,
+		Variant:  variant,
+	}
+	return nil
 }
 
-func (e *Extractor) fetch(url string, noCache bool) (*http.Response, cache.DocumentMetadata, error) {
+// fetch requests url, conditionally if the cached metadata, which may be nil, holds the headers needed for revalidation
+func (e *Extractor) fetch(url string, cached cache.DocumentMetadata) (*http.Response, error) {
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		e.log.Error("Error when constructing GET request", "err", err, "url", url)
-		return nil, nil, err
+		return nil, err
 	}
 
-	metadata := e.addCacheValidationHeaders(noCache, req, url)
+	addCacheValidationHeaders(req, cached)
 	e.log.Debug("Issuing conditional GET request", "url", url, "headers", req.Header)
 
 	response, err := e.httpClient.Do(req)
 	if err != nil {
-		return response, metadata, fmt.Errorf("fetching %s: %w", url, err)
+		return response, fmt.Errorf("fetching %s: %w", url, err)
 	}
-	return response, metadata, err
+	return response, err
 }
 
 func (e *Extractor) DocFromUrl(params RequestParams, w io.Writer, header http.Header) (status int, err error) {
 	url := params.Url
 	silent := params.Silent
+	plainText := params.plainText()
+	options, variant := e.variant(params)
 
 	noCache := params.NoCache || e.cacheNop
-	response, metadata, err := e.fetch(url, noCache)
+	var metadata cache.DocumentMetadata
+	if !noCache {
+		// revalidate only if the requested variant is cached, as it couldn't be served on 304 otherwise
+		metadata = e.cachedUrl(url, variant)
+	}
+	if ct := params.contentType(); ct != "" {
+		header.Set("Content-Type", ct)
+	}
+	if metadata != nil {
+		// cached text may only be served as long as the URL may be fetched
+		if err := fetcher.Permitted(e.httpClient, url); err != nil {
+			e.log.Warn("Refused to serve cached text", "err", err, "url", url)
+			return http.StatusForbidden, err
+		}
+		key := cache.VariantKey(metadata[cache.DigestKey], variant)
+		switch {
+		case e.fresh(params, metadata):
+			e.log.Debug("Cached text is fresh. Serving it without contacting the origin", "url", url, "fetched", metadata[fetchedKey])
+			if e.streamCached(key, metadata, w, header, silent) {
+				return http.StatusOK, nil
+			}
+			// the text is gone, so it has to be extracted again
+			metadata = nil
+		case e.staleWhileRevalidate(params, metadata):
+			e.log.Debug("Cached text is stale. Serving it while revalidating", "url", url, "fetched", metadata[fetchedKey])
+			if e.serveStale(key, metadata, w, header, silent, staleRevalidating) {
+				e.revalidate(params, variant)
+				return http.StatusOK, nil
+			}
+			metadata = nil
+		}
+	}
+	response, err := e.fetch(url, metadata)
+	if errors.Is(err, fetcher.ErrForbidden) {
+		e.log.Warn("Refused to fetch", "err", err, "url", url)
+		return http.StatusForbidden, err
+	}
 	if err != nil {
+		if e.serveStaleOnError(params, variant, metadata, w, header, err) {
+			return http.StatusOK, nil
+		}
 		e.log.Error("Error fetching", "err", err, "url", url)
 		return http.StatusBadRequest, err
 	}
 	if response.StatusCode >= 400 {
-		return response.StatusCode, errors.New("Could not get requested resource. Remote server replied: " + response.Status)
+		response.Body.Close()
+		err := errors.New("Could not get requested resource. Remote server replied: " + response.Status)
+		if response.StatusCode >= 500 && e.serveStaleOnError(params, variant, metadata, w, header, err) {
+			return http.StatusOK, nil
+		}
+		return response.StatusCode, err
 	}
-	defer response.Body.Close()
 
 	if response.StatusCode == http.StatusNotModified {
+		// a 304 response has no body, only its headers are used
+		response.Body.Close()
 		e.log.Debug("URL has not been modified. Text will be served from cache", "url", url, "etag", response.Header.Get("etag"), lastModified, response.Header.Get(lastModified))
-		addMetadataAsHeaders(header, metadata)
-		if silent {
-			return http.StatusNotModified, nil
+		if metadata != nil {
+			// the alias is saved again, as the document is fresh again
+			metadata = addHttpHeadersToMetadata(metadata, response)
+			revalidated := cache.ExtractedDocument{Url: &url, Metadata: &metadata, Digest: metadata[cache.DigestKey], Variant: variant, ContentCached: true}
+			if silent {
+				addMetadataAsHeaders(header, metadata)
+				e.postprocessDocsChan <- revalidated
+				return http.StatusNotModified, nil
+			}
+			if e.streamCached(cache.VariantKey(metadata[cache.DigestKey], variant), metadata, w, header, false) {
+				e.postprocessDocsChan <- revalidated
+				return http.StatusOK, nil
+			}
 		}
-
-		if err = e.tesCache.StreamText(url, w); err == nil {
-			return http.StatusOK, nil
-		} else {
-			e.log.Error("Could not receive text from NATS object store or write to output stream", "url", url, "err", err)
+		// We could not provide the client with cached text, e.g. because it was purged,
+		// so fetch the document again
+		response, err = e.fetch(url, nil)
+		if err != nil {
+			e.log.Error("Error fetching", "err", err, "url", url)
+			return http.StatusBadRequest, err
+		}
+		if response.StatusCode >= 400 {
+			response.Body.Close()
+			return response.StatusCode, errors.New("Could not get requested resource. Remote server replied: " + response.Status)
 		}
-		// We could not provide the client with cached text
-		// Resume with parsing the file (again)
 	}
+	defer response.Body.Close()
 	// We have no current version of the document but fetched it
 	// so parse and extract it
 	e.log.Debug("Start parsing", "url", url, "content-length", response.ContentLength)
-	doc, err, skipDehyphenator := e.constructDoc(url, response.Body, response.ContentLength)
+	body := docfactory.NewDigestReader(response.Body)
+	admitted, release, err := e.admit(body, response.ContentLength, params)
+	if err != nil {
+		return e.busy(header, err), err
+	}
+	defer release()
+	doc, err, skipDehyphenator := e.constructDoc(url, admitted, response.ContentLength, params)
 	if err != nil {
 		e.log.Error("Parsing failed", "err", err, "url", url, "headers", response.Header)
 		return http.StatusUnprocessableEntity, err
 	}
-	metadata = addHttpHeadersToMetadata(doc, response)
+	// a forked subprocess reads the body while extracting the text, otherwise it has been read completely
+	digestKnown := !e.forks(response.ContentLength)
+	if digestKnown && !noCache {
+		digest := body.Digest()
+		if cached := e.cachedContent(digest, variant); cached != nil {
+			// the same content has been extracted before, maybe from another URL
+			cached = addHttpHeadersToMetadata(cached, response)
+			if e.streamCached(cache.VariantKey(digest, variant), cached, w, header, silent) {
+				e.log.Debug("Content found in cache", "url", url, "digest", digest, "variant", variant)
+				e.closeDoc(doc)
+				e.postprocessDocsChan <- cache.ExtractedDocument{Url: &url, Metadata: &cached, Digest: digest, Variant: variant, ContentCached: true}
+				return http.StatusOK, nil
+			}
+		}
+	}
+	metadata = addHttpHeadersToMetadata(doc.MetadataMap(), response)
+	if digestKnown {
+		metadata[cache.DigestKey] = body.Digest()
+	}
+	metadata[optionsKey] = options
 	addMetadataAsHeaders(header, metadata)
 	e.log.Debug("Finished parsing", "url", url)
 	var text bytes.Buffer
@@ -170,19 +529,28 @@ func (e *Extractor) DocFromUrl(params RequestParams, w io.Writer, header http.He
 		mWriter = io.MultiWriter(w, &text)
 	}
 	var dstw io.Writer
-	if skipDehyphenator {
+	if skipDehyphenator || !plainText {
 		dstw = mWriter
 	} else {
 		dw := dehyphenator.New(mWriter, e.tesConfig.RemoveNewlines)
 		dstw = dw
 		defer dw.Close()
 	}
-	if err := e.WriteTextOrRunOcr(doc, dstw, url); err != nil {
-		doc.Close()
+	var stats OcrStats
+	err = e.writeOutput(doc, dstw, params, &stats, url)
+	e.closeDoc(doc)
+	if err != nil {
 		// Client might have closed connection, so text couldn't be written
 		// and is not complete. We don't want to save incomplete docs.
 		return 499, err
 	}
+	// the headers have been sent already
+	trailers := stats.Metadata()
+	if !digestKnown {
+		trailers[cache.DigestKey] = body.Digest()
+	}
+	addMetadataAsTrailers(header, trailers)
+	maps.Copy(metadata, trailers)
 
 	if !silent {
 		e.log.Debug("Streaming response done", "url", url)
@@ -191,28 +559,33 @@ func (e *Extractor) DocFromUrl(params RequestParams, w io.Writer, header http.He
 		Url:      &url,
 		Text:     text.Bytes(),
 		Metadata: &metadata,
-		Doc:      doc,
+		Digest:   body.Digest(),
+		Variant:  variant,
 	}
 	e.postprocessDocsChan <- extracted
 	return http.StatusOK, nil
 }
 
 func (e *Extractor) ExtractRemote(w http.ResponseWriter, r *http.Request) {
-	var params RequestParams
-	q := r.URL.Query()
-	params.NoCache = q.Has("noCache") || q.Has("nocache")
-	params.Silent = q.Has("silent")
+	params := paramsFromQuery(r.URL.Query())
+	if err := params.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if r.Method == "HEAD" {
 		params.Silent = true
 	}
-	url := q.Get("url")
+	url := params.Url
 	var errMsg string
-	if !(strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://")) {
-		errMsg = fmt.Sprintf("not a valid HTTP(S) URL: %s", url)
+	if !e.supportedUrl(url) {
+		errMsg = fmt.Sprintf("not a supported URL: %s", url)
 		http.Error(w, errMsg, http.StatusBadRequest)
 		return
 	}
-	params.Url = url
+	if params.Callback != "" {
+		e.createJob(w, r, params)
+		return
+	}
 
 	status, extractErr := e.DocFromUrl(params, w, w.Header())
 	if extractErr != nil {
@@ -227,37 +600,42 @@ func addMetadataAsHeaders(header http.Header, metadata cache.DocumentMetadata) {
 	}
 }
 
-func (e *Extractor) addCacheValidationHeaders(noCache bool, req *http.Request, url string) cache.DocumentMetadata {
-	if !noCache {
-		metadata, err := e.tesCache.GetMetadata(url)
-		if err != nil {
-			e.log.Error("Could not get metadata from NATS object store", "url", url, "err", err)
-			return make(cache.DocumentMetadata)
-		}
-		if etag, ok := metadata["etag"]; ok {
-			req.Header.Add("If-None-Match", etag)
-		}
-		if lastMod, ok := metadata["http-last-modified"]; ok {
-			req.Header.Add("If-Modified-Since", lastMod)
-		}
-		return metadata
+// addMetadataAsTrailers adds metadata known only after the body has been written, e.g. the OCR results, as HTTP trailers
+func addMetadataAsTrailers(header http.Header, metadata cache.DocumentMetadata) {
+	for k, v := range metadata {
+		header.Add(http.TrailerPrefix+k, v)
+	}
+}
+
+func addCacheValidationHeaders(req *http.Request, metadata cache.DocumentMetadata) {
+	if etag, ok := metadata["etag"]; ok {
+		req.Header.Add("If-None-Match", etag)
+	}
+	if lastMod, ok := metadata["http-last-modified"]; ok {
+		req.Header.Add("If-Modified-Since", lastMod)
 	}
-	return make(cache.DocumentMetadata)
 }
 
-func (e *Extractor) constructDoc(url string, r io.Reader, contentLength int64) (d cache.Document, err error, skipDehypenator bool) {
-	if e.tesConfig.ForkThreshold > -1 && contentLength > e.tesConfig.ForkThreshold {
+// forks reports whether a document of the given size is processed by a subprocess
+func (e *Extractor) forks(contentLength int64) bool {
+	return e.tesConfig.ForkThreshold > -1 && contentLength > e.tesConfig.ForkThreshold
+}
+
+func (e *Extractor) constructDoc(url string, r io.Reader, contentLength int64, params RequestParams) (d cache.Document, err error, skipDehypenator bool) {
+	if e.forks(contentLength) {
 		// file size above threshold - fork a subprocess
-		d, err = e.df.NewDocFromForkedProcess(r, url)
+		d, err = e.df.NewDocFromForkedProcess(r, url, params.forkArgs()...)
 	} else {
 		d, err = e.df.NewDocFromStream(r, contentLength, url)
 		// our PDFium impl also forks a new process when the lib is in use already
 	}
+	if err != nil {
+		return nil, err, false
+	}
 	return d, err, !d.HasNewlines()
 }
 
-func addHttpHeadersToMetadata(doc cache.Document, response *http.Response) cache.DocumentMetadata {
-	metadata := doc.MetadataMap()
+func addHttpHeadersToMetadata(metadata cache.DocumentMetadata, response *http.Response) cache.DocumentMetadata {
 	if etag := response.Header.Get("etag"); etag != "" {
 		metadata["etag"] = etag
 	}
@@ -267,5 +645,12 @@ func addHttpHeadersToMetadata(doc cache.Document, response *http.Response) cache
 	if contentLength := response.ContentLength; contentLength > 0 {
 		metadata["http-content-length"] = fmt.Sprintf("%d", contentLength)
 	}
+	// the headers deciding how long the document may be served without revalidation
+	for _, name := range []string{"Cache-Control", "Expires", "Date", "Age"} {
+		if value := response.Header.Get(name); value != "" {
+			metadata["http-"+strings.ToLower(name)] = value
+		}
+	}
+	metadata[fetchedKey] = time.Now().UTC().Format(time.RFC3339)
 	return metadata
 }
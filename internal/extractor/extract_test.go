@@ -1,9 +1,19 @@
 package extractor
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"slices"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/johbar/text-extraction-service/v4/internal/cache"
 	"github.com/johbar/text-extraction-service/v4/internal/config"
@@ -11,7 +21,10 @@ import (
 	"github.com/johbar/text-extraction-service/v4/pkg/tesswrap"
 )
 
-const readmeOcrPath = "../../pkg/pdflibwrappers/testdata/readme.pdf"
+const (
+	readmeOcrPath = "../../pkg/pdflibwrappers/testdata/readme.pdf"
+	readmeRtfPath = "../../pkg/rtfparser/testdata/readme.rtf"
+)
 
 func TestWriteTextOrRunOcr(t *testing.T) {
 	conf, err := config.NewTesConfigFromEnv()
@@ -31,7 +44,7 @@ func TestWriteTextOrRunOcr(t *testing.T) {
 		t.Fatal(err)
 	}
 	var sb strings.Builder
-	err = extract.WriteTextOrRunOcr(doc, &sb, readmeOcrPath)
+	err = extract.WriteTextOrRunOcr(doc, &sb, OcrOptions{}, readmeOcrPath)
 	if err != nil {
 		t.Error(err)
 	}
@@ -44,3 +57,217 @@ func TestWriteTextOrRunOcr(t *testing.T) {
 		os.Remove(doc.Path())
 	}
 }
+
+// coverageDoc is a document whose pages have no text and images covering the given fraction
+type coverageDoc struct {
+	cache.Document
+	coverage float64
+}
+
+func (d coverageDoc) ImageCoverage(int) (float64, error) { return d.coverage, nil }
+
+func TestOcrAction(t *testing.T) {
+	conf, err := config.NewTesConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	extract := &Extractor{tesConfig: conf, log: slog.New(slog.DiscardHandler)}
+	initialized := tesswrap.Initialized
+	tesswrap.Initialized = true
+	defer func() { tesswrap.Initialized = initialized }()
+
+	prose := strings.Repeat("The service extracts the text of documents and runs OCR on the images of scanned pages. ", 3)
+	garbage := strings.Repeat("Wkh vhuylfh h{wudfwv wkh wh{w ri grfxphqwv dqg uxqv RFU rq wkh lpdjhv. ", 3)
+	// some glyphs of the garbage have no Unicode mapping, but too few to fail the glyph check alone
+	doubtful := strings.Repeat("Wkh vhuylfh h{wudfwv wkh wh{w ri grfxphqwv \uFFFD\uFFFD\uFFFD. ", 3)
+	// the list of frequent words doesn't cover these languages
+	polish := strings.Repeat("Usługa wyodrębnia tekst z dokumentów i rozpoznaje obrazy zeskanowanych stron. ", 3)
+	finnish := strings.Repeat("Palvelu poimii asiakirjojen tekstin ja tunnistaa skannattujen sivujen kuvat. ", 3)
+	tests := []struct {
+		name      string
+		doc       cache.Document
+		text      string
+		hasImages bool
+		ocr       string
+		want      ocrAction
+	}{
+		{"prose", nil, prose, false, "", noOcr},
+		{"garbage never", nil, garbage, true, config.OcrNever, noOcr},
+		{"prose always", nil, prose, false, config.OcrAlways, ocrInsteadOfText},
+		{"blank page", nil, "", false, "", noOcr},
+		{"unknown words", nil, garbage, false, "", noOcr},
+		{"broken encoding", nil, doubtful, false, "", ocrInsteadOfText},
+		{"polish", nil, polish, false, "", noOcr},
+		{"finnish", nil, finnish, false, "", noOcr},
+		{"unmapped glyphs", nil, "\uFFFD\uFFFD\uFFFD abc", false, "", ocrInsteadOfText},
+		{"short page with images", nil, "Header", true, "", ocrWithText},
+		{"short page with logo", coverageDoc{coverage: 0.01}, "Header", true, "", noOcr},
+		{"scan with header", coverageDoc{coverage: 0.8}, prose, false, "", ocrWithText},
+		{"prose with figure", coverageDoc{coverage: 0.3}, prose, false, "", noOcr},
+	}
+	for _, tt := range tests {
+		if got := extract.ocrAction(tt.doc, 0, tt.text, tt.hasImages, tt.ocr, tt.name); got != tt.want {
+			t.Errorf("%s: ocrAction() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestInPageOrder(t *testing.T) {
+	const n, workers = 50, 8
+	var running, maxRunning atomic.Int32
+	work := func(i int) int {
+		r := running.Add(1)
+		for {
+			m := maxRunning.Load()
+			if r <= m || maxRunning.CompareAndSwap(m, r) {
+				break
+			}
+		}
+		// later pages finish first
+		time.Sleep(time.Duration(n-i) * 100 * time.Microsecond)
+		running.Add(-1)
+		return i * i
+	}
+	var got []int
+	err := inPageOrder(n, workers, work, func(i, result int) error {
+		if result != i*i {
+			t.Errorf("page %d: got result %d", i, result)
+		}
+		got = append(got, i)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.IsSorted(got) || len(got) != n {
+		t.Errorf("pages written out of order: %v", got)
+	}
+	if m := maxRunning.Load(); m > workers {
+		t.Errorf("%d pages processed concurrently, want at most %d", m, workers)
+	}
+
+	stop := errors.New("client gone")
+	var written int
+	err = inPageOrder(n, workers, work, func(i, result int) error {
+		written++
+		if i == 3 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || written != 4 {
+		t.Errorf("got error %v after %d pages, want %v after 4", err, written, stop)
+	}
+	if r := running.Load(); r != 0 {
+		t.Errorf("%d pages still being processed after return", r)
+	}
+}
+
+func TestOcrStats(t *testing.T) {
+	var stats OcrStats
+	if m := stats.Metadata(); len(m) != 0 {
+		t.Errorf("want no metadata without OCR, got %v", m)
+	}
+	stats.add(0, tesswrap.Result{Lang: "deu+pol", Confidence: 90, Words: 30})
+	stats.add(2, tesswrap.Result{Lang: "ell", Confidence: 70, Words: 8, Dropped: 2})
+	stats.add(2, tesswrap.Result{Lang: "ell"})
+	m := stats.Metadata()
+	want := map[string]string{
+		"x-ocr-lang":             "deu+pol, ell",
+		"x-ocr-pages":            "2",
+		"x-ocr-confidence":       "85.0",
+		"x-ocr-page-confidences": "1:90.0, 3:70.0",
+		"x-ocr-dropped-words":    "2",
+	}
+	for k, v := range want {
+		if m[k] != v {
+			t.Errorf("want %s: %q, got %q", k, v, m[k])
+		}
+	}
+	if !strings.HasPrefix(m["x-ocr-engine"], "tesseract") {
+		t.Errorf("want the engine to be reported, got %q", m["x-ocr-engine"])
+	}
+	var none *OcrStats
+	none.add(0, tesswrap.Result{Lang: "eng", Words: 1})
+}
+
+// closeSignal is a document closing done when it is closed
+type closeSignal struct {
+	cache.Document
+	done chan struct{}
+}
+
+func (d closeSignal) Close() {
+	close(d.done)
+}
+
+func (d closeSignal) Path() string {
+	return ""
+}
+
+// waitForSaves returns once the documents extracted so far have been saved to the cache,
+// as they are processed in order
+func waitForSaves(e *Extractor) {
+	done := make(chan struct{})
+	e.postprocessDocsChan <- cache.ExtractedDocument{Doc: closeSignal{done: done}}
+	<-done
+}
+
+// waitForEntry waits for the asynchronous save of the cache entry with the given key
+func waitForEntry(t *testing.T, c cache.Cache, key string) cache.DocumentMetadata {
+	t.Helper()
+	for range 100 {
+		if metadata, _ := c.GetMetadata(key); metadata != nil {
+			return metadata
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no cache entry %s", key)
+	return nil
+}
+
+// fixture is an extractor with an origin serving the RTF readme with ETag "v1"
+type fixture struct {
+	extract *Extractor
+	cache   cache.Cache
+	origin  *httptest.Server
+	rtf     []byte
+	// digest is the hex encoded SHA-256 digest of rtf
+	digest string
+}
+
+// newFixture returns a fixture whose extractor uses c or, if it is nil, a cache in a temp dir.
+// configure, if given, changes the config first. handle, if given, is called first by the origin
+// for every request and reports whether it responded itself.
+func newFixture(t *testing.T, c cache.Cache, configure func(conf *config.TesConfig), handle func(w http.ResponseWriter, r *http.Request) bool) *fixture {
+	t.Helper()
+	conf, err := config.NewTesConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if configure != nil {
+		configure(conf)
+	}
+	if c == nil {
+		if c, err = cache.NewFsCache(t.TempDir(), 1<<20, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f := &fixture{cache: c}
+	if f.rtf, err = os.ReadFile(readmeRtfPath); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(f.rtf)
+	f.digest = hex.EncodeToString(sum[:])
+	f.extract = New(conf, docfactory.New(conf, nil), c, nil, nil)
+	t.Cleanup(func() { waitForSaves(f.extract) })
+	f.origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if handle != nil && handle(w, r) {
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "readme.rtf", time.Time{}, bytes.NewReader(f.rtf))
+	}))
+	t.Cleanup(f.origin.Close)
+	return f
+}
@@ -0,0 +1,204 @@
+package extractor
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/johbar/text-extraction-service/v4/internal/cache"
+	"github.com/johbar/text-extraction-service/v4/internal/config"
+)
+
+// fetchedKey holds the time a URL was fetched or revalidated last
+const fetchedKey = "x-cache-fetched"
+
+// staleKey is the header of responses served from the cache after their freshness lifetime. Its value tells why.
+const (
+	staleKey = "x-cache-stale"
+	// staleRevalidating means the text is revalidated in the background
+	staleRevalidating = "revalidating"
+	// staleError means the origin failed
+	staleError = "error"
+)
+
+// fetchedAge returns how long ago a URL was fetched or revalidated according to its cached metadata
+func fetchedAge(metadata cache.DocumentMetadata) (time.Duration, bool) {
+	fetched, err := time.Parse(time.RFC3339, metadata[fetchedKey])
+	if err != nil {
+		return 0, false
+	}
+	return time.Since(fetched), true
+}
+
+// fresh reports whether the cached metadata of a URL is recent enough to serve its text without contacting the origin
+func (e *Extractor) fresh(params RequestParams, metadata cache.DocumentMetadata) bool {
+	age, ok := fetchedAge(metadata)
+	return ok && age < e.lifetime(params, metadata)
+}
+
+// staleWhileRevalidate reports whether the stale text of a URL may be served while it is revalidated in the background.
+// Requests with maxAge always wait for the origin.
+func (e *Extractor) staleWhileRevalidate(params RequestParams, metadata cache.DocumentMetadata) bool {
+	if params.MaxAge != nil || e.tesConfig.CacheStaleWhileRevalidate <= 0 || !mayServeStale(metadata) {
+		return false
+	}
+	age, ok := fetchedAge(metadata)
+	return ok && age-e.lifetime(params, metadata) < e.tesConfig.CacheStaleWhileRevalidate
+}
+
+// serveStale writes the cached text of a URL that is not fresh, marked as stale for the given reason.
+// The headers are removed again if the text can't be read.
+func (e *Extractor) serveStale(key string, metadata cache.DocumentMetadata, w io.Writer, header http.Header, silent bool, reason string) bool {
+	warning := `110 - "Response is Stale"`
+	if reason == staleError {
+		warning = `111 - "Revalidation Failed"`
+	}
+	header.Set("Warning", warning)
+	header.Set(staleKey, reason)
+	if e.streamCached(key, metadata, w, header, silent) {
+		return true
+	}
+	header.Del("Warning")
+	header.Del(staleKey)
+	return false
+}
+
+// serveStaleOnError writes the cached text of the requested URL, if there is any, after the origin failed with cause
+func (e *Extractor) serveStaleOnError(params RequestParams, variant string, metadata cache.DocumentMetadata, w io.Writer, header http.Header, cause error) bool {
+	if metadata == nil || !e.tesConfig.CacheStaleIfError || !mayServeStale(metadata) {
+		return false
+	}
+	e.log.Warn("Origin failed. Serving stale text from cache", "url", params.Url, "err", cause)
+	return e.serveStale(cache.VariantKey(metadata[cache.DigestKey], variant), metadata, w, header, params.Silent, staleError)
+}
+
+// mayServeStale reports whether the origin's Cache-Control header, as saved in the metadata, allows serving
+// the text after its freshness lifetime. TES is a shared cache, so proxy-revalidate applies, too.
+func mayServeStale(metadata cache.DocumentMetadata) bool {
+	for directive := range strings.SplitSeq(strings.ToLower(metadata["http-cache-control"]), ",") {
+		name, _, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch name {
+		case "no-cache", "no-store", "must-revalidate", "proxy-revalidate":
+			return false
+		}
+	}
+	return true
+}
+
+// revalidate refreshes the cached variant of the requested URL in the background, unless that is in progress already.
+// The text extracted or the alias revalidated are saved through postprocessDocsChan like those of other requests.
+func (e *Extractor) revalidate(params RequestParams, variant string) {
+	key := params.Url + " " + variant
+	if _, running := e.revalidating.LoadOrStore(key, struct{}{}); running {
+		return
+	}
+	maxAge := 0
+	params.MaxAge = &maxAge
+	params.Silent = true
+	go func() {
+		defer e.revalidating.Delete(key)
+		if _, err := e.DocFromUrl(params, io.Discard, http.Header{}); err != nil {
+			e.log.Warn("Revalidation in the background failed", "url", params.Url, "err", err)
+		}
+	}()
+}
+
+// lifetime returns how long the document at the requested URL is fresh after being fetched. The request's maxAge
+// takes precedence over the policy of the host, which overrides the headers of the origin, the configured default last.
+func (e *Extractor) lifetime(params RequestParams, metadata cache.DocumentMetadata) time.Duration {
+	if params.MaxAge != nil {
+		return time.Duration(*params.MaxAge) * time.Second
+	}
+	if maxAge, ok := hostMaxAge(e.tesConfig.CacheHostMaxAges, params.Url); ok {
+		return maxAge
+	}
+	if lifetime, ok := originLifetime(metadata); ok {
+		return lifetime
+	}
+	return e.tesConfig.CacheMaxAge
+}
+
+// hostMaxAge returns the max age configured for the host of rawUrl or one of its parent domains
+func hostMaxAge(maxAges map[string]time.Duration, rawUrl string) (time.Duration, bool) {
+	if len(maxAges) == 0 {
+		return 0, false
+	}
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return 0, false
+	}
+	host := strings.ToLower(u.Hostname())
+	for host != "" {
+		if maxAge, ok := maxAges[host]; ok {
+			return maxAge, true
+		}
+		_, host, _ = strings.Cut(host, ".")
+	}
+	return 0, false
+}
+
+// originLifetime returns the freshness lifetime announced by the origin's Cache-Control or Expires headers,
+// as saved in the metadata. It reports false if there are none.
+func originLifetime(metadata cache.DocumentMetadata) (time.Duration, bool) {
+	if cc := metadata["http-cache-control"]; cc != "" {
+		maxAge, sMaxAge := -1, -1
+		var noCache, immutable bool
+		// all directives are read first, as their order doesn't matter
+		for directive := range strings.SplitSeq(strings.ToLower(cc), ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			switch name {
+			case "no-cache", "no-store":
+				noCache = true
+			case "immutable":
+				immutable = true
+			case "max-age":
+				maxAge = parseSeconds(value)
+			case "s-maxage":
+				// TES is a shared cache
+				sMaxAge = parseSeconds(value)
+			}
+		}
+		if noCache {
+			return 0, true
+		}
+		if immutable {
+			return config.MaxAgeImmutable, true
+		}
+		if sMaxAge >= 0 {
+			maxAge = sMaxAge
+		}
+		if maxAge >= 0 {
+			// the time the document spent in other caches before being fetched
+			age := max(parseSeconds(metadata["http-age"]), 0)
+			return time.Duration(maxAge-age) * time.Second, true
+		}
+	}
+	if expires := metadata["http-expires"]; expires != "" {
+		expiry, err := http.ParseTime(expires)
+		if err != nil {
+			// invalid dates like "0" mean expired
+			return 0, true
+		}
+		date, err := http.ParseTime(metadata["http-date"])
+		if err != nil {
+			date, err = time.Parse(time.RFC3339, metadata[fetchedKey])
+			if err != nil {
+				return 0, true
+			}
+		}
+		return expiry.Sub(date), true
+	}
+	return 0, false
+}
+
+// parseSeconds returns the number of seconds s holds, -1 if it is invalid
+func parseSeconds(s string) int {
+	n, err := strconv.Atoi(strings.Trim(s, `"`))
+	if err != nil || n < 0 {
+		return -1
+	}
+	return n
+}
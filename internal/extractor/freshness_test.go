@@ -0,0 +1,208 @@
+package extractor
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/johbar/text-extraction-service/v4/internal/cache"
+	"github.com/johbar/text-extraction-service/v4/internal/config"
+	"github.com/johbar/text-extraction-service/v4/internal/fetcher"
+)
+
+func TestFreshness(t *testing.T) {
+	var fetched, notModified atomic.Int32
+	f := newFixture(t, nil, nil, func(w http.ResponseWriter, r *http.Request) bool {
+		fetched.Add(1)
+		if r.URL.Path == "/stable" {
+			w.Header().Set("Cache-Control", "public, max-age=3600")
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified.Add(1)
+		}
+		return false
+	})
+	extract, srv := f.extract, f.origin
+	get := func(path string, maxAge *int) {
+		t.Helper()
+		status, err := extract.DocFromUrl(RequestParams{Url: srv.URL + path, MaxAge: maxAge}, io.Discard, http.Header{})
+		if err != nil || status != http.StatusOK {
+			t.Fatalf("GET %s: status %d, err %v", path, status, err)
+		}
+	}
+	// fetchesOf returns the number of requests sent to the origin by f
+	fetchesOf := func(f func()) int32 {
+		n := fetched.Load()
+		f()
+		return fetched.Load() - n
+	}
+
+	get("/stable", nil)
+	waitForEntry(t, f.cache, srv.URL+"/stable")
+	if n := fetchesOf(func() { get("/stable", nil) }); n != 0 {
+		t.Errorf("fresh document was fetched %d times", n)
+	}
+	zero := 0
+	if n := fetchesOf(func() { get("/stable", &zero) }); n != 1 || notModified.Load() != 1 {
+		t.Errorf("maxAge=0 fetched %d times, %d revalidated", n, notModified.Load())
+	}
+
+	get("/plain", nil)
+	waitForEntry(t, f.cache, srv.URL+"/plain")
+	if n := fetchesOf(func() { get("/plain", nil) }); n != 1 {
+		t.Errorf("document without freshness info was fetched %d times", n)
+	}
+	hour := 3600
+	if n := fetchesOf(func() { get("/plain", &hour) }); n != 0 {
+		t.Errorf("maxAge=3600 fetched %d times", n)
+	}
+	extract.tesConfig.CacheHostMaxAges = map[string]time.Duration{"127.0.0.1": time.Hour}
+	if n := fetchesOf(func() { get("/plain", nil) }); n != 0 {
+		t.Errorf("document of host with max age was fetched %d times", n)
+	}
+
+	// fresh text of a host denied after it was cached isn't served
+	guard, _ := fetcher.NewGuard("", "127.0.0.1", true)
+	client, err := fetcher.NewClient("", fetcher.Options{Guard: guard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	extract.httpClient = client
+	n := fetched.Load()
+	status, err := extract.DocFromUrl(RequestParams{Url: srv.URL + "/stable"}, io.Discard, http.Header{})
+	if status != http.StatusForbidden || !errors.Is(err, fetcher.ErrForbidden) || fetched.Load() != n {
+		t.Errorf("denied host: status %d, err %v", status, err)
+	}
+}
+
+func TestOriginLifetime(t *testing.T) {
+	date := "Mon, 19 Oct 2026 10:00:00 GMT"
+	tests := []struct {
+		metadata cache.DocumentMetadata
+		lifetime time.Duration
+		ok       bool
+	}{
+		{cache.DocumentMetadata{}, 0, false},
+		{cache.DocumentMetadata{"http-cache-control": "public, max-age=60"}, time.Minute, true},
+		{cache.DocumentMetadata{"http-cache-control": "max-age=60, s-maxage=10"}, 10 * time.Second, true},
+		{cache.DocumentMetadata{"http-cache-control": "max-age=60", "http-age": "50"}, 10 * time.Second, true},
+		{cache.DocumentMetadata{"http-cache-control": "max-age=60, immutable"}, config.MaxAgeImmutable, true},
+		{cache.DocumentMetadata{"http-cache-control": "immutable, max-age=60"}, config.MaxAgeImmutable, true},
+		// no-cache wins, wherever it is
+		{cache.DocumentMetadata{"http-cache-control": "immutable, no-cache"}, 0, true},
+		{cache.DocumentMetadata{"http-cache-control": "max-age=60, no-store"}, 0, true},
+		{cache.DocumentMetadata{"http-cache-control": "no-cache", "http-expires": "Mon, 19 Oct 2026 11:00:00 GMT"}, 0, true},
+		{cache.DocumentMetadata{"http-expires": "Mon, 19 Oct 2026 11:00:00 GMT", "http-date": date}, time.Hour, true},
+		{cache.DocumentMetadata{"http-cache-control": "public", "http-expires": "0", "http-date": date}, 0, true},
+	}
+	for _, tt := range tests {
+		lifetime, ok := originLifetime(tt.metadata)
+		if lifetime != tt.lifetime || ok != tt.ok {
+			t.Errorf("%v: got %v %t, want %v %t", tt.metadata, lifetime, ok, tt.lifetime, tt.ok)
+		}
+	}
+	maxAges := map[string]time.Duration{"example.com": time.Hour}
+	if maxAge, ok := hostMaxAge(maxAges, "https://docs.Example.com/a.pdf"); !ok || maxAge != time.Hour {
+		t.Errorf("subdomain: %v %t", maxAge, ok)
+	}
+	if _, ok := hostMaxAge(maxAges, "https://example.org/a.pdf"); ok {
+		t.Error("other host matched")
+	}
+}
+
+func TestStaleCache(t *testing.T) {
+	var failing, modified atomic.Bool
+	var cacheControl atomic.Value
+	cacheControl.Store("")
+	var changed []byte
+	f := newFixture(t, nil, nil, func(w http.ResponseWriter, r *http.Request) bool {
+		if cc := cacheControl.Load().(string); cc != "" {
+			w.Header().Set("Cache-Control", cc)
+		}
+		if failing.Load() {
+			http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+			return true
+		}
+		if !modified.Load() {
+			return false
+		}
+		w.Header().Set("ETag", `"v2"`)
+		http.ServeContent(w, r, "readme.rtf", time.Time{}, bytes.NewReader(changed))
+		return true
+	})
+	extract, srv := f.extract, f.origin
+	changed = append(bytes.Clone(f.rtf), '\n')
+	get := func(params RequestParams) (string, http.Header) {
+		t.Helper()
+		var sb strings.Builder
+		header := http.Header{}
+		params.Url = srv.URL
+		status, err := extract.DocFromUrl(params, &sb, header)
+		if err != nil || status != http.StatusOK {
+			t.Fatalf("status %d, err %v", status, err)
+		}
+		return sb.String(), header
+	}
+
+	extracted, _ := get(RequestParams{})
+	waitForEntry(t, f.cache, srv.URL)
+	failing.Store(true)
+	text, header := get(RequestParams{})
+	if text != extracted || header.Get(staleKey) != staleError || !strings.HasPrefix(header.Get("Warning"), "111") {
+		t.Errorf("stale text not served on error: %q, headers %v", text, header)
+	}
+	var sb strings.Builder
+	if status, err := extract.DocFromUrl(RequestParams{Url: srv.URL, NoCache: true}, &sb, http.Header{}); err == nil {
+		t.Errorf("origin error ignored without cache: status %d", status)
+	}
+
+	failing.Store(false)
+	modified.Store(true)
+	extract.tesConfig.CacheStaleWhileRevalidate = time.Hour
+	text, header = get(RequestParams{})
+	if text != extracted || header.Get(staleKey) != staleRevalidating {
+		t.Errorf("stale text not served while revalidating: %q, headers %v", text, header)
+	}
+	sum := sha256.Sum256(changed)
+	digest := hex.EncodeToString(sum[:])
+	for range 100 {
+		if alias, _ := f.cache.GetMetadata(srv.URL); alias[cache.DigestKey] == digest {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if alias, _ := f.cache.GetMetadata(srv.URL); alias[cache.DigestKey] != digest {
+		t.Errorf("modified document was not extracted in the background: %v", alias)
+	}
+	maxAge := 0
+	if _, header := get(RequestParams{MaxAge: &maxAge}); header.Get(staleKey) != "" {
+		t.Errorf("stale text served despite maxAge=0: %v", header)
+	}
+
+	// the origin's directives forbid serving stale text
+	for _, cc := range []string{"no-cache", "no-store", "max-age=0, must-revalidate", "max-age=0, proxy-revalidate"} {
+		cacheControl.Store(cc)
+		failing.Store(false)
+		get(RequestParams{MaxAge: &maxAge})
+		waitForSaves(extract)
+		if alias, _ := f.cache.GetMetadata(srv.URL); alias["http-cache-control"] != cc {
+			t.Fatalf("%s: Cache-Control not saved: %v", cc, alias)
+		}
+		if _, header := get(RequestParams{}); header.Get(staleKey) != "" {
+			t.Errorf("%s: stale text served while revalidating: %v", cc, header)
+		}
+		waitForSaves(extract)
+		failing.Store(true)
+		var sb strings.Builder
+		if status, err := extract.DocFromUrl(RequestParams{Url: srv.URL}, &sb, http.Header{}); err == nil {
+			t.Errorf("%s: stale text served on error: status %d", cc, status)
+		}
+	}
+}
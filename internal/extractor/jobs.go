@@ -0,0 +1,267 @@
+package extractor
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"encoding/json/v2"
+
+	"github.com/johbar/text-extraction-service/v4/internal/auth"
+	"github.com/johbar/text-extraction-service/v4/internal/docfactory"
+	"github.com/johbar/text-extraction-service/v4/internal/fetcher"
+	"github.com/johbar/text-extraction-service/v4/internal/jobs"
+)
+
+// jobProgressInterval is the time between saving the progress of running jobs
+var jobProgressInterval = time.Second
+
+// Progress counts the pages of a document written so far. It is safe for concurrent use
+// and a nil Progress ignores all calls.
+type Progress struct {
+	total, done atomic.Int64
+}
+
+// start resets the progress of a document with the given number of pages
+func (p *Progress) start(pages int) {
+	if p == nil {
+		return
+	}
+	p.total.Store(int64(pages))
+	p.done.Store(0)
+}
+
+func (p *Progress) pageDone() {
+	if p != nil {
+		p.done.Add(1)
+	}
+}
+
+// Pages returns the number of pages written and the total, which is 0 if unknown
+func (p *Progress) Pages() (done, total int) {
+	return int(p.done.Load()), int(p.total.Load())
+}
+
+// SetJobStore replaces the store of jobs, which keeps them in memory by default
+func (e *Extractor) SetJobStore(store jobs.Store) {
+	e.jobs = store
+}
+
+// SetCallbackClient replaces the client callbacks are posted with, which is http.DefaultClient by default
+func (e *Extractor) SetCallbackClient(client *http.Client) {
+	e.callbackClient = client
+}
+
+// SetChargeOcrPages sets the func charging the pages OCRed by a job to the client that created it
+func (e *Extractor) SetChargeOcrPages(charge func(clientID string, pages int64)) {
+	e.chargeOcrPages = charge
+}
+
+// CreateJob extracts the document at the URL given as query param url or, if there is none, sent in the body in the
+// background. It responds with the job, whose state is found at the URL in the Location header.
+// The job and its result are posted to the URL given as query param callback, when it is finished.
+func (e *Extractor) CreateJob(w http.ResponseWriter, r *http.Request) {
+	params := paramsFromQuery(r.URL.Query())
+	if err := params.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if params.Url != "" && !e.supportedUrl(params.Url) {
+		http.Error(w, "not a supported URL: "+params.Url, http.StatusBadRequest)
+		return
+	}
+	e.createJob(w, r, params)
+}
+
+// createJob starts a job extracting the document at params.Url or, if there is none, sent in the body
+// and responds with it
+func (e *Extractor) createJob(w http.ResponseWriter, r *http.Request, params RequestParams) {
+	run := e.extractUrl
+	// the slot of a document sent in the body is released when the job is done. discard releases it
+	// and closes the document, if the job can't be started
+	discard := func() {}
+	if params.Url == "" {
+		// the body is read before responding, the document is extracted in the background
+		body := docfactory.NewDigestReader(r.Body)
+		admitted, releaseSlot, err := e.admit(body, r.ContentLength, params)
+		if err != nil {
+			http.Error(w, err.Error(), e.busy(w.Header(), err))
+			return
+		}
+		doc, err := e.df.NewDocFromStream(admitted, r.ContentLength, "POST job")
+		if err != nil {
+			releaseSlot()
+			e.log.Error("Error parsing request body", "err", err)
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		// the document is closed by extractDoc, unless the job can't be started
+		discard = func() {
+			doc.Close()
+			releaseSlot()
+		}
+		digest := body.Digest()
+		run = func(params RequestParams, w io.Writer, header http.Header) error {
+			defer releaseSlot()
+			return e.extractDoc(doc, digest, params, w, header)
+		}
+	}
+	job, err := e.startJob(params, auth.ClientID(r.Context()), run)
+	if err != nil {
+		discard()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.MarshalWrite(w, job)
+}
+
+// extractUrl writes the output of the document at params.Url
+func (e *Extractor) extractUrl(params RequestParams, w io.Writer, header http.Header) error {
+	_, err := e.DocFromUrl(params, w, header)
+	return err
+}
+
+// startJob saves a new job of the client with the given ID, if it was authenticated, and runs it in the background
+func (e *Extractor) startJob(params RequestParams, clientID string, run func(params RequestParams, w io.Writer, header http.Header) error) (jobs.Job, error) {
+	now := time.Now().UTC()
+	job := jobs.Job{ID: jobs.NewID(), Status: jobs.Queued, Url: params.Url, Callback: params.Callback, Client: clientID, Created: now, Updated: now}
+	if err := e.jobs.Put(job); err != nil {
+		e.log.Error("Could not save job", "id", job.ID, "err", err)
+		return job, err
+	}
+	e.log.Info("Job created", "id", job.ID, "url", job.Url)
+	params.progress = &Progress{}
+	params.background = true
+	go e.runJob(job, params, run)
+	return job, nil
+}
+
+// runJob runs the extraction, saving the job's progress regularly and its result when it is finished
+func (e *Extractor) runJob(job jobs.Job, params RequestParams, run func(params RequestParams, w io.Writer, header http.Header) error) {
+	job.Status = jobs.Running
+	e.saveJob(&job)
+	var result bytes.Buffer
+	header := http.Header{}
+	finished := make(chan error, 1)
+	go func() { finished <- run(params, &result, header) }()
+	progress := params.progress
+	ticker := time.NewTicker(jobProgressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if done, total := progress.Pages(); done != job.PagesDone || total != job.PagesTotal {
+				job.PagesDone, job.PagesTotal = done, total
+				e.saveJob(&job)
+			}
+		case err := <-finished:
+			job.PagesDone, job.PagesTotal = progress.Pages()
+			if e.chargeOcrPages != nil && job.Client != "" {
+				e.chargeOcrPages(job.Client, auth.OcrPages(header))
+			}
+			if err == nil {
+				err = e.jobs.SaveResult(job.ID, result.Bytes())
+			}
+			if err != nil {
+				e.log.Error("Job failed", "id", job.ID, "err", err)
+				job.Status, job.Error = jobs.Failed, err.Error()
+				result.Reset()
+			} else {
+				job.Status = jobs.Done
+				job.ContentType = header.Get("Content-Type")
+				header.Del("Content-Type")
+				job.Metadata = make(map[string]string)
+				for k, v := range trailersToHeaders(header) {
+					job.Metadata[strings.ToLower(k)] = v[0]
+				}
+			}
+			e.saveJob(&job)
+			e.notify(&job, result.Bytes())
+			return
+		}
+	}
+}
+
+// saveJob saves the job after updating its modification time. Failures are logged, as the job goes on.
+func (e *Extractor) saveJob(job *jobs.Job) {
+	job.Updated = time.Now().UTC()
+	if err := e.jobs.Put(*job); err != nil {
+		e.log.Error("Could not save job", "id", job.ID, "err", err)
+	}
+}
+
+// job returns the job with the ID given in the path, responding with an error if that fails.
+// Jobs of other clients than the one authenticated are not found.
+func (e *Extractor) job(w http.ResponseWriter, r *http.Request) (jobs.Job, bool) {
+	job, err := e.jobs.Get(r.PathValue("id"))
+	if err == nil && job.Client != auth.ClientID(r.Context()) {
+		err = jobs.ErrNotFound
+	}
+	if errors.Is(err, jobs.ErrNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return job, false
+	}
+	if err != nil {
+		e.log.Error("Could not get job", "id", r.PathValue("id"), "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return job, false
+	}
+	return job, true
+}
+
+// GetJob responds with the JSON encoded job, which reports its status and progress
+func (e *Extractor) GetJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := e.job(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.MarshalWrite(w, job)
+}
+
+// GetJobResult responds with the output of a job that is done, its metadata sent as headers.
+// Jobs that are not finished yet are answered with status 409, failed jobs with 422 and their error.
+func (e *Extractor) GetJobResult(w http.ResponseWriter, r *http.Request) {
+	job, ok := e.job(w, r)
+	if !ok {
+		return
+	}
+	switch job.Status {
+	case jobs.Done:
+	case jobs.Failed:
+		http.Error(w, job.Error, http.StatusUnprocessableEntity)
+		return
+	default:
+		http.Error(w, "job is "+job.Status, http.StatusConflict)
+		return
+	}
+	addMetadataAsHeaders(w.Header(), job.Metadata)
+	if job.ContentType != "" {
+		w.Header().Set("Content-Type", job.ContentType)
+	}
+	if err := e.jobs.StreamResult(job.ID, w); err != nil {
+		e.log.Error("Could not send job result", "id", job.ID, "err", err)
+		status := http.StatusInternalServerError
+		if errors.Is(err, jobs.ErrNotFound) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+	}
+}
+
+func isHttpUrl(url string) bool {
+	return strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://")
+}
+
+// supportedUrl reports whether documents can be fetched from url: HTTP(S) URLs and those of the sources of the HTTP client,
+// e.g. file:// or s3://
+func (e *Extractor) supportedUrl(url string) bool {
+	return fetcher.Supported(e.httpClient, url)
+}
@@ -0,0 +1,100 @@
+package extractor
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"encoding/json/v2"
+
+	"github.com/johbar/text-extraction-service/v4/internal/cache"
+	"github.com/johbar/text-extraction-service/v4/internal/jobs"
+)
+
+func TestJobs(t *testing.T) {
+	f := newFixture(t, &cache.NopCache{}, nil, nil)
+	extract, origin := f.extract, f.origin
+	callbacks := make(chan jobs.Job, 2)
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var job jobs.Job
+		if err := json.UnmarshalRead(r.Body, &job); err != nil {
+			t.Error(err)
+		}
+		callbacks <- job
+	}))
+	defer callback.Close()
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /jobs", extract.CreateJob)
+	mux.HandleFunc("GET /jobs/{id}", extract.GetJob)
+	mux.HandleFunc("GET /jobs/{id}/result", extract.GetJobResult)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	var want strings.Builder
+	if _, err := extract.DocFromUrl(RequestParams{Url: origin.URL}, &want, http.Header{}); err != nil {
+		t.Fatal(err)
+	}
+	// run creates a job and returns its result once the callback has been received
+	run := func(query string, body io.Reader) (jobs.Job, string, http.Header) {
+		t.Helper()
+		response, err := http.Post(srv.URL+"/jobs?callback="+url.QueryEscape(callback.URL)+query, "application/rtf", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var job jobs.Job
+		err = json.UnmarshalRead(response.Body, &job)
+		response.Body.Close()
+		if err != nil || response.StatusCode != http.StatusAccepted || response.Header.Get("Location") != "/jobs/"+job.ID {
+			t.Fatalf("status %d, location %s, err %v", response.StatusCode, response.Header.Get("Location"), err)
+		}
+		select {
+		case finished := <-callbacks:
+			if finished.ID != job.ID || finished.Status != jobs.Done {
+				t.Fatalf("callback of job %s: %+v", job.ID, finished)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("no callback")
+		}
+		response, err = http.Get(srv.URL + "/jobs/" + job.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		json.UnmarshalRead(response.Body, &job)
+		response.Body.Close()
+		response, err = http.Get(srv.URL + "/jobs/" + job.ID + "/result")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		result, _ := io.ReadAll(response.Body)
+		if response.StatusCode != http.StatusOK {
+			t.Fatalf("result: status %d %s", response.StatusCode, result)
+		}
+		return job, string(result), response.Header
+	}
+
+	job, result, header := run("&url="+url.QueryEscape(origin.URL), nil)
+	if job.Status != jobs.Done || job.Url != origin.URL || job.PagesDone != job.PagesTotal {
+		t.Errorf("job %+v", job)
+	}
+	if result != want.String() || header.Get(cache.DigestKey) == "" {
+		t.Errorf("result of URL %q, headers %v", result, header)
+	}
+	if _, result, _ := run("", bytes.NewReader(f.rtf)); result != want.String() {
+		t.Errorf("result of body %q", result)
+	}
+
+	response, err := http.Get(srv.URL + "/jobs/unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown job: status %d", response.StatusCode)
+	}
+}
@@ -3,29 +3,38 @@ package extractor
 import (
 	"bytes"
 	"encoding/json/v2"
+	"errors"
 	"io"
 	"net/http"
+	"strings"
 
+	"github.com/johbar/text-extraction-service/v4/internal/admission"
 	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nats.go/micro"
 )
 
-func (e *Extractor) RegisterNatsService(nc *nats.Conn) {
+// RegisterNatsService adds the NATS micro service with the endpoints extract-remote, update-cache and invalidate
+func (e *Extractor) RegisterNatsService(nc *nats.Conn) error {
 	extractService, err := micro.AddService(nc, micro.Config{
 		Name:        "extract-text",
 		Version:     "1.0.0",
 		Description: "Returns the plain text content of binary files like PDFs",
 	})
-
 	if err != nil {
-		panic(err)
+		return err
 	}
-	extractService.AddEndpoint("extract-remote",
-		micro.HandlerFunc(e.handleUrl),
-		micro.WithEndpointQueueGroup("text-extraction-service"))
-	extractService.AddEndpoint("update-cache",
-		micro.HandlerFunc(e.updateCache),
-		micro.WithEndpointQueueGroup("text-extraction-service"))
+	return errors.Join(
+		extractService.AddEndpoint("extract-remote",
+			micro.HandlerFunc(e.handleUrl),
+			micro.WithEndpointQueueGroup("text-extraction-service")),
+		extractService.AddEndpoint("update-cache",
+			micro.HandlerFunc(e.updateCache),
+			micro.WithEndpointQueueGroup("text-extraction-service")),
+		// every instance receives invalidations to clear its in-memory cache
+		extractService.AddEndpoint("invalidate",
+			micro.HandlerFunc(e.invalidate),
+			micro.WithEndpointQueueGroupDisabled()),
+	)
 }
 
 // HandleUrl replies to a Nats request
@@ -37,22 +46,55 @@ func (e *Extractor) handleUrl(req micro.Request) {
 		req.Error("invalid_params", err.Error(), nil)
 		return
 	}
+	if err := params.validate(); err != nil {
+		req.Error("invalid_params", err.Error(), nil)
+		return
+	}
 	e.log.Info("Received Nats request", "params", params)
+	if params.Callback != "" {
+		// the result is posted to the callback, the reply is the job
+		job, err := e.startJob(params, "", e.extractUrl)
+		if err != nil {
+			req.Error("failed", err.Error(), nil)
+			return
+		}
+		reply, _ := json.Marshal(job)
+		req.Respond(reply)
+		return
+	}
 	var b bytes.Buffer
 	header := http.Header{}
 	_, err = e.DocFromUrl(params, &b, header)
+	if errors.Is(err, admission.ErrQueueFull) || errors.Is(err, admission.ErrTimeout) {
+		req.Error("busy", err.Error(), nil)
+		return
+	}
 	if err != nil {
 		req.Error("failed", err.Error(), nil)
 		return
 	}
-	req.Respond(b.Bytes(), micro.WithHeaders(micro.Headers(header)))
+	req.Respond(b.Bytes(), micro.WithHeaders(micro.Headers(trailersToHeaders(header))))
+}
+
+// trailersToHeaders turns the HTTP trailers set after the text was written into regular headers,
+// as NATS replies are sent at once
+func trailersToHeaders(header http.Header) http.Header {
+	for k, v := range header {
+		if name, ok := strings.CutPrefix(k, http.TrailerPrefix); ok {
+			delete(header, k)
+			header[http.CanonicalHeaderKey(name)] = v
+		}
+	}
+	return header
 }
 
 // UpdateCache responds with 'done' once a document has been added
 // or refreshed in the cache
 func (e *Extractor) updateCache(req micro.Request) {
 	url := string(req.Data())
-	params := RequestParams{Url: url, Silent: true}
+	// the origin is always asked, as the entry may be fresh but outdated
+	maxAge := 0
+	params := RequestParams{Url: url, Silent: true, MaxAge: &maxAge}
 	e.log.Info("Received Nats request", "params", params)
 	header := http.Header{}
 	_, err := e.DocFromUrl(params, io.Discard, header)
@@ -62,3 +104,21 @@ func (e *Extractor) updateCache(req micro.Request) {
 	}
 	req.Respond([]byte("done"))
 }
+
+// invalidate deletes the cache entries selected by the JSON encoded PurgeParams
+// and replies with the keys of the deleted entries
+func (e *Extractor) invalidate(req micro.Request) {
+	var params PurgeParams
+	if err := json.Unmarshal(req.Data(), &params); err != nil {
+		req.Error("invalid_params", err.Error(), nil)
+		return
+	}
+	e.log.Info("Received Nats request", "params", params)
+	result, err := e.purge(params)
+	if err != nil {
+		req.Error("failed", err.Error(), nil)
+		return
+	}
+	reply, _ := json.Marshal(result)
+	req.Respond(reply)
+}
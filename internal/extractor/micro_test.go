@@ -0,0 +1,96 @@
+package extractor
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"encoding/json/v2"
+
+	"github.com/johbar/text-extraction-service/v4/internal/fetcher"
+	"github.com/johbar/text-extraction-service/v4/internal/jobs"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+func TestNatsService(t *testing.T) {
+	ns, err := server.NewServer(&server.Options{DontListen: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns.Start()
+	defer ns.Shutdown()
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatal("NATS not ready")
+	}
+	nc, err := nats.Connect("", nats.InProcessServer(ns))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	f := newFixture(t, nil, nil, nil)
+	extract, origin := f.extract, f.origin
+	callbackClient, _ := fetcher.NewGuardedClient(fetcher.Options{})
+	extract.SetCallbackClient(callbackClient)
+	if err := extract.RegisterNatsService(nc); err != nil {
+		t.Fatal(err)
+	}
+	request := func(subject string, data any) *nats.Msg {
+		t.Helper()
+		payload, _ := json.Marshal(data)
+		reply, err := nc.Request(subject, payload, 10*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status := reply.Header.Get("Nats-Service-Error-Code"); status != "" {
+			t.Fatalf("%s: error %s %s", subject, status, reply.Header.Get("Nats-Service-Error"))
+		}
+		return reply
+	}
+
+	reply := request("extract-remote", RequestParams{Url: origin.URL})
+	want := string(reply.Data)
+	if !strings.HasPrefix(want, "text-extraction-service") {
+		t.Errorf("extracted text %q", want)
+	}
+	waitForEntry(t, f.cache, origin.URL)
+	var result PurgeResult
+	if err := json.Unmarshal(request("invalidate", PurgeParams{Url: origin.URL}).Data, &result); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(result.Deleted, origin.URL) {
+		t.Errorf("deleted %v", result.Deleted)
+	}
+	if metadata, _ := f.cache.GetMetadata(origin.URL); metadata != nil {
+		t.Errorf("invalidated entry still cached: %v", metadata)
+	}
+
+	// with a callback the reply is the job, its result is posted to the callback
+	delivered := make(chan map[string]any, 1)
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]any
+		if err := json.UnmarshalRead(r.Body, &payload); err != nil {
+			t.Error(err)
+		}
+		delivered <- payload
+	}))
+	defer callback.Close()
+	var job jobs.Job
+	if err := json.Unmarshal(request("extract-remote", RequestParams{Url: origin.URL, Callback: callback.URL}).Data, &job); err != nil {
+		t.Fatal(err)
+	}
+	if job.ID == "" || job.Status != jobs.Queued {
+		t.Errorf("job %+v", job)
+	}
+	select {
+	case payload := <-delivered:
+		if payload["id"] != job.ID || payload["status"] != jobs.Done || payload["result"] != want {
+			t.Errorf("callback payload %v", payload)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("no callback")
+	}
+}
@@ -1,6 +1,7 @@
 package extractor
 
 import (
+	"errors"
 	"io"
 	"net/http"
 	"os"
@@ -10,75 +11,85 @@ import (
 	"encoding/json/v2"
 
 	"github.com/johbar/text-extraction-service/v4/internal/cache"
-	"github.com/johbar/text-extraction-service/v4/internal/pdfproc"
-
-	"github.com/johbar/pdfcpu-lite/pkg/pdfcpu/model"
 	"github.com/johbar/text-extraction-service/v4/pkg/dehyphenator"
+	"github.com/johbar/text-extraction-service/v4/pkg/layout"
 	"github.com/johbar/text-extraction-service/v4/pkg/tesswrap"
 )
 
-func (e *Extractor) parseForOcrOnce(d cache.Document, ctx *model.Context, origin string) (*model.Context, error) {
-	if ctx != nil {
-		return ctx, nil
+// WriteTextOrRunOcr writes the text of every page. Pages are OCRed according to ocr.
+// Documents whose text is recognized by OCR only, e.g. images, are OCRed regardless of the OCR mode.
+func (e *Extractor) WriteTextOrRunOcr(d cache.Document, w io.Writer, ocr OcrOptions, origin string) error {
+	o := e.newDocOcr(d, ocr, origin)
+	if od, ok := d.(cache.OcrDocument); ok {
+		type pageResult struct {
+			text string
+			err  error
+		}
+		// single images report no page count
+		n := max(d.Pages(), 1)
+		ocr.Progress.start(n)
+		return inPageOrder(n, o.workers(), func(i int) pageResult {
+			_, r, err := o.recognizeDoc(od, i)
+			return pageResult{r.Text, err}
+		}, func(_ int, r pageResult) error {
+			// a failed page of a multi-page image has been logged and is skipped
+			if r.err != nil && n == 1 {
+				return r.err
+			}
+			_, err := io.WriteString(w, r.text)
+			ocr.Progress.pageDone()
+			return err
+		})
 	}
-	e.log.Debug("Parsing PDF with pdfcpu for image extraction", "origin", origin)
-	if len(d.Path()) == 0 {
-		return pdfproc.ParseForImageExtraction(*d.Data())
-	} else {
-		return pdfproc.ParsePathForImageExtraction(d.Path())
+	if d.Pages() < 1 {
+		return d.StreamText(w)
 	}
+	ocr.Progress.start(d.Pages())
+	return inPageOrder(d.Pages(), o.workers(), o.pageText, func(_ int, text []byte) error {
+		_, err := w.Write(text)
+		ocr.Progress.pageDone()
+		return err
+	})
 }
 
-func (e *Extractor) WriteTextOrRunOcr(d cache.Document, w io.Writer, origin string) error {
-	var ctx *model.Context
-	var err error
-	if d.Pages() < 1 {
-		return d.StreamText(w)
+// WriteLayoutText writes the text of every page with its spatial alignment preserved, followed by a form feed.
+// Documents that don't know the position of their text and images are written as with [Extractor.WriteTextOrRunOcr].
+func (e *Extractor) WriteLayoutText(d cache.Document, w io.Writer, ocr OcrOptions, origin string) error {
+	ld, ok := d.(cache.LayoutDocument)
+	if _, isOcr := d.(cache.OcrDocument); !ok || isOcr || d.Pages() < 1 {
+		return e.WriteTextOrRunOcr(d, w, ocr, origin)
 	}
+	ocr.Progress.start(d.Pages())
 	for i := range d.Pages() {
-		text, hasImages := d.Text(i)
-		if len(text) < 200 && hasImages && tesswrap.Initialized {
-			ctx, err = e.parseForOcrOnce(d, ctx, origin)
-			if err != nil {
-				e.log.Error("pdfcpu failed", "err", err, "origin", origin)
-				continue
-			}
-			images, err := pdfproc.GetImages(ctx, i)
-			if err != nil {
-				e.log.Error("Extracting images failed", "err", err, "origin", origin)
-				continue
-			}
-			if len(images) < 1 {
-				e.log.Warn("No image found.", "origin", origin, "page", i)
-			}
-			for _, img := range images {
-				e.log.Info("Image found. Starting OCR", "origin", origin, "page", i, "type", img.FileType, "name", img.Name)
-				ocrText, err := tesswrap.ImageReaderToText(img)
-				if err != nil {
-					e.log.Error("Tesseract failed", "err", err, "origin", origin, "page", i, "imgName", img.Name)
-					// we don't return that error, because we don't want to abort/fail the processing
-					continue
-				}
-				if _, err := w.Write([]byte(ocrText)); err != nil {
-					e.log.Error("writing OCRed text to output", "err", err)
-					return err
-				}
-			}
+		page, err := ld.PageLayout(i)
+		if errors.Is(err, errors.ErrUnsupported) {
+			e.log.Debug("Document does not support layout mode", "origin", origin)
+			return e.WriteTextOrRunOcr(d, w, ocr, origin)
+		}
+		if err != nil {
+			e.log.Error("Could not determine page layout", "err", err, "origin", origin, "page", i)
+			page = &layout.Page{}
 		}
-		if _, err := w.Write([]byte(text)); err != nil {
+		if err := page.WriteText(w); err != nil {
 			return err
 		}
-		// ensure there is a newline at the end of every page
-		if _, err := w.Write([]byte{'\n'}); err != nil {
+		if _, err := w.Write([]byte{'\f'}); err != nil {
 			return err
 		}
+		ocr.Progress.pageDone()
 	}
 	return nil
 }
 
 // PrintMetadataAndTextToStdout prints a file's metadata (as JSON) on the first line, followed by the file's text content.
-// The file can be local or remote (http/https). When url is "-", the file will be read from Stdin
-func (e *Extractor) PrintMetadataAndTextToStdout(url string) {
+// The file (params.Url) can be local or remote (http/https). When it is "-", the file will be read from Stdin.
+// The output mode and format are taken from params, too.
+func (e *Extractor) PrintMetadataAndTextToStdout(params RequestParams) {
+	url := params.Url
+	if err := params.validate(); err != nil {
+		e.log.Error("Invalid options", "err", err)
+		os.Exit(1)
+	}
 	var doc cache.Document
 	var size int64 = -1
 	var err error
@@ -128,9 +139,18 @@ func (e *Extractor) PrintMetadataAndTextToStdout(url string) {
 		e.log.Error("Could not write to output", "err", err)
 		os.Exit(1)
 	}
-	dw := dehyphenator.New(os.Stdout, e.tesConfig.RemoveNewlines)
-	err = e.WriteTextOrRunOcr(doc, dw, url)
-	dw.Close()
+	var stats OcrStats
+	if !params.plainText() {
+		err = e.writeOutput(doc, os.Stdout, params, &stats, url)
+	} else {
+		dw := dehyphenator.New(os.Stdout, e.tesConfig.RemoveNewlines)
+		err = e.WriteTextOrRunOcr(doc, dw, params.ocrOptions(&stats), url)
+		dw.Close()
+	}
+	// the metadata has been printed already
+	if ocrMetadata := stats.Metadata(); len(ocrMetadata) > 0 {
+		e.log.Info("OCR done", "url", url, "metadata", ocrMetadata)
+	}
 	doc.Close()
 	if len(doc.Path()) > 1 && doc.Path() != url {
 		err = os.Remove(doc.Path())
@@ -157,6 +177,8 @@ func (e *Extractor) LogAndFixConfigIssues() {
 		}
 	}
 
+	e.log.Info("Admission limits", "concurrent", e.tesConfig.MaxConcurrent, "perType", e.tesConfig.MaxConcurrentPerTypes,
+		"memory", e.tesConfig.MemoryBudgetBytes, "queueSize", e.tesConfig.QueueSize, "queueTimeout", e.tesConfig.QueueTimeout)
 	e.log.Info("PDF implementation", "lib", e.df.PdfImpl())
 	// This ensures, that forked instances of TES will use the same lib
 	os.Setenv("TES_PDF_LIB_NAME", e.df.PdfImpl().LibShort)
@@ -0,0 +1,435 @@
+package extractor
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/johbar/pdfcpu-lite/pkg/pdfcpu/model"
+
+	"github.com/johbar/text-extraction-service/v4/internal/cache"
+	"github.com/johbar/text-extraction-service/v4/internal/config"
+	"github.com/johbar/text-extraction-service/v4/internal/pdfproc"
+	"github.com/johbar/text-extraction-service/v4/pkg/layout"
+	"github.com/johbar/text-extraction-service/v4/pkg/tesswrap"
+	"github.com/johbar/text-extraction-service/v4/pkg/textquality"
+)
+
+// OcrOptions are the OCR settings of a request
+type OcrOptions struct {
+	// Mode is "auto", "always" or "never". The configured mode is used if it is empty.
+	Mode string
+	// Lang are the Tesseract languages separated by '+' or "auto" to choose them by the detected script.
+	// The configured languages are used if it is empty.
+	Lang string
+	// MinConfidence drops recognized words with a lower confidence (0 to 100).
+	// The configured threshold is used if it is zero.
+	MinConfidence float64
+	// Stats collects the results of OCR, if it is not nil
+	Stats *OcrStats
+	// Progress counts the pages written, if it is not nil
+	Progress *Progress
+}
+
+// tesswrapOptions returns the options passed to Tesseract
+func (o OcrOptions) tesswrapOptions(conf *config.TesConfig) tesswrap.Options {
+	opts := tesswrap.Options{Lang: o.Lang, MinConfidence: o.MinConfidence}
+	if opts.MinConfidence == 0 {
+		opts.MinConfidence = conf.OcrMinConfidence
+	}
+	return opts
+}
+
+// OcrStats collects the languages used and the confidence of the text recognized in a document.
+// It is safe for concurrent use.
+type OcrStats struct {
+	mtx   sync.Mutex
+	langs []string
+	// pages holds the statistics of every OCRed page by its index
+	pages   map[int]*confidence
+	total   confidence
+	dropped int
+}
+
+// confidence accumulates the confidence of recognized words
+type confidence struct {
+	words int
+	// sum is the sum of the words' confidences
+	sum float64
+}
+
+func (c *confidence) add(words int, mean float64) {
+	c.words += words
+	c.sum += mean * float64(words)
+}
+
+// mean returns the mean confidence formatted for the metadata
+func (c *confidence) mean() string {
+	if c.words == 0 {
+		return "0"
+	}
+	return strconv.FormatFloat(c.sum/float64(c.words), 'f', 1, 64)
+}
+
+// add records the result of OCR on an image of page i
+func (s *OcrStats) add(i int, r tesswrap.Result) {
+	if s == nil {
+		return
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if r.Lang != "" && !slices.Contains(s.langs, r.Lang) {
+		s.langs = append(s.langs, r.Lang)
+	}
+	if s.pages == nil {
+		s.pages = make(map[int]*confidence)
+	}
+	page, ok := s.pages[i]
+	if !ok {
+		page = &confidence{}
+		s.pages[i] = page
+	}
+	// the mean confidence covers the dropped words, too
+	words := r.Words + r.Dropped
+	page.add(words, r.Confidence)
+	s.total.add(words, r.Confidence)
+	s.dropped += r.Dropped
+}
+
+// Metadata returns the metadata describing the OCR of the document. It is empty if nothing was OCRed.
+//   - x-ocr-engine: the OCR engine, e.g. "tesseract 5.3.4 (cli)"
+//   - x-ocr-lang: the languages used
+//   - x-ocr-pages: the number of pages OCRed
+//   - x-ocr-confidence: Tesseract's mean confidence (0 to 100) in the recognized words
+//   - x-ocr-page-confidences: the mean confidence of every OCRed page, e.g. "1:93.5, 3:41.0"
+//   - x-ocr-dropped-words: the number of words dropped for their low confidence, if any
+func (s *OcrStats) Metadata() cache.DocumentMetadata {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	metadata := make(cache.DocumentMetadata)
+	if len(s.pages) == 0 {
+		return metadata
+	}
+	metadata["x-ocr-engine"] = tesswrap.Engine()
+	metadata["x-ocr-lang"] = strings.Join(s.langs, ", ")
+	metadata["x-ocr-pages"] = strconv.Itoa(len(s.pages))
+	metadata["x-ocr-confidence"] = s.total.mean()
+	pageConfidences := make([]string, 0, len(s.pages))
+	for _, i := range slices.Sorted(maps.Keys(s.pages)) {
+		pageConfidences = append(pageConfidences, strconv.Itoa(i+1)+":"+s.pages[i].mean())
+	}
+	metadata["x-ocr-page-confidences"] = strings.Join(pageConfidences, ", ")
+	if s.dropped > 0 {
+		metadata["x-ocr-dropped-words"] = strconv.Itoa(s.dropped)
+	}
+	return metadata
+}
+
+// ocrAction is what is done to a page in terms of OCR
+type ocrAction int
+
+const (
+	// noOcr keeps the page's text as it is
+	noOcr ocrAction = iota
+	// ocrWithText runs OCR on the page's images and keeps its text, e.g. a scan with a text header
+	ocrWithText
+	// ocrInsteadOfText renders the whole page and replaces its text with the OCR result,
+	// e.g. text made of vector outlines or garbled by a broken font encoding
+	ocrInsteadOfText
+)
+
+// ocrAction decides whether and how page i is OCRed. ocr is the requested OCR mode,
+// the configured one is used if it is empty.
+func (e *Extractor) ocrAction(d cache.Document, i int, text string, hasImages bool, ocr, origin string) ocrAction {
+	if ocr == "" {
+		ocr = e.tesConfig.Ocr
+	}
+	if !tesswrap.Initialized || ocr == config.OcrNever {
+		return noOcr
+	}
+	if ocr == config.OcrAlways {
+		return ocrInsteadOfText
+	}
+	policy := e.tesConfig.OcrPolicy
+	stats := textquality.Analyze(text)
+	if stats.Runes == 0 && !hasImages {
+		// a blank page has nothing to recognize
+		return noOcr
+	}
+	failures, printable := stats.FailureRate(), stats.PrintableRatio()
+	if failures > policy.MaxGlyphFailures {
+		e.log.Info("Text has unmapped glyphs. Page will be OCRed", "origin", origin, "page", i, "rate", failures)
+		return ocrInsteadOfText
+	}
+	if printable < policy.MinPrintable {
+		e.log.Info("Text has unprintable characters. Page will be OCRed", "origin", origin, "page", i, "ratio", printable)
+		return ocrInsteadOfText
+	}
+	// The list of frequent words covers a few languages only, so it merely decides
+	// about text that is already doubtful, i.e. halfway to failing one of the checks above.
+	doubtful := failures > policy.MaxGlyphFailures/2 || printable < (1+policy.MinPrintable)/2
+	if rate, ok := stats.DictionaryHitRate(); ok && doubtful && rate < policy.MinDictionaryHits {
+		e.log.Info("Doubtful text has no known words. Page will be OCRed", "origin", origin, "page", i, "rate", rate)
+		return ocrInsteadOfText
+	}
+	coverage, ok := e.imageCoverage(d, i, origin)
+	if !ok {
+		// without knowing the images' size every image on a short page is OCRed
+		if stats.Runes < policy.MinTextLength && hasImages {
+			return ocrWithText
+		}
+		return noOcr
+	}
+	if coverage >= policy.ScanCoverage || (stats.Runes < policy.MinTextLength && coverage >= policy.MinImageCoverage) {
+		e.log.Debug("Images cover the page. Page will be OCRed", "origin", origin, "page", i, "coverage", coverage)
+		return ocrWithText
+	}
+	return noOcr
+}
+
+// imageCoverage returns the fraction of page i's area covered by images
+// and false if the document can't tell.
+func (e *Extractor) imageCoverage(d cache.Document, i int, origin string) (float64, bool) {
+	cd, ok := d.(cache.ImageCoverageDocument)
+	if !ok {
+		return 0, false
+	}
+	coverage, err := cd.ImageCoverage(i)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return 0, false
+	}
+	if err != nil {
+		e.log.Error("Could not determine image coverage", "err", err, "origin", origin, "page", i)
+		return 0, false
+	}
+	return coverage, true
+}
+
+// docOcr holds the state of a document whose pages are processed concurrently
+type docOcr struct {
+	e      *Extractor
+	d      cache.Document
+	opts   OcrOptions
+	origin string
+	// mtx serializes the access to d and ctx, as documents are not safe for concurrent use
+	mtx sync.Mutex
+	// ctx is the document parsed by pdfcpu for image extraction, created on demand
+	ctx       *model.Context
+	ctxFailed bool
+}
+
+func (e *Extractor) newDocOcr(d cache.Document, opts OcrOptions, origin string) *docOcr {
+	return &docOcr{e: e, d: d, opts: opts, origin: origin}
+}
+
+// workers returns the number of pages to be processed concurrently
+func (o *docOcr) workers() int {
+	if !tesswrap.Initialized || o.opts.Mode == config.OcrNever || (o.opts.Mode == "" && o.e.tesConfig.Ocr == config.OcrNever) {
+		return 1
+	}
+	return o.e.tesConfig.OcrWorkersPerRequest
+}
+
+// page returns page i's text, whether it has images and what is to be done in terms of OCR
+func (o *docOcr) page(i int) (string, bool, ocrAction) {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	text, hasImages := o.d.Text(i)
+	return text, hasImages, o.e.ocrAction(o.d, i, text, hasImages, o.opts.Mode, o.origin)
+}
+
+// pageText returns page i's text followed by a newline.
+// OCRed text precedes the text or replaces it, depending on the page's [ocrAction].
+func (o *docOcr) pageText(i int) []byte {
+	text, hasImages, action := o.page(i)
+	var buf bytes.Buffer
+	switch action {
+	case ocrWithText:
+		// tiled or masked images and images Tesseract can't read (JBIG2, CCITT) need the page to be rendered
+		if !o.imagesText(i, &buf) {
+			o.renderedText(i, &buf)
+		}
+	case ocrInsteadOfText:
+		// the document may not be able to render pages
+		if o.renderedText(i, &buf) || (hasImages && o.imagesText(i, &buf)) {
+			text = ""
+		}
+	}
+	buf.WriteString(text)
+	// ensure there is a newline at the end of every page
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// images returns the images of PDF page i. The document is parsed by pdfcpu once.
+func (o *docOcr) images(i int) []model.Image {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	if o.ctx == nil && !o.ctxFailed {
+		o.e.log.Debug("Parsing PDF with pdfcpu for image extraction", "origin", o.origin)
+		var err error
+		if len(o.d.Path()) == 0 {
+			o.ctx, err = pdfproc.ParseForImageExtraction(*o.d.Data())
+		} else {
+			o.ctx, err = pdfproc.ParsePathForImageExtraction(o.d.Path())
+		}
+		if err != nil {
+			o.e.log.Error("pdfcpu failed", "err", err, "origin", o.origin)
+			o.ctxFailed = true
+		}
+	}
+	if o.ctx == nil {
+		return nil
+	}
+	images, err := pdfproc.GetImages(o.ctx, i)
+	if err != nil {
+		o.e.log.Error("Extracting images failed", "err", err, "origin", o.origin)
+		return nil
+	}
+	if len(images) < 1 {
+		o.e.log.Warn("No image found.", "origin", o.origin, "page", i)
+	}
+	return images
+}
+
+// imagesText runs OCR on the images of page i and writes the recognized text to w.
+// It reports whether any text was recognized.
+func (o *docOcr) imagesText(i int, w *bytes.Buffer) bool {
+	recognized := false
+	for _, img := range o.images(i) {
+		_, r, ok := o.recognizeImage(i, img)
+		if !ok {
+			continue
+		}
+		w.WriteString(r.Text)
+		recognized = recognized || strings.TrimSpace(r.Text) != ""
+	}
+	return recognized
+}
+
+// recognizeImage runs OCR on an image of page i and returns the recognized words and text.
+// Failures are logged, as they shouldn't abort the processing of the document.
+func (o *docOcr) recognizeImage(i int, img model.Image) (*layout.Page, tesswrap.Result, bool) {
+	o.e.log.Info("Image found. Starting OCR", "origin", o.origin, "page", i, "type", img.FileType, "name", img.Name)
+	data, err := io.ReadAll(img)
+	if err != nil {
+		o.e.log.Error("Reading image failed", "err", err, "origin", o.origin, "page", i, "imgName", img.Name)
+		return nil, tesswrap.Result{}, false
+	}
+	page, r, err := tesswrap.RecognizeWords(data, o.opts.tesswrapOptions(o.e.tesConfig))
+	if err != nil {
+		o.e.log.Error("Tesseract failed", "err", err, "origin", o.origin, "page", i, "imgName", img.Name)
+		return nil, r, false
+	}
+	o.opts.Stats.add(i, r)
+	o.e.log.Debug("OCR done", "origin", o.origin, "page", i, "imgName", img.Name, "lang", r.Lang, "confidence", r.Confidence)
+	return page, r, true
+}
+
+// render rasterizes page i for OCR at the configured resolution.
+// It returns nil if rendering is disabled, not supported by the document or failed.
+func (o *docOcr) render(i int) *image.Gray {
+	rd, ok := o.d.(cache.RenderDocument)
+	if !ok || o.e.tesConfig.OcrDpi <= 0 {
+		return nil
+	}
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	img, err := rd.RenderPage(i, float64(o.e.tesConfig.OcrDpi))
+	if errors.Is(err, errors.ErrUnsupported) {
+		o.e.log.Debug("Document does not support rendering", "origin", o.origin)
+		return nil
+	}
+	if err != nil {
+		o.e.log.Error("Rendering page failed", "err", err, "origin", o.origin, "page", i)
+		return nil
+	}
+	o.e.log.Info("Page rendered. Starting OCR", "origin", o.origin, "page", i, "dpi", o.e.tesConfig.OcrDpi,
+		"width", img.Rect.Dx(), "height", img.Rect.Dy())
+	return img
+}
+
+// renderedText renders page i and writes the text recognized by OCR to w.
+// It reports whether any text was recognized.
+func (o *docOcr) renderedText(i int, w *bytes.Buffer) bool {
+	_, _, r, ok := o.recognizeRendered(i)
+	if !ok {
+		return false
+	}
+	w.WriteString(r.Text)
+	return strings.TrimSpace(r.Text) != ""
+}
+
+// recognizeRendered renders page i and runs OCR on the bitmap. It returns the bitmap along with the
+// recognized words and text. It reports false if the page couldn't be rendered or OCR failed.
+func (o *docOcr) recognizeRendered(i int) (*image.Gray, *layout.Page, tesswrap.Result, bool) {
+	img := o.render(i)
+	if img == nil {
+		return nil, nil, tesswrap.Result{}, false
+	}
+	page, r, err := tesswrap.RecognizeGrayWords(img, float64(o.e.tesConfig.OcrDpi), o.opts.tesswrapOptions(o.e.tesConfig))
+	if err != nil {
+		o.e.log.Error("Tesseract failed", "err", err, "origin", o.origin, "page", i)
+		return nil, nil, r, false
+	}
+	o.opts.Stats.add(i, r)
+	o.e.log.Debug("OCR done", "origin", o.origin, "page", i, "lang", r.Lang, "confidence", r.Confidence)
+	return img, page, r, true
+}
+
+// recognizeDoc runs OCR on page i of a document whose text is recognized by OCR only, e.g. an image.
+// Without Tesseract the page is empty.
+func (o *docOcr) recognizeDoc(od cache.OcrDocument, i int) (*layout.Page, tesswrap.Result, error) {
+	page, r, err := od.Recognize(i, o.opts.tesswrapOptions(o.e.tesConfig))
+	if err != nil {
+		o.e.log.Error("Tesseract failed", "err", err, "origin", o.origin, "page", i)
+		return nil, r, err
+	}
+	if !tesswrap.Initialized {
+		return page, r, nil
+	}
+	o.opts.Stats.add(i, r)
+	o.e.log.Debug("OCR done", "origin", o.origin, "page", i, "lang", r.Lang, "confidence", r.Confidence)
+	return page, r, nil
+}
+
+// inPageOrder calls work for pages 0 to n-1 with up to workers pages in flight and passes the results
+// to write in page order. work is called concurrently, write is called by the calling goroutine.
+// Processing stops at the first error returned by write, which is returned after all running work is done.
+func inPageOrder[T any](n, workers int, work func(i int) T, write func(i int, result T) error) error {
+	results := make([]chan T, n)
+	for i := range results {
+		results[i] = make(chan T, 1)
+	}
+	inFlight := make(chan struct{}, max(workers, 1))
+	stop := make(chan struct{})
+	// the producer is part of wg, so that no work is added while waiting for an idle wg
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		for i := range n {
+			select {
+			case inFlight <- struct{}{}:
+			case <-stop:
+				return
+			}
+			wg.Go(func() { results[i] <- work(i) })
+		}
+	})
+	defer wg.Wait()
+	defer close(stop)
+	for i := range n {
+		result := <-results[i]
+		// the slot is freed after the page was written, which limits the results waiting in memory
+		<-inFlight
+		if err := write(i, result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package extractor
+
+import (
+	"errors"
+	"io"
+
+	"encoding/json/v2"
+
+	"github.com/johbar/text-extraction-service/v4/internal/cache"
+	"github.com/johbar/text-extraction-service/v4/internal/docfactory"
+	"github.com/johbar/text-extraction-service/v4/pkg/layout"
+)
+
+// WriteTables writes the tables found in the document in the given format:
+// a JSON array of tables with their page numbers and cell grids (default), CSV or Markdown.
+// Multiple CSV and Markdown tables are separated by an empty line.
+func (e *Extractor) WriteTables(d cache.Document, w io.Writer, format, origin string) error {
+	if _, ok := d.(*docfactory.ForkedDoc); ok {
+		// the subprocess has been told to print the tables already
+		return d.StreamText(w)
+	}
+	tables := e.findTables(d, origin)
+	switch format {
+	case FormatCSV, FormatMarkdown:
+		for i, t := range tables {
+			if i > 0 {
+				if _, err := w.Write([]byte{'\n'}); err != nil {
+					return err
+				}
+			}
+			var err error
+			if format == FormatCSV {
+				err = t.WriteCSV(w)
+			} else {
+				err = t.WriteMarkdown(w)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if tables == nil {
+		tables = []layout.Table{}
+	}
+	return json.MarshalWrite(w, tables)
+}
+
+// findTables returns the tables from the document's markup or, for PDFs, the tables detected on its pages.
+func (e *Extractor) findTables(d cache.Document, origin string) []layout.Table {
+	if td, ok := d.(cache.TableDocument); ok {
+		tables, err := td.Tables()
+		if !errors.Is(err, errors.ErrUnsupported) {
+			if err != nil {
+				e.log.Error("Reading tables failed", "err", err, "origin", origin)
+			}
+			return tables
+		}
+	}
+	ld, ok := d.(cache.LayoutDocument)
+	if !ok {
+		return nil
+	}
+	var tables []layout.Table
+	for i := range d.Pages() {
+		page, err := ld.PageLayout(i)
+		if errors.Is(err, errors.ErrUnsupported) {
+			e.log.Debug("Document does not support table detection", "origin", origin)
+			return nil
+		}
+		if err != nil {
+			e.log.Error("Could not determine page layout", "err", err, "origin", origin, "page", i)
+			continue
+		}
+		for _, t := range page.Tables() {
+			t.Page = i + 1
+			tables = append(tables, t)
+		}
+	}
+	return tables
+}
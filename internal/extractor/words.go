@@ -0,0 +1,178 @@
+package extractor
+
+import (
+	"errors"
+	"io"
+	"math"
+
+	"encoding/json/v2"
+
+	"github.com/johbar/text-extraction-service/v4/internal/cache"
+	"github.com/johbar/text-extraction-service/v4/internal/docfactory"
+	"github.com/johbar/text-extraction-service/v4/pkg/layout"
+)
+
+// wordsPage is the compact JSON representation of a page's words
+type wordsPage struct {
+	// Page is the 1-based page number
+	Page   int     `json:"page"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+	// Confidence is the mean confidence (0 to 100) of the page's OCRed words
+	Confidence float64 `json:"confidence,omitzero"`
+	// Words contains one array per word: [text, x0, y0, x1, y1], followed by the confidence for OCRed words
+	Words [][]any `json:"words"`
+}
+
+// WriteWords writes the words of the document and their bounding boxes in the given format:
+// compact JSON (default), hOCR or ALTO XML. Coordinates are PDF points for PDFs and pixels for images,
+// the origin is the top left corner of the page.
+// Pages without text are OCRed, if Tesseract is available.
+func (e *Extractor) WriteWords(d cache.Document, w io.Writer, format string, ocr OcrOptions, origin string) error {
+	if _, ok := d.(*docfactory.ForkedDoc); ok {
+		// the subprocess has been told to print the words already
+		return d.StreamText(w)
+	}
+	pages := e.wordPages(d, ocr, origin)
+	switch format {
+	case FormatHOCR:
+		return layout.WriteHOCR(w, pages)
+	case FormatALTO:
+		return layout.WriteALTO(w, pages)
+	}
+	result := make([]wordsPage, 0, len(pages))
+	for i, p := range pages {
+		if p == nil {
+			continue
+		}
+		wp := wordsPage{Page: i + 1, Width: round2(p.Width), Height: round2(p.Height), Words: make([][]any, 0, len(p.Words))}
+		var conf confidence
+		for _, word := range p.Words {
+			b := word.Box
+			entry := []any{word.Text, round2(b.X0), round2(b.Y0), round2(b.X1), round2(b.Y1)}
+			if word.Confidence > 0 {
+				entry = append(entry, round2(word.Confidence))
+				conf.add(1, word.Confidence)
+			}
+			wp.Words = append(wp.Words, entry)
+		}
+		if conf.words > 0 {
+			wp.Confidence = round2(conf.sum / float64(conf.words))
+		}
+		result = append(result, wp)
+	}
+	return json.MarshalWrite(w, result)
+}
+
+func round2(f float64) float64 {
+	return math.Round(f*100) / 100
+}
+
+// wordPages returns the positioned words of every page. The slice contains nil for pages that failed.
+// Pages are OCRed according to ocr.
+func (e *Extractor) wordPages(d cache.Document, ocr OcrOptions, origin string) []*layout.Page {
+	o := e.newDocOcr(d, ocr, origin)
+	// single images report no page count
+	n := max(d.Pages(), 1)
+	ocr.Progress.start(n)
+	if od, ok := d.(cache.OcrDocument); ok {
+		pages := make([]*layout.Page, n)
+		inPageOrder(n, o.workers(), func(i int) *layout.Page {
+			page, _, _ := o.recognizeDoc(od, i)
+			return page
+		}, func(i int, page *layout.Page) error {
+			pages[i] = page
+			ocr.Progress.pageDone()
+			return nil
+		})
+		return pages
+	}
+	ld, ok := d.(cache.LayoutDocument)
+	if !ok {
+		return nil
+	}
+	pages := make([]*layout.Page, n)
+	err := inPageOrder(n, o.workers(), func(i int) layoutResult {
+		return o.pageWords(ld, i)
+	}, func(i int, r layoutResult) error {
+		if errors.Is(r.err, errors.ErrUnsupported) {
+			return r.err
+		}
+		if r.err != nil {
+			e.log.Error("Could not determine page layout", "err", r.err, "origin", origin, "page", i)
+		}
+		pages[i] = r.page
+		ocr.Progress.pageDone()
+		return nil
+	})
+	if err != nil {
+		e.log.Debug("Document does not support word positions", "origin", origin)
+		return nil
+	}
+	return pages
+}
+
+type layoutResult struct {
+	page *layout.Page
+	err  error
+}
+
+// pageWords returns the words of page i. OCRed words are added or replace the words, depending on the page's [ocrAction].
+func (o *docOcr) pageWords(ld cache.LayoutDocument, i int) layoutResult {
+	o.mtx.Lock()
+	page, err := ld.PageLayout(i)
+	o.mtx.Unlock()
+	if err != nil {
+		return layoutResult{err: err}
+	}
+	_, hasImages, action := o.page(i)
+	switch action {
+	case ocrWithText:
+		if !o.imagesWords(i, page) {
+			o.renderedWords(i, page)
+		}
+	case ocrInsteadOfText:
+		ocrPage := &layout.Page{Width: page.Width, Height: page.Height}
+		if !o.renderedWords(i, ocrPage) && hasImages {
+			o.imagesWords(i, ocrPage)
+		}
+		if len(ocrPage.Words) > 0 {
+			page.Words = ocrPage.Words
+		}
+	}
+	return layoutResult{page: page}
+}
+
+// imagesWords runs OCR on the images of PDF page i and adds the recognized words to page.
+// The images are assumed to cover the whole page, as is the case for scanned documents.
+// It reports whether any word was recognized.
+func (o *docOcr) imagesWords(i int, page *layout.Page) bool {
+	recognized := false
+	for _, img := range o.images(i) {
+		ocrPage, _, ok := o.recognizeImage(i, img)
+		if !ok {
+			continue
+		}
+		if ocrPage.Width > 0 && ocrPage.Height > 0 {
+			ocrPage.Scale(page.Width/ocrPage.Width, page.Height/ocrPage.Height)
+		}
+		page.Words = append(page.Words, ocrPage.Words...)
+		recognized = recognized || len(ocrPage.Words) > 0
+	}
+	return recognized
+}
+
+// renderedWords renders PDF page i, runs OCR on it and adds the recognized words to page.
+// It reports whether any word was recognized.
+func (o *docOcr) renderedWords(i int, page *layout.Page) bool {
+	img, ocrPage, _, ok := o.recognizeRendered(i)
+	if !ok {
+		return false
+	}
+	// the bitmap covers the whole page
+	if w, h := img.Rect.Dx(), img.Rect.Dy(); page.Width > 0 && page.Height > 0 {
+		ocrPage.Scale(page.Width/float64(w), page.Height/float64(h))
+	}
+	page.Words = append(page.Words, ocrPage.Words...)
+	return len(ocrPage.Words) > 0
+}
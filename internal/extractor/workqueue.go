@@ -0,0 +1,329 @@
+package extractor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"encoding/json/v2"
+
+	"github.com/johbar/text-extraction-service/v4/internal/config"
+	"github.com/johbar/text-extraction-service/v4/internal/fetcher"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// Headers of result and dead-letter messages
+const (
+	// urlHeader holds the URL of the document
+	urlHeader = "Tes-Url"
+	// requestSeqHeader holds the stream sequence of the request
+	requestSeqHeader = "Tes-Request-Seq"
+	// requestIdHeader holds the Nats-Msg-Id of the request, if it had one
+	requestIdHeader = "Tes-Request-Id"
+	// resultObjectHeader holds the name of the object the text was saved as
+	resultObjectHeader = "Tes-Result-Object"
+	// errorHeader holds the reason a request was dead-lettered
+	errorHeader = "Tes-Error"
+	// deliveriesHeader holds the number of deliveries of a dead-lettered request
+	deliveriesHeader = "Tes-Deliveries"
+)
+
+// errResultTooLarge fails requests, whose result exceeds the maximum payload of the NATS connection, on their first delivery
+var errResultTooLarge = errors.New("result exceeds the NATS max payload")
+
+// workQueueRetryDelay is multiplied by the number of deliveries to delay the redelivery of failed requests
+var workQueueRetryDelay = 5 * time.Second
+
+// workQueue processes the extraction requests of a JetStream work-queue stream
+type workQueue struct {
+	e    *Extractor
+	conf config.WorkQueueConfig
+	// publish sends a message to a stream and waits for its acknowledgement
+	publish func(ctx context.Context, msg *nats.Msg) error
+	// results stores the text of documents, which is sent in the result message if nil
+	results jetstream.ObjectStore
+	// maxPayload is the maximum size of result messages, 0 if unlimited
+	maxPayload int64
+}
+
+// ConsumeWorkQueue creates the work-queue stream, if it doesn't exist, a stream for results and dead letters, if their
+// subjects are not captured by another one, and the durable consumer. It then processes requests in the background,
+// fetching only as many as there are free workers.
+func (e *Extractor) ConsumeWorkQueue(js jetstream.JetStream) error {
+	conf := e.tesConfig.WorkQueueConfig
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := js.Stream(ctx, conf.WorkQueueStream)
+	if errors.Is(err, jetstream.ErrStreamNotFound) {
+		stream, err = js.CreateStream(ctx, jetstream.StreamConfig{
+			Name:      conf.WorkQueueStream,
+			Subjects:  []string{conf.WorkQueueSubject},
+			Retention: jetstream.WorkQueuePolicy,
+			Storage:   jetstream.FileStorage,
+			Replicas:  e.tesConfig.Replicas,
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("initializing work-queue stream %s: %w", conf.WorkQueueStream, err)
+	}
+	var uncaptured []string
+	for _, subject := range []string{conf.WorkQueueResultSubject, conf.WorkQueueDeadLetterSubject} {
+		if _, err := js.StreamNameBySubject(ctx, subject); err != nil {
+			uncaptured = append(uncaptured, subject)
+		}
+	}
+	if len(uncaptured) > 0 {
+		_, err = js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+			Name:     conf.WorkQueueStream + "_RESULTS",
+			Subjects: uncaptured,
+			Storage:  jetstream.FileStorage,
+			Replicas: e.tesConfig.Replicas,
+		})
+		if err != nil {
+			return fmt.Errorf("initializing stream for work-queue results: %w", err)
+		}
+	}
+	q := &workQueue{e: e, conf: conf, maxPayload: js.Conn().MaxPayload(), publish: func(ctx context.Context, msg *nats.Msg) error {
+		_, err := js.PublishMsg(ctx, msg)
+		return err
+	}}
+	if conf.WorkQueueResultBucket != "" {
+		q.results, err = js.CreateOrUpdateObjectStore(ctx, jetstream.ObjectStoreConfig{
+			Bucket:      conf.WorkQueueResultBucket,
+			Storage:     jetstream.FileStorage,
+			Compression: true,
+			Replicas:    e.tesConfig.Replicas,
+		})
+		if err != nil {
+			return fmt.Errorf("initializing object store for work-queue results: %w", err)
+		}
+	}
+	consumer, err := js.CreateOrUpdateConsumer(ctx, conf.WorkQueueStream, jetstream.ConsumerConfig{
+		Durable:       conf.WorkQueueConsumer,
+		FilterSubject: conf.WorkQueueSubject,
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		AckWait:       conf.WorkQueueAckWait,
+		MaxDeliver:    conf.WorkQueueMaxDeliver,
+	})
+	if err != nil {
+		return fmt.Errorf("initializing work-queue consumer %s: %w", conf.WorkQueueConsumer, err)
+	}
+	// requests whose last delivery wasn't acknowledged in time, e.g. because the instance died, are announced by the server
+	advisories := "$JS.EVENT.ADVISORY.CONSUMER.MAX_DELIVERIES." + conf.WorkQueueStream + "." + conf.WorkQueueConsumer
+	_, err = js.Conn().QueueSubscribe(advisories, conf.WorkQueueConsumer, func(msg *nats.Msg) {
+		q.deadLetterExceeded(stream, msg.Data)
+	})
+	if err != nil {
+		return fmt.Errorf("subscribing to work-queue advisories: %w", err)
+	}
+	e.log.Info("Consuming work queue", "stream", conf.WorkQueueStream, "subject", conf.WorkQueueSubject, "workers", conf.WorkQueueWorkers)
+	go q.consume(consumer)
+	return nil
+}
+
+// consume fetches a request whenever a worker is free and processes it
+func (q *workQueue) consume(consumer jetstream.Consumer) {
+	workers := make(chan struct{}, q.conf.WorkQueueWorkers)
+	for {
+		workers <- struct{}{}
+		msg, err := consumer.Next(jetstream.FetchMaxWait(30 * time.Second))
+		if err != nil {
+			<-workers
+			if !errors.Is(err, nats.ErrTimeout) && !errors.Is(err, jetstream.ErrNoMessages) {
+				q.e.log.Warn("Fetching from work queue failed", "err", err)
+				time.Sleep(time.Second)
+			}
+			continue
+		}
+		go func() {
+			defer func() { <-workers }()
+			q.process(msg)
+		}()
+	}
+}
+
+// process extracts the document of a request and publishes the result, acknowledging the request afterwards.
+// Failed requests are redelivered with a delay, until they are dead-lettered on their last delivery.
+// Invalid requests are dead-lettered right away.
+func (q *workQueue) process(msg jetstream.Msg) {
+	meta, err := msg.Metadata()
+	if err != nil {
+		q.e.log.Error("Not a JetStream message", "subject", msg.Subject(), "err", err)
+		_ = msg.Term()
+		return
+	}
+	var params RequestParams
+	err = json.Unmarshal(msg.Data(), &params)
+	if err == nil {
+		err = params.validate()
+	}
+	if err == nil && !q.e.supportedUrl(params.Url) {
+		err = fmt.Errorf("not a supported URL: %s", params.Url)
+	}
+	if err != nil {
+		q.deadLetter(msg, meta, err)
+		return
+	}
+	q.e.log.Info("Received work-queue request", "seq", meta.Sequence.Stream, "deliveries", meta.NumDelivered, "params", params)
+	// the number of requests is limited by the workers
+	params.background = true
+	stop := q.keepInProgress(msg)
+	var text bytes.Buffer
+	header := http.Header{}
+	_, err = q.e.DocFromUrl(params, &text, header)
+	stop()
+	if err == nil {
+		err = q.publishResult(msg, meta, params, text.Bytes(), trailersToHeaders(header))
+	}
+	if err == nil {
+		if err = msg.Ack(); err != nil {
+			q.e.log.Warn("Acknowledging work-queue request failed", "seq", meta.Sequence.Stream, "err", err)
+		}
+		return
+	}
+	// forbidden URLs won't be allowed on the next delivery, nor will the result get smaller
+	if meta.NumDelivered >= uint64(q.conf.WorkQueueMaxDeliver) || errors.Is(err, fetcher.ErrForbidden) || errors.Is(err, errResultTooLarge) {
+		q.deadLetter(msg, meta, err)
+		return
+	}
+	q.e.log.Warn("Work-queue request failed. Retrying", "seq", meta.Sequence.Stream, "deliveries", meta.NumDelivered, "err", err)
+	_ = msg.NakWithDelay(time.Duration(meta.NumDelivered) * workQueueRetryDelay)
+}
+
+// keepInProgress resets the ack wait of msg regularly, e.g. during long OCR runs, until stop is called
+func (q *workQueue) keepInProgress(msg jetstream.Msg) (stop func()) {
+	done := make(chan struct{})
+	ticker := time.NewTicker(max(q.conf.WorkQueueAckWait/2, 100*time.Millisecond))
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				_ = msg.InProgress()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// publishResult publishes the metadata of the document as headers along with its text, which is saved
+// in the object store instead, if there is one. Otherwise results exceeding the max payload fail with [errResultTooLarge].
+// The result is deduplicated by the stream sequence of the request,
+// as it is published again, if the request is redelivered after its acknowledgement got lost.
+func (q *workQueue) publishResult(msg jetstream.Msg, meta *jetstream.MsgMetadata, params RequestParams, text []byte, header http.Header) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result := nats.NewMsg(q.conf.WorkQueueResultSubject)
+	result.Header = nats.Header(header)
+	q.addRequestHeaders(result.Header, msg, meta)
+	result.Header.Set(urlHeader, params.Url)
+	result.Header.Set(nats.MsgIdHdr, fmt.Sprintf("%s-%d", meta.Stream, meta.Sequence.Stream))
+	if q.results != nil {
+		name := fmt.Sprintf("%s-%d", meta.Stream, meta.Sequence.Stream)
+		if _, err := q.results.PutBytes(ctx, name, text); err != nil {
+			return fmt.Errorf("saving work-queue result: %w", err)
+		}
+		result.Header.Set(resultObjectHeader, name)
+	} else {
+		result.Data = text
+	}
+	if size := messageSize(result); q.maxPayload > 0 && size > q.maxPayload {
+		return fmt.Errorf("%w: %d bytes of text and headers, %d allowed; set TES_WORK_QUEUE_RESULT_BUCKET to save the text in an object store",
+			errResultTooLarge, size, q.maxPayload)
+	}
+	if err := q.publish(ctx, result); err != nil {
+		return fmt.Errorf("publishing work-queue result: %w", err)
+	}
+	return nil
+}
+
+// messageSize returns the size of the payload and headers of msg, as counted against the max payload
+func messageSize(msg *nats.Msg) int64 {
+	// NATS/1.0 line and the blank line ending the headers
+	size := int64(len(msg.Data) + len("NATS/1.0\r\n\r\n"))
+	for k, values := range msg.Header {
+		for _, v := range values {
+			size += int64(len(k) + len(": \r\n") + len(v))
+		}
+	}
+	return size
+}
+
+// deadLetter publishes the request with the reason of its failure to the dead-letter subject and terminates it.
+// If that fails, it is redelivered or, after its last delivery, announced by an advisory.
+func (q *workQueue) deadLetter(msg jetstream.Msg, meta *jetstream.MsgMetadata, cause error) {
+	q.e.log.Error("Dead-lettering work-queue request", "seq", meta.Sequence.Stream, "deliveries", meta.NumDelivered, "err", cause)
+	header := nats.Header{}
+	for k, v := range msg.Headers() {
+		header[k] = v
+	}
+	q.addRequestHeaders(header, msg, meta)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := q.publishDeadLetter(ctx, header, msg.Data(), meta.NumDelivered, cause); err != nil {
+		q.e.log.Error("Publishing dead letter failed", "seq", meta.Sequence.Stream, "err", err)
+		_ = msg.Nak()
+		return
+	}
+	_ = msg.TermWithReason(cause.Error())
+}
+
+// deadLetterExceeded dead-letters the request announced by a max deliveries advisory and deletes it from the stream
+func (q *workQueue) deadLetterExceeded(stream jetstream.Stream, advisory []byte) {
+	var event struct {
+		StreamSeq  uint64 `json:"stream_seq"`
+		Deliveries uint64 `json:"deliveries"`
+	}
+	if err := json.Unmarshal(advisory, &event); err != nil {
+		q.e.log.Error("Invalid max deliveries advisory", "err", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	msg, err := stream.GetMsg(ctx, event.StreamSeq)
+	if err != nil {
+		// dead-lettered or acknowledged already
+		return
+	}
+	header := msg.Header
+	if header == nil {
+		header = nats.Header{}
+	}
+	header.Set(requestSeqHeader, strconv.FormatUint(event.StreamSeq, 10))
+	if id := header.Get(nats.MsgIdHdr); id != "" {
+		header.Set(requestIdHeader, id)
+		header.Del(nats.MsgIdHdr)
+	}
+	q.e.log.Error("Dead-lettering work-queue request", "seq", event.StreamSeq, "deliveries", event.Deliveries, "err", "not acknowledged in time")
+	if err := q.publishDeadLetter(ctx, header, msg.Data, event.Deliveries, errors.New("maximum deliveries exceeded")); err != nil {
+		q.e.log.Error("Publishing dead letter failed", "seq", event.StreamSeq, "err", err)
+		return
+	}
+	_ = stream.DeleteMsg(ctx, event.StreamSeq)
+}
+
+func (q *workQueue) publishDeadLetter(ctx context.Context, header nats.Header, data []byte, deliveries uint64, cause error) error {
+	dead := nats.NewMsg(q.conf.WorkQueueDeadLetterSubject)
+	dead.Header = header
+	dead.Header.Set(errorHeader, cause.Error())
+	dead.Header.Set(deliveriesHeader, strconv.FormatUint(deliveries, 10))
+	dead.Data = data
+	return q.publish(ctx, dead)
+}
+
+// addRequestHeaders adds the sequence and ID of the request, which callers use to correlate results and requests.
+// The ID is moved, as the stream would drop messages with the ID of another one as duplicates.
+func (q *workQueue) addRequestHeaders(header nats.Header, msg jetstream.Msg, meta *jetstream.MsgMetadata) {
+	header.Set(requestSeqHeader, strconv.FormatUint(meta.Sequence.Stream, 10))
+	header.Del(nats.MsgIdHdr)
+	if id := msg.Headers().Get(nats.MsgIdHdr); id != "" {
+		header.Set(requestIdHeader, id)
+	}
+}
@@ -0,0 +1,111 @@
+package extractor
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/johbar/text-extraction-service/v4/internal/cache"
+	"github.com/johbar/text-extraction-service/v4/internal/config"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// fakeMsg records how a work-queue request was settled
+type fakeMsg struct {
+	data                 []byte
+	header               nats.Header
+	meta                 jetstream.MsgMetadata
+	acked, naked, termed bool
+	inProgress           atomic.Int32
+	delay                time.Duration
+}
+
+func (m *fakeMsg) Metadata() (*jetstream.MsgMetadata, error) { return &m.meta, nil }
+func (m *fakeMsg) Data() []byte                              { return m.data }
+func (m *fakeMsg) Headers() nats.Header                      { return m.header }
+func (m *fakeMsg) Subject() string                           { return "tes.extract" }
+func (m *fakeMsg) Reply() string                             { return "" }
+func (m *fakeMsg) Ack() error                                { m.acked = true; return nil }
+func (m *fakeMsg) DoubleAck(context.Context) error           { m.acked = true; return nil }
+func (m *fakeMsg) Nak() error                                { m.naked = true; return nil }
+func (m *fakeMsg) NakWithDelay(delay time.Duration) error    { m.naked, m.delay = true, delay; return nil }
+func (m *fakeMsg) InProgress() error                         { m.inProgress.Add(1); return nil }
+func (m *fakeMsg) Term() error                               { m.termed = true; return nil }
+func (m *fakeMsg) TermWithReason(string) error               { m.termed = true; return nil }
+
+func TestWorkQueue(t *testing.T) {
+	f := newFixture(t, &cache.NopCache{}, func(conf *config.TesConfig) {
+		conf.WorkQueueMaxDeliver = 2
+		conf.WorkQueueAckWait = 200 * time.Millisecond
+	}, func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Path == "/broken" {
+			http.Error(w, "broken", http.StatusInternalServerError)
+			return true
+		}
+		// long enough for the ack wait to be extended
+		time.Sleep(300 * time.Millisecond)
+		return false
+	})
+	extract, origin, conf := f.extract, f.origin, f.extract.tesConfig
+	var want strings.Builder
+	if _, err := extract.DocFromUrl(RequestParams{Url: origin.URL + "/readme.rtf"}, &want, http.Header{}); err != nil {
+		t.Fatal(err)
+	}
+	var published []*nats.Msg
+	q := &workQueue{e: extract, conf: conf.WorkQueueConfig, publish: func(_ context.Context, msg *nats.Msg) error {
+		published = append(published, msg)
+		return nil
+	}}
+	request := func(data string, delivery uint64) *fakeMsg {
+		msg := &fakeMsg{data: []byte(data), header: nats.Header{nats.MsgIdHdr: {"doc-1"}}}
+		msg.meta.Stream, msg.meta.Sequence.Stream, msg.meta.NumDelivered = "WORK", 7, delivery
+		published = nil
+		q.process(msg)
+		return msg
+	}
+
+	msg := request(`{"url":"`+origin.URL+`/readme.rtf"}`, 1)
+	if !msg.acked || msg.inProgress.Load() == 0 || len(published) != 1 {
+		t.Fatalf("acked %v, in progress %d, published %d", msg.acked, msg.inProgress.Load(), len(published))
+	}
+	result := published[0]
+	if result.Subject != conf.WorkQueueResultSubject || string(result.Data) != want.String() {
+		t.Errorf("result on %s: %q", result.Subject, result.Data)
+	}
+	if result.Header.Get(urlHeader) != origin.URL+"/readme.rtf" || result.Header.Get(requestSeqHeader) != "7" ||
+		result.Header.Get(requestIdHeader) != "doc-1" || result.Header.Get(nats.MsgIdHdr) != "WORK-7" ||
+		result.Header.Get("X-Document-Sha256") == "" {
+		t.Errorf("result headers %v", result.Header)
+	}
+
+	for _, data := range []string{`{"url":`, `{"url":"file:///etc/passwd"}`} {
+		msg = request(data, 1)
+		if !msg.termed || len(published) != 1 || published[0].Subject != conf.WorkQueueDeadLetterSubject ||
+			string(published[0].Data) != data || published[0].Header.Get(errorHeader) == "" {
+			t.Errorf("invalid request %s: termed %v, published %v", data, msg.termed, published)
+		}
+	}
+
+	// results exceeding the max payload fail right away
+	q.maxPayload = int64(len(want.String()))
+	msg = request(`{"url":"`+origin.URL+`/readme.rtf"}`, 1)
+	if !msg.termed || msg.acked || len(published) != 1 || published[0].Subject != conf.WorkQueueDeadLetterSubject ||
+		!strings.Contains(published[0].Header.Get(errorHeader), "max payload") {
+		t.Errorf("result too large: termed %v, acked %v, published %v", msg.termed, msg.acked, published)
+	}
+	q.maxPayload = 0
+
+	msg = request(`{"url":"`+origin.URL+`/broken"}`, 1)
+	if !msg.naked || msg.delay != workQueueRetryDelay || msg.acked || msg.termed || len(published) != 0 {
+		t.Errorf("failed request: naked %v after %v, acked %v, termed %v, published %d", msg.naked, msg.delay, msg.acked, msg.termed, len(published))
+	}
+	msg = request(`{"url":"`+origin.URL+`/broken"}`, 2)
+	if !msg.termed || len(published) != 1 || published[0].Subject != conf.WorkQueueDeadLetterSubject ||
+		published[0].Header.Get(deliveriesHeader) != "2" || published[0].Header.Get(requestIdHeader) != "doc-1" {
+		t.Errorf("request failed on last delivery: termed %v, published %v", msg.termed, published)
+	}
+}
@@ -0,0 +1,486 @@
+package fetcher
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"encoding/json/v2"
+)
+
+// maxRetryAfter limits the delay origins may request with a Retry-After header. Responses requesting
+// a longer one are returned as they are.
+const maxRetryAfter = 30 * time.Second
+
+// Options of the client returned by [NewClient]. Profiles may override the timeouts and retries.
+type Options struct {
+	// Guard checks the hosts and addresses fetched
+	Guard *Guard
+	// MaxRedirects is the number of redirects followed
+	MaxRedirects       int
+	DisableCompression bool
+	// ConnectTimeout limits connecting, ResponseTimeout waiting for the response headers
+	// and BodyTimeout reading the body. Zero means unlimited.
+	ConnectTimeout  time.Duration
+	ResponseTimeout time.Duration
+	BodyTimeout     time.Duration
+	// Retries is the number of times GET and HEAD requests are retried on status 429 and 503,
+	// after RetryDelay, doubled for every further retry, or the delay requested by Retry-After
+	Retries    int
+	RetryDelay time.Duration
+	// FileRoots are the directories file:// URLs may point into. file:// URLs are not supported if there are none.
+	FileRoots []string
+	// S3 locates the object store of s3:// URLs, which are not supported if it is nil
+	S3 *S3Options
+	// Sources fetch the URLs of further schemes
+	Sources map[string]Source
+}
+
+// Profile is an entry of the profiles file, which configures the requests to some hosts
+type Profile struct {
+	// Hosts are host names, "*.domain"s, IP addresses and CIDR ranges like the entries of the allow list of a [Guard],
+	// or "*" for all hosts
+	Hosts []string `json:"hosts"`
+	// Username and Password for basic authentication
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// BearerToken is sent in the Authorization header
+	BearerToken string            `json:"bearerToken,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	UserAgent   string            `json:"userAgent,omitempty"`
+	// CaFile is a PEM bundle of CA certificates trusted besides the system's
+	CaFile string `json:"caFile,omitempty"`
+	// CertFile and KeyFile hold the PEM encoded client certificate and key for mutual TLS
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+	// Proxy is the URL of an HTTP(S) proxy, which may contain credentials
+	Proxy string `json:"proxy,omitempty"`
+	// ConnectTimeout, ResponseTimeout and BodyTimeout are durations like "30s", overriding those of the [Options]
+	ConnectTimeout  string `json:"connectTimeout,omitempty"`
+	ResponseTimeout string `json:"responseTimeout,omitempty"`
+	BodyTimeout     string `json:"bodyTimeout,omitempty"`
+	// Retries overrides those of the [Options]
+	Retries *int `json:"retries,omitempty"`
+	// PrivateKeyFile holds the PEM encoded SSH key for SFTP, which is authenticated with it or the password
+	PrivateKeyFile string `json:"privateKeyFile,omitempty"`
+	// KnownHostsFile lists the SSH host keys of SFTP servers in OpenSSH's known_hosts format. It is required for SFTP.
+	KnownHostsFile string `json:"knownHostsFile,omitempty"`
+	// Roots are the absolute directories sftp:// URLs may point into. They are required for SFTP.
+	Roots []string `json:"roots,omitempty"`
+}
+
+// profile is a parsed Profile
+type profile struct {
+	Profile
+	hosts     rules
+	any       bool
+	transport *http.Transport
+	proxied   bool
+	// dial connects to the hosts directly, e.g. for SFTP
+	dial        func(ctx context.Context, network, address string) (net.Conn, error)
+	bodyTimeout time.Duration
+	retries     int
+}
+
+// transport applies the first profile matching the host of a request, or the options, if there is none.
+// URLs of other schemes than http and https are fetched by the sources.
+type transport struct {
+	guard      *Guard
+	profiles   []*profile
+	fallback   *profile
+	retryDelay time.Duration
+	sources    map[string]http.RoundTripper
+}
+
+// NewClient returns a client for fetching documents configured by opts and the profiles in profilesFile, if not empty.
+// Credentials and headers of a profile are sent to its hosts only, also when following redirects.
+func NewClient(profilesFile string, opts Options) (*http.Client, error) {
+	if opts.Guard == nil {
+		var err error
+		if opts.Guard, err = NewGuard("", "", true); err != nil {
+			return nil, err
+		}
+	}
+	t := &transport{guard: opts.Guard, retryDelay: opts.RetryDelay}
+	var err error
+	if t.fallback, err = newProfile(Profile{}, opts); err != nil {
+		return nil, err
+	}
+	if profilesFile != "" {
+		data, err := os.ReadFile(profilesFile)
+		if err != nil {
+			return nil, err
+		}
+		var file struct {
+			Profiles []Profile `json:"profiles"`
+		}
+		if err := json.Unmarshal(data, &file); err != nil {
+			return nil, fmt.Errorf("parsing profiles file: %w", err)
+		}
+		for i, p := range file.Profiles {
+			parsed, err := newProfile(p, opts)
+			if err != nil {
+				return nil, fmt.Errorf("profile %d %v: %w", i+1, p.Hosts, err)
+			}
+			t.profiles = append(t.profiles, parsed)
+		}
+	}
+	if err := t.addSources(opts); err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: t, CheckRedirect: opts.Guard.CheckRedirect(opts.MaxRedirects)}, nil
+}
+
+// NewGuardedClient returns a client for sending requests to URLs chosen by clients, e.g. callbacks.
+// It is guarded and times out like one returned by [NewClient], but applies no profiles and doesn't retry.
+func NewGuardedClient(opts Options) (*http.Client, error) {
+	if opts.Guard == nil {
+		var err error
+		if opts.Guard, err = NewGuard("", "", true); err != nil {
+			return nil, err
+		}
+	}
+	p, err := newProfile(Profile{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: p.transport, CheckRedirect: opts.Guard.CheckRedirect(opts.MaxRedirects)}, nil
+}
+
+// addSources adds the sources of the schemes supported besides http and https
+func (t *transport) addSources(opts Options) error {
+	t.sources = map[string]http.RoundTripper{
+		"sftp": sourceTransport{sftpSource{t}},
+		// WebDAV is fetched with plain GET requests
+		"webdav":  schemeTransport{t, "http"},
+		"webdavs": schemeTransport{t, "https"},
+	}
+	if len(opts.FileRoots) > 0 {
+		files, err := newFileSource(opts.FileRoots)
+		if err != nil {
+			return fmt.Errorf("file roots: %w", err)
+		}
+		t.sources["file"] = sourceTransport{files}
+	}
+	if opts.S3 != nil {
+		endpoint, err := url.Parse(opts.S3.Endpoint)
+		if err != nil {
+			return fmt.Errorf("invalid S3 endpoint: %q", opts.S3.Endpoint)
+		}
+		// the object store is trusted and signs requests itself, so only the TLS settings, proxy and timeouts
+		// of the profile of its host apply
+		p := t.profile(endpoint.Hostname()).Profile
+		p.Username, p.Password, p.BearerToken, p.Headers = "", "", "", nil
+		unguarded := opts
+		unguarded.Guard = &Guard{allowPrivate: true, resolver: net.DefaultResolver}
+		s3Profile, err := newProfile(p, unguarded)
+		if err != nil {
+			return err
+		}
+		s3, err := newS3Source(*opts.S3, s3Profile.send)
+		if err != nil {
+			return err
+		}
+		t.sources["s3"] = retryTransport{s3, s3Profile.retries, t.retryDelay}
+	}
+	for scheme, source := range opts.Sources {
+		t.sources[scheme] = sourceTransport{source}
+	}
+	return nil
+}
+
+// Supported reports whether the URL rawUrl can be fetched with client, a client returned by [NewClient] or another one,
+// which supports http and https only
+func Supported(client *http.Client, rawUrl string) bool {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return false
+	}
+	if (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" {
+		return true
+	}
+	t, ok := client.Transport.(*transport)
+	return ok && t.sources[u.Scheme] != nil
+}
+
+// Permitted returns an error wrapping [ErrForbidden] if the guard of client, a client returned by [NewClient],
+// forbids fetching rawUrl judging by its host. It checks URLs whose content is served without fetching them,
+// e.g. from a cache, as their addresses are only checked when they are fetched.
+func Permitted(client *http.Client, rawUrl string) error {
+	t, ok := client.Transport.(*transport)
+	if !ok {
+		return nil
+	}
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "http", "https", "sftp", "webdav", "webdavs":
+		return t.guard.checkName(u.Hostname())
+	}
+	// the other sources are trusted
+	return nil
+}
+
+// schemeTransport fetches URLs with the scheme replaced, e.g. webdav:// with http://
+type schemeTransport struct {
+	t      *transport
+	scheme string
+}
+
+func (s schemeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	out := req.Clone(req.Context())
+	out.URL.Scheme = s.scheme
+	response, err := s.t.RoundTrip(out)
+	if err == nil {
+		response.Request = req
+	}
+	return response, err
+}
+
+func newProfile(p Profile, opts Options) (*profile, error) {
+	parsed := &profile{Profile: p, any: slices.Contains(p.Hosts, "*"), bodyTimeout: opts.BodyTimeout, retries: opts.Retries}
+	var err error
+	if parsed.hosts, err = parseRules(strings.Join(p.Hosts, ",")); err != nil {
+		return nil, err
+	}
+	connectTimeout, responseTimeout := opts.ConnectTimeout, opts.ResponseTimeout
+	for _, d := range []struct {
+		value  string
+		target *time.Duration
+	}{{p.ConnectTimeout, &connectTimeout}, {p.ResponseTimeout, &responseTimeout}, {p.BodyTimeout, &parsed.bodyTimeout}} {
+		if d.value == "" {
+			continue
+		}
+		if *d.target, err = time.ParseDuration(d.value); err != nil || *d.target < 0 {
+			return nil, fmt.Errorf("invalid timeout %q", d.value)
+		}
+	}
+	if p.Retries != nil {
+		parsed.retries = max(*p.Retries, 0)
+	}
+
+	dialer := &net.Dialer{Timeout: connectTimeout, KeepAlive: 30 * time.Second}
+	parsed.dial = opts.Guard.DialContext(dialer)
+	parsed.transport = &http.Transport{
+		DialContext:           parsed.dial,
+		DisableCompression:    opts.DisableCompression,
+		MaxIdleConnsPerHost:   100,
+		IdleConnTimeout:       90 * time.Second,
+		ResponseHeaderTimeout: responseTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ForceAttemptHTTP2:     true,
+	}
+	if p.Proxy != "" {
+		proxy, err := url.Parse(p.Proxy)
+		if err != nil || proxy.Host == "" {
+			return nil, fmt.Errorf("invalid proxy %q", p.Proxy)
+		}
+		// the proxy is trusted, the hosts and their addresses are checked before sending requests through it
+		parsed.transport.Proxy = http.ProxyURL(proxy)
+		parsed.transport.DialContext = dialer.DialContext
+		parsed.proxied = true
+	}
+	if p.CaFile != "" || p.CertFile != "" || p.KeyFile != "" {
+		tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+		if p.CaFile != "" {
+			pem, err := os.ReadFile(p.CaFile)
+			if err != nil {
+				return nil, err
+			}
+			if tlsConfig.RootCAs, err = x509.SystemCertPool(); err != nil {
+				tlsConfig.RootCAs = x509.NewCertPool()
+			}
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in %s", p.CaFile)
+			}
+		}
+		if p.CertFile != "" || p.KeyFile != "" {
+			cert, err := tls.LoadX509KeyPair(p.CertFile, p.KeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("loading client certificate: %w", err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		parsed.transport.TLSClientConfig = tlsConfig
+	}
+	return parsed, nil
+}
+
+func (p *profile) matches(host string) bool {
+	if p.any || p.hosts.matchHost(host) {
+		return true
+	}
+	addr, err := netip.ParseAddr(host)
+	return err == nil && p.hosts.matchAddr(addr.Unmap())
+}
+
+// profile returns the profile applying to host
+func (t *transport) profile(host string) *profile {
+	for _, p := range t.profiles {
+		if p.matches(host) {
+			return p
+		}
+	}
+	return t.fallback
+}
+
+// RoundTrip sends req with the credentials and headers of its profile, retrying on status 429 and 503
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		source, ok := t.sources[req.URL.Scheme]
+		if !ok {
+			return nil, fmt.Errorf("unsupported URL scheme %q", req.URL.Scheme)
+		}
+		return source.RoundTrip(req)
+	}
+	host := req.URL.Hostname()
+	p := t.profile(host)
+	if p.proxied {
+		// the proxy connects to the host, so its addresses are checked before
+		if err := t.guard.checkResolved(req.Context(), host); err != nil {
+			return nil, err
+		}
+	}
+	return retryTransport{roundTripperFunc(p.send), p.retries, t.retryDelay}.RoundTrip(req)
+}
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+// retryTransport retries GET and HEAD requests on status 429 and 503
+type retryTransport struct {
+	next    http.RoundTripper
+	retries int
+	delay   time.Duration
+}
+
+func (t retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	retries := t.retries
+	if (req.Method != http.MethodGet && req.Method != http.MethodHead) || (req.Body != nil && req.GetBody == nil) {
+		retries = 0
+	}
+	delay := t.delay
+	for attempt := 0; ; attempt++ {
+		response, err := t.next.RoundTrip(req)
+		if err != nil || attempt >= retries ||
+			(response.StatusCode != http.StatusTooManyRequests && response.StatusCode != http.StatusServiceUnavailable) {
+			return response, err
+		}
+		wait := delay
+		if retryAfter, ok := ParseRetryAfter(response.Header.Get("Retry-After"), time.Now()); ok {
+			if retryAfter > maxRetryAfter {
+				return response, nil
+			}
+			wait = retryAfter
+		}
+		_, _ = io.Copy(io.Discard, io.LimitReader(response.Body, 4096))
+		response.Body.Close()
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(wait):
+		}
+		delay *= 2
+	}
+}
+
+// send sends a copy of req with the credentials and headers of p once
+func (p *profile) send(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	out := req.Clone(ctx)
+	if req.Body != nil && req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		out.Body = body
+	}
+	for name, value := range p.Headers {
+		out.Header.Set(name, value)
+	}
+	if p.UserAgent != "" {
+		out.Header.Set("User-Agent", p.UserAgent)
+	}
+	if p.Username != "" || p.Password != "" {
+		out.SetBasicAuth(p.Username, p.Password)
+	}
+	if p.BearerToken != "" {
+		out.Header.Set("Authorization", "Bearer "+p.BearerToken)
+	}
+	response, err := p.transport.RoundTrip(out)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	body := &timedBody{ReadCloser: response.Body, cancel: cancel, timeout: p.bodyTimeout}
+	if p.bodyTimeout > 0 {
+		body.timer = time.AfterFunc(p.bodyTimeout, body.expire)
+	}
+	response.Body = body
+	return response, nil
+}
+
+// ParseRetryAfter returns the delay requested by the value of a Retry-After header, seconds or a date
+func ParseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(max(seconds, 0)) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(date.Sub(now), 0), true
+	}
+	return 0, false
+}
+
+// errBodyTimeout is returned when reading a response body takes longer than the body timeout
+var errBodyTimeout = errors.New("timeout reading the response body")
+
+// timedBody cancels its request when it is closed or, if there is a timer, when the timeout expires
+type timedBody struct {
+	io.ReadCloser
+	cancel  context.CancelFunc
+	timer   *time.Timer
+	timeout time.Duration
+	expired atomic.Bool
+}
+
+func (b *timedBody) expire() {
+	b.expired.Store(true)
+	b.cancel()
+}
+
+func (b *timedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF && b.expired.Load() {
+		return n, fmt.Errorf("%w after %s: %w", errBodyTimeout, b.timeout, err)
+	}
+	return n, err
+}
+
+func (b *timedBody) Close() error {
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,305 @@
+package fetcher
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"encoding/json/v2"
+)
+
+func writeProfiles(t *testing.T, profiles ...Profile) string {
+	t.Helper()
+	data, err := json.Marshal(map[string]any{"profiles": profiles})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "profiles.json")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func writePem(t *testing.T, name, blockType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestProfiles(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "http://"+strings.Replace(r.Host, "127.0.0.1", "localhost", 1)+"/", http.StatusFound)
+			return
+		}
+		user, password, _ := r.BasicAuth()
+		io.WriteString(w, strings.Join([]string{user, password, r.Header.Get("X-Tenant"), r.UserAgent()}, ","))
+	}))
+	t.Cleanup(srv.Close)
+	client, err := NewClient(writeProfiles(t,
+		Profile{Hosts: []string{"127.0.0.0/8"}, Username: "user", Password: "secret", Headers: map[string]string{"X-Tenant": "a"}, UserAgent: "tes"},
+	), Options{MaxRedirects: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(url string) string {
+		t.Helper()
+		response, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		body, _ := io.ReadAll(response.Body)
+		return string(body)
+	}
+	if got := get(srv.URL); got != "user,secret,a,tes" {
+		t.Errorf("profile not applied: %s", got)
+	}
+	// credentials are not sent to other hosts
+	if got := get(srv.URL + "/redirect"); strings.Contains(got, "secret") || strings.HasSuffix(got, ",tes") {
+		t.Errorf("profile applied after redirect to other host: %s", got)
+	}
+
+	for name, p := range map[string]Profile{
+		"timeout": {Hosts: []string{"*"}, BodyTimeout: "soon"},
+		"proxy":   {Hosts: []string{"*"}, Proxy: "proxy:3128"},
+		"ca":      {Hosts: []string{"*"}, CaFile: filepath.Join(t.TempDir(), "missing.pem")},
+		"hosts":   {Hosts: []string{"10.0.0.0/33"}},
+	} {
+		if _, err := NewClient(writeProfiles(t, p), Options{}); err == nil {
+			t.Errorf("%s: invalid profile accepted", name)
+		}
+	}
+}
+
+func TestRetries(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := requests.Add(1)
+		switch {
+		case r.URL.Path == "/later":
+			w.Header().Set("Retry-After", "3600")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case n == 1:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case n == 2:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			io.WriteString(w, "ok")
+		}
+	}))
+	t.Cleanup(srv.Close)
+	client, err := NewClient("", Options{Retries: 2, RetryDelay: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := client.Get(srv.URL)
+	if err != nil || response.StatusCode != http.StatusOK || requests.Load() != 3 {
+		t.Fatalf("got %v after %d requests", err, requests.Load())
+	}
+	response.Body.Close()
+
+	// a longer delay than maxRetryAfter is not waited for
+	requests.Store(10)
+	if response, err = client.Get(srv.URL + "/later"); err != nil || response.StatusCode != http.StatusServiceUnavailable || requests.Load() != 11 {
+		t.Errorf("got %v after %d requests", err, requests.Load()-10)
+	}
+	response.Body.Close()
+
+	// other methods are not retried
+	requests.Store(0)
+	if response, err = client.Post(srv.URL, "text/plain", strings.NewReader("body")); err != nil || response.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("POST: got %v", err)
+	}
+	response.Body.Close()
+
+	if d, ok := ParseRetryAfter("Wed, 21 Oct 2026 07:28:30 GMT", time.Date(2026, 10, 21, 7, 28, 0, 0, time.UTC)); !ok || d != 30*time.Second {
+		t.Errorf("date: got %v", d)
+	}
+}
+
+func TestGuardedClient(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(srv.Close)
+	client, err := NewGuardedClient(Options{Retries: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := client.Get(srv.URL)
+	if err != nil || requests.Load() != 1 {
+		t.Fatalf("got %v after %d requests", err, requests.Load())
+	}
+	response.Body.Close()
+
+	guard, _ := NewGuard("", "", false)
+	if client, err = NewGuardedClient(Options{Guard: guard}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Get(srv.URL); !errors.Is(err, ErrForbidden) {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestPermitted(t *testing.T) {
+	guard, err := NewGuard("docs.example.com, *.intranet", "secret.intranet", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClient("", Options{Guard: guard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rawUrl, forbidden := range map[string]bool{
+		"https://docs.example.com/a.pdf": false,
+		"webdav://files.intranet/a.pdf":  false,
+		"http://secret.intranet/a.pdf":   true,
+		"sftp://secret.intranet/a.pdf":   true,
+		"https://other.com/a.pdf":        true,
+		"http://127.0.0.1/a.pdf":         true,
+		"s3://secret.intranet/a.pdf":     false,
+	} {
+		if err := Permitted(client, rawUrl); forbidden != errors.Is(err, ErrForbidden) {
+			t.Errorf("%s: got %v", rawUrl, err)
+		}
+	}
+	// host names may resolve to allowed addresses, which are checked when fetching
+	if guard, err = NewGuard("10.0.0.0/8", "", false); err != nil {
+		t.Fatal(err)
+	}
+	if client, err = NewClient("", Options{Guard: guard}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Permitted(client, "https://other.com/a.pdf"); err != nil {
+		t.Errorf("got %v", err)
+	}
+	if err := Permitted(http.DefaultClient, "http://127.0.0.1/a.pdf"); err != nil {
+		t.Errorf("unguarded client: got %v", err)
+	}
+}
+
+func TestBodyTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "slow")
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	t.Cleanup(srv.Close)
+	client, err := NewClient(writeProfiles(t, Profile{Hosts: []string{"127.0.0.1"}, BodyTimeout: "50ms"}), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if _, err := io.ReadAll(response.Body); !errors.Is(err, errBodyTimeout) {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestMutualTls(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalPKCS8PrivateKey(key)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	caFile := writePem(t, "ca.pem", "CERTIFICATE", srv.Certificate().Raw)
+	client, err := NewClient(writeProfiles(t, Profile{
+		Hosts:    []string{"127.0.0.1"},
+		CaFile:   caFile,
+		CertFile: writePem(t, "cert.pem", "CERTIFICATE", der),
+		KeyFile:  writePem(t, "key.pem", "PRIVATE KEY", keyDer),
+	}), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	// without the client certificate
+	client, _ = NewClient(writeProfiles(t, Profile{Hosts: []string{"127.0.0.1"}, CaFile: caFile}), Options{})
+	if response, err := client.Get(srv.URL); err == nil {
+		response.Body.Close()
+		t.Error("connected without client certificate")
+	}
+}
+
+func TestProxy(t *testing.T) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.String())
+	}))
+	t.Cleanup(proxy.Close)
+	profiles := writeProfiles(t, Profile{Hosts: []string{"*"}, Proxy: proxy.URL})
+	guard, _ := NewGuard("*.intranet.invalid", "", false)
+	client, err := NewClient(profiles, Options{Guard: guard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := client.Get("http://docs.intranet.invalid/a.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if body, _ := io.ReadAll(response.Body); string(body) != "http://docs.intranet.invalid/a.pdf" {
+		t.Errorf("proxy got %s", body)
+	}
+
+	// hosts and their addresses are checked, though the proxy connects
+	guard, _ = NewGuard("", "", false)
+	if client, err = NewClient(profiles, Options{Guard: guard}); err != nil {
+		t.Fatal(err)
+	}
+	for _, forbidden := range []string{"http://10.1.2.3/a.pdf", "http://localhost/a.pdf", "http://docs.intranet.invalid/a.pdf"} {
+		if _, err := client.Get(forbidden); !errors.Is(err, ErrForbidden) {
+			t.Errorf("%s: got %v", forbidden, err)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+// Package fetcher provides the HTTP client remote documents are fetched with, configured per host
+// and guarded against server-side request forgery.
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ErrForbidden is returned when a URL's host or address may not be fetched
+var ErrForbidden = errors.New("forbidden destination")
+
+// internal holds the address ranges that are not reachable from the internet, apart from those
+// covered by the methods of netip.Addr, like loopback, private and link-local addresses
+var internal = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),       // this network
+	netip.MustParsePrefix("100.64.0.0/10"),   // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),    // IETF protocol assignments
+	netip.MustParsePrefix("192.0.2.0/24"),    // documentation
+	netip.MustParsePrefix("198.18.0.0/15"),   // benchmarking
+	netip.MustParsePrefix("198.51.100.0/24"), // documentation
+	netip.MustParsePrefix("203.0.113.0/24"),  // documentation
+	netip.MustParsePrefix("240.0.0.0/4"),     // reserved, including broadcast
+	netip.MustParsePrefix("64:ff9b::/96"),    // NAT64, which may embed internal IPv4 addresses
+	netip.MustParsePrefix("64:ff9b:1::/48"),  // local-use NAT64
+	netip.MustParsePrefix("100::/64"),        // discard-only
+	netip.MustParsePrefix("2001::/23"),       // IETF protocol assignments, including Teredo
+	netip.MustParsePrefix("2001:db8::/32"),   // documentation
+	netip.MustParsePrefix("2002::/16"),       // 6to4, which may embed internal IPv4 addresses
+	netip.MustParsePrefix("fec0::/10"),       // deprecated site-local
+}
+
+// Guard decides which hosts and addresses may be fetched. Entries of the allow and deny lists are
+// host names, matching the host itself, host names starting with "*." or ".", matching all subdomains,
+// IP addresses and CIDR ranges.
+//
+// Denied hosts and addresses are never fetched. If there are allowed ones, nothing else is fetched.
+// Otherwise internal addresses, e.g. loopback, private and link-local ones, are not fetched, unless
+// allowPrivate is set or they are allowed explicitly.
+type Guard struct {
+	allow        rules
+	deny         rules
+	allowPrivate bool
+	resolver     *net.Resolver
+}
+
+type rules struct {
+	hosts    []string
+	suffixes []string
+	prefixes []netip.Prefix
+}
+
+// NewGuard returns a Guard with the comma separated allow and deny lists
+func NewGuard(allow, deny string, allowPrivate bool) (*Guard, error) {
+	g := &Guard{allowPrivate: allowPrivate, resolver: net.DefaultResolver}
+	var err error
+	if g.allow, err = parseRules(allow); err != nil {
+		return nil, fmt.Errorf("parsing allow list: %w", err)
+	}
+	if g.deny, err = parseRules(deny); err != nil {
+		return nil, fmt.Errorf("parsing deny list: %w", err)
+	}
+	return g, nil
+}
+
+func parseRules(list string) (rules, error) {
+	var r rules
+	for entry := range strings.SplitSeq(list, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch {
+		case entry == "":
+		case strings.Contains(entry, "/"):
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return r, err
+			}
+			r.prefixes = append(r.prefixes, prefix.Masked())
+		case strings.HasPrefix(entry, "*.") || strings.HasPrefix(entry, "."):
+			r.suffixes = append(r.suffixes, "."+strings.TrimLeft(entry, "*."))
+		default:
+			if addr, err := netip.ParseAddr(strings.Trim(entry, "[]")); err == nil {
+				r.prefixes = append(r.prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+				continue
+			}
+			r.hosts = append(r.hosts, strings.TrimSuffix(entry, "."))
+		}
+	}
+	return r, nil
+}
+
+func (r rules) empty() bool {
+	return len(r.hosts) == 0 && len(r.suffixes) == 0 && len(r.prefixes) == 0
+}
+
+func (r rules) matchHost(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, h := range r.hosts {
+		if host == h {
+			return true
+		}
+	}
+	for _, suffix := range r.suffixes {
+		if strings.HasSuffix(host, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r rules) matchAddr(addr netip.Addr) bool {
+	for _, prefix := range r.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// isInternal reports whether addr is not reachable from the internet
+func isInternal(addr netip.Addr) bool {
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() || addr.IsUnspecified() {
+		return true
+	}
+	for _, prefix := range internal {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkHost returns an error if host may not be fetched, whatever its addresses are.
+// It reports whether host is allowed explicitly.
+func (g *Guard) checkHost(host string) (allowed bool, err error) {
+	if g.deny.matchHost(host) {
+		return false, fmt.Errorf("%w: host %s is denied", ErrForbidden, host)
+	}
+	return g.allow.matchHost(host), nil
+}
+
+// checkAddr returns an error if addr, an address of host, may not be fetched
+func (g *Guard) checkAddr(host string, addr netip.Addr, hostAllowed bool) error {
+	addr = addr.Unmap()
+	switch {
+	case g.deny.matchAddr(addr):
+		return fmt.Errorf("%w: address %s of %s is denied", ErrForbidden, addr, host)
+	case hostAllowed || g.allow.matchAddr(addr):
+		return nil
+	case !g.allow.empty():
+		return fmt.Errorf("%w: %s (%s) is not allowed", ErrForbidden, host, addr)
+	case isInternal(addr) && !g.allowPrivate:
+		return fmt.Errorf("%w: address %s of %s is internal", ErrForbidden, addr, host)
+	}
+	return nil
+}
+
+// checkName returns an error if host may not be fetched judging by its name, or its address if it is one.
+// Host names allowed by none of the lists may still resolve to allowed addresses.
+func (g *Guard) checkName(host string) error {
+	hostAllowed, err := g.checkHost(host)
+	if err != nil {
+		return err
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return g.checkAddr(host, addr, hostAllowed)
+	}
+	if !hostAllowed && !g.allow.empty() && len(g.allow.prefixes) == 0 {
+		return fmt.Errorf("%w: %s is not allowed", ErrForbidden, host)
+	}
+	return nil
+}
+
+// checkResolved returns an error if host or any of its addresses may not be fetched. It checks the hosts
+// of requests sent through a proxy, which connects to them itself. Hosts that can't be resolved must be
+// allowed explicitly, unless no addresses are forbidden at all.
+func (g *Guard) checkResolved(ctx context.Context, host string) error {
+	hostAllowed, err := g.checkHost(host)
+	if err != nil {
+		return err
+	}
+	var addrs []netip.Addr
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addrs = []netip.Addr{addr}
+	} else if addrs, err = g.resolver.LookupNetIP(ctx, "ip", host); err != nil {
+		if hostAllowed || (g.allowPrivate && g.allow.empty() && len(g.deny.prefixes) == 0) {
+			return nil
+		}
+		return fmt.Errorf("%w: addresses of %s can't be checked: %w", ErrForbidden, host, err)
+	}
+	for _, addr := range addrs {
+		if err := g.checkAddr(host, addr, hostAllowed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DialContext returns a dial func for http.Transport, which resolves the host, checks its addresses and
+// connects to the first allowed one that answers. As the address checked is the one dialed,
+// DNS rebinding can't sneak in another one.
+func (g *Guard) DialContext(dialer *net.Dialer) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		hostAllowed, err := g.checkHost(host)
+		if err != nil {
+			return nil, err
+		}
+		var addrs []netip.Addr
+		if addr, err := netip.ParseAddr(host); err == nil {
+			addrs = []netip.Addr{addr}
+		} else if addrs, err = g.resolver.LookupNetIP(ctx, "ip", host); err != nil {
+			return nil, err
+		}
+		var errs []error
+		for _, addr := range addrs {
+			if err := g.checkAddr(host, addr, hostAllowed); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(addr.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			errs = append(errs, err)
+		}
+		if len(errs) == 0 {
+			return nil, fmt.Errorf("no address found for %s", host)
+		}
+		return nil, errors.Join(errs...)
+	}
+}
+
+// CheckRedirect returns a func for http.Client, which follows up to maxRedirects redirects
+// to http and https URLs of hosts that are not denied. Their addresses are checked when dialing.
+func (g *Guard) CheckRedirect(maxRedirects int) func(req *http.Request, via []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if len(via) > maxRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxRedirects)
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return fmt.Errorf("%w: redirect to %s", ErrForbidden, req.URL.Redacted())
+		}
+		_, err := g.checkHost(req.URL.Hostname())
+		return err
+	}
+}
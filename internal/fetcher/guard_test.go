@@ -0,0 +1,136 @@
+package fetcher
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckAddr(t *testing.T) {
+	g, err := NewGuard("", "203.0.114.0/24", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, forbidden := range map[string]bool{
+		"93.184.215.14":         false,
+		"2606:2800:21f:cb07::1": false,
+		"127.0.0.1":             true,
+		"::1":                   true,
+		"::ffff:127.0.0.1":      true,
+		"10.1.2.3":              true,
+		"172.16.0.1":            true,
+		"192.168.1.1":           true,
+		"169.254.169.254":       true,
+		"fe80::1":               true,
+		"fd00::1":               true,
+		"0.0.0.0":               true,
+		"100.64.0.1":            true,
+		"64:ff9b::a00:1":        true,
+		"203.0.114.7":           true,
+	} {
+		err := g.checkAddr("host", netip.MustParseAddr(addr), false)
+		if forbidden != errors.Is(err, ErrForbidden) {
+			t.Errorf("%s: got %v", addr, err)
+		}
+	}
+
+	g, err = NewGuard("docs.example.com, *.intranet, 10.0.0.0/8", "secret.intranet", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		host, addr string
+		forbidden  bool
+	}{
+		{"docs.example.com", "192.168.1.1", false},
+		{"files.intranet", "172.16.0.1", false},
+		{"other.com", "10.1.2.3", false},
+		{"other.com", "93.184.215.14", true},
+		{"secret.intranet", "93.184.215.14", true},
+	} {
+		allowed, err := g.checkHost(tc.host)
+		if err == nil {
+			err = g.checkAddr(tc.host, netip.MustParseAddr(tc.addr), allowed)
+		}
+		if tc.forbidden != errors.Is(err, ErrForbidden) {
+			t.Errorf("%s (%s): got %v", tc.host, tc.addr, err)
+		}
+	}
+
+	if _, err := NewGuard("10.0.0.0/33", "", false); err == nil {
+		t.Error("invalid CIDR accepted")
+	}
+}
+
+func TestGuard(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/redirect":
+			hops, _ := strconv.Atoi(r.URL.Query().Get("hops"))
+			if hops > 0 {
+				http.Redirect(w, r, "/redirect?hops="+strconv.Itoa(hops-1), http.StatusFound)
+				return
+			}
+		case "/ftp":
+			http.Redirect(w, r, "ftp://localhost/file", http.StatusFound)
+			return
+		case "/localhost":
+			http.Redirect(w, r, "http://"+strings.Replace(r.Host, "127.0.0.1", "localhost", 1)+"/", http.StatusFound)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	t.Cleanup(srv.Close)
+	get := func(allow, deny string, allowPrivate bool, path string) error {
+		t.Helper()
+		g, err := NewGuard(allow, deny, allowPrivate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := &http.Client{
+			Transport:     &http.Transport{DialContext: g.DialContext(&net.Dialer{Timeout: time.Second})},
+			CheckRedirect: g.CheckRedirect(2),
+		}
+		response, err := client.Get(srv.URL + path)
+		if err == nil {
+			response.Body.Close()
+		}
+		return err
+	}
+
+	if err := get("", "", false, "/"); !errors.Is(err, ErrForbidden) {
+		t.Errorf("loopback fetched by default: %v", err)
+	}
+	if err := get("", "", true, "/"); err != nil {
+		t.Errorf("private allowed: %v", err)
+	}
+	if err := get("127.0.0.0/8", "", false, "/"); err != nil {
+		t.Errorf("loopback allowed: %v", err)
+	}
+	if err := get("example.com", "", true, "/"); !errors.Is(err, ErrForbidden) {
+		t.Errorf("fetched host not allowed: %v", err)
+	}
+	if err := get("", "127.0.0.1", true, "/"); !errors.Is(err, ErrForbidden) {
+		t.Errorf("fetched denied address: %v", err)
+	}
+
+	// every hop is checked
+	if err := get("", "", true, "/redirect?hops=2"); err != nil {
+		t.Errorf("2 redirects: %v", err)
+	}
+	if err := get("", "", true, "/redirect?hops=3"); err == nil || !strings.Contains(err.Error(), "redirects") {
+		t.Errorf("3 redirects: %v", err)
+	}
+	if err := get("", "", true, "/ftp"); !errors.Is(err, ErrForbidden) {
+		t.Errorf("redirect to ftp: %v", err)
+	}
+	if err := get("", "localhost", true, "/localhost"); !errors.Is(err, ErrForbidden) {
+		t.Errorf("redirect to denied host: %v", err)
+	}
+}
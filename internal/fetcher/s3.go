@@ -0,0 +1,82 @@
+package fetcher
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/johbar/text-extraction-service/v4/internal/awssig"
+)
+
+// S3Options locate the S3-compatible object store s3://bucket/key URLs are fetched from
+type S3Options struct {
+	// Endpoint is the base URL of the service, e.g. https://s3.eu-central-1.amazonaws.com or http://localhost:9000
+	Endpoint  string
+	Region    string
+	AccessKey string
+	SecretKey string
+	// Buckets are those objects may be fetched from. There must be at least one.
+	Buckets []string
+	// PathStyle puts the bucket into the path instead of the host name, as required by MinIO and most other implementations
+	PathStyle bool
+}
+
+// s3Source fetches objects with signed GET requests. Conditional headers are passed on,
+// so the object store answers with 304 and sets ETag and Last-Modified itself.
+type s3Source struct {
+	conf     S3Options
+	endpoint *url.URL
+	// send sends the signed request
+	send func(req *http.Request) (*http.Response, error)
+}
+
+func newS3Source(conf S3Options, send func(req *http.Request) (*http.Response, error)) (*s3Source, error) {
+	endpoint, err := url.Parse(conf.Endpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint: %q", conf.Endpoint)
+	}
+	if len(conf.Buckets) == 0 {
+		return nil, errors.New("no S3 buckets allowed")
+	}
+	if conf.Region == "" {
+		conf.Region = "us-east-1"
+	}
+	return &s3Source{conf: conf, endpoint: endpoint, send: send}, nil
+}
+
+func (s *s3Source) RoundTrip(req *http.Request) (*http.Response, error) {
+	bucket, key := req.URL.Host, strings.TrimPrefix(req.URL.Path, "/")
+	if bucket == "" || key == "" {
+		return nil, fmt.Errorf("invalid S3 URL %s: bucket or key missing", req.URL.Redacted())
+	}
+	if !slices.Contains(s.conf.Buckets, bucket) {
+		return nil, fmt.Errorf("%w: bucket %s is not allowed", ErrForbidden, bucket)
+	}
+	u := *s.endpoint
+	if s.conf.PathStyle {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + bucket + "/" + key
+	} else {
+		u.Host = bucket + "." + u.Host
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + key
+	}
+	out, err := http.NewRequestWithContext(req.Context(), req.Method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range []string{"If-None-Match", "If-Modified-Since", "Range"} {
+		if value := req.Header.Get(name); value != "" {
+			out.Header.Set(name, value)
+		}
+	}
+	awssig.Sign(out, s.conf.Region, s.conf.AccessKey, s.conf.SecretKey, awssig.EmptyPayloadHash, time.Now())
+	response, err := s.send(out)
+	if err != nil {
+		return nil, err
+	}
+	response.Request = req
+	return response, nil
+}
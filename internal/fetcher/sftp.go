@@ -0,0 +1,157 @@
+package fetcher
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sftpSource fetches sftp:// URLs. The user, credentials, private key, known hosts file and roots are those of the profile
+// of the host. Every request opens a connection of its own.
+type sftpSource struct {
+	t *transport
+}
+
+func (s sftpSource) Stat(ctx context.Context, u *url.URL) (Info, error) {
+	c, path, err := s.connect(ctx, u)
+	if err != nil {
+		return Info{}, err
+	}
+	defer c.Close()
+	return fileInfo(c.Stat(path))
+}
+
+func (s sftpSource) Open(ctx context.Context, u *url.URL) (io.ReadCloser, Info, error) {
+	c, path, err := s.connect(ctx, u)
+	if err != nil {
+		return nil, Info{}, err
+	}
+	f, err := c.Open(path)
+	if err != nil {
+		c.Close()
+		return nil, Info{}, err
+	}
+	info, err := fileInfo(f.Stat())
+	if err != nil {
+		f.Close()
+		c.Close()
+		return nil, Info{}, err
+	}
+	return &sftpFile{File: f, c: c}, info, nil
+}
+
+// connect opens an SFTP session on the host of u and returns the canonical path of u's file,
+// which must be below one of the roots of the profile
+func (s sftpSource) connect(ctx context.Context, u *url.URL) (*sftpClient, string, error) {
+	p := s.t.profile(u.Hostname())
+	if p.KnownHostsFile == "" || len(p.Roots) == 0 {
+		return nil, "", fmt.Errorf("%w: no known hosts file or roots configured for sftp://%s", ErrForbidden, u.Hostname())
+	}
+	// the credentials are those of the profile's user only
+	if name := u.User.Username(); name != "" && name != p.Username {
+		return nil, "", fmt.Errorf("%w: sftp user %s", ErrForbidden, name)
+	}
+	if !withinRoots(p.Roots, u.Path) {
+		return nil, "", fmt.Errorf("%w: %s is outside the allowed directories", ErrForbidden, u.Path)
+	}
+	hostKeys, err := knownhosts.New(p.KnownHostsFile)
+	if err != nil {
+		return nil, "", err
+	}
+	config := &ssh.ClientConfig{User: p.Username, HostKeyCallback: hostKeys}
+	if p.PrivateKeyFile != "" {
+		pem, err := os.ReadFile(p.PrivateKeyFile)
+		if err != nil {
+			return nil, "", err
+		}
+		signer, err := ssh.ParsePrivateKey(pem)
+		if err != nil {
+			return nil, "", fmt.Errorf("sftp: parsing private key: %w", err)
+		}
+		config.Auth = append(config.Auth, ssh.PublicKeys(signer))
+	}
+	if p.Password != "" {
+		config.Auth = append(config.Auth, ssh.Password(p.Password))
+	}
+	port := u.Port()
+	if port == "" {
+		port = "22"
+	}
+	address := net.JoinHostPort(u.Hostname(), port)
+	conn, err := p.dial(ctx, "tcp", address)
+	if err != nil {
+		return nil, "", err
+	}
+	// the connection is aborted with ctx
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	sshConn, channels, requests, err := ssh.NewClientConn(conn, address, config)
+	if err != nil {
+		stop()
+		conn.Close()
+		return nil, "", err
+	}
+	client := ssh.NewClient(sshConn, channels, requests)
+	sc, err := sftp.NewClient(client)
+	if err != nil {
+		stop()
+		client.Close()
+		return nil, "", err
+	}
+	c := &sftpClient{Client: sc, ssh: client, stop: stop}
+	// symbolic links may not lead out of the roots
+	path, err := c.RealPath(u.Path)
+	if err == nil && !withinRoots(p.Roots, path) {
+		err = fmt.Errorf("%w: %s leads to %s outside the allowed directories", ErrForbidden, u.Path, path)
+	}
+	if err != nil {
+		c.Close()
+		return nil, "", err
+	}
+	return c, path, nil
+}
+
+// withinRoots reports whether the absolute path p is one of roots or below one of them
+func withinRoots(roots []string, p string) bool {
+	p = path.Clean(p)
+	for _, root := range roots {
+		root = path.Clean(root)
+		if p == root || strings.HasPrefix(p, strings.TrimSuffix(root, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// sftpClient is an SFTP session closing its SSH connection when it is closed
+type sftpClient struct {
+	*sftp.Client
+	ssh  *ssh.Client
+	stop func() bool
+}
+
+func (c *sftpClient) Close() error {
+	c.stop()
+	c.Client.Close()
+	return c.ssh.Close()
+}
+
+// sftpFile closes the connection it was opened with when it is closed
+type sftpFile struct {
+	*sftp.File
+	c *sftpClient
+}
+
+func (f *sftpFile) Close() error {
+	f.File.Close()
+	return f.c.Close()
+}
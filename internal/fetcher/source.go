@@ -0,0 +1,194 @@
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Source fetches the documents of a URL scheme other than http and https
+type Source interface {
+	// Stat returns the size and modification time of the document at u, an error wrapping [fs.ErrNotExist]
+	// if there is none or [ErrForbidden] if it may not be fetched
+	Stat(ctx context.Context, u *url.URL) (Info, error)
+	// Open returns the content of the document at u and what Stat would return
+	Open(ctx context.Context, u *url.URL) (io.ReadCloser, Info, error)
+}
+
+// Info describes a document of a [Source]
+type Info struct {
+	// Size is the number of bytes, -1 if unknown
+	Size    int64
+	ModTime time.Time
+	// ETag identifies the version of the document. It defaults to one derived from size and modification time.
+	ETag string
+}
+
+func (i Info) etag() string {
+	if i.ETag != "" {
+		return i.ETag
+	}
+	return `"` + strconv.FormatInt(i.Size, 16) + "-" + strconv.FormatInt(i.ModTime.UnixNano(), 16) + `"`
+}
+
+// notModified reports whether the document described by i matches the conditional headers of req
+func (i Info) notModified(req *http.Request) bool {
+	if match := req.Header.Get("If-None-Match"); match != "" {
+		return match == i.etag()
+	}
+	since, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	return err == nil && !i.ModTime.IsZero() && !i.ModTime.Truncate(time.Second).After(since)
+}
+
+// sourceTransport answers requests for the documents of a Source like a web server, with status 200,
+// 304 if the document matches the conditional headers of the request, or 404 if there is none.
+// ETag and Last-Modified are set, so that the text extracted can be revalidated.
+type sourceTransport struct {
+	source Source
+}
+
+func (t sourceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	if req.Method == http.MethodHead || req.Header.Get("If-None-Match") != "" || req.Header.Get("If-Modified-Since") != "" {
+		info, err := t.source.Stat(ctx, req.URL)
+		switch {
+		case err != nil:
+			return failed(req, err)
+		case info.notModified(req):
+			return response(req, http.StatusNotModified, info, http.NoBody), nil
+		case req.Method == http.MethodHead:
+			return response(req, http.StatusOK, info, http.NoBody), nil
+		}
+	}
+	body, info, err := t.source.Open(ctx, req.URL)
+	if err != nil {
+		return failed(req, err)
+	}
+	return response(req, http.StatusOK, info, body), nil
+}
+
+// failed responds with 404 to requests for documents that don't exist
+func failed(req *http.Request, err error) (*http.Response, error) {
+	if errors.Is(err, fs.ErrNotExist) {
+		return response(req, http.StatusNotFound, Info{}, http.NoBody), nil
+	}
+	return nil, err
+}
+
+func response(req *http.Request, status int, info Info, body io.ReadCloser) *http.Response {
+	header := http.Header{}
+	if status != http.StatusNotFound {
+		header.Set("ETag", info.etag())
+		if !info.ModTime.IsZero() {
+			header.Set("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+		}
+	}
+	size := info.Size
+	if status == http.StatusNotModified {
+		size = 0
+	}
+	if size >= 0 {
+		header.Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	return &http.Response{
+		Status:        strconv.Itoa(status) + " " + http.StatusText(status),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          body,
+		ContentLength: size,
+		Request:       req,
+	}
+}
+
+// fileSource serves file:// URLs from the files below some root directories. Symbolic links
+// may not lead out of them.
+type fileSource struct {
+	roots []*os.Root
+}
+
+// newFileSource returns a source for the files below the directories roots
+func newFileSource(roots []string) (*fileSource, error) {
+	s := &fileSource{}
+	for _, dir := range roots {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+		root, err := os.OpenRoot(abs)
+		if err != nil {
+			return nil, err
+		}
+		s.roots = append(s.roots, root)
+	}
+	return s, nil
+}
+
+// resolve returns the root containing the file at u and the file's path relative to it
+func (s *fileSource) resolve(u *url.URL) (*os.Root, string, error) {
+	if u.Host != "" && u.Host != "localhost" {
+		return nil, "", fmt.Errorf("%w: file on host %s", ErrForbidden, u.Host)
+	}
+	path := filepath.Clean(filepath.FromSlash(u.Path))
+	for _, root := range s.roots {
+		if rel, err := filepath.Rel(root.Name(), path); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return root, rel, nil
+		}
+	}
+	return nil, "", fmt.Errorf("%w: %s is outside the allowed directories", ErrForbidden, path)
+}
+
+func (s *fileSource) Stat(_ context.Context, u *url.URL) (Info, error) {
+	root, rel, err := s.resolve(u)
+	if err != nil {
+		return Info{}, err
+	}
+	fi, err := root.Stat(rel)
+	return fileInfo(fi, err)
+}
+
+func (s *fileSource) Open(_ context.Context, u *url.URL) (io.ReadCloser, Info, error) {
+	root, rel, err := s.resolve(u)
+	if err != nil {
+		return nil, Info{}, err
+	}
+	f, err := root.Open(rel)
+	if err != nil {
+		return nil, Info{}, forbiddenIfEscaping(err)
+	}
+	info, err := fileInfo(f.Stat())
+	if err != nil {
+		f.Close()
+		return nil, Info{}, err
+	}
+	return f, info, nil
+}
+
+func fileInfo(fi fs.FileInfo, err error) (Info, error) {
+	if err != nil {
+		return Info{}, forbiddenIfEscaping(err)
+	}
+	if !fi.Mode().IsRegular() {
+		return Info{}, fmt.Errorf("%s is not a regular file: %w", fi.Name(), fs.ErrNotExist)
+	}
+	return Info{Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+// forbiddenIfEscaping turns the error of os.Root for paths leading out of it into ErrForbidden
+func forbiddenIfEscaping(err error) error {
+	if err != nil && strings.Contains(err.Error(), "path escapes from parent") {
+		return fmt.Errorf("%w: %w", ErrForbidden, err)
+	}
+	return err
+}
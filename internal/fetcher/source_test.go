@@ -0,0 +1,309 @@
+package fetcher
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestFileSource(t *testing.T) {
+	root, outside := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "a.pdf"), []byte("%PDF-"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(outside, "secret.pdf"), []byte("secret"), 0o600)
+	if err := os.Symlink(filepath.Join(outside, "secret.pdf"), filepath.Join(root, "link.pdf")); err != nil {
+		t.Skip("symbolic links not supported:", err)
+	}
+	client, err := NewClient("", Options{FileRoots: []string{root}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileUrl := "file://" + filepath.ToSlash(filepath.Join(root, "a.pdf"))
+	if !Supported(client, fileUrl) || Supported(client, "ftp://host/a.pdf") || Supported(http.DefaultClient, fileUrl) {
+		t.Error("Supported: wrong result")
+	}
+
+	response, err := client.Get(fileUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	etag := response.Header.Get("ETag")
+	if string(body) != "%PDF-" || etag == "" || response.Header.Get("Last-Modified") == "" || response.ContentLength != 5 {
+		t.Errorf("got %q, header %v", body, response.Header)
+	}
+
+	for name, header := range map[string]string{"If-None-Match": etag, "If-Modified-Since": response.Header.Get("Last-Modified")} {
+		req, _ := http.NewRequest(http.MethodGet, fileUrl, nil)
+		req.Header.Set(name, header)
+		if response, err := client.Do(req); err != nil || response.StatusCode != http.StatusNotModified {
+			t.Errorf("%s: got %v", name, err)
+		}
+	}
+
+	if response, err := client.Get("file://" + filepath.ToSlash(filepath.Join(root, "missing.pdf"))); err != nil || response.StatusCode != http.StatusNotFound {
+		t.Errorf("missing file: got %v", err)
+	}
+	for _, forbidden := range []string{
+		filepath.Join(outside, "secret.pdf"),
+		filepath.Join(root, "link.pdf"),
+		filepath.Join(root, "..", filepath.Base(outside), "secret.pdf"),
+	} {
+		if _, err := client.Get("file://" + filepath.ToSlash(forbidden)); !errors.Is(err, ErrForbidden) {
+			t.Errorf("%s: got %v", forbidden, err)
+		}
+	}
+	if _, err := client.Get("file://fileserver/share/a.pdf"); !errors.Is(err, ErrForbidden) {
+		t.Errorf("remote host: got %v", err)
+	}
+}
+
+func TestS3Source(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.URL.Path != "/docs/reports/a.pdf" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		io.WriteString(w, "%PDF-")
+	}))
+	t.Cleanup(srv.Close)
+	// the object store is reachable, though private addresses are forbidden
+	guard, _ := NewGuard("", "", false)
+	client, err := NewClient("", Options{Guard: guard, S3: &S3Options{Endpoint: srv.URL, AccessKey: "key", SecretKey: "secret", Buckets: []string{"docs"}, PathStyle: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := client.Get("s3://docs/reports/a.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK || string(body) != "%PDF-" || response.Request.URL.Scheme != "s3" {
+		t.Errorf("got %d %q", response.StatusCode, body)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "s3://docs/reports/a.pdf", nil)
+	req.Header.Set("If-None-Match", `"v1"`)
+	if response, err := client.Do(req); err != nil || response.StatusCode != http.StatusNotModified {
+		t.Errorf("conditional request: got %v", err)
+	}
+	if response, err := client.Get("s3://docs/missing.pdf"); err != nil || response.StatusCode != http.StatusNotFound {
+		t.Errorf("missing object: got %v", err)
+	}
+	if _, err := client.Get("s3://docs"); err == nil {
+		t.Error("URL without key accepted")
+	}
+	if _, err := client.Get("s3://other/reports/a.pdf"); !errors.Is(err, ErrForbidden) {
+		t.Errorf("other bucket: got %v", err)
+	}
+	if _, err := NewClient("", Options{S3: &S3Options{Endpoint: srv.URL}}); err == nil {
+		t.Error("object store without buckets accepted")
+	}
+}
+
+func TestWebdavSource(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, _ := r.BasicAuth()
+		io.WriteString(w, user+":"+password+" "+r.URL.Path)
+	}))
+	t.Cleanup(srv.Close)
+	client, err := NewClient(writeProfiles(t, Profile{Hosts: []string{"127.0.0.1"}, Username: "user", Password: "secret"}), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := client.Get(strings.Replace(srv.URL, "http://", "webdav://", 1) + "/dav/a.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if body, _ := io.ReadAll(response.Body); string(body) != "user:secret /dav/a.pdf" || response.Request.URL.Scheme != "webdav" {
+		t.Errorf("got %q", body)
+	}
+}
+
+func TestSftpSource(t *testing.T) {
+	modTime := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	files := map[string]string{"/docs/a.pdf": strings.Repeat("%PDF-", 10000), "/etc/shadow": "root:*:"}
+	addr, hostKey := serveSftp(t, files, map[string]string{"/docs/shadow": "/etc/shadow"}, modTime)
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	if err := os.WriteFile(knownHosts, []byte(knownhosts.Line([]string{addr}, hostKey)+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClient(writeProfiles(t, Profile{Hosts: []string{"127.0.0.1"}, Username: "tes", Password: "secret", KnownHostsFile: knownHosts, Roots: []string{"/docs"}}), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := client.Get("sftp://" + addr + "/docs/a.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil || len(body) != 50000 || response.Header.Get("Last-Modified") != modTime.Format(http.TimeFormat) {
+		t.Errorf("got %d bytes, %v, header %v", len(body), err, response.Header)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "sftp://"+addr+"/docs/a.pdf", nil)
+	req.Header.Set("If-None-Match", response.Header.Get("ETag"))
+	if response, err := client.Do(req); err != nil || response.StatusCode != http.StatusNotModified {
+		t.Errorf("conditional request: got %v", err)
+	}
+	if response, err := client.Get("sftp://" + addr + "/docs/missing.pdf"); err != nil || response.StatusCode != http.StatusNotFound {
+		t.Errorf("missing file: got %v", err)
+	}
+	if response, err := client.Get("sftp://tes@" + addr + "/docs/a.pdf"); err != nil || response.StatusCode != http.StatusOK {
+		t.Errorf("user of profile: got %v", err)
+	} else {
+		response.Body.Close()
+	}
+	// neither other users nor files outside the roots, also by symbolic links, are fetched
+	for _, forbidden := range []string{"sftp://root@" + addr + "/docs/a.pdf", "sftp://" + addr + "/etc/shadow", "sftp://" + addr + "/docs/../etc/shadow", "sftp://" + addr + "/docs/shadow"} {
+		if _, err := client.Get(forbidden); !errors.Is(err, ErrForbidden) {
+			t.Errorf("%s: got %v", forbidden, err)
+		}
+	}
+
+	// unknown host keys are rejected
+	os.WriteFile(knownHosts, nil, 0o600)
+	if _, err := client.Get("sftp://" + addr + "/docs/a.pdf"); err == nil {
+		t.Error("unknown host key accepted")
+	}
+}
+
+// serveSftp starts an SSH server with an SFTP subsystem serving files and symbolic links, which accepts user tes
+// with password secret
+func serveSftp(t *testing.T, files, links map[string]string, modTime time.Time) (string, ssh.PublicKey) {
+	t.Helper()
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+		if conn.User() != "tes" || string(password) != "secret" {
+			return nil, errors.New("denied")
+		}
+		return nil, nil
+	}}
+	config.AddHostKey(signer)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, channels, requests, err := ssh.NewServerConn(conn, config)
+				if err != nil {
+					conn.Close()
+					return
+				}
+				go ssh.DiscardRequests(requests)
+				for newChannel := range channels {
+					channel, requests, err := newChannel.Accept()
+					if err != nil {
+						continue
+					}
+					go func() {
+						for req := range requests {
+							req.Reply(req.Type == "subsystem", nil)
+						}
+					}()
+					go serveSftpSession(channel, files, links, modTime)
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String(), signer.PublicKey()
+}
+
+// sftpFiles serves files and symbolic links, resolved by RealPath, via an SFTP request server
+type sftpFiles struct {
+	files, links map[string]string
+	modTime      time.Time
+}
+
+func (h sftpFiles) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	content, ok := h.files[r.Filepath]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return strings.NewReader(content), nil
+}
+
+func (h sftpFiles) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	content, ok := h.files[r.Filepath]
+	if !ok || r.Method != "Stat" {
+		return nil, os.ErrNotExist
+	}
+	return listerAt{regularFile{name: path.Base(r.Filepath), size: int64(len(content)), modTime: h.modTime}}, nil
+}
+
+func (h sftpFiles) RealPath(p string) (string, error) {
+	p = path.Clean("/" + p)
+	if target, ok := h.links[p]; ok {
+		return target, nil
+	}
+	return p, nil
+}
+
+type listerAt []os.FileInfo
+
+func (l listerAt) ListAt(infos []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	return copy(infos, l[offset:]), nil
+}
+
+// regularFile describes a regular file
+type regularFile struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (fi regularFile) Name() string       { return fi.name }
+func (fi regularFile) Size() int64        { return fi.size }
+func (fi regularFile) Mode() os.FileMode  { return 0o644 }
+func (fi regularFile) ModTime() time.Time { return fi.modTime }
+func (fi regularFile) IsDir() bool        { return false }
+func (fi regularFile) Sys() any           { return nil }
+
+func serveSftpSession(channel ssh.Channel, files, links map[string]string, modTime time.Time) {
+	h := sftpFiles{files: files, links: links, modTime: modTime}
+	server := sftp.NewRequestServer(channel, sftp.Handlers{FileGet: h, FileList: h})
+	defer server.Close()
+	server.Serve()
+}
@@ -0,0 +1,185 @@
+package imageparser
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strconv"
+	"time"
+)
+
+// exifDateLayout is the format of EXIF timestamps, which lack a time zone
+const exifDateLayout = "2006:01:02 15:04:05"
+
+// EXIF tags not used for TIFF pages
+const (
+	tagImageDescription = 270
+	tagSoftware         = 305
+	tagArtist           = 315
+	tagCopyright        = 33432
+	tagIptc             = 33723
+	tagGpsLatitudeRef   = 1
+	tagGpsLatitude      = 2
+	tagGpsLongitudeRef  = 3
+	tagGpsLongitude     = 4
+	tagGpsAltitudeRef   = 5
+	tagGpsAltitude      = 6
+)
+
+// exifData returns the EXIF block, a TIFF structure, of a JPEG, PNG or WebP image, nil if there is none.
+// TIFF files are returned as they are, as their first IFD holds the EXIF data.
+func exifData(data []byte) []byte {
+	switch {
+	case isTiff(data):
+		return data
+	case bytes.HasPrefix(data, []byte{0xff, 0xd8}):
+		if segment := jpegSegment(data[2:], 0xe1, "Exif\x00\x00"); segment != nil {
+			return segment[6:]
+		}
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return pngExif(data[8:])
+	case isWebp(data):
+		v, _ := riffChunk(data[12:], "EXIF")
+		// some writers keep the JPEG APP1 identifier
+		return bytes.TrimPrefix(v, []byte("Exif\x00\x00"))
+	}
+	return nil
+}
+
+// jpegSegment returns the first segment of a JPEG with the given marker and prefix, nil if there is none.
+// data starts after the SOI marker.
+func jpegSegment(data []byte, marker byte, prefix string) []byte {
+	for len(data) >= 4 && data[0] == 0xff {
+		m := data[1]
+		if m == 0xd8 || m == 0x01 || (m >= 0xd0 && m <= 0xd7) || m == 0xff {
+			// markers without a segment and fill bytes
+			data = data[1:]
+			if m != 0xff {
+				data = data[1:]
+			}
+			continue
+		}
+		if m == 0xda || m == 0xd9 {
+			// metadata precedes the image data
+			return nil
+		}
+		length := int(binary.BigEndian.Uint16(data[2:]))
+		if length < 2 || len(data) < 2+length {
+			return nil
+		}
+		segment := data[4 : 2+length]
+		if m == marker && bytes.HasPrefix(segment, []byte(prefix)) {
+			return segment
+		}
+		data = data[2+length:]
+	}
+	return nil
+}
+
+func pngExif(data []byte) []byte {
+	for len(data) >= 12 {
+		length := int(binary.BigEndian.Uint32(data))
+		if length < 0 || len(data) < 12+length {
+			break
+		}
+		switch string(data[4:8]) {
+		case "eXIf":
+			return data[8 : 8+length]
+		case "IEND":
+			return nil
+		}
+		data = data[12+length:]
+	}
+	return nil
+}
+
+// exifMetadata returns the metadata stored in the TIFF structure of an EXIF block or of a TIFF file:
+// camera, orientation, GPS position, timestamp, description, artist, copyright and software.
+// The timestamp is formatted as RFC 3339 without a time zone offset, as EXIF lacks it.
+func exifMetadata(data []byte) map[string]string {
+	meta := make(map[string]string)
+	t, off, err := newTiffReader(data)
+	if err != nil {
+		return meta
+	}
+	ifd0, _, err := t.ifd(off)
+	if err != nil {
+		return meta
+	}
+	for tag, key := range map[uint16]string{
+		tagMake:             "x-exif-make",
+		tagModel:            "x-exif-model",
+		tagImageDescription: "x-document-description",
+		tagArtist:           "x-document-author",
+		tagCopyright:        "x-document-copyright",
+		tagSoftware:         "x-document-creator",
+	} {
+		if v := t.ascii(ifd0, tag); v != "" {
+			meta[key] = v
+		}
+	}
+	if v, ok := t.uint(ifd0, tagOrientation); ok && v >= 1 && v <= 8 {
+		meta["x-exif-orientation"] = strconv.Itoa(int(v))
+	}
+	created := t.ascii(ifd0, tagDateTime)
+	if exifOff, ok := t.uint(ifd0, tagExifIFD); ok {
+		if exif, _, err := t.ifd(exifOff); err == nil {
+			if v := t.ascii(exif, tagDateTimeOriginal); v != "" {
+				created = v
+			}
+		}
+	}
+	if ts, err := time.Parse(exifDateLayout, created); err == nil {
+		meta["x-document-created"] = ts.Format("2006-01-02T15:04:05")
+	}
+	if gpsOff, ok := t.uint(ifd0, tagGpsIFD); ok {
+		if gps, _, err := t.ifd(gpsOff); err == nil {
+			t.gpsMetadata(gps, meta)
+		}
+	}
+	return meta
+}
+
+// gpsMetadata adds the latitude and longitude in decimal degrees and the altitude in meters
+// from the GPS IFD to meta.
+func (t *tiffReader) gpsMetadata(gps []ifdEntry, meta map[string]string) {
+	lat, okLat := t.degrees(gps, tagGpsLatitude)
+	lon, okLon := t.degrees(gps, tagGpsLongitude)
+	if okLat && okLon {
+		if t.ascii(gps, tagGpsLatitudeRef) == "S" {
+			lat = -lat
+		}
+		if t.ascii(gps, tagGpsLongitudeRef) == "W" {
+			lon = -lon
+		}
+		meta["x-exif-gps-latitude"] = strconv.FormatFloat(lat, 'f', 6, 64)
+		meta["x-exif-gps-longitude"] = strconv.FormatFloat(lon, 'f', 6, 64)
+	}
+	if alt, ok := t.rational(gps, tagGpsAltitude); ok {
+		// reference 1 means below sea level
+		if ref, _ := t.uint(gps, tagGpsAltitudeRef); ref == 1 {
+			alt = -alt
+		}
+		meta["x-exif-gps-altitude"] = strconv.FormatFloat(alt, 'f', 1, 64)
+	}
+}
+
+// degrees returns the value of a GPS coordinate given as degrees, minutes and seconds in decimal degrees.
+func (t *tiffReader) degrees(entries []ifdEntry, tag uint16) (float64, bool) {
+	e, ok := find(entries, tag)
+	if !ok || e.typ != 5 || e.count != 3 {
+		return 0, false
+	}
+	v, ok := t.bytes(e)
+	if !ok {
+		return 0, false
+	}
+	var dms [3]float64
+	for i := range dms {
+		num, denom := t.bo.Uint32(v[8*i:]), t.bo.Uint32(v[8*i+4:])
+		if denom == 0 {
+			return 0, false
+		}
+		dms[i] = float64(num) / float64(denom)
+	}
+	return dms[0] + dms[1]/60 + dms[2]/3600, true
+}
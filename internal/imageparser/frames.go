@@ -0,0 +1,152 @@
+package imageparser
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/draw"
+	"image/gif"
+
+	"github.com/johbar/text-extraction-service/v4/pkg/imgprep"
+)
+
+// gifFrames returns the frames of an animated GIF as they are displayed, i.e. drawn over the preceding ones.
+// It returns nil for GIFs with a single frame.
+func gifFrames(data []byte) ([]*image.Gray, error) {
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if len(g.Image) < 2 {
+		return nil, nil
+	}
+	canvas := image.NewRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	frames := make([]*image.Gray, 0, len(g.Image))
+	for i, frame := range g.Image {
+		var disposal byte
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		var previous *image.RGBA
+		if disposal == gif.DisposalPrevious {
+			previous = image.NewRGBA(canvas.Rect)
+			copy(previous.Pix, canvas.Pix)
+		}
+		draw.Draw(canvas, frame.Rect, frame, frame.Rect.Min, draw.Over)
+		frames = append(frames, imgprep.Gray(canvas))
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Rect, image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	return frames, nil
+}
+
+func isWebp(data []byte) bool {
+	return len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP"
+}
+
+// riffChunks calls yield with the type and payload of every chunk in data until it returns false.
+func riffChunks(data []byte, yield func(fourcc string, payload []byte) bool) {
+	for len(data) >= 8 {
+		size := uint64(binary.LittleEndian.Uint32(data[4:]))
+		if 8+size > uint64(len(data)) {
+			return
+		}
+		if !yield(string(data[:4]), data[8:8+size]) {
+			return
+		}
+		// chunks are padded to an even size
+		next := 8 + size + size%2
+		if next > uint64(len(data)) {
+			return
+		}
+		data = data[next:]
+	}
+}
+
+// riffChunk returns the payload of the first chunk of the given type.
+func riffChunk(data []byte, fourcc string) ([]byte, bool) {
+	var found []byte
+	ok := false
+	riffChunks(data, func(typ string, payload []byte) bool {
+		if typ == fourcc {
+			found, ok = payload, true
+		}
+		return !ok
+	})
+	return found, ok
+}
+
+// webpInfo returns the canvas size of a WebP image and the frames of an animated one.
+// Every frame is returned as WebP image of its own. As Go can't decode WebP, frames are not combined
+// with the preceding ones and their alpha channel is dropped. frames is nil for still images.
+func webpInfo(data []byte) (width, height int, frames [][]byte) {
+	riffChunks(data[12:], func(fourcc string, payload []byte) bool {
+		switch fourcc {
+		case "VP8X":
+			if len(payload) >= 10 {
+				width, height = 1+int(uint24(payload[4:])), 1+int(uint24(payload[7:]))
+			}
+		case "VP8 ", "VP8L":
+			if width == 0 {
+				width, height = vp8Size(fourcc, payload)
+			}
+		case "ANMF":
+			// the frame header is followed by the frame's chunks
+			if len(payload) < 16 {
+				break
+			}
+			riffChunks(payload[16:], func(fourcc string, frame []byte) bool {
+				if fourcc == "VP8 " || fourcc == "VP8L" {
+					frames = append(frames, webpFile(fourcc, frame))
+					return false
+				}
+				return true
+			})
+		}
+		return true
+	})
+	if len(frames) < 2 {
+		frames = nil
+	}
+	return width, height, frames
+}
+
+// vp8Size returns the size stored in the header of a lossy (VP8) or lossless (VP8L) bitstream.
+func vp8Size(fourcc string, payload []byte) (int, int) {
+	if fourcc == "VP8L" {
+		if len(payload) < 5 || payload[0] != 0x2f {
+			return 0, 0
+		}
+		bits := binary.LittleEndian.Uint32(payload[1:])
+		return int(bits&0x3fff) + 1, int(bits>>14&0x3fff) + 1
+	}
+	// frame tag, start code, then width and height with 2 bits of scaling each
+	if len(payload) < 10 || !bytes.Equal(payload[3:6], []byte{0x9d, 0x01, 0x2a}) {
+		return 0, 0
+	}
+	return int(binary.LittleEndian.Uint16(payload[6:]) & 0x3fff), int(binary.LittleEndian.Uint16(payload[8:]) & 0x3fff)
+}
+
+// webpFile returns a WebP file consisting of a single bitstream chunk.
+func webpFile(fourcc string, payload []byte) []byte {
+	size := len(payload) + len(payload)%2
+	buf := make([]byte, 0, 20+size)
+	buf = append(buf, "RIFF"...)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(4+8+size))
+	buf = append(buf, "WEBP"...)
+	buf = append(buf, fourcc...)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(payload)))
+	buf = append(buf, payload...)
+	if len(payload)%2 == 1 {
+		buf = append(buf, 0)
+	}
+	return buf
+}
+
+func uint24(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+}
@@ -3,16 +3,54 @@ package imageparser
 import (
 	"bytes"
 	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
 	"io"
+	"maps"
+	"math"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
 
+	"github.com/johbar/text-extraction-service/v4/pkg/imgprep"
+	"github.com/johbar/text-extraction-service/v4/pkg/layout"
 	"github.com/johbar/text-extraction-service/v4/pkg/tesswrap"
 )
 
+// ImageDoc is an image whose text is recognized by OCR, if Tesseract is available. The pages of multi-page TIFFs and
+// the frames of animated GIFs and WebPs are exposed as pages.
 type ImageDoc struct {
 	data *[]byte
 	typ  string
 	path string
+
+	once sync.Once
+	info imageInfo
+	err  error
+}
+
+// imageInfo is what is known about an image without running OCR
+type imageInfo struct {
+	// data is the encoded image, read from disk if necessary
+	data          []byte
+	width, height int
+	dpiX, dpiY    float64
+	// pages holds the pages or frames of multi-page images, nil for images with a single page
+	pages []page
+	meta  map[string]string
+}
+
+// page is a page of a multi-page image: a decoded frame, an encoded image or a TIFF page
+type page struct {
+	img  *image.Gray
+	data []byte
+	// ifd is the offset of the IFD of a TIFF page read by tiff
+	tiff *tiffReader
+	ifd  uint32
 }
 
 func NewFromBytes(data []byte, ext string) *ImageDoc {
@@ -26,14 +64,119 @@ func Open(path, ext string) *ImageDoc {
 	return &ImageDoc{path: path, typ: strings.TrimPrefix(ext, ".")}
 }
 
+// load reads the image's size, resolution, pages and EXIF data once.
+func (d *ImageDoc) load() (*imageInfo, error) {
+	d.once.Do(func() {
+		switch {
+		case d.data != nil:
+			d.info.data = *d.data
+		case len(d.path) > 0:
+			d.info.data, d.err = os.ReadFile(d.path)
+		default:
+			d.err = errors.New("image has neither bytes nor path")
+		}
+		if d.err == nil {
+			d.info.parse()
+		}
+	})
+	return &d.info, d.err
+}
+
+// parse reads the size, resolution and metadata of the image and splits multi-page images into pages.
+func (info *imageInfo) parse() {
+	data := info.data
+	switch {
+	case isTiff(data):
+		// files this parser can't read, e.g. BigTIFF, are passed to Tesseract as they are
+		t, first, err := newTiffReader(data)
+		if err != nil {
+			break
+		}
+		offsets, err := t.pages(first)
+		if err != nil {
+			break
+		}
+		ifd0, _, _ := t.ifd(offsets[0])
+		info.width, info.height = t.size(ifd0)
+		if len(offsets) > 1 {
+			for _, off := range offsets {
+				info.pages = append(info.pages, page{tiff: t, ifd: off})
+			}
+		}
+	case isWebp(data):
+		var frames [][]byte
+		info.width, info.height, frames = webpInfo(data)
+		for _, frame := range frames {
+			info.pages = append(info.pages, page{data: frame})
+		}
+	case bytes.HasPrefix(data, []byte("GIF8")):
+		// GIFs Go can't decode are passed to Tesseract as they are
+		frames, _ := gifFrames(data)
+		for _, frame := range frames {
+			info.pages = append(info.pages, page{img: frame})
+		}
+	}
+	if info.width == 0 {
+		if conf, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+			info.width, info.height = conf.Width, conf.Height
+		}
+	}
+	exif := exifData(data)
+	info.dpiX, info.dpiY = imgprep.Resolution(data)
+	if info.dpiX == 0 && exif != nil {
+		if t, off, err := newTiffReader(exif); err == nil {
+			ifd0, _, _ := t.ifd(off)
+			info.dpiX, info.dpiY = t.resolution(ifd0)
+		}
+	}
+	// XMP takes precedence over IPTC, which takes precedence over EXIF
+	info.meta = exifMetadata(exif)
+	maps.Copy(info.meta, iptcMetadata(iptcData(data)))
+	maps.Copy(info.meta, xmpMetadata(xmpData(data)))
+}
+
+// recognize runs OCR on page i, 0 for images with a single page.
+// Without Tesseract the page is empty.
+func (info *imageInfo) recognize(i int, opts tesswrap.Options) (*layout.Page, tesswrap.Result, error) {
+	if i < 0 || i >= max(len(info.pages), 1) {
+		return nil, tesswrap.Result{}, fmt.Errorf("image has no page %d", i)
+	}
+	if !tesswrap.Initialized {
+		return &layout.Page{Width: float64(info.width), Height: float64(info.height)}, tesswrap.Result{}, nil
+	}
+	if len(info.pages) == 0 {
+		return tesswrap.RecognizeWords(info.data, opts)
+	}
+	p := info.pages[i]
+	switch {
+	case p.img != nil:
+		return tesswrap.RecognizeGrayWords(p.img, 0, opts)
+	case p.tiff != nil:
+		data, err := p.tiff.page(p.ifd)
+		if err != nil {
+			return nil, tesswrap.Result{}, err
+		}
+		return tesswrap.RecognizeWords(data, opts)
+	}
+	return tesswrap.RecognizeWords(p.data, opts)
+}
+
+// StreamText runs OCR on every page and writes the recognized text to w.
 func (d *ImageDoc) StreamText(w io.Writer) error {
-	if d.data != nil {
-		return tesswrap.ImageReaderToWriter(bytes.NewReader(*d.data), w)
+	info, err := d.load()
+	if err != nil {
+		return err
 	}
-	if len(d.path) > 0 {
-		return tesswrap.ImageToWriter(d.path, w)
+	for i := range max(len(info.pages), 1) {
+		_, r, err := info.recognize(i, tesswrap.Options{})
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, r.Text); err != nil {
+			return err
+		}
 	}
-	return errors.New("image has neither bytes nor path")
+	return nil
 }
 
 func (d *ImageDoc) Close() {
@@ -44,8 +187,13 @@ func (d *ImageDoc) HasNewlines() bool {
 	return true
 }
 
+// Pages returns the number of pages of multi-page images and -1 for images with a single page.
 func (d *ImageDoc) Pages() int {
-	return -1
+	info, err := d.load()
+	if err != nil || len(info.pages) == 0 {
+		return -1
+	}
+	return len(info.pages)
 }
 
 func (d *ImageDoc) Path() string {
@@ -56,27 +204,57 @@ func (d *ImageDoc) Data() *[]byte {
 	return d.data
 }
 
+// Text runs OCR on page i, 0 for images with a single page.
 func (d *ImageDoc) Text(i int) (string, bool) {
-	if i != 1 {
+	_, r, err := d.Recognize(i, tesswrap.Options{})
+	if err != nil {
 		return "", false
 	}
-	text, _ := tesswrap.ImageBytesToText(*d.data)
 	// an image has no image
-	return text, false
+	return r.Text, false
+}
+
+// PageLayout runs OCR on page i and returns the recognized words and their bounding boxes in pixels.
+func (d *ImageDoc) PageLayout(i int) (*layout.Page, error) {
+	page, _, err := d.Recognize(i, tesswrap.Options{})
+	return page, err
+}
+
+// Recognize runs OCR on page i, 0 for images with a single page, with the given options
+// and returns the recognized words in pixels along with the text.
+func (d *ImageDoc) Recognize(i int, opts tesswrap.Options) (*layout.Page, tesswrap.Result, error) {
+	info, err := d.load()
+	if err != nil {
+		return nil, tesswrap.Result{}, err
+	}
+	return info.recognize(i, opts)
 }
 
+// MetadataMap returns the image's type and, as far as known, its size in pixels, resolution,
+// number of pages or frames and the camera, timestamp and orientation from its EXIF data.
 func (d *ImageDoc) MetadataMap() map[string]string {
 	meta := make(map[string]string)
 	meta["x-doctype"] = d.typ
-	// this isn't really useful and may even be expensive in terms of cpu/memory and new deps
-	// so omitting it for now...
-
-	// img, typ, err := image.Decode(bytes.NewReader(d.data))
-	// if err != nil {
-	// 	return
-	// }
-
-	// p := img.Bounds().Size()
-	// meta["x-image-dimensions"] = fmt.Sprintf("%dx%d", p.X, p.Y)
+	info, err := d.load()
+	if err != nil {
+		return meta
+	}
+	maps.Copy(meta, info.meta)
+	if info.width > 0 && info.height > 0 {
+		meta["x-image-dimensions"] = fmt.Sprintf("%dx%d", info.width, info.height)
+	}
+	if info.dpiX > 0 && info.dpiY > 0 {
+		meta["x-image-dpi"] = fmt.Sprintf("%sx%s", formatDpi(info.dpiX), formatDpi(info.dpiY))
+	}
+	frames := max(len(info.pages), 1)
+	meta["x-image-frames"] = strconv.Itoa(frames)
+	if frames > 1 {
+		meta["x-document-pages"] = strconv.Itoa(frames)
+	}
 	return meta
 }
+
+// formatDpi rounds dpi, which is stored as pixels per meter in PNGs
+func formatDpi(dpi float64) string {
+	return strconv.Itoa(int(math.Round(dpi)))
+}
@@ -0,0 +1,353 @@
+package imageparser
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"testing"
+
+	"github.com/johbar/text-extraction-service/v4/pkg/tesswrap"
+)
+
+// field is a TIFF field to be encoded by encodeTiff
+type field struct {
+	tag, typ uint16
+	count    uint32
+	value    []byte
+}
+
+func short(tag uint16, v uint16) field {
+	return field{tag, 3, 1, binary.LittleEndian.AppendUint16(nil, v)}
+}
+
+func long(tag uint16, v uint32) field {
+	return field{tag, 4, 1, binary.LittleEndian.AppendUint32(nil, v)}
+}
+
+func rational(tag uint16, num, denom uint32) field {
+	return field{tag, 5, 1, binary.LittleEndian.AppendUint32(binary.LittleEndian.AppendUint32(nil, num), denom)}
+}
+
+func ascii(tag uint16, s string) field {
+	return field{tag, 2, uint32(len(s) + 1), append([]byte(s), 0)}
+}
+
+// encodeTiff encodes the IFDs as little endian TIFF file. The StripOffsets of page i point to strips[i].
+func encodeTiff(ifds [][]field, strips [][]byte) []byte {
+	buf := []byte("II*\x00\x00\x00\x00\x00")
+	next := 4
+	for i, fields := range ifds {
+		binary.LittleEndian.PutUint32(buf[next:], uint32(len(buf)))
+		ifdPos := len(buf)
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(len(fields)))
+		buf = append(buf, make([]byte, 12*len(fields)+4)...)
+		next = len(buf) - 4
+		for j, f := range fields {
+			p := ifdPos + 2 + 12*j
+			binary.LittleEndian.PutUint16(buf[p:], f.tag)
+			binary.LittleEndian.PutUint16(buf[p+2:], f.typ)
+			binary.LittleEndian.PutUint32(buf[p+4:], f.count)
+			switch {
+			case f.tag == tagStripOffsets:
+				binary.LittleEndian.PutUint32(buf[p+8:], uint32(len(buf)))
+				buf = append(buf, strips[i]...)
+			case len(f.value) > 4:
+				binary.LittleEndian.PutUint32(buf[p+8:], uint32(len(buf)))
+				buf = append(buf, f.value...)
+			default:
+				copy(buf[p+8:], f.value)
+			}
+		}
+	}
+	return buf
+}
+
+// grayPage returns the fields of an uncompressed 8 bit grayscale page
+func grayPage(w, h int, dpi uint32) []field {
+	return []field{
+		short(tagImageWidth, uint16(w)),
+		short(tagImageLength, uint16(h)),
+		short(258, 8),
+		short(259, 1),
+		short(262, 1),
+		long(tagStripOffsets, 0),
+		short(277, 1),
+		short(278, uint16(h)),
+		long(tagStripByteCounts, uint32(w*h)),
+		rational(tagXResolution, dpi, 1),
+		rational(tagYResolution, dpi/2, 1),
+		short(tagResolutionUnit, 2),
+	}
+}
+
+func TestMultiPageTiff(t *testing.T) {
+	strips := [][]byte{bytes.Repeat([]byte{10}, 12), bytes.Repeat([]byte{20}, 12), bytes.Repeat([]byte{30}, 12)}
+	data := encodeTiff([][]field{
+		append(grayPage(4, 3, 204), ascii(tagMake, "Fax"), ascii(tagDateTime, "2024:05:06 07:08:09")),
+		grayPage(4, 3, 204),
+		grayPage(4, 3, 204),
+	}, strips)
+	d := NewFromBytes(data, ".tiff")
+	if n := d.Pages(); n != 3 {
+		t.Fatalf("Pages() = %d, want 3", n)
+	}
+	meta := d.MetadataMap()
+	want := map[string]string{
+		"x-doctype":          "tiff",
+		"x-image-dimensions": "4x3",
+		"x-image-dpi":        "204x102",
+		"x-image-frames":     "3",
+		"x-document-pages":   "3",
+		"x-exif-make":        "Fax",
+		"x-document-created": "2024-05-06T07:08:09",
+	}
+	for k, v := range want {
+		if meta[k] != v {
+			t.Errorf("metadata %s = %q, want %q", k, meta[k], v)
+		}
+	}
+
+	info, _ := d.load()
+	for i, p := range info.pages {
+		single, err := p.tiff.page(p.ifd)
+		if err != nil {
+			t.Fatalf("page %d: %v", i, err)
+		}
+		r, first, err := newTiffReader(single)
+		if err != nil {
+			t.Fatalf("page %d: %v", i, err)
+		}
+		offsets, _ := r.pages(first)
+		if len(offsets) != 1 {
+			t.Fatalf("page %d has %d IFDs, want 1", i, len(offsets))
+		}
+		entries, _, _ := r.ifd(offsets[0])
+		if w, h := r.size(entries); w != 4 || h != 3 {
+			t.Errorf("page %d: size %dx%d, want 4x3", i, w, h)
+		}
+		if x, y := r.resolution(entries); x != 204 || y != 102 {
+			t.Errorf("page %d: resolution %vx%v, want 204x102", i, x, y)
+		}
+		off, _ := r.uint(entries, tagStripOffsets)
+		if got := single[off : off+12]; !bytes.Equal(got, strips[i]) {
+			t.Errorf("page %d: image data %v, want %v", i, got, strips[i])
+		}
+	}
+}
+
+func TestSinglePageTiff(t *testing.T) {
+	d := NewFromBytes(encodeTiff([][]field{grayPage(4, 3, 300)}, [][]byte{make([]byte, 12)}), ".tiff")
+	if n := d.Pages(); n != -1 {
+		t.Errorf("Pages() = %d, want -1", n)
+	}
+	if frames := d.MetadataMap()["x-image-frames"]; frames != "1" {
+		t.Errorf("x-image-frames = %q, want 1", frames)
+	}
+	if _, _, err := d.Recognize(1, tesswrap.Options{}); err == nil {
+		t.Error("expected an error for page 1 of a single image")
+	}
+}
+
+func TestGifFrames(t *testing.T) {
+	palette := color.Palette{color.Transparent, color.White, color.Black}
+	g := &gif.GIF{Config: image.Config{Width: 4, Height: 4, ColorModel: palette}}
+	for i := range 3 {
+		frame := image.NewPaletted(image.Rect(i, 0, i+1, 1), palette)
+		frame.SetColorIndex(i, 0, 2)
+		g.Image = append(g.Image, frame)
+		g.Delay = append(g.Delay, 10)
+		g.Disposal = append(g.Disposal, gif.DisposalNone)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	frames, err := gifFrames(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 3 {
+		t.Fatalf("got %d frames, want 3", len(frames))
+	}
+	// every frame adds a black pixel to the preceding ones on white
+	last := frames[2]
+	for x := range 4 {
+		want := uint8(0)
+		if x == 3 {
+			want = 255
+		}
+		if got := last.GrayAt(x, 0).Y; got != want {
+			t.Errorf("pixel %d of the last frame = %d, want %d", x, got, want)
+		}
+	}
+	if n := NewFromBytes(buf.Bytes(), ".gif").Pages(); n != 3 {
+		t.Errorf("Pages() = %d, want 3", n)
+	}
+}
+
+func TestAnimatedWebp(t *testing.T) {
+	// lossless bitstream header of a 5x7 image
+	vp8l := []byte{0x2f, 4, 0x80, 1, 0}
+	chunk := func(fourcc string, payload []byte) []byte {
+		b := append([]byte(fourcc), binary.LittleEndian.AppendUint32(nil, uint32(len(payload)))...)
+		b = append(b, payload...)
+		if len(payload)%2 == 1 {
+			b = append(b, 0)
+		}
+		return b
+	}
+	vp8x := make([]byte, 10)
+	vp8x[0] = 0x02
+	vp8x[4], vp8x[7] = 9, 19
+	body := []byte("WEBP")
+	body = append(body, chunk("VP8X", vp8x)...)
+	for range 2 {
+		body = append(body, chunk("ANMF", append(make([]byte, 16), chunk("VP8L", vp8l)...))...)
+	}
+	data := append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(len(body)))...)
+	data = append(data, body...)
+
+	w, h, frames := webpInfo(data)
+	if w != 10 || h != 20 {
+		t.Errorf("size %dx%d, want 10x20", w, h)
+	}
+	if len(frames) != 2 {
+		t.Fatalf("got %d frames, want 2", len(frames))
+	}
+	fw, fh, fframes := webpInfo(frames[0])
+	if fw != 5 || fh != 7 || fframes != nil {
+		t.Errorf("frame: size %dx%d with %d frames, want 5x7 without frames", fw, fh, len(fframes))
+	}
+}
+
+// segment returns a JPEG segment with the given marker
+func segment(marker byte, payload []byte) []byte {
+	b := binary.BigEndian.AppendUint16([]byte{0xff, marker}, uint16(2+len(payload)))
+	return append(b, payload...)
+}
+
+func TestJpegMetadata(t *testing.T) {
+	gpsRationals := func(tag uint16, values ...uint32) field {
+		var b []byte
+		for _, v := range values {
+			b = binary.LittleEndian.AppendUint32(binary.LittleEndian.AppendUint32(b, v), 1)
+		}
+		return field{tag, 5, uint32(len(values)), b}
+	}
+	exif := encodeTiff([][]field{{
+		ascii(tagMake, "Canon"),
+		ascii(tagModel, "EOS 5D"),
+		short(tagOrientation, 6),
+		rational(tagXResolution, 72, 1),
+		rational(tagYResolution, 72, 1),
+		ascii(tagDateTime, "2021:09:08 15:51:50"),
+		ascii(tagArtist, "EXIF Artist"),
+		ascii(tagCopyright, "EXIF Copyright"),
+		long(tagGpsIFD, 0),
+	}, {
+		ascii(tagGpsLatitudeRef, "N"),
+		gpsRationals(tagGpsLatitude, 52, 31, 12),
+		ascii(tagGpsLongitudeRef, "W"),
+		gpsRationals(tagGpsLongitude, 13, 24, 36),
+		field{tagGpsAltitudeRef, 1, 1, []byte{0}},
+		gpsRationals(tagGpsAltitude, 34),
+	}}, nil)
+	// the second IFD of the chain serves as GPS IFD
+	r, first, _ := newTiffReader(exif)
+	offsets, _ := r.pages(first)
+	ifd0, _, _ := r.ifd(offsets[0])
+	gps, _ := find(ifd0, tagGpsIFD)
+	binary.LittleEndian.PutUint32(gps.value, offsets[1])
+
+	var iptc []byte
+	for _, ds := range []struct {
+		record, dataset byte
+		value           string
+	}{
+		{1, 90, "\x1b%G"},
+		{2, iptcObjectName, "IPTC Title"},
+		{2, iptcKeywords, "Grüße"},
+		{2, iptcKeywords, "Berlin"},
+		{2, iptcCaption, "IPTC Caption"},
+		{2, iptcByline, "IPTC Author"},
+	} {
+		iptc = append(iptc, 0x1c, ds.record, ds.dataset)
+		iptc = binary.BigEndian.AppendUint16(iptc, uint16(len(ds.value)))
+		iptc = append(iptc, ds.value...)
+	}
+	photoshop := []byte("Photoshop 3.0\x00")
+	photoshop = append(photoshop, "8BIM\x04\x04\x00\x00"...)
+	photoshop = binary.BigEndian.AppendUint32(photoshop, uint32(len(iptc)))
+	photoshop = append(photoshop, iptc...)
+
+	xmp := `http://ns.adobe.com/xap/1.0/` + "\x00" + `<x:xmpmeta xmlns:x="adobe:ns:meta/">
+<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+<rdf:Description rdf:about="" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:xmp="http://ns.adobe.com/xap/1.0/"
+ xmp:CreatorTool="Darktable" xmp:CreateDate="2021-09-08T15:51:50+02:00">
+<dc:creator><rdf:Seq><rdf:li>Jane Doe</rdf:li><rdf:li>John Doe</rdf:li></rdf:Seq></dc:creator>
+<dc:description><rdf:Alt><rdf:li xml:lang="x-default">XMP Description</rdf:li><rdf:li xml:lang="de">XMP Beschreibung</rdf:li></rdf:Alt></dc:description>
+</rdf:Description>
+</rdf:RDF>
+</x:xmpmeta>`
+
+	var img bytes.Buffer
+	if err := jpeg.Encode(&img, image.NewGray(image.Rect(0, 0, 8, 6)), nil); err != nil {
+		t.Fatal(err)
+	}
+	data := []byte{0xff, 0xd8}
+	data = append(data, segment(0xe1, append([]byte("Exif\x00\x00"), exif...))...)
+	data = append(data, segment(0xe1, []byte(xmp))...)
+	data = append(data, segment(0xed, photoshop)...)
+	data = append(data, img.Bytes()[2:]...)
+
+	meta := NewFromBytes(data, ".jpg").MetadataMap()
+	want := map[string]string{
+		"x-exif-make":            "Canon",
+		"x-exif-model":           "EOS 5D",
+		"x-exif-orientation":     "6",
+		"x-exif-gps-latitude":    "52.520000",
+		"x-exif-gps-longitude":   "-13.410000",
+		"x-exif-gps-altitude":    "34.0",
+		"x-document-created":     "2021-09-08T15:51:50+02:00",
+		"x-document-title":       "IPTC Title",
+		"x-document-keywords":    "Grüße, Berlin",
+		"x-document-description": "XMP Description",
+		"x-document-author":      "Jane Doe, John Doe",
+		"x-document-copyright":   "EXIF Copyright",
+		"x-document-creator":     "Darktable",
+		"x-image-dimensions":     "8x6",
+		"x-image-frames":         "1",
+		// Go writes no JFIF header, so the resolution is taken from EXIF
+		"x-image-dpi": "72x72",
+	}
+	for k, v := range want {
+		if meta[k] != v {
+			t.Errorf("metadata %s = %q, want %q", k, meta[k], v)
+		}
+	}
+}
+
+func TestWithoutOcr(t *testing.T) {
+	var img bytes.Buffer
+	if err := jpeg.Encode(&img, image.NewGray(image.Rect(0, 0, 8, 6)), nil); err != nil {
+		t.Fatal(err)
+	}
+	initialized := tesswrap.Initialized
+	tesswrap.Initialized = false
+	defer func() { tesswrap.Initialized = initialized }()
+	d := NewFromBytes(img.Bytes(), ".jpg")
+	page, r, err := d.Recognize(0, tesswrap.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Text != "" || page.Width != 8 || page.Height != 6 {
+		t.Errorf("got text %q on a %vx%v page, want an empty 8x6 page", r.Text, page.Width, page.Height)
+	}
+	var text bytes.Buffer
+	if err := d.StreamText(&text); err != nil || text.Len() > 0 {
+		t.Errorf("StreamText wrote %q, err %v", text.String(), err)
+	}
+}
@@ -0,0 +1,155 @@
+package imageparser
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// IPTC-IIM datasets of the application record (2)
+const (
+	iptcObjectName = 5
+	iptcKeywords   = 25
+	iptcDate       = 55
+	iptcTime       = 60
+	iptcByline     = 80
+	iptcHeadline   = 105
+	iptcCopyright  = 116
+	iptcCaption    = 120
+)
+
+// iptcData returns the IPTC-IIM records embedded in the Photoshop resources (APP13) of a JPEG
+// or the IPTC field of a TIFF, nil if there are none.
+func iptcData(data []byte) []byte {
+	if isTiff(data) {
+		t, off, err := newTiffReader(data)
+		if err != nil {
+			return nil
+		}
+		ifd0, _, err := t.ifd(off)
+		if err != nil {
+			return nil
+		}
+		e, ok := find(ifd0, tagIptc)
+		if !ok {
+			return nil
+		}
+		// the field is declared as LONG or UNDEFINED, but holds bytes either way
+		v, _ := t.bytes(e)
+		return v
+	}
+	if !bytes.HasPrefix(data, []byte{0xff, 0xd8}) {
+		return nil
+	}
+	segment := jpegSegment(data[2:], 0xed, "Photoshop 3.0\x00")
+	if segment == nil {
+		return nil
+	}
+	return photoshopResource(segment[len("Photoshop 3.0\x00"):], 0x0404)
+}
+
+// photoshopResource returns the Photoshop image resource with the given ID, nil if there is none.
+func photoshopResource(data []byte, id uint16) []byte {
+	for len(data) >= 12 && bytes.HasPrefix(data, []byte("8BIM")) {
+		resourceID := binary.BigEndian.Uint16(data[4:])
+		// the name is a Pascal string, padded to an even size
+		nameSize := int(data[6]) + 1
+		nameSize += nameSize % 2
+		if len(data) < 6+nameSize+4 {
+			return nil
+		}
+		size := int(binary.BigEndian.Uint32(data[6+nameSize:]))
+		start := 6 + nameSize + 4
+		if size < 0 || len(data) < start+size {
+			return nil
+		}
+		if resourceID == id {
+			return data[start : start+size]
+		}
+		data = data[start+size+size%2:]
+	}
+	return nil
+}
+
+// iptcMetadata returns the title, caption, keywords, author, copyright and creation date stored in IPTC-IIM records.
+func iptcMetadata(data []byte) map[string]string {
+	meta := make(map[string]string)
+	values := make(map[byte][]string)
+	utf8Charset := false
+	for len(data) >= 5 && data[0] == 0x1c {
+		record, dataset := data[1], data[2]
+		size := int(binary.BigEndian.Uint16(data[3:]))
+		if size&0x8000 != 0 || len(data) < 5+size {
+			// extended datasets are used for binary data only
+			break
+		}
+		value := data[5 : 5+size]
+		data = data[5+size:]
+		switch record {
+		case 1:
+			// the coded character set ESC % G declares UTF-8
+			if dataset == 90 && bytes.Equal(value, []byte("\x1b%G")) {
+				utf8Charset = true
+			}
+		case 2:
+			values[dataset] = append(values[dataset], string(value))
+		}
+	}
+	text := func(dataset byte) []string {
+		var texts []string
+		for _, v := range values[dataset] {
+			if !utf8Charset && !utf8.ValidString(v) {
+				v = latin1(v)
+			}
+			if v = strings.TrimSpace(v); v != "" {
+				texts = append(texts, v)
+			}
+		}
+		return texts
+	}
+	for dataset, key := range map[byte]string{
+		iptcCaption:   "x-document-description",
+		iptcByline:    "x-document-author",
+		iptcCopyright: "x-document-copyright",
+		iptcKeywords:  "x-document-keywords",
+	} {
+		if v := text(dataset); len(v) > 0 {
+			meta[key] = strings.Join(v, ", ")
+		}
+	}
+	// the object name is preferred to the headline as title
+	if v := append(text(iptcObjectName), text(iptcHeadline)...); len(v) > 0 {
+		meta["x-document-title"] = v[0]
+	}
+	if created := iptcCreated(text(iptcDate), text(iptcTime)); created != "" {
+		meta["x-document-created"] = created
+	}
+	return meta
+}
+
+// iptcCreated returns the date (CCYYMMDD) and optional time (HHMMSS±HHMM) formatted as RFC 3339.
+func iptcCreated(date, clock []string) string {
+	if len(date) == 0 {
+		return ""
+	}
+	if len(clock) > 0 {
+		if ts, err := time.Parse("20060102150405-0700", date[0]+clock[0]); err == nil {
+			return ts.Format(time.RFC3339)
+		}
+	}
+	if ts, err := time.Parse("20060102", date[0]); err == nil {
+		return ts.Format(time.DateOnly)
+	}
+	return ""
+}
+
+// latin1 converts ISO 8859-1 encoded text to UTF-8.
+func latin1(s string) string {
+	var sb strings.Builder
+	for i := range len(s) {
+		sb.WriteRune(rune(s[i]))
+	}
+	return sb.String()
+}
@@ -0,0 +1,329 @@
+package imageparser
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// TIFF tags used for pages and metadata
+const (
+	tagImageWidth       = 256
+	tagImageLength      = 257
+	tagMake             = 271
+	tagModel            = 272
+	tagStripOffsets     = 273
+	tagOrientation      = 274
+	tagStripByteCounts  = 279
+	tagXResolution      = 282
+	tagYResolution      = 283
+	tagResolutionUnit   = 296
+	tagDateTime         = 306
+	tagTileOffsets      = 324
+	tagTileByteCounts   = 325
+	tagSubIFDs          = 330
+	tagJpegIFOffset     = 513
+	tagJpegIFByteCount  = 514
+	tagExifIFD          = 34665
+	tagGpsIFD           = 34853
+	tagDateTimeOriginal = 36867
+	tagInteropIFD       = 40965
+)
+
+// maxPages limits the number of pages read from a TIFF file
+const maxPages = 10000
+
+var errTiff = errors.New("invalid TIFF data")
+
+// typeSizes holds the size in bytes of the TIFF field types
+var typeSizes = [...]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8, 13: 4}
+
+// tiffReader reads the image file directories (IFDs) of a TIFF file. EXIF data has the same structure.
+type tiffReader struct {
+	data []byte
+	bo   binary.ByteOrder
+}
+
+// ifdEntry is a field of an IFD
+type ifdEntry struct {
+	tag, typ uint16
+	count    uint32
+	// value holds the value or its offset, if it takes more than 4 bytes
+	value []byte
+}
+
+func isTiff(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("II*\x00")) || bytes.HasPrefix(data, []byte("MM\x00*"))
+}
+
+// newTiffReader returns a reader for the TIFF data and the offset of the first IFD.
+// BigTIFF is not supported.
+func newTiffReader(data []byte) (*tiffReader, uint32, error) {
+	if len(data) < 8 {
+		return nil, 0, errTiff
+	}
+	var bo binary.ByteOrder
+	switch string(data[:2]) {
+	case "II":
+		bo = binary.LittleEndian
+	case "MM":
+		bo = binary.BigEndian
+	default:
+		return nil, 0, errTiff
+	}
+	if version := bo.Uint16(data[2:]); version != 42 {
+		return nil, 0, fmt.Errorf("unsupported TIFF version %d", version)
+	}
+	return &tiffReader{data: data, bo: bo}, bo.Uint32(data[4:]), nil
+}
+
+// ifd returns the entries of the IFD at off and the offset of the next IFD, 0 if it is the last one.
+func (t *tiffReader) ifd(off uint32) ([]ifdEntry, uint32, error) {
+	if uint64(off)+2 > uint64(len(t.data)) {
+		return nil, 0, fmt.Errorf("%w: IFD offset %d out of bounds", errTiff, off)
+	}
+	n := int(t.bo.Uint16(t.data[off:]))
+	end := int(off) + 2 + 12*n + 4
+	if end > len(t.data) {
+		return nil, 0, fmt.Errorf("%w: IFD at %d exceeds the data", errTiff, off)
+	}
+	entries := make([]ifdEntry, n)
+	for i := range entries {
+		p := int(off) + 2 + 12*i
+		entries[i] = ifdEntry{
+			tag:   t.bo.Uint16(t.data[p:]),
+			typ:   t.bo.Uint16(t.data[p+2:]),
+			count: t.bo.Uint32(t.data[p+4:]),
+			value: t.data[p+8 : p+12],
+		}
+	}
+	return entries, t.bo.Uint32(t.data[end-4:]), nil
+}
+
+// pages returns the offsets of the IFDs in the chain starting at first, i.e. the pages of the file.
+// A broken chain ends with the last readable IFD.
+func (t *tiffReader) pages(first uint32) ([]uint32, error) {
+	var offsets []uint32
+	seen := make(map[uint32]bool)
+	for off := first; off != 0 && !seen[off] && len(offsets) < maxPages; {
+		seen[off] = true
+		_, next, err := t.ifd(off)
+		if err != nil {
+			if len(offsets) > 0 {
+				break
+			}
+			return nil, err
+		}
+		offsets = append(offsets, off)
+		off = next
+	}
+	return offsets, nil
+}
+
+func find(entries []ifdEntry, tag uint16) (ifdEntry, bool) {
+	for _, e := range entries {
+		if e.tag == tag {
+			return e, true
+		}
+	}
+	return ifdEntry{}, false
+}
+
+// bytes returns the raw value of e and false if its type is unknown or it is out of bounds.
+func (t *tiffReader) bytes(e ifdEntry) ([]byte, bool) {
+	if int(e.typ) >= len(typeSizes) || typeSizes[e.typ] == 0 {
+		return nil, false
+	}
+	size := uint64(typeSizes[e.typ]) * uint64(e.count)
+	if size <= 4 {
+		return e.value[:size], true
+	}
+	off := uint64(t.bo.Uint32(e.value))
+	if off+size > uint64(len(t.data)) {
+		return nil, false
+	}
+	return t.data[off : off+size], true
+}
+
+// uints returns the values of a BYTE, SHORT or LONG entry.
+func (t *tiffReader) uints(e ifdEntry) ([]uint32, bool) {
+	v, ok := t.bytes(e)
+	if !ok {
+		return nil, false
+	}
+	values := make([]uint32, e.count)
+	for i := range values {
+		switch e.typ {
+		case 1:
+			values[i] = uint32(v[i])
+		case 3:
+			values[i] = uint32(t.bo.Uint16(v[2*i:]))
+		case 4:
+			values[i] = t.bo.Uint32(v[4*i:])
+		default:
+			return nil, false
+		}
+	}
+	return values, true
+}
+
+// uint returns the first value of the BYTE, SHORT or LONG entry with the given tag.
+func (t *tiffReader) uint(entries []ifdEntry, tag uint16) (uint32, bool) {
+	e, ok := find(entries, tag)
+	if !ok || e.count == 0 {
+		return 0, false
+	}
+	values, ok := t.uints(e)
+	if !ok {
+		return 0, false
+	}
+	return values[0], true
+}
+
+// rational returns the first value of the RATIONAL entry with the given tag.
+func (t *tiffReader) rational(entries []ifdEntry, tag uint16) (float64, bool) {
+	e, ok := find(entries, tag)
+	if !ok || e.typ != 5 || e.count == 0 {
+		return 0, false
+	}
+	v, ok := t.bytes(e)
+	if !ok {
+		return 0, false
+	}
+	num, denom := t.bo.Uint32(v), t.bo.Uint32(v[4:])
+	if denom == 0 {
+		return 0, false
+	}
+	return float64(num) / float64(denom), true
+}
+
+// ascii returns the value of the ASCII entry with the given tag without trailing NULs and spaces.
+func (t *tiffReader) ascii(entries []ifdEntry, tag uint16) string {
+	e, ok := find(entries, tag)
+	if !ok || e.typ != 2 {
+		return ""
+	}
+	v, _ := t.bytes(e)
+	if i := bytes.IndexByte(v, 0); i >= 0 {
+		v = v[:i]
+	}
+	return string(bytes.TrimSpace(v))
+}
+
+// size returns the width and height in pixels of the page described by entries.
+func (t *tiffReader) size(entries []ifdEntry) (int, int) {
+	w, _ := t.uint(entries, tagImageWidth)
+	h, _ := t.uint(entries, tagImageLength)
+	return int(w), int(h)
+}
+
+// resolution returns the horizontal and vertical resolution in dpi of the page described by entries, 0 if unknown.
+func (t *tiffReader) resolution(entries []ifdEntry) (float64, float64) {
+	x, okX := t.rational(entries, tagXResolution)
+	y, okY := t.rational(entries, tagYResolution)
+	if !okX || !okY {
+		return 0, 0
+	}
+	unit, ok := t.uint(entries, tagResolutionUnit)
+	if !ok {
+		// inch is the default
+		unit = 2
+	}
+	switch unit {
+	case 2:
+		return x, y
+	case 3:
+		return x * 2.54, y * 2.54
+	}
+	return 0, 0
+}
+
+// page returns the IFD at off as TIFF file of its own, containing only the data the IFD refers to.
+// Pointers to other IFDs, e.g. the EXIF IFD, and old-style JPEG data are dropped.
+func (t *tiffReader) page(off uint32) ([]byte, error) {
+	entries, _, err := t.ifd(off)
+	if err != nil {
+		return nil, err
+	}
+	offsetsTag, countsTag := uint16(tagStripOffsets), uint16(tagStripByteCounts)
+	if _, ok := find(entries, tagTileOffsets); ok {
+		offsetsTag, countsTag = tagTileOffsets, tagTileByteCounts
+	}
+	offsetsEntry, ok := find(entries, offsetsTag)
+	if !ok {
+		return nil, fmt.Errorf("%w: page has no image data", errTiff)
+	}
+	countsEntry, _ := find(entries, countsTag)
+	offsets, okOffsets := t.uints(offsetsEntry)
+	counts, okCounts := t.uints(countsEntry)
+	if !okOffsets || !okCounts || len(offsets) != len(counts) {
+		return nil, fmt.Errorf("%w: invalid image data offsets", errTiff)
+	}
+
+	type field struct {
+		entry ifdEntry
+		value []byte
+	}
+	fields := make([]field, 0, len(entries))
+	for _, e := range entries {
+		switch e.tag {
+		case tagSubIFDs, tagExifIFD, tagGpsIFD, tagInteropIFD, tagJpegIFOffset, tagJpegIFByteCount:
+			continue
+		case offsetsTag:
+			// the offsets are rewritten as LONGs, once the data has been placed
+			e.typ = 4
+			fields = append(fields, field{e, make([]byte, 4*len(offsets))})
+			continue
+		}
+		v, ok := t.bytes(e)
+		if !ok {
+			return nil, fmt.Errorf("%w: value of tag %d out of bounds", errTiff, e.tag)
+		}
+		fields = append(fields, field{e, v})
+	}
+
+	// header, the IFD, values that don't fit into the IFD, then the image data
+	buf := make([]byte, 8+2+12*len(fields)+4)
+	copy(buf, t.data[:4])
+	t.bo.PutUint32(buf[4:], 8)
+	t.bo.PutUint16(buf[8:], uint16(len(fields)))
+	offsetsPos := 0
+	for i, f := range fields {
+		p := 10 + 12*i
+		t.bo.PutUint16(buf[p:], f.entry.tag)
+		t.bo.PutUint16(buf[p+2:], f.entry.typ)
+		t.bo.PutUint32(buf[p+4:], f.entry.count)
+		valuePos := p + 8
+		if len(f.value) > 4 {
+			// values start on a word boundary
+			if len(buf)%2 == 1 {
+				buf = append(buf, 0)
+			}
+			valuePos = len(buf)
+			t.bo.PutUint32(buf[p+8:], uint32(valuePos))
+			buf = append(buf, f.value...)
+		} else {
+			copy(buf[valuePos:], f.value)
+		}
+		if f.entry.tag == offsetsTag {
+			offsetsPos = valuePos
+		}
+	}
+	for i, o := range offsets {
+		end := uint64(o) + uint64(counts[i])
+		if end > uint64(len(t.data)) {
+			return nil, fmt.Errorf("%w: image data out of bounds", errTiff)
+		}
+		if len(buf)%2 == 1 {
+			buf = append(buf, 0)
+		}
+		if len(buf) > math.MaxUint32 {
+			return nil, fmt.Errorf("%w: page too large", errTiff)
+		}
+		t.bo.PutUint32(buf[offsetsPos+4*i:], uint32(len(buf)))
+		buf = append(buf, t.data[o:end]...)
+	}
+	return buf, nil
+}
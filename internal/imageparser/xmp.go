@@ -0,0 +1,127 @@
+package imageparser
+
+import (
+	"bytes"
+	"encoding/xml"
+	"strings"
+	"time"
+)
+
+// XML namespaces of the XMP properties read
+const (
+	nsRdf       = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+	nsDc        = "http://purl.org/dc/elements/1.1/"
+	nsXmp       = "http://ns.adobe.com/xap/1.0/"
+	nsPhotoshop = "http://ns.adobe.com/photoshop/1.0/"
+)
+
+// xmpKeys maps XMP properties to metadata keys
+var xmpKeys = map[xml.Name]string{
+	{Space: nsDc, Local: "title"}:              "x-document-title",
+	{Space: nsDc, Local: "description"}:        "x-document-description",
+	{Space: nsDc, Local: "subject"}:            "x-document-keywords",
+	{Space: nsDc, Local: "creator"}:            "x-document-author",
+	{Space: nsDc, Local: "rights"}:             "x-document-copyright",
+	{Space: nsXmp, Local: "CreatorTool"}:       "x-document-creator",
+	{Space: nsXmp, Local: "CreateDate"}:        "x-document-created",
+	{Space: nsXmp, Local: "ModifyDate"}:        "x-document-modified",
+	{Space: nsPhotoshop, Local: "DateCreated"}: "x-document-created",
+}
+
+// xmpData returns the XMP packet embedded in an image, nil if there is none.
+// XMP is stored uncompressed in all common formats, so the packet is searched for instead of parsing the container.
+// Compressed XMP in PNG is not found.
+func xmpData(data []byte) []byte {
+	for _, tags := range [][2]string{{"<x:xmpmeta", "</x:xmpmeta>"}, {"<rdf:RDF", "</rdf:RDF>"}} {
+		start := bytes.Index(data, []byte(tags[0]))
+		if start < 0 {
+			continue
+		}
+		end := bytes.Index(data[start:], []byte(tags[1]))
+		if end < 0 {
+			continue
+		}
+		return data[start : start+end+len(tags[1])]
+	}
+	return nil
+}
+
+// xmpMetadata returns the Dublin Core title, description, keywords, author and rights,
+// the creator tool and the creation and modification dates stored in an XMP packet.
+// Properties may be given as elements, with values in rdf:Alt, rdf:Bag or rdf:Seq lists, or as attributes.
+func xmpMetadata(data []byte) map[string]string {
+	meta := make(map[string]string)
+	values := make(map[string][]string)
+	add := func(name xml.Name, value string) {
+		key, ok := xmpKeys[name]
+		if value = strings.TrimSpace(value); ok && value != "" {
+			values[key] = append(values[key], value)
+		}
+	}
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	// elements holds the open elements, properties the property each of them belongs to
+	var elements, properties []xml.Name
+	description := xml.Name{Space: nsRdf, Local: "Description"}
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			break
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			var parent, property xml.Name
+			if len(elements) > 0 {
+				parent, property = elements[len(elements)-1], properties[len(properties)-1]
+			}
+			switch {
+			case tok.Name == description:
+				for _, attr := range tok.Attr {
+					add(attr.Name, attr.Value)
+				}
+			case parent == description:
+				property = tok.Name
+			}
+			// list items and structures belong to the enclosing property
+			elements = append(elements, tok.Name)
+			properties = append(properties, property)
+		case xml.EndElement:
+			if len(elements) > 0 {
+				elements, properties = elements[:len(elements)-1], properties[:len(properties)-1]
+			}
+		case xml.CharData:
+			if len(properties) > 0 {
+				add(properties[len(properties)-1], string(tok))
+			}
+		}
+	}
+	for key, v := range values {
+		switch key {
+		case "x-document-created", "x-document-modified":
+			if ts, ok := xmpDate(v[0]); ok {
+				meta[key] = ts
+			}
+		case "x-document-keywords", "x-document-author":
+			meta[key] = strings.Join(v, ", ")
+		default:
+			// language alternatives repeat the text, the first one is the default
+			meta[key] = v[0]
+		}
+	}
+	return meta
+}
+
+// xmpDate validates an XMP date, which may lack the time or the time zone, and returns it in RFC 3339 format.
+func xmpDate(s string) (string, bool) {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02T15:04", time.DateOnly} {
+		if ts, err := time.Parse(layout, s); err == nil {
+			switch layout {
+			case time.RFC3339Nano:
+				return ts.Format(time.RFC3339), true
+			case time.DateOnly:
+				return s, true
+			}
+			return ts.Format("2006-01-02T15:04:05"), true
+		}
+	}
+	return "", false
+}
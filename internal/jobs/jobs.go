@@ -0,0 +1,71 @@
+// Package jobs persists the state and results of extractions running in the background,
+// so that any replica can report them.
+package jobs
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	"time"
+)
+
+// States of a job
+const (
+	// Queued jobs have been accepted, but not started yet
+	Queued = "queued"
+	// Running jobs are being extracted
+	Running = "running"
+	// Done jobs have a result
+	Done = "done"
+	// Failed jobs have an error message
+	Failed = "failed"
+)
+
+// ErrNotFound is returned for unknown or expired jobs
+var ErrNotFound = errors.New("job not found")
+
+// Job is the extraction of a document in the background
+type Job struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	// Url of the document; empty for documents sent in the request body
+	Url string `json:"url,omitempty"`
+	// Callback is the URL the job and its result are posted to when it is finished
+	Callback string `json:"callback,omitempty"`
+	// Client is the ID of the authenticated client that created the job, the only one that may get it
+	Client string `json:"client,omitempty"`
+	// CallbackStatus is the HTTP status of the last attempt to post to the callback, CallbackError the reason it failed
+	CallbackStatus int    `json:"callbackStatus,omitempty"`
+	CallbackError  string `json:"callbackError,omitempty"`
+	// PagesDone of PagesTotal have been extracted. PagesTotal is 0 if the number of pages is unknown.
+	PagesDone  int    `json:"pagesDone"`
+	PagesTotal int    `json:"pagesTotal"`
+	Error      string `json:"error,omitempty"`
+	// Metadata of the document, sent as headers along with the result
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	ContentType string            `json:"contentType,omitempty"`
+	Created     time.Time         `json:"created"`
+	Updated     time.Time         `json:"updated"`
+}
+
+// Finished reports whether the job is done or failed
+func (j Job) Finished() bool {
+	return j.Status == Done || j.Status == Failed
+}
+
+// Store saves jobs and their results until they expire
+type Store interface {
+	// Put saves the job's state
+	Put(job Job) error
+	// Get returns the job with the given ID or an error wrapping [ErrNotFound]
+	Get(id string) (Job, error)
+	// SaveResult stores the output of the job
+	SaveResult(id string, result []byte) error
+	// StreamResult writes the output of the job to w
+	StreamResult(id string, w io.Writer) error
+}
+
+// NewID returns a random job ID
+func NewID() string {
+	return rand.Text()
+}
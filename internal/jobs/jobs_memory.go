@@ -0,0 +1,77 @@
+package jobs
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps jobs in memory, so they are only known to the replica running them.
+type MemoryStore struct {
+	ttl  time.Duration
+	mtx  sync.Mutex
+	jobs map[string]*memoryJob
+}
+
+type memoryJob struct {
+	job    Job
+	result []byte
+}
+
+// NewMemoryStore returns a store dropping jobs that haven't been updated for ttl
+func NewMemoryStore(ttl time.Duration) *MemoryStore {
+	return &MemoryStore{ttl: ttl, jobs: make(map[string]*memoryJob)}
+}
+
+func (s *MemoryStore) Put(job Job) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for id, j := range s.jobs {
+		if time.Since(j.job.Updated) > s.ttl {
+			delete(s.jobs, id)
+		}
+	}
+	if j, ok := s.jobs[job.ID]; ok {
+		j.job = job
+	} else {
+		s.jobs[job.ID] = &memoryJob{job: job}
+	}
+	return nil
+}
+
+func (s *MemoryStore) Get(id string) (Job, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	j, ok := s.jobs[id]
+	if !ok || time.Since(j.job.Updated) > s.ttl {
+		return Job{}, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	return j.job, nil
+}
+
+func (s *MemoryStore) SaveResult(id string, result []byte) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	j.result = result
+	return nil
+}
+
+func (s *MemoryStore) StreamResult(id string, w io.Writer) error {
+	s.mtx.Lock()
+	j, ok := s.jobs[id]
+	var result []byte
+	if ok {
+		result = j.result
+	}
+	s.mtx.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	_, err := w.Write(result)
+	return err
+}
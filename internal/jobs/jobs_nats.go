@@ -0,0 +1,94 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"encoding/json/v2"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// NatsStore keeps the state of jobs in a NATS key-value bucket and their results in an object store of the same name,
+// so that every replica connected to NATS can report them.
+type NatsStore struct {
+	kv  jetstream.KeyValue
+	obj jetstream.ObjectStore
+}
+
+// NewNatsStore creates or updates the bucket and object store, which drop jobs and results after ttl
+func NewNatsStore(js jetstream.JetStream, bucket string, ttl time.Duration, replicas int) (*NatsStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	kv, err := js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{
+		Bucket:   bucket,
+		TTL:      ttl,
+		Storage:  jetstream.FileStorage,
+		Replicas: replicas,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("initializing NATS key-value bucket for jobs: %w", err)
+	}
+	obj, err := js.CreateOrUpdateObjectStore(ctx, jetstream.ObjectStoreConfig{
+		Bucket:      bucket,
+		TTL:         ttl,
+		Storage:     jetstream.FileStorage,
+		Compression: true,
+		Replicas:    replicas,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("initializing NATS object store for job results: %w", err)
+	}
+	return &NatsStore{kv, obj}, nil
+}
+
+func (s *NatsStore) Put(job Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err = s.kv.Put(ctx, job.ID, data)
+	return err
+}
+
+func (s *NatsStore) Get(id string) (Job, error) {
+	var job Job
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	entry, err := s.kv.Get(ctx, id)
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		return job, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	if err != nil {
+		return job, fmt.Errorf("retrieving job %s: %w", id, err)
+	}
+	err = json.Unmarshal(entry.Value(), &job)
+	return job, err
+}
+
+func (s *NatsStore) SaveResult(id string, result []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := s.obj.PutBytes(ctx, id, result)
+	return err
+}
+
+func (s *NatsStore) StreamResult(id string, w io.Writer) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result, err := s.obj.Get(ctx, id)
+	if errors.Is(err, jetstream.ErrObjectNotFound) {
+		return fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	if err != nil {
+		return fmt.Errorf("retrieving result of job %s: %w", id, err)
+	}
+	defer result.Close()
+	_, err = io.Copy(w, result)
+	return err
+}
@@ -0,0 +1,42 @@
+package jobs
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMemoryStore(t *testing.T) {
+	s := NewMemoryStore(time.Hour)
+	job := Job{ID: NewID(), Status: Queued, Created: time.Now(), Updated: time.Now()}
+	if err := s.Put(job); err != nil {
+		t.Fatal(err)
+	}
+	job.Status, job.PagesDone, job.PagesTotal = Running, 1, 3
+	s.Put(job)
+	got, err := s.Get(job.ID)
+	if err != nil || got.Status != Running || got.PagesDone != 1 || got.Finished() {
+		t.Errorf("got %+v, %v", got, err)
+	}
+	if err := s.SaveResult(job.ID, []byte("text")); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := s.StreamResult(job.ID, &buf); err != nil || buf.String() != "text" {
+		t.Errorf("result %q, %v", buf.String(), err)
+	}
+	if _, err := s.Get("unknown"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unknown job: %v", err)
+	}
+
+	// jobs expire after the TTL
+	s.ttl = time.Nanosecond
+	if _, err := s.Get(job.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expired job: %v", err)
+	}
+	s.Put(Job{ID: NewID(), Updated: time.Now().Add(time.Hour)})
+	if len(s.jobs) != 1 {
+		t.Errorf("expired jobs kept: %d", len(s.jobs))
+	}
+}
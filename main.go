@@ -1,21 +1,30 @@
 package main
 
 import (
+	"errors"
+	"expvar"
+	"flag"
 	"log/slog"
 	"net/http"
 	"os"
+	"strings"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/httplog/v2"
 
+	"github.com/johbar/text-extraction-service/v4/internal/auth"
 	"github.com/johbar/text-extraction-service/v4/internal/cache"
 	tesnats "github.com/johbar/text-extraction-service/v4/internal/cache/nats"
 	"github.com/johbar/text-extraction-service/v4/internal/config"
 	"github.com/johbar/text-extraction-service/v4/internal/docfactory"
 	"github.com/johbar/text-extraction-service/v4/internal/extractor"
+	"github.com/johbar/text-extraction-service/v4/internal/fetcher"
+	"github.com/johbar/text-extraction-service/v4/internal/jobs"
 	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
 
+	"github.com/johbar/text-extraction-service/v4/pkg/imgprep"
 	"github.com/johbar/text-extraction-service/v4/pkg/tesswrap"
 )
 
@@ -29,6 +38,7 @@ func main() {
 	tesConfig, err := config.NewTesConfigFromEnv()
 	if err != nil {
 		slog.Error("FATAL: error when parsing config values", "err", err)
+		os.Exit(2)
 	}
 
 	h := slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: tesConfig.LogLevel})
@@ -36,62 +46,113 @@ func main() {
 	log = slog.New(h)
 	// set static/global config of submodules
 	tesswrap.Languages = tesConfig.TesseractLangs
+	tesswrap.SetMaxConcurrency(tesConfig.OcrWorkers)
+	tesswrap.Preprocessing = imgprep.Options{
+		NormalizeDpi: tesConfig.OcrNormalizeDpi,
+		MinDpi:       float64(tesConfig.OcrMinDpi),
+		TargetDpi:    float64(tesConfig.OcrDpi),
+		Deskew:       tesConfig.OcrDeskew,
+		Binarize:     tesConfig.OcrBinarize,
+	}
+	if tesConfig.OcrRotate {
+		tesswrap.Preprocessing.Orient = tesswrap.DetectOrientation
+	}
 	docFactory := docfactory.New(tesConfig, log)
 
-	var tesCache cache.Cache
-	var objStore *cache.ObjectStoreCache
+	var tesCache cache.Cache = &cache.NopCache{}
 	var nc *nats.Conn
-	/*
-		There are 4 cases:
-		1. A NatsUrl is configured. -> connect
-			a. If that fails and FailWithoutJetstream == true, fail the program start.
-			b. If that fails and FailWithoutJetstream == false, continue with NopCache.
-		2. No NatsUrl is configured but NATS is embedded -> connect.
-	*/
-	natsConfigured := len(tesConfig.NatsUrl) > 0
-	if natsConfigured {
-		// case 1
-		nc, err = tesnats.SetupNatsConnection(*tesConfig, log)
-	} else if tesnats.NatsEmbedded {
-		// case 2
-		nc, err = tesnats.ConnectToEmbeddedNatsServer(*tesConfig)
-	}
-	if err != nil {
-		log.Error("connecting to NATS failed", "err", err)
-	} else {
-		objStore, err = cache.New(*tesConfig, log, nc)
+	switch tesConfig.Cache {
+	case config.CacheNats:
+		tesCache, nc = setupNatsCache(tesConfig)
+	case config.CacheFs:
+		fsCache, err := cache.NewFsCache(tesConfig.CacheDir, int64(tesConfig.CacheMaxSizeBytes), log)
 		if err != nil {
-			if tesConfig.FailWithoutJetstream && natsConfigured {
-				// case 1a
-				log.Error("FATAL: could not init NATS based cache and TES_FAIL_WITHOUT_JS is true", "err", err)
-				os.Exit(2)
-			}
-			if tesConfig.NoHttp {
-				log.Error("FATAL: NATS not connected and HTTP disabled.", "err", err)
-				os.Exit(1)
-			}
+			log.Error("FATAL: could not init file system cache", "err", err)
+			os.Exit(2)
 		}
+		tesCache = fsCache
+	case config.CacheS3:
+		s3Cache, err := cache.NewS3Cache(cache.S3Config{
+			Endpoint:  tesConfig.S3Endpoint,
+			Region:    tesConfig.S3Region,
+			Bucket:    tesConfig.S3Bucket,
+			AccessKey: tesConfig.S3AccessKey,
+			SecretKey: tesConfig.S3SecretKey,
+			Prefix:    tesConfig.S3Prefix,
+			PathStyle: tesConfig.S3PathStyle,
+		}, nil, log)
+		if err != nil {
+			log.Error("FATAL: could not init S3 cache", "err", err)
+			os.Exit(2)
+		}
+		tesCache = s3Cache
 	}
-	if objStore == nil {
-		// case 1b
-		tesCache = &cache.NopCache{}
-	} else {
-		tesCache = objStore
+	if _, nop := tesCache.(*cache.NopCache); !nop && tesConfig.CacheMemorySizeBytes > 0 {
+		tesCache = cache.NewMemoryCache(tesCache, int64(tesConfig.CacheMemorySizeBytes))
 	}
 
-	httpClient := &http.Client{
-		Transport: &http.Transport{DisableCompression: tesConfig.HttpClientDisableCompression, MaxIdleConnsPerHost: 100},
+	guard, err := fetcher.NewGuard(tesConfig.FetchAllow, tesConfig.FetchDeny, tesConfig.FetchAllowPrivate)
+	if err != nil {
+		log.Error("FATAL: invalid fetch allow or deny list", "err", err)
+		os.Exit(2)
+	}
+	httpClient, err := fetcher.NewClient(tesConfig.FetchProfilesFile, fetcher.Options{
+		Guard:              guard,
+		MaxRedirects:       tesConfig.FetchMaxRedirects,
+		DisableCompression: tesConfig.HttpClientDisableCompression,
+		ConnectTimeout:     tesConfig.HttpClientConnectTimeout,
+		ResponseTimeout:    tesConfig.HttpClientResponseTimeout,
+		BodyTimeout:        tesConfig.HttpClientBodyTimeout,
+		Retries:            tesConfig.HttpClientRetries,
+		RetryDelay:         tesConfig.HttpClientRetryDelay,
+		FileRoots:          splitList(tesConfig.FileRoots),
+		S3:                 sourceS3(tesConfig.SourceS3Config),
+	})
+	if err != nil {
+		log.Error("FATAL: could not init HTTP client", "err", err)
+		os.Exit(2)
+	}
+	// callbacks are posted to URLs chosen by clients, so profiles don't apply
+	callbackClient, err := fetcher.NewGuardedClient(fetcher.Options{
+		Guard:           guard,
+		MaxRedirects:    tesConfig.FetchMaxRedirects,
+		ConnectTimeout:  tesConfig.HttpClientConnectTimeout,
+		ResponseTimeout: tesConfig.HttpClientResponseTimeout,
+	})
+	if err != nil {
+		log.Error("FATAL: could not init HTTP client", "err", err)
+		os.Exit(2)
 	}
 	extr := extractor.New(tesConfig, docFactory, tesCache, log, httpClient)
+	extr.SetCallbackClient(callbackClient)
 	extr.LogAndFixConfigIssues()
+	var params extractor.RequestParams
+	flag.StringVar(&params.Mode, "mode", extractor.ModeText, "output mode in one shot mode: text, layout, tables or words")
+	flag.StringVar(&params.Format, "format", "", "output format of mode tables (json, csv or markdown) or words (json, hocr or alto)")
+	flag.StringVar(&params.Ocr, "ocr", "", "OCR mode in one shot mode: auto, always or never (default: TES_OCR)")
+	flag.StringVar(&params.OcrLang, "ocrLang", "", "Tesseract languages in one shot mode, separated by '+', or auto (default: TES_TESSERACT_LANGS)")
+	flag.Float64Var(&params.OcrMinConfidence, "ocrMinConfidence", 0, "drop OCRed words with a lower confidence (0 to 100) in one shot mode (default: TES_OCR_MIN_CONFIDENCE)")
+	flag.Parse()
 	// one shot mode: don't start a server, just process a single file provided on the command line
-	if len(os.Args) > 1 {
+	if flag.NArg() > 0 {
 		// logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn}))
-		extr.PrintMetadataAndTextToStdout(os.Args[1])
+		params.Url = flag.Arg(0)
+		extr.PrintMetadataAndTextToStdout(params)
 		return
 	}
 
 	log.Debug("Starting Text Extraction Service with config", "conf", tesConfig)
+	if tesConfig.WorkQueueStream != "" {
+		nc = setupWorkQueue(tesConfig, nc, extr)
+	}
+	// jobs are created by requests with a callback, via HTTP or NATS
+	nc = setupJobStore(tesConfig, nc, extr)
+	if nc != nil {
+		if err := extr.RegisterNatsService(nc); err != nil {
+			log.Error("FATAL: could not register NATS service", "err", err)
+			os.Exit(2)
+		}
+	}
 	if tesConfig.NoHttp {
 		wait := make(chan struct{})
 		log.Info("Service started with no HTTP endpoints. Waiting for interrupt.")
@@ -105,11 +166,28 @@ func main() {
 			Concise: true,
 		},
 	}), middleware.Recoverer)
-	router.Post("/", extr.ExtractBody)
-	router.Get("/", extr.ExtractRemote)
-	router.Head("/", extr.ExtractRemote)
-	// FIXME: do we need this?
-	// router.GET("/debug/vars", expvar.Handler())
+	// require is a no-op, unless authentication is enabled
+	require := func(string) func(http.Handler) http.Handler {
+		return func(next http.Handler) http.Handler { return next }
+	}
+	if tesConfig.AuthClientsFile != "" || tesConfig.AuthJwksFile != "" {
+		authn, err := auth.New(tesConfig.AuthClientsFile, tesConfig.AuthJwksFile, tesConfig.AuthJwtIssuer, tesConfig.AuthJwtAudience, log)
+		if err != nil {
+			log.Error("FATAL: could not init authentication", "err", err)
+			os.Exit(2)
+		}
+		router.Use(authn.Authenticate)
+		require = authn.Require
+		extr.SetChargeOcrPages(authn.ChargeOcrPages)
+	}
+	router.With(require(auth.FeatureExtract)).Post("/", extr.ExtractBody)
+	router.With(require(auth.FeatureExtract)).Get("/", extr.ExtractRemote)
+	router.With(require(auth.FeatureExtract)).Head("/", extr.ExtractRemote)
+	router.With(require(auth.FeaturePurge)).Delete("/", extr.Purge)
+	router.With(require(auth.FeatureJobs)).Post("/jobs", extr.CreateJob)
+	router.With(require(auth.FeatureJobs)).Get("/jobs/{id}", extr.GetJob)
+	router.With(require(auth.FeatureJobs)).Get("/jobs/{id}/result", extr.GetJobResult)
+	router.With(require(auth.FeatureMetrics)).Get("/debug/vars", expvar.Handler().ServeHTTP)
 
 	srv.Addr = tesConfig.SrvAddr
 	srv.Handler = router
@@ -121,3 +199,126 @@ func main() {
 		log.Error("Webserver failed", "err", err)
 	}
 }
+
+// setupNatsCache connects to NATS and returns the object store cache and the connection
+// or a NopCache and nil, if that fails and is tolerated.
+func setupNatsCache(tesConfig *config.TesConfig) (cache.Cache, *nats.Conn) {
+	var objStore *cache.ObjectStoreCache
+	/*
+		There are 4 cases:
+		1. A NatsUrl is configured. -> connect
+			a. If that fails and FailWithoutJetstream == true, fail the program start.
+			b. If that fails and FailWithoutJetstream == false, continue with NopCache.
+		2. No NatsUrl is configured but NATS is embedded -> connect.
+	*/
+	natsConfigured := len(tesConfig.NatsUrl) > 0
+	nc, err := connectToNats(tesConfig)
+	if err != nil {
+		log.Error("connecting to NATS failed", "err", err)
+	} else {
+		objStore, err = cache.New(*tesConfig, log, nc)
+		if err != nil {
+			if tesConfig.FailWithoutJetstream && natsConfigured {
+				// case 1a
+				log.Error("FATAL: could not init NATS based cache and TES_FAIL_WITHOUT_JS is true", "err", err)
+				os.Exit(2)
+			}
+			if tesConfig.NoHttp {
+				log.Error("FATAL: NATS not connected and HTTP disabled.", "err", err)
+				os.Exit(1)
+			}
+		}
+	}
+	if objStore == nil {
+		// case 1b
+		return &cache.NopCache{}, nil
+	}
+	return objStore, nc
+}
+
+// connectToNats connects to the configured NATS server (case 1) or the embedded one (case 2).
+// It returns nil and no error if neither exists.
+func connectToNats(tesConfig *config.TesConfig) (*nats.Conn, error) {
+	if len(tesConfig.NatsUrl) > 0 {
+		return tesnats.SetupNatsConnection(*tesConfig, log)
+	}
+	if tesnats.NatsEmbedded {
+		return tesnats.ConnectToEmbeddedNatsServer(*tesConfig)
+	}
+	return nil, nil
+}
+
+// setupWorkQueue starts consuming the work-queue stream using the connection of the cache or a new one, which is returned
+func setupWorkQueue(tesConfig *config.TesConfig, nc *nats.Conn, extr *extractor.Extractor) *nats.Conn {
+	var err error
+	if nc == nil {
+		if nc, err = connectToNats(tesConfig); err == nil && nc == nil {
+			err = errors.New("neither TES_NATS_URL is set nor NATS is embedded")
+		}
+	}
+	if err == nil {
+		var js jetstream.JetStream
+		if js, err = jetstream.New(nc); err == nil {
+			err = extr.ConsumeWorkQueue(js)
+		}
+	}
+	if err != nil {
+		log.Error("FATAL: could not consume work queue", "stream", tesConfig.WorkQueueStream, "err", err)
+		os.Exit(2)
+	}
+	return nc
+}
+
+// setupJobStore keeps the jobs of extr in NATS, using the connection of the cache or a new one, so that all replicas know them.
+// Otherwise they are kept in memory, which is fatal if TES_REPLICAS > 1 suggests several replicas.
+// The connection is returned, nil if NATS is not configured or not reachable.
+func setupJobStore(tesConfig *config.TesConfig, nc *nats.Conn, extr *extractor.Extractor) *nats.Conn {
+	var err error
+	if nc == nil {
+		if nc, err = connectToNats(tesConfig); err == nil && nc == nil {
+			err = errors.New("neither TES_NATS_URL is set nor NATS is embedded")
+		}
+	}
+	if err == nil {
+		var js jetstream.JetStream
+		if js, err = jetstream.New(nc); err == nil {
+			var store *jobs.NatsStore
+			if store, err = jobs.NewNatsStore(js, tesConfig.JobsBucket, tesConfig.JobsTtl, tesConfig.Replicas); err == nil {
+				extr.SetJobStore(store)
+				return nc
+			}
+		}
+	}
+	if tesConfig.Replicas > 1 {
+		log.Error("FATAL: jobs need NATS to be shared by replicas, as TES_REPLICAS is greater than 1", "err", err)
+		os.Exit(2)
+	}
+	log.Warn("Jobs are kept in memory and only known to this instance", "err", err)
+	return nc
+}
+
+// splitList splits a comma separated list, e.g. of the directories file:// URLs may point into
+func splitList(list string) []string {
+	var entries []string
+	for entry := range strings.SplitSeq(list, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// sourceS3 returns the options of the object store of s3:// URLs or nil, if there is none
+func sourceS3(conf config.SourceS3Config) *fetcher.S3Options {
+	if conf.SourceS3Endpoint == "" {
+		return nil
+	}
+	return &fetcher.S3Options{
+		Endpoint:  conf.SourceS3Endpoint,
+		Region:    conf.SourceS3Region,
+		AccessKey: conf.SourceS3AccessKey,
+		SecretKey: conf.SourceS3SecretKey,
+		Buckets:   splitList(conf.SourceS3Buckets),
+		PathStyle: conf.SourceS3PathStyle,
+	}
+}
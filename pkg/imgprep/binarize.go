@@ -0,0 +1,59 @@
+package imgprep
+
+import "image"
+
+// OtsuThreshold returns the threshold separating dark and light pixels of img that
+// maximizes the variance between both classes.
+func OtsuThreshold(img *image.Gray) uint8 {
+	var hist [256]int
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	for y := range h {
+		for _, v := range img.Pix[y*img.Stride : y*img.Stride+w] {
+			hist[v]++
+		}
+	}
+	total := w * h
+	var sum float64
+	for v, n := range hist {
+		sum += float64(v * n)
+	}
+	var (
+		best      uint8
+		bestVar   float64
+		sumDark   float64
+		countDark int
+	)
+	for t, n := range hist {
+		countDark += n
+		if countDark == 0 {
+			continue
+		}
+		countLight := total - countDark
+		if countLight == 0 {
+			break
+		}
+		sumDark += float64(t * n)
+		meanDark := sumDark / float64(countDark)
+		meanLight := (sum - sumDark) / float64(countLight)
+		between := float64(countDark) * float64(countLight) * (meanDark - meanLight) * (meanDark - meanLight)
+		if between > bestVar {
+			bestVar, best = between, uint8(t)
+		}
+	}
+	return best
+}
+
+// Binarize sets pixels of img up to threshold to black and all others to white.
+func Binarize(img *image.Gray, threshold uint8) {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	for y := range h {
+		row := img.Pix[y*img.Stride : y*img.Stride+w]
+		for x, v := range row {
+			if v <= threshold {
+				row[x] = 0
+			} else {
+				row[x] = 255
+			}
+		}
+	}
+}
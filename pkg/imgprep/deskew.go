@@ -0,0 +1,110 @@
+package imgprep
+
+import (
+	"image"
+	"math"
+)
+
+const (
+	// MaxSkew is the largest skew in degrees Deskew corrects
+	MaxSkew = 10.0
+	// minSkew is the smallest skew in degrees worth correcting
+	minSkew = 0.1
+	// maxSamples limits the dark pixels considered when determining the skew
+	maxSamples = 200_000
+)
+
+// SkewAngle returns the angle in degrees by which the text lines in img descend from left to right,
+// i.e. are rotated clockwise. Rotating img by the negated angle straightens them.
+//
+// The angle is found by projecting the dark pixels onto the vertical axis for candidate
+// angles between -[MaxSkew] and [MaxSkew]. Aligned text lines produce the sharpest profile.
+func SkewAngle(img *image.Gray) float64 {
+	xs, ys := darkPixels(img)
+	if len(xs) == 0 {
+		return 0
+	}
+	height := float64(img.Rect.Dx() + img.Rect.Dy())
+	hist := make([]float64, int(2*height)+2)
+	score := func(deg float64) float64 {
+		sin, cos := math.Sincos(deg * math.Pi / 180)
+		clear(hist)
+		for i := range xs {
+			y := ys[i]*cos - xs[i]*sin + height
+			hist[int(y)]++
+		}
+		var s float64
+		for _, n := range hist {
+			s += n * n
+		}
+		return s
+	}
+	search := func(from, to, step float64) float64 {
+		best, bestScore := 0.0, -1.0
+		for deg := from; deg <= to+step/2; deg += step {
+			if s := score(deg); s > bestScore {
+				best, bestScore = deg, s
+			}
+		}
+		return best
+	}
+	coarse := search(-MaxSkew, MaxSkew, 0.5)
+	return search(coarse-0.5, coarse+0.5, 0.05)
+}
+
+// darkPixels returns the coordinates of a sample of pixels darker than Otsu's threshold.
+func darkPixels(img *image.Gray) (xs, ys []float64) {
+	threshold := OtsuThreshold(img)
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	dark := 0
+	for y := range h {
+		for _, v := range img.Pix[y*img.Stride : y*img.Stride+w] {
+			if v <= threshold {
+				dark++
+			}
+		}
+	}
+	// a page that is mostly dark has no text lines to align
+	if dark == 0 || dark > w*h/2 {
+		return nil, nil
+	}
+	stride := dark/maxSamples + 1
+	xs = make([]float64, 0, dark/stride+1)
+	ys = make([]float64, 0, dark/stride+1)
+	n := 0
+	for y := range h {
+		for x, v := range img.Pix[y*img.Stride : y*img.Stride+w] {
+			if v > threshold {
+				continue
+			}
+			if n%stride == 0 {
+				xs = append(xs, float64(x))
+				ys = append(ys, float64(y))
+			}
+			n++
+		}
+	}
+	return xs, ys
+}
+
+// Rotate rotates img clockwise by degrees around its center. The result is enlarged to hold the
+// whole rotated image, uncovered areas are white.
+func Rotate(img *image.Gray, degrees float64) *image.Gray {
+	sin, cos := math.Sincos(degrees * math.Pi / 180)
+	w, h := float64(img.Rect.Dx()), float64(img.Rect.Dy())
+	dw := int(math.Ceil(w*math.Abs(cos) + h*math.Abs(sin)))
+	dh := int(math.Ceil(w*math.Abs(sin) + h*math.Abs(cos)))
+	dst := image.NewGray(image.Rect(0, 0, dw, dh))
+	cx, cy := w/2, h/2
+	dcx, dcy := float64(dw)/2, float64(dh)/2
+	for y := range dh {
+		for x := range dw {
+			// map the destination pixel back to the source by rotating counter-clockwise
+			rx, ry := float64(x)+0.5-dcx, float64(y)+0.5-dcy
+			sx := rx*cos + ry*sin + cx - 0.5
+			sy := -rx*sin + ry*cos + cy - 0.5
+			dst.Pix[y*dst.Stride+x] = bilinear(img, sx, sy, 255)
+		}
+	}
+	return dst
+}
@@ -0,0 +1,187 @@
+/*
+Package imgprep prepares scans and photos of documents for OCR.
+
+All steps work on grayscale images and are implemented in pure Go:
+normalization of the resolution (e.g. faxes with non-square pixels),
+upscaling of low resolution images, rotation by multiples of 90°, deskewing
+and binarization.
+*/
+package imgprep
+
+import (
+	"image"
+	"image/draw"
+	"math"
+)
+
+const (
+	// maxUpscale limits the factor images are enlarged by
+	maxUpscale = 4.0
+	// a4ShortSide is the width of an A4 page in inches, used to estimate the resolution of
+	// images lacking this information. It is close enough to US Letter's 8.5 in.
+	a4ShortSide = 8.27
+)
+
+// Options select the preprocessing steps. The zero value disables all of them.
+type Options struct {
+	// NormalizeDpi stretches images with different horizontal and vertical resolution, e.g. faxes, to square pixels
+	NormalizeDpi bool
+	// MinDpi is the resolution below which images are upscaled to TargetDpi. Zero disables upscaling.
+	MinDpi float64
+	// TargetDpi is the resolution low resolution images are upscaled to
+	TargetDpi float64
+	// Deskew straightens text lines rotated by up to [MaxSkew] degrees
+	Deskew bool
+	// Binarize converts the image to black and white using Otsu's threshold
+	Binarize bool
+	// Orient, if set, returns the clockwise rotation in degrees that turns the image upright,
+	// e.g. using Tesseract's orientation and script detection
+	Orient func(img *image.Gray) (degrees int, err error)
+}
+
+// Enabled reports whether any preprocessing step is enabled
+func (o Options) Enabled() bool {
+	return o.NormalizeDpi || (o.MinDpi > 0 && o.TargetDpi > o.MinDpi) || o.Orient != nil || o.Deskew || o.Binarize
+}
+
+// Process applies the steps enabled in o to img and returns the result as grayscale image.
+// dpiX and dpiY are the image's resolution, 0 if unknown. Unknown resolutions are estimated
+// by assuming the image shows a page of A4 or Letter size.
+func Process(img image.Image, dpiX, dpiY float64, o Options) *image.Gray {
+	gray := Gray(img)
+	if sx, sy := o.Scale(gray.Rect.Dx(), gray.Rect.Dy(), dpiX, dpiY); sx != 1 || sy != 1 {
+		gray = Resize(gray, int(math.Round(float64(gray.Rect.Dx())*sx)), int(math.Round(float64(gray.Rect.Dy())*sy)))
+	}
+	if o.Orient != nil {
+		// a failed detection leaves the image as it is
+		if degrees, err := o.Orient(gray); err == nil {
+			gray = Rotate90(gray, degrees)
+		}
+	}
+	if o.Deskew {
+		if angle := SkewAngle(gray); math.Abs(angle) >= minSkew {
+			gray = Rotate(gray, -angle)
+		}
+	}
+	if o.Binarize {
+		Binarize(gray, OtsuThreshold(gray))
+	}
+	return gray
+}
+
+// Scale returns the factors Process scales an image of w x h pixels with the given resolution by.
+func (o Options) Scale(w, h int, dpiX, dpiY float64) (sx, sy float64) {
+	if dpiX <= 0 || dpiY <= 0 {
+		dpiX = EstimateDpi(w, h)
+		dpiY = dpiX
+	}
+	sx, sy = 1, 1
+	if o.NormalizeDpi && dpiX != dpiY {
+		// stretch the axis with the lower resolution
+		dpi := max(dpiX, dpiY)
+		sx, sy = dpi/dpiX, dpi/dpiY
+		dpiX, dpiY = dpi, dpi
+	}
+	if dpi := min(dpiX, dpiY); o.MinDpi > 0 && dpi > 0 && dpi < o.MinDpi && o.TargetDpi > dpi {
+		f := min(o.TargetDpi/dpi, maxUpscale)
+		sx, sy = sx*f, sy*f
+	}
+	return sx, sy
+}
+
+// EstimateDpi returns the resolution of an image of w x h pixels, assuming it shows a page of A4 or Letter size.
+func EstimateDpi(w, h int) float64 {
+	return float64(min(w, h)) / a4ShortSide
+}
+
+// Gray returns img as grayscale image with its origin at (0, 0). Gray images are returned as they are.
+func Gray(img image.Image) *image.Gray {
+	if g, ok := img.(*image.Gray); ok && g.Rect.Min == (image.Point{}) {
+		return g
+	}
+	b := img.Bounds()
+	g := image.NewGray(image.Rect(0, 0, b.Dx(), b.Dy()))
+	if !isOpaque(img) {
+		// transparent areas become white, like a sheet of paper
+		draw.Draw(g, g.Rect, image.White, image.Point{}, draw.Src)
+	}
+	draw.Draw(g, g.Rect, img, b.Min, draw.Over)
+	return g
+}
+
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return false
+}
+
+// Resize scales img to w x h pixels using bilinear interpolation.
+func Resize(img *image.Gray, w, h int) *image.Gray {
+	w, h = max(w, 1), max(h, 1)
+	dst := image.NewGray(image.Rect(0, 0, w, h))
+	sw, sh := img.Rect.Dx(), img.Rect.Dy()
+	fx, fy := float64(sw)/float64(w), float64(sh)/float64(h)
+	for y := range h {
+		// map the center of the destination pixel to the source
+		srcY := (float64(y)+0.5)*fy - 0.5
+		for x := range w {
+			srcX := (float64(x)+0.5)*fx - 0.5
+			dst.Pix[y*dst.Stride+x] = bilinear(img, srcX, srcY, 255)
+		}
+	}
+	return dst
+}
+
+// bilinear returns the interpolated value of img at (x, y), which are relative to img's origin.
+// Positions outside of img have the value bg.
+func bilinear(img *image.Gray, x, y float64, bg uint8) uint8 {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	x0, y0 := int(math.Floor(x)), int(math.Floor(y))
+	dx, dy := x-float64(x0), y-float64(y0)
+	at := func(x, y int) float64 {
+		// clamp to the edges within half a pixel, use the background beyond
+		if x == -1 && dx > 0 || x == w && dx < 1 {
+			x = min(max(x, 0), w-1)
+		}
+		if y == -1 && dy > 0 || y == h && dy < 1 {
+			y = min(max(y, 0), h-1)
+		}
+		if x < 0 || y < 0 || x >= w || y >= h {
+			return float64(bg)
+		}
+		return float64(img.Pix[y*img.Stride+x])
+	}
+	v := at(x0, y0)*(1-dx)*(1-dy) + at(x0+1, y0)*dx*(1-dy) + at(x0, y0+1)*(1-dx)*dy + at(x0+1, y0+1)*dx*dy
+	return uint8(math.Round(min(max(v, 0), 255)))
+}
+
+// Rotate90 rotates img clockwise by degrees, which is rounded to a multiple of 90.
+func Rotate90(img *image.Gray, degrees int) *image.Gray {
+	turns := ((degrees%360+360)%360 + 45) / 90 % 4
+	if turns == 0 {
+		return img
+	}
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	var dst *image.Gray
+	if turns == 2 {
+		dst = image.NewGray(image.Rect(0, 0, w, h))
+	} else {
+		dst = image.NewGray(image.Rect(0, 0, h, w))
+	}
+	for y := range h {
+		for x := range w {
+			var dx, dy int
+			switch turns {
+			case 1:
+				dx, dy = h-1-y, x
+			case 2:
+				dx, dy = w-1-x, h-1-y
+			case 3:
+				dx, dy = y, w-1-x
+			}
+			dst.Pix[dy*dst.Stride+dx] = img.Pix[y*img.Stride+x]
+		}
+	}
+	return dst
+}
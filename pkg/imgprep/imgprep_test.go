@@ -0,0 +1,156 @@
+package imgprep
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"testing"
+)
+
+// lines draws horizontal black bars on a white image, like lines of text.
+func lines(w, h int) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for y := range h {
+		for x := range w {
+			v := uint8(255)
+			if y%20 < 6 && x > w/10 && x < w*9/10 && y > h/10 && y < h*9/10 {
+				v = 0
+			}
+			img.SetGray(x, y, color.Gray{v})
+		}
+	}
+	return img
+}
+
+func TestSkewAngle(t *testing.T) {
+	for _, deg := range []float64{-4, 0, 2.5, 7} {
+		img := Rotate(lines(400, 300), deg)
+		if got := SkewAngle(img); math.Abs(got-deg) > 0.2 {
+			t.Errorf("want skew of %v°, got %v°", deg, got)
+		}
+	}
+}
+
+func TestProcessDeskews(t *testing.T) {
+	img := Rotate(lines(400, 300), 3)
+	got := Process(img, 300, 300, Options{Deskew: true})
+	if angle := SkewAngle(got); math.Abs(angle) > 0.2 {
+		t.Errorf("want straight lines after deskewing, got %v°", angle)
+	}
+}
+
+func TestProcessScales(t *testing.T) {
+	img := lines(200, 100)
+	tests := []struct {
+		name       string
+		dpiX, dpiY float64
+		opts       Options
+		w, h       int
+	}{
+		{"disabled", 100, 100, Options{}, 200, 100},
+		{"fax", 200, 100, Options{NormalizeDpi: true}, 200, 200},
+		{"upscale", 100, 100, Options{MinDpi: 150, TargetDpi: 300}, 600, 300},
+		{"high enough", 200, 200, Options{MinDpi: 150, TargetDpi: 300}, 200, 100},
+		{"limited", 50, 50, Options{MinDpi: 150, TargetDpi: 300}, 800, 400},
+		{"fax upscaled", 200, 100, Options{NormalizeDpi: true, MinDpi: 250, TargetDpi: 300}, 300, 300},
+	}
+	for _, tt := range tests {
+		got := Process(img, tt.dpiX, tt.dpiY, tt.opts)
+		if got.Rect.Dx() != tt.w || got.Rect.Dy() != tt.h {
+			t.Errorf("%s: want %dx%d, got %dx%d", tt.name, tt.w, tt.h, got.Rect.Dx(), got.Rect.Dy())
+		}
+	}
+}
+
+func TestProcessOrients(t *testing.T) {
+	orient := func(img *image.Gray) (int, error) { return 90, nil }
+	got := Process(lines(200, 100), 300, 300, Options{Orient: orient})
+	if got.Rect.Dx() != 100 || got.Rect.Dy() != 200 {
+		t.Errorf("want image turned by 90°, got %dx%d", got.Rect.Dx(), got.Rect.Dy())
+	}
+}
+
+func TestOtsuThreshold(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 10, 10))
+	for i := range img.Pix {
+		img.Pix[i] = 200 + uint8(i%10)
+		if i%3 == 0 {
+			img.Pix[i] = 40 + uint8(i%10)
+		}
+	}
+	th := OtsuThreshold(img)
+	if th < 49 || th >= 200 {
+		t.Fatalf("want threshold between both classes, got %d", th)
+	}
+	Binarize(img, th)
+	for i, v := range img.Pix {
+		if want := map[bool]uint8{true: 0, false: 255}[i%3 == 0]; v != want {
+			t.Fatalf("pixel %d: want %d, got %d", i, want, v)
+		}
+	}
+}
+
+func TestRotate90(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 3, 2))
+	copy(img.Pix, []uint8{1, 2, 3, 4, 5, 6})
+	tests := []struct {
+		deg  int
+		w    int
+		want []uint8
+	}{
+		{0, 3, []uint8{1, 2, 3, 4, 5, 6}},
+		{90, 2, []uint8{4, 1, 5, 2, 6, 3}},
+		{180, 3, []uint8{6, 5, 4, 3, 2, 1}},
+		{270, 2, []uint8{3, 6, 2, 5, 1, 4}},
+		{-90, 2, []uint8{3, 6, 2, 5, 1, 4}},
+	}
+	for _, tt := range tests {
+		got := Rotate90(img, tt.deg)
+		if got.Rect.Dx() != tt.w || !bytes.Equal(got.Pix, tt.want) {
+			t.Errorf("%d°: want %v (width %d), got %v (width %d)", tt.deg, tt.want, tt.w, got.Pix, got.Rect.Dx())
+		}
+	}
+}
+
+func TestResolution(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+	// insert a pHYs chunk after IHDR: 8 bytes signature, 25 bytes IHDR
+	encoded := buf.Bytes()
+	phys := make([]byte, 9)
+	binary.BigEndian.PutUint32(phys, 11811) // 300 dpi
+	binary.BigEndian.PutUint32(phys[4:], 3937)
+	phys[8] = 1
+	chunk := binary.BigEndian.AppendUint32(nil, 9)
+	chunk = append(chunk, "pHYs"...)
+	chunk = append(chunk, phys...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+	withPhys := append(append(append([]byte{}, encoded[:33]...), chunk...), encoded[33:]...)
+
+	jfif := []byte{0xff, 0xd8, 0xff, 0xe0, 0, 16, 'J', 'F', 'I', 'F', 0, 1, 1, 2, 0, 80, 0, 40, 0, 0}
+	tests := []struct {
+		name       string
+		data       []byte
+		dpiX, dpiY float64
+	}{
+		{"png", withPhys, 300, 100},
+		{"png without pHYs", encoded, 0, 0},
+		{"jfif", jfif, 203.2, 101.6},
+		{"unknown", []byte("GIF89a"), 0, 0},
+	}
+	for _, tt := range tests {
+		x, y := Resolution(tt.data)
+		if math.Abs(x-tt.dpiX) > 0.1 || math.Abs(y-tt.dpiY) > 0.1 {
+			t.Errorf("%s: want %vx%v dpi, got %vx%v", tt.name, tt.dpiX, tt.dpiY, x, y)
+		}
+	}
+	if _, err := png.Decode(bytes.NewReader(withPhys)); err != nil {
+		t.Errorf("test image is broken: %v", err)
+	}
+}
@@ -0,0 +1,59 @@
+package imgprep
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Resolution returns the horizontal and vertical resolution in dpi stored in the
+// JFIF header of a JPEG or the pHYs chunk of a PNG image. Both are 0 if unknown.
+func Resolution(data []byte) (dpiX, dpiY float64) {
+	switch {
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return pngResolution(data[8:])
+	case bytes.HasPrefix(data, []byte{0xff, 0xd8}):
+		return jfifResolution(data[2:])
+	}
+	return 0, 0
+}
+
+func pngResolution(data []byte) (float64, float64) {
+	for len(data) >= 12 {
+		length := int(binary.BigEndian.Uint32(data))
+		typ := string(data[4:8])
+		if length < 0 || len(data) < 12+length {
+			break
+		}
+		chunk := data[8 : 8+length]
+		switch typ {
+		case "pHYs":
+			// pixels per unit, unit 1 is the meter
+			if length == 9 && chunk[8] == 1 {
+				x, y := binary.BigEndian.Uint32(chunk), binary.BigEndian.Uint32(chunk[4:])
+				return float64(x) * 0.0254, float64(y) * 0.0254
+			}
+			return 0, 0
+		case "IDAT", "IEND":
+			// pHYs must precede the image data
+			return 0, 0
+		}
+		data = data[12+length:]
+	}
+	return 0, 0
+}
+
+func jfifResolution(data []byte) (float64, float64) {
+	// the JFIF segment, if any, directly follows the SOI marker
+	if len(data) < 16 || data[0] != 0xff || data[1] != 0xe0 || !bytes.HasPrefix(data[4:], []byte("JFIF\x00")) {
+		return 0, 0
+	}
+	units := data[11]
+	x, y := float64(binary.BigEndian.Uint16(data[12:])), float64(binary.BigEndian.Uint16(data[14:]))
+	switch units {
+	case 1: // dots per inch
+		return x, y
+	case 2: // dots per cm
+		return x * 2.54, y * 2.54
+	}
+	return 0, 0
+}
@@ -0,0 +1,163 @@
+package layout
+
+import (
+	"math"
+	"slices"
+)
+
+const (
+	// minColumnLines is the minimum number of consecutive lines on either side of a gutter
+	// for it to be considered a column gutter.
+	minColumnLines = 3
+	// minColumnWords is the minimum average number of words per line in each column.
+	// Whitespace-aligned tables usually have fewer words per cell than prose columns,
+	// which keeps their rows together.
+	minColumnWords = 3.0
+	// maxColumnDepth limits the recursion when splitting columns into sub-columns.
+	maxColumnDepth = 4
+)
+
+// gutter describes a vertical strip of white space separating two columns
+// in the lines start (inclusive) to end (exclusive).
+type gutter struct {
+	x          float64
+	start, end int
+}
+
+// arrange splits lines into blocks in reading order. Multi-column regions are
+// split at their gutters, so that each column becomes a block of its own.
+func arrange(lines []Line, charW float64, depth int) [][]Line {
+	if len(lines) == 0 {
+		return nil
+	}
+	g, ok := findGutter(lines, charW)
+	if !ok || depth >= maxColumnDepth {
+		return [][]Line{lines}
+	}
+	left, right := splitLines(lines[g.start:g.end], g.x)
+	var blocks [][]Line
+	blocks = append(blocks, arrange(lines[:g.start], charW, depth+1)...)
+	blocks = append(blocks, arrange(left, charW, depth+1)...)
+	blocks = append(blocks, arrange(right, charW, depth+1)...)
+	blocks = append(blocks, arrange(lines[g.end:], charW, depth+1)...)
+	return blocks
+}
+
+// findGutter returns the column gutter covering the most lines.
+// Candidates are the centers of wide gaps between words. A candidate is valid for
+// a run of consecutive lines none of which has a word crossing it.
+func findGutter(lines []Line, charW float64) (gutter, bool) {
+	minGap := 2 * charW
+	var candidates []float64
+	for _, l := range lines {
+		for i := 1; i < len(l.Words); i++ {
+			if gap := l.Words[i].Box.X0 - l.Words[i-1].Box.X1; gap >= minGap {
+				x := (l.Words[i].Box.X0 + l.Words[i-1].Box.X1) / 2
+				// snap to the character grid to reduce the number of candidates
+				candidates = append(candidates, math.Round(x/charW)*charW)
+			}
+		}
+	}
+	slices.Sort(candidates)
+	candidates = slices.Compact(candidates)
+
+	var best gutter
+	found := false
+	for _, x := range candidates {
+		for _, g := range gutterRuns(lines, x, charW/2) {
+			if !isColumnGutter(lines[g.start:g.end], x) {
+				continue
+			}
+			if !found || g.end-g.start > best.end-best.start {
+				best, found = g, true
+			}
+		}
+	}
+	return best, found
+}
+
+// gutterRuns returns the runs of consecutive lines not crossed by a vertical line at x
+// that have enough lines with words on both sides. Words must keep a distance of clearance to x.
+func gutterRuns(lines []Line, x, clearance float64) []gutter {
+	var runs []gutter
+	start := 0
+	for i := 0; i <= len(lines); i++ {
+		if i < len(lines) && !crosses(lines[i], x, clearance) {
+			continue
+		}
+		if hasBothSides(lines[start:i], x) {
+			runs = append(runs, gutter{x: x, start: start, end: i})
+		}
+		start = i + 1
+	}
+	return runs
+}
+
+func crosses(l Line, x, clearance float64) bool {
+	for _, w := range l.Words {
+		if w.Box.X0 < x+clearance && w.Box.X1 > x-clearance {
+			return true
+		}
+	}
+	return false
+}
+
+func hasBothSides(lines []Line, x float64) bool {
+	var left, right int
+	for _, l := range lines {
+		if l.Words[0].Box.X1 <= x {
+			left++
+		}
+		if l.Words[len(l.Words)-1].Box.X0 >= x {
+			right++
+		}
+	}
+	return left >= minColumnLines && right >= minColumnLines
+}
+
+// isColumnGutter reports whether the gutter at x separates columns of running text
+// rather than the columns of a table. Table rows are kept on one line.
+func isColumnGutter(lines []Line, x float64) bool {
+	left, right := splitLines(lines, x)
+	return avgWords(left) >= minColumnWords && avgWords(right) >= minColumnWords
+}
+
+func avgWords(lines []Line) float64 {
+	if len(lines) == 0 {
+		return 0
+	}
+	n := 0
+	for _, l := range lines {
+		n += len(l.Words)
+	}
+	return float64(n) / float64(len(lines))
+}
+
+// splitLines divides each line at x and returns the non-empty parts on both sides.
+func splitLines(lines []Line, x float64) (left, right []Line) {
+	for _, l := range lines {
+		var lw, rw []Word
+		for _, w := range l.Words {
+			if w.Box.X1 <= x {
+				lw = append(lw, w)
+			} else {
+				rw = append(rw, w)
+			}
+		}
+		if len(lw) > 0 {
+			left = append(left, newLine(lw))
+		}
+		if len(rw) > 0 {
+			right = append(right, newLine(rw))
+		}
+	}
+	return left, right
+}
+
+func newLine(words []Word) Line {
+	l := Line{Words: words}
+	for _, w := range words {
+		l.Box = l.Box.Union(w.Box)
+	}
+	return l
+}
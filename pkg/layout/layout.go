@@ -0,0 +1,288 @@
+/*
+Package layout arranges positioned glyphs into words and lines and renders them
+as plain text that preserves the spatial alignment of a page, similar to
+`pdftotext -layout`.
+
+All coordinates are page coordinates with the origin in the top left corner
+and Y growing downwards. PDF backends that use the PDF user space (origin in
+the bottom left corner) have to flip the Y axis before handing glyphs over.
+*/
+package layout
+
+import (
+	"cmp"
+	"math"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Rect is an axis-aligned box in page coordinates.
+type Rect struct {
+	X0 float64 `json:"x0"`
+	Y0 float64 `json:"y0"`
+	X1 float64 `json:"x1"`
+	Y1 float64 `json:"y1"`
+}
+
+func (r Rect) Width() float64  { return r.X1 - r.X0 }
+func (r Rect) Height() float64 { return r.Y1 - r.Y0 }
+
+// IsEmpty reports whether r has no area.
+func (r Rect) IsEmpty() bool { return r.X1 <= r.X0 || r.Y1 <= r.Y0 }
+
+// Union returns the smallest Rect containing r and o. Empty rects are ignored.
+func (r Rect) Union(o Rect) Rect {
+	if r.IsEmpty() {
+		return o
+	}
+	if o.IsEmpty() {
+		return r
+	}
+	return Rect{min(r.X0, o.X0), min(r.Y0, o.Y0), max(r.X1, o.X1), max(r.Y1, o.Y1)}
+}
+
+// centerX returns the horizontal center of r.
+func (r Rect) centerX() float64 { return (r.X0 + r.X1) / 2 }
+
+// centerY returns the vertical center of r.
+func (r Rect) centerY() float64 { return (r.Y0 + r.Y1) / 2 }
+
+// Contains reports whether the point (x, y) lies within r.
+func (r Rect) Contains(x, y float64) bool {
+	return x >= r.X0 && x < r.X1 && y >= r.Y0 && y < r.Y1
+}
+
+// Intersect returns the largest rectangle contained by both r and o. It is empty if they don't overlap.
+func (r Rect) Intersect(o Rect) Rect {
+	return Rect{X0: max(r.X0, o.X0), Y0: max(r.Y0, o.Y0), X1: min(r.X1, o.X1), Y1: min(r.Y1, o.Y1)}
+}
+
+// Coverage returns the fraction (0 to 1) of area covered by the union of boxes.
+// Overlapping boxes are counted once, the parts outside of area are ignored.
+func Coverage(area Rect, boxes []Rect) float64 {
+	if area.IsEmpty() {
+		return 0
+	}
+	var clipped []Rect
+	var xs []float64
+	for _, b := range boxes {
+		if c := b.Intersect(area); !c.IsEmpty() {
+			clipped = append(clipped, c)
+			xs = append(xs, c.X0, c.X1)
+		}
+	}
+	slices.Sort(xs)
+	xs = slices.Compact(xs)
+	// sweep over the vertical strips between adjacent box edges
+	covered := 0.0
+	for i := 1; i < len(xs); i++ {
+		x0, x1 := xs[i-1], xs[i]
+		var spans [][2]float64
+		for _, c := range clipped {
+			if c.X0 <= x0 && c.X1 >= x1 {
+				spans = append(spans, [2]float64{c.Y0, c.Y1})
+			}
+		}
+		slices.SortFunc(spans, func(a, b [2]float64) int { return cmp.Compare(a[0], b[0]) })
+		height, end := 0.0, math.Inf(-1)
+		for _, s := range spans {
+			if s[0] > end {
+				height += s[1] - s[0]
+				end = s[1]
+			} else if s[1] > end {
+				height += s[1] - end
+				end = s[1]
+			}
+		}
+		covered += height * (x1 - x0)
+	}
+	return min(1, covered/(area.Width()*area.Height()))
+}
+
+// Char is a single glyph and its bounding box.
+type Char struct {
+	Box  Rect
+	Rune rune
+}
+
+// Word is a run of glyphs without whitespace in between.
+type Word struct {
+	Text string `json:"text"`
+	Box  Rect   `json:"bbox"`
+	// Confidence is the OCR engine's confidence (0 to 100) in the recognized word; zero for extracted text
+	Confidence float64 `json:"confidence,omitzero"`
+}
+
+// Line is a sequence of words sharing a baseline, ordered from left to right.
+type Line struct {
+	Words []Word
+	Box   Rect
+}
+
+// Page holds the words of a single page together with the page dimensions.
+type Page struct {
+	Words []Word
+	// Rules are the horizontal and vertical lines drawn on the page, e.g. table borders.
+	// They are optional and only used for table detection.
+	Rules         []Rect
+	Width, Height float64
+}
+
+// Scale multiplies all coordinates and the page dimensions by sx and sy respectively,
+// e.g. to convert the pixel coordinates of a scanned page to PDF points.
+func (p *Page) Scale(sx, sy float64) {
+	scale := func(r Rect) Rect { return Rect{r.X0 * sx, r.Y0 * sy, r.X1 * sx, r.Y1 * sy} }
+	for i := range p.Words {
+		p.Words[i].Box = scale(p.Words[i].Box)
+	}
+	for i := range p.Rules {
+		p.Rules[i] = scale(p.Rules[i])
+	}
+	p.Width *= sx
+	p.Height *= sy
+}
+
+// NewPage returns a Page built from glyphs in content order.
+func NewPage(width, height float64, chars []Char) *Page {
+	return &Page{Width: width, Height: height, Words: WordsFromChars(chars)}
+}
+
+// WordsFromChars groups glyphs into words. Whitespace glyphs and glyphs without
+// a bounding box (e.g. line breaks generated by a PDF lib) end a word,
+// as do significant horizontal gaps and changes of the baseline.
+func WordsFromChars(chars []Char) []Word {
+	var words []Word
+	var sb strings.Builder
+	var box, prev Rect
+	flush := func() {
+		if sb.Len() > 0 {
+			words = append(words, Word{Text: sb.String(), Box: box})
+			sb.Reset()
+		}
+		box = Rect{}
+	}
+	for _, c := range chars {
+		if unicode.IsSpace(c.Rune) || c.Box.IsEmpty() || c.Rune == 0 || c.Rune == utf8.RuneError {
+			flush()
+			continue
+		}
+		if sb.Len() > 0 {
+			h := max(prev.Height(), c.Box.Height())
+			gap := c.Box.X0 - prev.X1
+			dy := c.Box.centerY() - prev.centerY()
+			if gap > h*0.25 || gap < -h || dy > h*0.5 || dy < -h*0.5 {
+				flush()
+			}
+		}
+		sb.WriteRune(c.Rune)
+		box = box.Union(c.Box)
+		prev = c.Box
+	}
+	flush()
+	return words
+}
+
+// WordsFromSpan splits a run of text known to occupy box into words.
+// Backends that only report positions of whole text runs can use it to
+// approximate word boxes by distributing the width evenly among runes.
+func WordsFromSpan(text string, box Rect) []Word {
+	n := utf8.RuneCountInString(text)
+	if n == 0 {
+		return nil
+	}
+	runeW := box.Width() / float64(n)
+	var words []Word
+	i := 0
+	for field := range strings.FieldsSeq(text) {
+		idx := strings.Index(text[i:], field)
+		start := utf8.RuneCountInString(text[:i+idx])
+		length := utf8.RuneCountInString(field)
+		words = append(words, Word{
+			Text: field,
+			Box: Rect{
+				X0: box.X0 + float64(start)*runeW,
+				Y0: box.Y0,
+				X1: box.X0 + float64(start+length)*runeW,
+				Y1: box.Y1,
+			},
+		})
+		i += idx + len(field)
+	}
+	return words
+}
+
+// Lines groups the page's words into lines, sorted top to bottom.
+// Words whose vertical centers lie within the same band are considered to be on the same line.
+func (p *Page) Lines() []Line {
+	words := slices.Clone(p.Words)
+	slices.SortStableFunc(words, func(a, b Word) int {
+		return cmp.Compare(a.Box.centerY(), b.Box.centerY())
+	})
+	var lines []Line
+	for _, w := range words {
+		if n := len(lines); n > 0 {
+			l := &lines[n-1]
+			tol := min(l.Box.Height(), w.Box.Height()) * 0.5
+			if w.Box.centerY()-l.Box.centerY() <= tol {
+				l.Words = append(l.Words, w)
+				l.Box = l.Box.Union(w.Box)
+				continue
+			}
+		}
+		lines = append(lines, Line{Words: []Word{w}, Box: w.Box})
+	}
+	for i := range lines {
+		slices.SortFunc(lines[i].Words, func(a, b Word) int {
+			return cmp.Compare(a.Box.X0, b.Box.X0)
+		})
+	}
+	return lines
+}
+
+// Text returns the words of the line separated by single spaces.
+func (l Line) Text() string {
+	var sb strings.Builder
+	for i, w := range l.Words {
+		if i > 0 {
+			sb.WriteByte(' ')
+		}
+		sb.WriteString(w.Text)
+	}
+	return sb.String()
+}
+
+// charWidth returns the median width of a glyph on the page, used as the
+// width of one column of the character grid when rendering.
+func charWidth(words []Word) float64 {
+	widths := make([]float64, 0, len(words))
+	for _, w := range words {
+		if n := utf8.RuneCountInString(w.Text); n > 0 && w.Box.Width() > 0 {
+			widths = append(widths, w.Box.Width()/float64(n))
+		}
+	}
+	if len(widths) == 0 {
+		return 5
+	}
+	return median(widths)
+}
+
+// lineHeight returns the median height of the lines.
+func lineHeight(lines []Line) float64 {
+	heights := make([]float64, 0, len(lines))
+	for _, l := range lines {
+		if h := l.Box.Height(); h > 0 {
+			heights = append(heights, h)
+		}
+	}
+	if len(heights) == 0 {
+		return 10
+	}
+	return median(heights)
+}
+
+func median(s []float64) float64 {
+	slices.Sort(s)
+	return s[len(s)/2]
+}
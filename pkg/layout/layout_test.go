@@ -0,0 +1,214 @@
+package layout
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+const (
+	testCharW = 6.0
+	testLineH = 12.0
+)
+
+// place puts text on a character grid, starting at column col on row row.
+func place(text string, col, row int) []Char {
+	var chars []Char
+	for i, r := range []rune(text) {
+		x := float64(col+i) * testCharW
+		y := float64(row) * testLineH
+		chars = append(chars, Char{Rune: r, Box: Rect{x, y, x + testCharW, y + testLineH*0.8}})
+	}
+	return chars
+}
+
+func page(parts ...[]Char) *Page {
+	var chars []Char
+	for _, p := range parts {
+		chars = append(chars, p...)
+	}
+	return NewPage(600, 800, chars)
+}
+
+func TestWordsFromChars(t *testing.T) {
+	p := page(place("Hello World", 0, 0), place("again", 20, 0))
+	got := make([]string, 0, len(p.Words))
+	for _, w := range p.Words {
+		got = append(got, w.Text)
+	}
+	if want := "Hello World again"; strings.Join(got, " ") != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	if p.Words[2].Box.X0 != 20*testCharW {
+		t.Errorf("want third word to start at %v, got %v", 20*testCharW, p.Words[2].Box.X0)
+	}
+}
+
+func TestWordsFromSpan(t *testing.T) {
+	words := WordsFromSpan("ab  cd", Rect{0, 0, 60, 10})
+	if len(words) != 2 {
+		t.Fatalf("want 2 words, got %d", len(words))
+	}
+	if words[1].Box.X0 != 40 || words[1].Box.X1 != 60 {
+		t.Errorf("want second word at 40..60, got %v", words[1].Box)
+	}
+}
+
+func TestTableRowsStayOnOneLine(t *testing.T) {
+	p := page(
+		place("Item", 0, 0), place("Qty", 20, 0), place("Price", 30, 0),
+		place("Apples", 0, 1), place("3", 20, 1), place("1.20", 30, 1),
+		place("Pears", 0, 2), place("12", 20, 2), place("0.80", 30, 2),
+		place("Plums", 0, 3), place("7", 20, 3), place("2.10", 30, 3),
+	)
+	want := "Item                Qty       Price\n" +
+		"Apples              3         1.20\n" +
+		"Pears               12        0.80\n" +
+		"Plums               7         2.10\n"
+	if got := p.Text(); got != want {
+		t.Errorf("want\n%s\ngot\n%s", want, got)
+	}
+}
+
+func TestColumnsAreReordered(t *testing.T) {
+	p := page(
+		place("A heading spanning both of the columns", 0, 0),
+		place("left one is a column", 0, 2), place("right one is another", 30, 2),
+		place("left two of running text", 0, 3), place("right two with more words", 30, 3),
+		place("left three goes on and", 0, 4), place("right three and so on", 30, 4),
+		place("left four ends here", 0, 5), place("right four ends here", 30, 5),
+	)
+	want := "A heading spanning both of the columns\n" +
+		"\n" +
+		"left one is a column\n" +
+		"left two of running text\n" +
+		"left three goes on and\n" +
+		"left four ends here\n" +
+		"\n" +
+		"right one is another\n" +
+		"right two with more words\n" +
+		"right three and so on\n" +
+		"right four ends here\n"
+	if got := p.Text(); got != want {
+		t.Errorf("want\n%s\ngot\n%s", want, got)
+	}
+}
+
+func TestAlignedTable(t *testing.T) {
+	p := page(
+		place("Invoice for March", 0, 0),
+		place("Item", 0, 2), place("Qty", 20, 2), place("Price", 30, 2),
+		place("Green apples", 0, 3), place("3", 20, 3), place("1.20", 30, 3),
+		place("Pears", 0, 4), place("12", 20, 4), place("0.80", 30, 4),
+		place("Thank you for your order", 0, 6),
+	)
+	tables := p.Tables()
+	if len(tables) != 1 {
+		t.Fatalf("want 1 table, got %d", len(tables))
+	}
+	var sb strings.Builder
+	if err := tables[0].WriteMarkdown(&sb); err != nil {
+		t.Fatal(err)
+	}
+	want := "| Item | Qty | Price |\n" +
+		"| --- | --- | --- |\n" +
+		"| Green apples | 3 | 1.20 |\n" +
+		"| Pears | 12 | 0.80 |\n"
+	if got := sb.String(); got != want {
+		t.Errorf("want\n%s\ngot\n%s", want, got)
+	}
+}
+
+func TestRuledTable(t *testing.T) {
+	p := page(
+		place("Name", 1, 1), place("City", 11, 1),
+		place("Ada", 1, 2), place("New York", 11, 2),
+	)
+	// a 2x2 grid, cells are 10 chars wide and one line high
+	for _, y := range []float64{0.9, 1.9, 2.9} {
+		p.Rules = append(p.Rules, Rect{0, y * testLineH, 21 * testCharW, y*testLineH + 1})
+	}
+	for _, x := range []float64{0, 10, 20} {
+		p.Rules = append(p.Rules, Rect{x * testCharW, 0.9 * testLineH, x*testCharW + 1, 2.9*testLineH + 1})
+	}
+	tables := p.Tables()
+	if len(tables) != 1 {
+		t.Fatalf("want 1 table, got %d", len(tables))
+	}
+	var sb strings.Builder
+	if err := tables[0].WriteCSV(&sb); err != nil {
+		t.Fatal(err)
+	}
+	if want := "Name,City\nAda,New York\n"; sb.String() != want {
+		t.Errorf("want %q, got %q", want, sb.String())
+	}
+	if !tables[0].Ruled {
+		t.Error("want ruled table")
+	}
+}
+
+func TestColumnsAreNoTable(t *testing.T) {
+	p := page(
+		place("left one is a column", 0, 0), place("right one is another", 30, 0),
+		place("left two of running text", 0, 1), place("right two with more words", 30, 1),
+		place("left three goes on and", 0, 2), place("right three and so on", 30, 2),
+	)
+	if tables := p.Tables(); len(tables) != 0 {
+		t.Errorf("want no tables, got %v", tables)
+	}
+}
+
+func TestWordFormats(t *testing.T) {
+	p := page(place("Hello World", 0, 0))
+	var hocr, alto strings.Builder
+	if err := WriteHOCR(&hocr, []*Page{nil, p}); err != nil {
+		t.Fatal(err)
+	}
+	if want := `<span class="ocrx_word" title="bbox 36 0 66 10">World</span>`; !strings.Contains(hocr.String(), want) {
+		t.Errorf("want hOCR to contain %s, got\n%s", want, hocr.String())
+	}
+	if !strings.Contains(hocr.String(), `id="page_2"`) {
+		t.Errorf("want page to be numbered 2")
+	}
+	if err := WriteALTO(&alto, []*Page{p}); err != nil {
+		t.Fatal(err)
+	}
+	if want := `<String CONTENT="World" HPOS="36" VPOS="0" WIDTH="30" HEIGHT="10"/>`; !strings.Contains(alto.String(), want) {
+		t.Errorf("want ALTO to contain %s, got\n%s", want, alto.String())
+	}
+	p.Words[0].Confidence = 87.4
+	hocr.Reset()
+	alto.Reset()
+	if err := WriteHOCR(&hocr, []*Page{p}); err != nil {
+		t.Fatal(err)
+	}
+	if want := `title="bbox 0 0 30 10; x_wconf 87">Hello`; !strings.Contains(hocr.String(), want) {
+		t.Errorf("want hOCR to contain %s, got\n%s", want, hocr.String())
+	}
+	if err := WriteALTO(&alto, []*Page{p}); err != nil {
+		t.Fatal(err)
+	}
+	if want := `HEIGHT="10" WC="0.87"/>`; !strings.Contains(alto.String(), want) {
+		t.Errorf("want ALTO to contain %s, got\n%s", want, alto.String())
+	}
+}
+
+func TestCoverage(t *testing.T) {
+	page := Rect{0, 0, 100, 200}
+	tests := []struct {
+		name  string
+		boxes []Rect
+		want  float64
+	}{
+		{"none", nil, 0},
+		{"full page", []Rect{{0, 0, 100, 200}}, 1},
+		{"overlapping", []Rect{{0, 0, 50, 100}, {25, 50, 75, 150}}, 0.4375},
+		{"clipped", []Rect{{-50, -50, 50, 50}}, 0.125},
+		{"outside", []Rect{{200, 0, 300, 100}}, 0},
+	}
+	for _, tt := range tests {
+		if got := Coverage(page, tt.boxes); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("Coverage(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
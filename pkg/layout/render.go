@@ -0,0 +1,69 @@
+package layout
+
+import (
+	"io"
+	"math"
+	"strings"
+	"unicode/utf8"
+)
+
+// WriteText writes the page's text to w, keeping words at their horizontal
+// position on a character grid. Columns of running text are written one after
+// another, while table rows are kept on one line.
+func (p *Page) WriteText(w io.Writer) error {
+	_, err := io.WriteString(w, p.Text())
+	return err
+}
+
+// Text returns the page's text as written by [Page.WriteText].
+func (p *Page) Text() string {
+	lines := p.Lines()
+	if len(lines) == 0 {
+		return ""
+	}
+	charW := charWidth(p.Words)
+	lineH := lineHeight(lines)
+	var sb strings.Builder
+	for i, block := range p.blocks(lines) {
+		if i > 0 {
+			sb.WriteByte('\n')
+		}
+		writeBlock(&sb, block, charW, lineH)
+	}
+	return sb.String()
+}
+
+// blocks splits the page's lines into blocks in reading order, one per column.
+func (p *Page) blocks(lines []Line) [][]Line {
+	return arrange(lines, charWidth(p.Words), 0)
+}
+
+// writeBlock renders lines relative to the leftmost word of the block.
+func writeBlock(sb *strings.Builder, lines []Line, charW, lineH float64) {
+	originX := math.Inf(1)
+	for _, l := range lines {
+		originX = min(originX, l.Box.X0)
+	}
+	for i, l := range lines {
+		if i > 0 {
+			// keep larger vertical gaps (e.g. between paragraphs) as blank lines
+			gap := l.Box.Y0 - lines[i-1].Box.Y1
+			for n := 0.8; gap > lineH*n && n < 3; n += 1.5 {
+				sb.WriteByte('\n')
+			}
+		}
+		col := 0
+		for j, w := range l.Words {
+			pos := int(math.Round((w.Box.X0 - originX) / charW))
+			if j > 0 && pos <= col {
+				pos = col + 1
+			}
+			for ; col < pos; col++ {
+				sb.WriteByte(' ')
+			}
+			sb.WriteString(w.Text)
+			col += utf8.RuneCountInString(w.Text)
+		}
+		sb.WriteByte('\n')
+	}
+}
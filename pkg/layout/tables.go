@@ -0,0 +1,345 @@
+package layout
+
+import (
+	"cmp"
+	"encoding/csv"
+	"io"
+	"math"
+	"slices"
+	"strings"
+)
+
+const (
+	// ruleThickness is the maximum thickness of a line to be considered a rule.
+	ruleThickness = 2.0
+	// minTableRows and minTableCols are the minimum dimensions of a detected table.
+	minTableRows = 2
+	minTableCols = 2
+	// minAlignedRows is the minimum number of lines of a table without rules.
+	// It is larger than minTableRows, because whitespace alone is weaker evidence.
+	minAlignedRows = 3
+	// maxRules limits the number of rules considered per page.
+	maxRules = 2000
+)
+
+// Table is a grid of cells, either detected on a page or read from a document's markup.
+type Table struct {
+	// Page is the 1-based number of the page the table was found on, 0 if unknown.
+	Page int `json:"page,omitzero"`
+	// Box is the table's bounding box. It is empty for tables read from markup.
+	Box Rect `json:"bbox,omitzero"`
+	// Ruled is true if the cells are delimited by drawn lines rather than whitespace.
+	Ruled bool `json:"ruled,omitzero"`
+	// Rows contains the text of the cells, row by row.
+	Rows [][]string `json:"rows"`
+}
+
+// Columns returns the number of columns of the widest row.
+func (t Table) Columns() int {
+	n := 0
+	for _, row := range t.Rows {
+		n = max(n, len(row))
+	}
+	return n
+}
+
+// WriteCSV writes the table's rows as CSV (RFC 4180).
+func (t Table) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	return cw.WriteAll(t.Rows)
+}
+
+// WriteMarkdown writes the table as a GitHub flavored Markdown table.
+// The first row is used as header row.
+func (t Table) WriteMarkdown(w io.Writer) error {
+	cols := t.Columns()
+	if cols == 0 {
+		return nil
+	}
+	var sb strings.Builder
+	writeRow := func(row []string) {
+		sb.WriteByte('|')
+		for i := range cols {
+			cell := ""
+			if i < len(row) {
+				cell = markdownCell(row[i])
+			}
+			sb.WriteString(" ")
+			sb.WriteString(cell)
+			sb.WriteString(" |")
+		}
+		sb.WriteByte('\n')
+	}
+	writeRow(t.Rows[0])
+	sb.WriteByte('|')
+	for range cols {
+		sb.WriteString(" --- |")
+	}
+	sb.WriteByte('\n')
+	for _, row := range t.Rows[1:] {
+		writeRow(row)
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+var markdownEscaper = strings.NewReplacer("|", `\|`, "\r\n", "<br>", "\n", "<br>")
+
+func markdownCell(s string) string {
+	return markdownEscaper.Replace(strings.TrimSpace(s))
+}
+
+// Tables detects the tables on the page. Tables delimited by rules are detected first.
+// The remaining lines are searched for whitespace-aligned tables, i.e. runs of lines
+// whose words are separated into the same columns by wide gaps.
+// The returned tables are ordered from top to bottom.
+func (p *Page) Tables() []Table {
+	lines := p.Lines()
+	tables := p.ruledTables(lines)
+	var rest []Line
+	for _, l := range lines {
+		if !insideTable(l.Box, tables) {
+			rest = append(rest, l)
+		}
+	}
+	tables = append(tables, alignedTables(rest, charWidth(p.Words), lineHeight(lines))...)
+	slices.SortFunc(tables, func(a, b Table) int { return cmp.Compare(a.Box.Y0, b.Box.Y0) })
+	return tables
+}
+
+func insideTable(r Rect, tables []Table) bool {
+	for _, t := range tables {
+		if t.Box.Contains(r.centerX(), r.centerY()) {
+			return true
+		}
+	}
+	return false
+}
+
+// ruledTables finds grids of horizontal and vertical rules and fills their cells
+// with the words whose center lies within.
+func (p *Page) ruledTables(lines []Line) []Table {
+	rules := p.Rules
+	if len(rules) > maxRules {
+		rules = rules[:maxRules]
+	}
+	var tables []Table
+	for _, grid := range connectedRules(rules) {
+		var xs, ys []float64
+		for _, r := range grid {
+			if r.Height() <= ruleThickness {
+				ys = append(ys, r.centerY())
+			} else {
+				xs = append(xs, r.centerX())
+			}
+		}
+		xs, ys = dedupe(xs, 2*ruleThickness), dedupe(ys, 2*ruleThickness)
+		if len(xs) <= minTableCols || len(ys) <= minTableRows {
+			continue
+		}
+		cells := make([][][]string, len(ys)-1)
+		for i := range cells {
+			cells[i] = make([][]string, len(xs)-1)
+		}
+		for _, l := range lines {
+			for _, w := range l.Words {
+				row, ok := interval(ys, w.Box.centerY())
+				if !ok {
+					continue
+				}
+				col, ok := interval(xs, w.Box.centerX())
+				if !ok {
+					continue
+				}
+				cells[row][col] = append(cells[row][col], w.Text)
+			}
+		}
+		t := Table{Box: Rect{xs[0], ys[0], xs[len(xs)-1], ys[len(ys)-1]}, Ruled: true}
+		for _, row := range cells {
+			texts := make([]string, len(row))
+			empty := true
+			for i, words := range row {
+				texts[i] = strings.Join(words, " ")
+				empty = empty && len(words) == 0
+			}
+			// double rules produce narrow rows without content
+			if !empty {
+				t.Rows = append(t.Rows, texts)
+			}
+		}
+		if len(t.Rows) >= minTableRows {
+			tables = append(tables, t)
+		}
+	}
+	return tables
+}
+
+// connectedRules returns the groups of touching rules that have horizontal as well as vertical members.
+func connectedRules(rules []Rect) [][]Rect {
+	var straight []Rect
+	for _, r := range rules {
+		horizontal := r.Height() <= ruleThickness && r.Width() > ruleThickness
+		vertical := r.Width() <= ruleThickness && r.Height() > ruleThickness
+		if horizontal || vertical {
+			straight = append(straight, r)
+		}
+	}
+	// union-find over touching rules
+	parent := make([]int, len(straight))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	for i := range straight {
+		for j := i + 1; j < len(straight); j++ {
+			if touches(straight[i], straight[j]) {
+				parent[find(i)] = find(j)
+			}
+		}
+	}
+	groups := make(map[int][]Rect)
+	for i, r := range straight {
+		groups[find(i)] = append(groups[find(i)], r)
+	}
+	var grids [][]Rect
+	for _, g := range groups {
+		var h, v bool
+		for _, r := range g {
+			if r.Height() <= ruleThickness {
+				h = true
+			} else {
+				v = true
+			}
+		}
+		if h && v {
+			grids = append(grids, g)
+		}
+	}
+	slices.SortFunc(grids, func(a, b []Rect) int { return cmp.Compare(a[0].Y0, b[0].Y0) })
+	return grids
+}
+
+// touches reports whether a and b intersect, allowing for a small gap.
+func touches(a, b Rect) bool {
+	const tolerance = ruleThickness
+	return a.X0 <= b.X1+tolerance && b.X0 <= a.X1+tolerance &&
+		a.Y0 <= b.Y1+tolerance && b.Y0 <= a.Y1+tolerance
+}
+
+// dedupe sorts values and merges those closer than tolerance.
+func dedupe(values []float64, tolerance float64) []float64 {
+	slices.Sort(values)
+	var out []float64
+	for _, v := range values {
+		if len(out) == 0 || v-out[len(out)-1] > tolerance {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// interval returns the index i of the interval bounds[i]..bounds[i+1] containing v.
+func interval(bounds []float64, v float64) (int, bool) {
+	i, _ := slices.BinarySearch(bounds, v)
+	if i == 0 || i == len(bounds) {
+		return 0, false
+	}
+	return i - 1, true
+}
+
+// alignedTables finds runs of consecutive lines that are split into the same columns by white space.
+func alignedTables(lines []Line, charW, lineH float64) []Table {
+	var tables []Table
+	start := 0
+	for i := 0; i <= len(lines); i++ {
+		if i < len(lines) && isTableRow(lines[i], charW) &&
+			(i == start || lines[i].Box.Y0-lines[i-1].Box.Y1 <= lineH) {
+			continue
+		}
+		if t, ok := alignedTable(lines[start:i], charW); ok {
+			tables = append(tables, t)
+		}
+		start = i
+		if i < len(lines) && !isTableRow(lines[i], charW) {
+			start = i + 1
+		}
+	}
+	return tables
+}
+
+// isTableRow reports whether l has at least two groups of words separated by a wide gap.
+func isTableRow(l Line, charW float64) bool {
+	for i := 1; i < len(l.Words); i++ {
+		if l.Words[i].Box.X0-l.Words[i-1].Box.X1 >= 2*charW {
+			return true
+		}
+	}
+	return false
+}
+
+func alignedTable(lines []Line, charW float64) (Table, bool) {
+	if len(lines) < minAlignedRows {
+		return Table{}, false
+	}
+	cols := columnSpans(lines, 1.5*charW)
+	if len(cols) < minTableCols {
+		return Table{}, false
+	}
+	if len(cols) == 2 && isColumnGutter(lines, (cols[0].X1+cols[1].X0)/2) {
+		// two columns of running text
+		return Table{}, false
+	}
+	t := Table{}
+	filled := make([]int, len(cols))
+	for _, l := range lines {
+		row := make([]string, len(cols))
+		for _, w := range l.Words {
+			i := slices.IndexFunc(cols, func(c Rect) bool { return w.Box.X0 >= c.X0 && w.Box.X1 <= c.X1 })
+			if i < 0 {
+				continue
+			}
+			if row[i] == "" {
+				filled[i]++
+				row[i] = w.Text
+			} else {
+				row[i] += " " + w.Text
+			}
+		}
+		t.Rows = append(t.Rows, row)
+		t.Box = t.Box.Union(l.Box)
+	}
+	// every column must be used by at least half of the rows
+	for _, n := range filled {
+		if 2*n < len(lines) {
+			return Table{}, false
+		}
+	}
+	return t, true
+}
+
+// columnSpans projects the words of all lines onto the X axis and returns the
+// horizontal extents of the columns, i.e. the spans separated by gaps of at least minGap.
+func columnSpans(lines []Line, minGap float64) []Rect {
+	var spans []Rect
+	for _, l := range lines {
+		for _, w := range l.Words {
+			spans = append(spans, Rect{X0: w.Box.X0, X1: w.Box.X1, Y0: 0, Y1: 1})
+		}
+	}
+	slices.SortFunc(spans, func(a, b Rect) int { return cmp.Compare(a.X0, b.X0) })
+	var cols []Rect
+	for _, s := range spans {
+		if n := len(cols); n > 0 && s.X0-cols[n-1].X1 < minGap {
+			cols[n-1].X1 = math.Max(cols[n-1].X1, s.X1)
+			continue
+		}
+		cols = append(cols, s)
+	}
+	return cols
+}
@@ -0,0 +1,122 @@
+package layout
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"math"
+	"strings"
+)
+
+// WriteHOCR writes the words of the pages as hOCR document (https://kba.github.io/hocr-spec/1.2/).
+// Pages are numbered by their index in pages, nil pages are skipped.
+// Coordinates are rounded to integers: pixels for images, PDF points (1/72 inch) for PDFs.
+// The confidence of OCRed words is given as x_wconf.
+func WriteHOCR(w io.Writer, pages []*Page) error {
+	var sb strings.Builder
+	sb.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html PUBLIC "-//W3C//DTD XHTML 1.0 Transitional//EN" "http://www.w3.org/TR/xhtml1/DTD/xhtml1-transitional.dtd">
+<html xmlns="http://www.w3.org/1999/xhtml" xml:lang="en" lang="en">
+<head>
+<title></title>
+<meta http-equiv="Content-Type" content="text/html;charset=utf-8"/>
+<meta name="ocr-system" content="text-extraction-service"/>
+<meta name="ocr-capabilities" content="ocr_page ocr_carea ocr_line ocrx_word"/>
+</head>
+<body>
+`)
+	for i, p := range pages {
+		if p == nil {
+			continue
+		}
+		fmt.Fprintf(&sb, "<div class=\"ocr_page\" id=\"page_%d\" title=\"bbox 0 0 %d %d; ppageno %d\">\n",
+			i+1, round(p.Width), round(p.Height), i)
+		lines := p.Lines()
+		for j, block := range p.blocks(lines) {
+			fmt.Fprintf(&sb, "<div class=\"ocr_carea\" id=\"block_%d_%d\" title=\"%s\">\n", i+1, j+1, hocrBbox(blockBox(block)))
+			for _, l := range block {
+				fmt.Fprintf(&sb, "<span class=\"ocr_line\" title=\"%s\">", hocrBbox(l.Box))
+				for k, word := range l.Words {
+					if k > 0 {
+						sb.WriteByte(' ')
+					}
+					title := hocrBbox(word.Box)
+					if word.Confidence > 0 {
+						title += fmt.Sprintf("; x_wconf %d", round(word.Confidence))
+					}
+					fmt.Fprintf(&sb, "<span class=\"ocrx_word\" title=\"%s\">%s</span>", title, html.EscapeString(word.Text))
+				}
+				sb.WriteString("</span>\n")
+			}
+			sb.WriteString("</div>\n")
+		}
+		sb.WriteString("</div>\n")
+	}
+	sb.WriteString("</body>\n</html>\n")
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func hocrBbox(r Rect) string {
+	return fmt.Sprintf("bbox %d %d %d %d", round(r.X0), round(r.Y0), round(r.X1), round(r.Y1))
+}
+
+// WriteALTO writes the words of the pages as ALTO XML v4 document (https://www.loc.gov/standards/alto/).
+// Pages are numbered by their index in pages, nil pages are skipped.
+// The measurement unit is pixel, which equals a PDF point (1/72 inch) for PDFs.
+// The confidence of OCRed words is given as WC.
+func WriteALTO(w io.Writer, pages []*Page) error {
+	var sb strings.Builder
+	sb.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<alto xmlns="http://www.loc.gov/standards/alto/ns-v4#">
+<Description><MeasurementUnit>pixel</MeasurementUnit></Description>
+<Layout>
+`)
+	for i, p := range pages {
+		if p == nil {
+			continue
+		}
+		fmt.Fprintf(&sb, "<Page ID=\"page_%d\" PHYSICAL_IMG_NR=\"%d\" WIDTH=\"%d\" HEIGHT=\"%d\">\n", i+1, i+1, round(p.Width), round(p.Height))
+		fmt.Fprintf(&sb, "<PrintSpace %s>\n", altoBox(Rect{0, 0, p.Width, p.Height}))
+		lines := p.Lines()
+		for j, block := range p.blocks(lines) {
+			fmt.Fprintf(&sb, "<TextBlock ID=\"block_%d_%d\" %s>\n", i+1, j+1, altoBox(blockBox(block)))
+			for _, l := range block {
+				fmt.Fprintf(&sb, "<TextLine %s>", altoBox(l.Box))
+				for k, word := range l.Words {
+					if k > 0 {
+						sb.WriteString("<SP/>")
+					}
+					wc := ""
+					if word.Confidence > 0 {
+						// ALTO's word confidence ranges from 0 to 1
+						wc = fmt.Sprintf(" WC=\"%.2f\"", word.Confidence/100)
+					}
+					fmt.Fprintf(&sb, "<String CONTENT=\"%s\" %s%s/>", html.EscapeString(word.Text), altoBox(word.Box), wc)
+				}
+				sb.WriteString("</TextLine>\n")
+			}
+			sb.WriteString("</TextBlock>\n")
+		}
+		sb.WriteString("</PrintSpace>\n</Page>\n")
+	}
+	sb.WriteString("</Layout>\n</alto>\n")
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func altoBox(r Rect) string {
+	return fmt.Sprintf("HPOS=\"%d\" VPOS=\"%d\" WIDTH=\"%d\" HEIGHT=\"%d\"", round(r.X0), round(r.Y0), round(r.Width()), round(r.Height()))
+}
+
+func blockBox(lines []Line) Rect {
+	var r Rect
+	for _, l := range lines {
+		r = r.Union(l.Box)
+	}
+	return r
+}
+
+func round(f float64) int {
+	return int(math.Round(f))
+}
@@ -9,7 +9,9 @@ import (
 )
 
 type Mempool struct {
-	mmaps      chan mmap.MMap
+	mmaps chan mmap.MMap
+	// inUse holds a token for every byte slice handed out by a bounded pool, nil otherwise
+	inUse      chan struct{}
 	log        *slog.Logger
 	elemSize   int
 	NumCreated atomic.Int32
@@ -29,8 +31,17 @@ func New(elemSize, poolSize int, logger *slog.Logger) *Mempool {
 	return &Mempool{mmaps: ch, elemSize: elemSize, log: logger}
 }
 
+// NewBounded creates a new memory pool like [New], which never hands out more than `poolsize` byte slices at once.
+// [Mempool.Get] blocks until one is returned by calling [Mempool.Put] then.
+func NewBounded(elemSize, poolSize int, logger *slog.Logger) *Mempool {
+	m := New(elemSize, poolSize, logger)
+	m.inUse = make(chan struct{}, poolSize)
+	return m
+}
+
 // Get returns a byte slice (mmap) from the pool. The pool will create a new one, if none is available for use,
-// no matter if this results in exceeding the pool size. Mmaps created beyond the poolsize will be free (unmapped)
+// no matter if this results in exceeding the pool size, unless it is bounded. A bounded pool blocks until a byte slice
+// is returned instead. Mmaps created beyond the poolsize will be free (unmapped)
 // when they are returned to the pool by calling [Put]. The caller is
 // responsible for calling [Put]. Not doing so will result in a memory leak.
 // If creating an off-heap chunk of memory fails, an ordinary []byte will be returned instead. Additionally
@@ -38,6 +49,9 @@ func New(elemSize, poolSize int, logger *slog.Logger) *Mempool {
 // Slices returned by Get should not be resliced regarding the lower bound.
 // It is also illegal to grow the underlying array
 func (m *Mempool) Get() ([]byte, error) {
+	if m.inUse != nil {
+		m.inUse <- struct{}{}
+	}
 	select {
 	case mmap := <-m.mmaps:
 		return mmap[:m.elemSize], nil
@@ -61,6 +75,9 @@ func (m *Mempool) Put(b []byte) {
 		// this does not belong here
 		return
 	}
+	if m.inUse != nil {
+		defer m.release()
+	}
 	select {
 	case m.mmaps <- b[:m.elemSize]:
 		m.log.Debug("buffer returned to pool", "len", len(b), "cap", cap(b))
@@ -72,6 +89,15 @@ func (m *Mempool) Put(b []byte) {
 	}
 }
 
+// release frees the slot of a byte slice returned to a bounded pool
+func (m *Mempool) release() {
+	select {
+	case <-m.inUse:
+	default:
+		m.log.Warn("More byte slices returned than handed out")
+	}
+}
+
 // CurrentSize reports the number of allocated byte slices ready to use.
 func (m *Mempool) CurrentSize() int {
 	return len(m.mmaps)
@@ -4,6 +4,7 @@ import (
 	"log/slog"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/edsrzf/mmap-go"
 	"github.com/johbar/text-extraction-service/v4/pkg/mmappool"
@@ -103,3 +104,37 @@ func BenchmarkMempoolAlloc(b *testing.B) {
 		pool.Put(buf)
 	}
 }
+
+func TestBoundedMemPool(t *testing.T) {
+	poolsize := 2
+	mp := mmappool.NewBounded(256, poolsize, nil)
+	bufs := make([][]byte, 0, poolsize)
+	for range poolsize {
+		b, err := mp.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		bufs = append(bufs, b)
+	}
+	got := make(chan []byte)
+	go func() {
+		b, _ := mp.Get()
+		got <- b
+	}()
+	select {
+	case <-got:
+		t.Fatal("Get did not block with all buffers in use")
+	case <-time.After(50 * time.Millisecond):
+	}
+	mp.Put(bufs[0])
+	select {
+	case b := <-got:
+		mp.Put(b)
+	case <-time.After(time.Second):
+		t.Fatal("Get did not return after Put")
+	}
+	mp.Put(bufs[1])
+	if created := mp.NumCreated.Load(); created != int32(poolsize) {
+		t.Errorf("got %d buffers created, want %d", created, poolsize)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"archive/zip"
 	"io"
 	"os"
+	"slices"
 	"strings"
 	"testing"
 )
@@ -134,3 +135,30 @@ func checkMetaData(m map[string]string, t *testing.T) {
 		}
 	}
 }
+
+func TestReadTables(t *testing.T) {
+	tests := map[string]string{
+		"docx": `<w:document><w:body><w:p><w:r><w:t>Intro</w:t></w:r></w:p>
+<w:tbl><w:tr><w:tc><w:p><w:r><w:t>Item</w:t></w:r></w:p></w:tc><w:tc><w:p><w:r><w:t>Price</w:t></w:r></w:p></w:tc></w:tr>
+<w:tr><w:tc><w:p><w:r><w:t>Green</w:t></w:r><w:r><w:t xml:space="preserve"> apples</w:t></w:r></w:p></w:tc><w:tc><w:p><w:r><w:t>1.20</w:t></w:r></w:p></w:tc></w:tr></w:tbl>
+</w:body></w:document>`,
+		"odt": `<office:document-content><office:body><office:text><text:p>Intro</text:p>
+<table:table><table:table-column table:number-columns-repeated="2"/>
+<table:table-row><table:table-cell><text:p>Item</text:p></table:table-cell><table:table-cell><text:p>Price</text:p></table:table-cell></table:table-row>
+<table:table-row><table:table-cell><text:p>Green<text:s/>apples</text:p></table:table-cell><table:table-cell><text:p>1.20</text:p></table:table-cell></table:table-row>
+</table:table></office:text></office:body></office:document-content>`,
+	}
+	want := [][]string{{"Item", "Price"}, {"Green apples", "1.20"}}
+	for format, content := range tests {
+		tables, err := readTables(strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tables) != 1 {
+			t.Fatalf("%s: want 1 table, got %d", format, len(tables))
+		}
+		if !slices.EqualFunc(tables[0].Rows, want, slices.Equal) {
+			t.Errorf("%s: want %q, got %q", format, want, tables[0].Rows)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package officexmlparser
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/johbar/text-extraction-service/v4/pkg/layout"
+)
+
+// maxRepeatedCells limits the expansion of ODF's table:number-columns-repeated,
+// which is used to describe empty columns up to the end of a spreadsheet.
+const maxRepeatedCells = 100
+
+// tableBuilder collects the rows and cells of a (possibly nested) table.
+type tableBuilder struct {
+	table layout.Table
+	row   []string
+	cell  strings.Builder
+	// inCell is true between the start and end of a cell element
+	inCell bool
+	// repeat is the number of times the current cell is repeated (ODF only)
+	repeat int
+	// span is the number of grid columns the current cell spans (DOCX only)
+	span int
+	// odf is true for ODF tables, whose cells contain text without a dedicated text element
+	odf bool
+}
+
+// Tables returns the tables of the document: <w:tbl> in DOCX, <a:tbl> in PPTX and <table:table> in ODF.
+// The tables of a PPTX are numbered by slide. Nested tables are returned as tables of their own.
+func (d *XmlBasedDocument) Tables() ([]layout.Table, error) {
+	var tables []layout.Table
+	var errs error
+	for i, f := range d.contentFiles {
+		r, err := f.Open()
+		if err != nil {
+			errs = errors.Join(errs, err)
+			continue
+		}
+		found, err := readTables(r)
+		r.Close()
+		errs = errors.Join(errs, err)
+		for _, t := range found {
+			if d.Pages() > 0 {
+				t.Page = i + 1
+			}
+			tables = append(tables, t)
+		}
+	}
+	return tables, errs
+}
+
+// readTables returns the tables of an Office Open XML or ODF content file in document order.
+func readTables(r io.Reader) ([]layout.Table, error) {
+	var tables []layout.Table
+	// the innermost table is the last one
+	var stack []*tableBuilder
+	// inText is true in <w:t> and <a:t>, the elements containing text in OOXML.
+	// ODF has no such element, all char data within a cell is text.
+	inText := false
+	d := xml.NewDecoder(r)
+	for {
+		token, err := d.RawToken()
+		if err == io.EOF {
+			return tables, nil
+		}
+		if err != nil {
+			return tables, err
+		}
+		var top *tableBuilder
+		if len(stack) > 0 {
+			top = stack[len(stack)-1]
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch tableElement(t.Name) {
+			case "table":
+				stack = append(stack, &tableBuilder{odf: t.Name.Space == "table"})
+			case "row":
+				if top != nil {
+					top.row = nil
+				}
+			case "cell":
+				if top != nil {
+					top.inCell = true
+					top.cell.Reset()
+					top.repeat = repeatedCells(t)
+					top.span = 1
+				}
+			case "gridSpan":
+				// DOCX: <w:gridSpan w:val="2"/> in the cell properties
+				if top != nil && top.inCell {
+					top.span = intAttr(t, "val", 1)
+				}
+			case "coveredCell":
+				// cells hidden by a merged cell keep the grid intact
+				if top != nil {
+					top.row = append(top.row, "")
+				}
+			case "text":
+				inText = true
+			case "break":
+				if top != nil && top.inCell {
+					top.cell.WriteByte('\n')
+				}
+			case "space":
+				if top != nil && top.inCell {
+					top.cell.WriteByte(' ')
+				}
+			}
+		case xml.EndElement:
+			if top == nil {
+				continue
+			}
+			switch tableElement(t.Name) {
+			case "table":
+				stack = stack[:len(stack)-1]
+				if len(top.table.Rows) > 0 {
+					tables = append(tables, top.table)
+				}
+			case "row":
+				top.table.Rows = append(top.table.Rows, top.row)
+				top.row = nil
+			case "cell":
+				text := strings.TrimSpace(excessiveWhitespace.ReplaceAllString(top.cell.String(), " "))
+				for range top.repeat {
+					top.row = append(top.row, text)
+				}
+				// merged cells keep the grid intact, like ODF's covered cells
+				for i := 1; i < top.span; i++ {
+					top.row = append(top.row, "")
+				}
+				top.inCell = false
+			case "text":
+				inText = false
+			case "paragraph":
+				if top.inCell {
+					top.cell.WriteByte('\n')
+				}
+			}
+		case xml.CharData:
+			if top != nil && top.inCell && (inText || top.odf) {
+				top.cell.Write(t)
+			}
+		}
+	}
+}
+
+// tableElement maps the element names of the different formats to a common vocabulary.
+func tableElement(name xml.Name) string {
+	switch name.Space {
+	case "w", "a":
+		switch name.Local {
+		case "tbl":
+			return "table"
+		case "tr":
+			return "row"
+		case "tc":
+			return "cell"
+		case "t":
+			return "text"
+		case "p":
+			return "paragraph"
+		case "br", "cr":
+			return "break"
+		case "tab":
+			return "space"
+		}
+	case "table":
+		switch name.Local {
+		case "table":
+			return "table"
+		case "table-row":
+			return "row"
+		case "table-cell":
+			return "cell"
+		case "covered-table-cell":
+			return "coveredCell"
+		}
+	case "text":
+		switch name.Local {
+		case "p", "h":
+			return "paragraph"
+		case "line-break":
+			return "break"
+		case "s", "tab":
+			return "space"
+		}
+	}
+	return ""
+}
+
+// repeatedCells returns the value of an ODF cell's table:number-columns-repeated attribute, 1 if absent.
+func repeatedCells(cell xml.StartElement) int {
+	if cell.Name.Space != "table" {
+		return 1
+	}
+	return min(intAttr(cell, "number-columns-repeated", 1), maxRepeatedCells)
+}
+
+// intAttr returns the positive integer value of the attribute with the given local name or def.
+func intAttr(el xml.StartElement, name string, def int) int {
+	for _, a := range el.Attr {
+		if a.Name.Local == name {
+			if n, err := strconv.Atoi(a.Value); err == nil && n > 0 {
+				return n
+			}
+		}
+	}
+	return def
+}
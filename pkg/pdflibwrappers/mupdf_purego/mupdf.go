@@ -3,15 +3,19 @@ package mupdf_purego
 
 import (
 	"errors"
+	"fmt"
+	"image"
 	"io"
 	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"unsafe"
 
 	"github.com/ebitengine/purego"
 	"github.com/johbar/text-extraction-service/v4/internal/pdfdateparser"
 	"github.com/johbar/text-extraction-service/v4/internal/unix"
+	"github.com/johbar/text-extraction-service/v4/pkg/layout"
 	"github.com/johbar/text-extraction-service/v4/pkg/pdflibwrappers"
 )
 
@@ -31,6 +35,28 @@ type fzDocument uintptr
 type fzStream uintptr
 type fzBuffer uintptr
 type fzSTextOptions uintptr
+type fzSTextPage uintptr
+type fzOutput uintptr
+type fzPixmap uintptr
+type fzColorspace uintptr
+type fzPage uintptr
+
+// fzMatrix is a fz_matrix, passed by value
+type fzMatrix struct {
+	a, b, c, d, e, f float32
+}
+
+// stextOptions is a fz_stext_options. The trailing clip rectangle of newer versions is left zero.
+type stextOptions struct {
+	flags int32
+	scale float32
+	clip  fzRect
+}
+
+// fzRect is a fz_rect, returned by value
+type fzRect struct {
+	x0, y0, x1, y1 float32
+}
 
 const (
 	fzMaxStore uint64 = (256 << 20)
@@ -65,6 +91,26 @@ var (
 	fz_drop_buffer                 func(ctx fzContext, buf fzBuffer)
 	fz_count_pages                 func(ctx fzContext, doc fzDocument) int
 	fz_lookup_metadata             func(ctx fzContext, doc fzDocument, key string, buf []byte, size int) int32
+	// structured text
+	fz_new_stext_page_from_page_number func(ctx fzContext, doc fzDocument, number int, options *stextOptions) fzSTextPage
+	fz_drop_stext_page                 func(ctx fzContext, page fzSTextPage)
+	fz_new_buffer                      func(ctx fzContext, size uint64) fzBuffer
+	fz_new_output_with_buffer          func(ctx fzContext, buf fzBuffer) fzOutput
+	fz_close_output                    func(ctx fzContext, out fzOutput)
+	fz_drop_output                     func(ctx fzContext, out fzOutput)
+	fz_print_stext_page_as_xml         func(ctx fzContext, out fzOutput, page fzSTextPage, id int)
+	// rendering
+	fz_load_page                   func(ctx fzContext, doc fzDocument, number int) fzPage
+	fz_drop_page                   func(ctx fzContext, page fzPage)
+	fz_bound_page                  func(ctx fzContext, page fzPage) fzRect
+	fz_device_gray                 func(ctx fzContext) fzColorspace
+	fz_new_pixmap_from_page_number func(ctx fzContext, doc fzDocument, number int, ctm fzMatrix, cs fzColorspace, alpha int) fzPixmap
+	fz_drop_pixmap                 func(ctx fzContext, pix fzPixmap)
+	fz_pixmap_samples              func(ctx fzContext, pix fzPixmap) unsafe.Pointer
+	fz_pixmap_stride               func(ctx fzContext, pix fzPixmap) int
+	fz_pixmap_width                func(ctx fzContext, pix fzPixmap) int
+	fz_pixmap_height               func(ctx fzContext, pix fzPixmap) int
+	fz_pixmap_components           func(ctx fzContext, pix fzPixmap) int
 
 	defaultLibNames = []string{"libmupdf.so", "libmupdf.dylib", "/usr/local/lib/libmupdf.so"}
 )
@@ -93,6 +139,24 @@ func InitLib(path string) (string, error) {
 	purego.RegisterLibFunc(&fz_string_from_buffer, lib, "fz_string_from_buffer")
 	purego.RegisterLibFunc(&fz_lookup_metadata, lib, "fz_lookup_metadata")
 	purego.RegisterLibFunc(&fz_drop_buffer, lib, "fz_drop_buffer")
+	purego.RegisterLibFunc(&fz_new_stext_page_from_page_number, lib, "fz_new_stext_page_from_page_number")
+	purego.RegisterLibFunc(&fz_drop_stext_page, lib, "fz_drop_stext_page")
+	purego.RegisterLibFunc(&fz_new_buffer, lib, "fz_new_buffer")
+	purego.RegisterLibFunc(&fz_new_output_with_buffer, lib, "fz_new_output_with_buffer")
+	purego.RegisterLibFunc(&fz_close_output, lib, "fz_close_output")
+	purego.RegisterLibFunc(&fz_drop_output, lib, "fz_drop_output")
+	purego.RegisterLibFunc(&fz_print_stext_page_as_xml, lib, "fz_print_stext_page_as_xml")
+	purego.RegisterLibFunc(&fz_load_page, lib, "fz_load_page")
+	purego.RegisterLibFunc(&fz_drop_page, lib, "fz_drop_page")
+	purego.RegisterLibFunc(&fz_bound_page, lib, "fz_bound_page")
+	purego.RegisterLibFunc(&fz_device_gray, lib, "fz_device_gray")
+	purego.RegisterLibFunc(&fz_new_pixmap_from_page_number, lib, "fz_new_pixmap_from_page_number")
+	purego.RegisterLibFunc(&fz_drop_pixmap, lib, "fz_drop_pixmap")
+	purego.RegisterLibFunc(&fz_pixmap_samples, lib, "fz_pixmap_samples")
+	purego.RegisterLibFunc(&fz_pixmap_stride, lib, "fz_pixmap_stride")
+	purego.RegisterLibFunc(&fz_pixmap_width, lib, "fz_pixmap_width")
+	purego.RegisterLibFunc(&fz_pixmap_height, lib, "fz_pixmap_height")
+	purego.RegisterLibFunc(&fz_pixmap_components, lib, "fz_pixmap_components")
 	ver := version()
 	if ver != "" {
 		MuPdfVersion = ver
@@ -182,6 +246,71 @@ func (d *Document) Text(pageIndex int) (string, bool) {
 	return txt, true
 }
 
+// PageLayout returns page i's words and their bounding boxes
+func (d *Document) PageLayout(pageIndex int) (*layout.Page, error) {
+	page, _, err := d.structuredText(pageIndex, nil)
+	return page, err
+}
+
+// ImageCoverage returns the fraction of page i's area covered by images
+func (d *Document) ImageCoverage(pageIndex int) (float64, error) {
+	// FZ_STEXT_PRESERVE_IMAGES
+	page, images, err := d.structuredText(pageIndex, &stextOptions{flags: 4, scale: 1})
+	if err != nil {
+		return 0, err
+	}
+	return layout.Coverage(layout.Rect{X1: page.Width, Y1: page.Height}, images), nil
+}
+
+// structuredText returns the words and images of page i, which MuPDF hands out as XML.
+func (d *Document) structuredText(pageIndex int, opts *stextOptions) (*layout.Page, []layout.Rect, error) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	stext := fz_new_stext_page_from_page_number(d.ctx, d.doc, pageIndex, opts)
+	if stext == 0 {
+		return nil, nil, fmt.Errorf("mupdf: cannot load structured text of page %d", pageIndex)
+	}
+	defer fz_drop_stext_page(d.ctx, stext)
+	buf := fz_new_buffer(d.ctx, 8192)
+	defer fz_drop_buffer(d.ctx, buf)
+	out := fz_new_output_with_buffer(d.ctx, buf)
+	fz_print_stext_page_as_xml(d.ctx, out, stext, pageIndex+1)
+	fz_close_output(d.ctx, out)
+	fz_drop_output(d.ctx, out)
+	return parseSTextXml(strings.NewReader(fz_string_from_buffer(d.ctx, buf)))
+}
+
+// RenderPage renders page i at the given resolution as grayscale bitmap, e.g. for OCR
+func (d *Document) RenderPage(pageIndex int, dpi float64) (*image.Gray, error) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	page := fz_load_page(d.ctx, d.doc, pageIndex)
+	if page == 0 {
+		return nil, fmt.Errorf("mupdf: cannot load page %d", pageIndex)
+	}
+	bounds := fz_bound_page(d.ctx, page)
+	fz_drop_page(d.ctx, page)
+	_, _, scale := pdflibwrappers.RenderSize(float64(bounds.x1-bounds.x0), float64(bounds.y1-bounds.y0), dpi)
+	ctm := fzMatrix{a: float32(scale), d: float32(scale)}
+	pix := fz_new_pixmap_from_page_number(d.ctx, d.doc, pageIndex, ctm, fz_device_gray(d.ctx), 0)
+	if pix == 0 {
+		return nil, fmt.Errorf("mupdf: cannot render page %d", pageIndex)
+	}
+	defer fz_drop_pixmap(d.ctx, pix)
+	w, h := fz_pixmap_width(d.ctx, pix), fz_pixmap_height(d.ctx, pix)
+	n, stride := fz_pixmap_components(d.ctx, pix), fz_pixmap_stride(d.ctx, pix)
+	samples := unsafe.Slice((*byte)(fz_pixmap_samples(d.ctx, pix)), stride*h)
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for y := range h {
+		row := samples[y*stride:]
+		for x := range w {
+			// the first component is the gray value
+			img.Pix[y*img.Stride+x] = row[x*n]
+		}
+	}
+	return img, nil
+}
+
 func (d *Document) StreamText(w io.Writer) error {
 	for i := 0; i < d.pages; i++ {
 		txt, _ := d.Text(i)
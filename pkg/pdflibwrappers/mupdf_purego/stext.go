@@ -0,0 +1,91 @@
+package mupdf_purego
+
+import (
+	"encoding/xml"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/johbar/text-extraction-service/v4/pkg/layout"
+)
+
+// parseSTextXml reads the XML representation of a structured text page as written by
+// fz_print_stext_page_as_xml and returns its glyphs grouped into words and the bounding boxes of its images,
+// which are only included if the page was created with FZ_STEXT_PRESERVE_IMAGES.
+// The coordinates used by MuPDF already have their origin in the top left corner.
+func parseSTextXml(r io.Reader) (*layout.Page, []layout.Rect, error) {
+	page := &layout.Page{}
+	var images []layout.Rect
+	var chars []layout.Char
+	dec := xml.NewDecoder(r)
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		switch el := tok.(type) {
+		case xml.StartElement:
+			switch el.Name.Local {
+			case "page":
+				page.Width, _ = strconv.ParseFloat(attr(el, "width"), 64)
+				page.Height, _ = strconv.ParseFloat(attr(el, "height"), 64)
+			case "char":
+				c, _ := utf8.DecodeRuneInString(attr(el, "c"))
+				chars = append(chars, layout.Char{Rune: c, Box: quadToRect(attr(el, "quad"))})
+			case "image":
+				images = append(images, bboxToRect(attr(el, "bbox")))
+			}
+		case xml.EndElement:
+			if el.Name.Local == "line" {
+				// lines are not separated by whitespace glyphs
+				chars = append(chars, layout.Char{Rune: '\n'})
+			}
+		}
+	}
+	page.Words = layout.WordsFromChars(chars)
+	return page, images, nil
+}
+
+func attr(el xml.StartElement, name string) string {
+	for _, a := range el.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// bboxToRect parses a bounding box given as "x0 y0 x1 y1".
+func bboxToRect(bbox string) layout.Rect {
+	fields := strings.Fields(bbox)
+	if len(fields) != 4 {
+		return layout.Rect{}
+	}
+	var v [4]float64
+	for i, f := range fields {
+		v[i], _ = strconv.ParseFloat(f, 64)
+	}
+	return layout.Rect{X0: v[0], Y0: v[1], X1: v[2], Y1: v[3]}
+}
+
+// quadToRect returns the bounding box of a quad given as "ulx uly urx ury llx lly lrx lry".
+func quadToRect(quad string) layout.Rect {
+	fields := strings.Fields(quad)
+	if len(fields) != 8 {
+		return layout.Rect{}
+	}
+	var v [8]float64
+	for i, f := range fields {
+		v[i], _ = strconv.ParseFloat(f, 64)
+	}
+	return layout.Rect{
+		X0: min(v[0], v[2], v[4], v[6]),
+		Y0: min(v[1], v[3], v[5], v[7]),
+		X1: max(v[0], v[2], v[4], v[6]),
+		Y1: max(v[1], v[3], v[5], v[7]),
+	}
+}
@@ -4,14 +4,17 @@ package pdfium_purego
 import (
 	"errors"
 	"fmt"
+	"image"
 	"io"
 	"log/slog"
 	"strconv"
 	"sync"
 	"unicode/utf8"
+	"unsafe"
 
 	"github.com/ebitengine/purego"
 	"github.com/johbar/text-extraction-service/v4/internal/pdfdateparser"
+	"github.com/johbar/text-extraction-service/v4/pkg/layout"
 	"github.com/johbar/text-extraction-service/v4/pkg/mmappool"
 	"github.com/johbar/text-extraction-service/v4/pkg/pdflibwrappers"
 	"golang.org/x/text/encoding"
@@ -21,6 +24,7 @@ import (
 type document uintptr
 type page uintptr
 type textPage uintptr
+type bitmap uintptr
 
 var (
 	lib uintptr
@@ -39,11 +43,24 @@ var (
 	// page
 	FPDF_LoadPage         func(docHandle document, index int32) page
 	FPDF_ClosePage        func(pageHandle page)
+	FPDF_GetPageWidth     func(pageHandle page) float64
+	FPDF_GetPageHeight    func(pageHandle page) float64
 	FPDFPage_CountObjects func(pageHandle page) int32
 	FPDFPage_GetObject    func(pageHandle page, index int32) (pageObjectHandle uintptr)
 	FPDFPageObj_GetType   func(objHandle uintptr) int32
+	// Get the bounding box of a page object in page coordinates (origin in the bottom left corner).
+	FPDFPageObj_GetBounds func(objHandle uintptr, left, bottom, right, top *float32) bool
+	// Get the drawing mode of a path object. fillMode 0 means the path is not filled.
+	FPDFPath_GetDrawMode func(objHandle uintptr, fillMode *int32, stroke *int32) bool
 
 	FPDFImageObj_GetImageDataDecoded func(objHandle uintptr, resultBuffer []byte, bufLength uint64) (length uint64)
+	// rendering
+	FPDFBitmap_CreateEx   func(width, height, format int32, firstScan uintptr, stride int32) bitmap
+	FPDFBitmap_FillRect   func(b bitmap, left, top, width, height int32, color uint64) bool
+	FPDFBitmap_GetBuffer  func(b bitmap) unsafe.Pointer
+	FPDFBitmap_GetStride  func(b bitmap) int32
+	FPDFBitmap_Destroy    func(b bitmap)
+	FPDF_RenderPageBitmap func(b bitmap, pageHandle page, startX, startY, sizeX, sizeY, rotate, flags int32)
 	// text
 	FPDFText_LoadPage   func(page) textPage
 	FPDFText_ClosePage  func(textPage)
@@ -53,6 +70,8 @@ var (
 	// Returns Number of characters written into parameter result buffer, excluding the trailing terminator.
 	FPDFText_GetText    func(textHandle textPage, startIndex int, count int, resultBuf []byte) (charsWritten int)
 	FPDFText_GetUnicode func(textHandle textPage, index int) rune
+	// Get bounding box of a particular character in page coordinates (origin in the bottom left corner).
+	FPDFText_GetCharBox func(textHandle textPage, index int, left, right, bottom, top *float64) bool
 	/*
 		Get the text string of specific tag from meta data of a PDF document.
 
@@ -102,17 +121,28 @@ func InitLib(path string) (string, error) {
 	purego.RegisterLibFunc(&FPDF_GetPageCount, lib, "FPDF_GetPageCount")
 	purego.RegisterLibFunc(&FPDF_LoadPage, lib, "FPDF_LoadPage")
 	purego.RegisterLibFunc(&FPDF_ClosePage, lib, "FPDF_ClosePage")
+	purego.RegisterLibFunc(&FPDF_GetPageWidth, lib, "FPDF_GetPageWidth")
+	purego.RegisterLibFunc(&FPDF_GetPageHeight, lib, "FPDF_GetPageHeight")
 
 	purego.RegisterLibFunc(&FPDFPage_CountObjects, lib, "FPDFPage_CountObjects")
 	purego.RegisterLibFunc(&FPDFPage_GetObject, lib, "FPDFPage_GetObject")
 	purego.RegisterLibFunc(&FPDFPageObj_GetType, lib, "FPDFPageObj_GetType")
+	purego.RegisterLibFunc(&FPDFPageObj_GetBounds, lib, "FPDFPageObj_GetBounds")
+	purego.RegisterLibFunc(&FPDFPath_GetDrawMode, lib, "FPDFPath_GetDrawMode")
 	purego.RegisterLibFunc(&FPDFImageObj_GetImageDataDecoded, lib, "FPDFImageObj_GetImageDataDecoded")
+	purego.RegisterLibFunc(&FPDFBitmap_CreateEx, lib, "FPDFBitmap_CreateEx")
+	purego.RegisterLibFunc(&FPDFBitmap_FillRect, lib, "FPDFBitmap_FillRect")
+	purego.RegisterLibFunc(&FPDFBitmap_GetBuffer, lib, "FPDFBitmap_GetBuffer")
+	purego.RegisterLibFunc(&FPDFBitmap_GetStride, lib, "FPDFBitmap_GetStride")
+	purego.RegisterLibFunc(&FPDFBitmap_Destroy, lib, "FPDFBitmap_Destroy")
+	purego.RegisterLibFunc(&FPDF_RenderPageBitmap, lib, "FPDF_RenderPageBitmap")
 
 	purego.RegisterLibFunc(&FPDFText_LoadPage, lib, "FPDFText_LoadPage")
 	purego.RegisterLibFunc(&FPDFText_ClosePage, lib, "FPDFText_ClosePage")
 	purego.RegisterLibFunc(&FPDFText_CountChars, lib, "FPDFText_CountChars")
 	purego.RegisterLibFunc(&FPDFText_GetText, lib, "FPDFText_GetText")
 	purego.RegisterLibFunc(&FPDFText_GetUnicode, lib, "FPDFText_GetUnicode")
+	purego.RegisterLibFunc(&FPDFText_GetCharBox, lib, "FPDFText_GetCharBox")
 	purego.RegisterLibFunc(&FPDF_GetMetaText, lib, "FPDF_GetMetaText")
 
 	FPDF_InitLibrary()
@@ -266,6 +296,127 @@ func (d *Document) textOptimzed(i int) ([]byte, bool) {
 	return text, hasImages
 }
 
+// PageLayout returns page i's words and their bounding boxes
+func (d *Document) PageLayout(i int) (*layout.Page, error) {
+	p := d.page(i)
+	if p == 0 {
+		return nil, fmt.Errorf("pdfium: cannot load page %d", i)
+	}
+	defer p.close()
+	t := d.textPage(p)
+	defer t.close()
+	Lock.Lock()
+	defer Lock.Unlock()
+	width, height := FPDF_GetPageWidth(p), FPDF_GetPageHeight(p)
+	n := FPDFText_CountChars(t)
+	chars := make([]layout.Char, 0, n)
+	var left, right, bottom, top float64
+	for c := range n {
+		r := FPDFText_GetUnicode(t, c)
+		if r == '\uFFFE' || r == '\u0002' {
+			// PDFium's marker for hyphens at line endings
+			r = '-'
+		}
+		if !FPDFText_GetCharBox(t, c, &left, &right, &bottom, &top) {
+			chars = append(chars, layout.Char{Rune: r})
+			continue
+		}
+		chars = append(chars, layout.Char{
+			Rune: r,
+			Box:  layout.Rect{X0: left, Y0: height - top, X1: right, Y1: height - bottom},
+		})
+	}
+	page := layout.NewPage(width, height, chars)
+	page.Rules = pathRules(p, height)
+	return page, nil
+}
+
+// pathRules returns the horizontal and vertical lines drawn on the page in top-left based coordinates.
+// Thin path objects are returned as they are, stroked rectangles as their four edges.
+// The caller must hold Lock.
+func pathRules(p page, height float64) []layout.Rect {
+	const (
+		pathObject = 2
+		thickness  = 2.0
+	)
+	var rules []layout.Rect
+	var left, bottom, right, top float32
+	var fillMode, stroke int32
+	for i := range FPDFPage_CountObjects(p) {
+		obj := FPDFPage_GetObject(p, i)
+		if FPDFPageObj_GetType(obj) != pathObject || !FPDFPageObj_GetBounds(obj, &left, &bottom, &right, &top) {
+			continue
+		}
+		r := layout.Rect{X0: float64(left), Y0: height - float64(top), X1: float64(right), Y1: height - float64(bottom)}
+		if min(r.Width(), r.Height()) <= thickness {
+			rules = append(rules, r)
+			continue
+		}
+		if FPDFPath_GetDrawMode(obj, &fillMode, &stroke) && stroke != 0 {
+			rules = append(rules,
+				layout.Rect{X0: r.X0, Y0: r.Y0, X1: r.X1, Y1: r.Y0 + 1},
+				layout.Rect{X0: r.X0, Y0: r.Y1 - 1, X1: r.X1, Y1: r.Y1},
+				layout.Rect{X0: r.X0, Y0: r.Y0, X1: r.X0 + 1, Y1: r.Y1},
+				layout.Rect{X0: r.X1 - 1, Y0: r.Y0, X1: r.X1, Y1: r.Y1},
+			)
+		}
+	}
+	return rules
+}
+
+// ImageCoverage returns the fraction of page i's area covered by images
+func (d *Document) ImageCoverage(i int) (float64, error) {
+	const imageObject = 3
+	p := d.page(i)
+	if p == 0 {
+		return 0, fmt.Errorf("pdfium: cannot load page %d", i)
+	}
+	defer p.close()
+	Lock.Lock()
+	defer Lock.Unlock()
+	var boxes []layout.Rect
+	var left, bottom, right, top float32
+	for j := range FPDFPage_CountObjects(p) {
+		obj := FPDFPage_GetObject(p, j)
+		if FPDFPageObj_GetType(obj) == imageObject && FPDFPageObj_GetBounds(obj, &left, &bottom, &right, &top) {
+			boxes = append(boxes, layout.Rect{X0: float64(left), Y0: float64(bottom), X1: float64(right), Y1: float64(top)})
+		}
+	}
+	// coverage doesn't depend on the direction of the Y axis
+	return layout.Coverage(layout.Rect{X1: FPDF_GetPageWidth(p), Y1: FPDF_GetPageHeight(p)}, boxes), nil
+}
+
+// RenderPage renders page i at the given resolution as grayscale bitmap, e.g. for OCR
+func (d *Document) RenderPage(i int, dpi float64) (*image.Gray, error) {
+	const (
+		bitmapGray = 1
+		// FPDF_ANNOT | FPDF_GRAYSCALE | FPDF_PRINTING
+		renderFlags = 0x01 | 0x08 | 0x800
+	)
+	p := d.page(i)
+	if p == 0 {
+		return nil, fmt.Errorf("pdfium: cannot load page %d", i)
+	}
+	defer p.close()
+	Lock.Lock()
+	defer Lock.Unlock()
+	w, h, _ := pdflibwrappers.RenderSize(FPDF_GetPageWidth(p), FPDF_GetPageHeight(p), dpi)
+	bm := FPDFBitmap_CreateEx(int32(w), int32(h), bitmapGray, 0, 0)
+	if bm == 0 {
+		return nil, fmt.Errorf("pdfium: cannot create bitmap of %dx%d pixels", w, h)
+	}
+	defer FPDFBitmap_Destroy(bm)
+	FPDFBitmap_FillRect(bm, 0, 0, int32(w), int32(h), 0xFFFFFFFF)
+	FPDF_RenderPageBitmap(bm, p, 0, 0, int32(w), int32(h), 0, renderFlags)
+	stride := int(FPDFBitmap_GetStride(bm))
+	buf := unsafe.Slice((*byte)(FPDFBitmap_GetBuffer(bm)), stride*h)
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for y := range h {
+		copy(img.Pix[y*img.Stride:y*img.Stride+w], buf[y*stride:])
+	}
+	return img, nil
+}
+
 func (d *Document) StreamText(w io.Writer) error {
 	for i := range d.pages {
 		pageText, _ := d.textOptimzed(i)
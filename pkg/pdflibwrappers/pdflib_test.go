@@ -4,6 +4,7 @@ import (
 	"os"
 	"testing"
 
+	"github.com/johbar/text-extraction-service/v4/pkg/pdflibwrappers"
 	"github.com/johbar/text-extraction-service/v4/pkg/pdflibwrappers/mupdf_purego"
 	"github.com/johbar/text-extraction-service/v4/pkg/pdflibwrappers/pdfium_purego"
 	"github.com/johbar/text-extraction-service/v4/pkg/pdflibwrappers/poppler_purego"
@@ -156,3 +157,19 @@ func checkMetadataEntries(t *testing.T, meta map[string]string) {
 		t.Errorf("expected document title to be 'Drucksache 20/1', but was '%s'", meta["x-document-title"])
 	}
 }
+
+func TestRenderSize(t *testing.T) {
+	// A4 at 300 dpi
+	w, h, scale := pdflibwrappers.RenderSize(595, 842, 300)
+	if w != 2479 || h != 3508 {
+		t.Errorf("RenderSize(A4, 300) = %dx%d, want 2479x3508", w, h)
+	}
+	// a huge poster must not exceed the limit
+	w, h, scale = pdflibwrappers.RenderSize(14400, 7200, 300)
+	if w != pdflibwrappers.MaxRenderDimension || h != pdflibwrappers.MaxRenderDimension/2 {
+		t.Errorf("RenderSize(poster, 300) = %dx%d, want %dx%d", w, h, pdflibwrappers.MaxRenderDimension, pdflibwrappers.MaxRenderDimension/2)
+	}
+	if want := float64(pdflibwrappers.MaxRenderDimension) / 14400; scale != want {
+		t.Errorf("scale = %f, want %f", scale, want)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/johbar/pdfcpu-lite/pkg/pdfcpu/validate"
 	"github.com/johbar/text-extraction-service/v4/internal/cache"
 	"github.com/johbar/text-extraction-service/v4/internal/pdfdateparser"
+	"github.com/johbar/text-extraction-service/v4/pkg/layout"
 )
 
 var pdfcpuConfig *model.Configuration = model.NewDefaultConfiguration()
@@ -129,3 +130,8 @@ func (d *Document) StreamText(w io.Writer) error {
 	}
 	return nil
 }
+
+// PageLayout returns the positioned words of page i (0-based)
+func (d *Document) PageLayout(i int) (*layout.Page, error) {
+	return extractPageLayout(&d.ctx, i+1)
+}
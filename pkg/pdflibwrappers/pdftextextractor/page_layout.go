@@ -0,0 +1,69 @@
+package pdftextextractor
+
+import (
+	"unicode/utf8"
+
+	"github.com/johbar/pdfcpu-lite/pkg/pdfcpu/model"
+	"github.com/johbar/pdfcpu-lite/pkg/pdfcpu/types"
+	"github.com/johbar/text-extraction-service/v4/pkg/layout"
+)
+
+const (
+	// defaultFontSize is assumed for spans whose font size could not be determined.
+	defaultFontSize = 10.0
+	// ascent and descent approximate the part of the font size above and below the baseline.
+	ascent  = 0.8
+	descent = 0.2
+)
+
+// defaultMediaBox is used for pages without a MediaBox (A4).
+var defaultMediaBox = types.Rectangle{UR: types.Point{X: 595, Y: 842}}
+
+// extractPageLayout returns the positioned words of page pageNr (1-based).
+// The word boxes are approximated from the spans' device-space coordinates,
+// because glyph-level positions are not tracked.
+func extractPageLayout(ctx *model.Context, pageNr int) (*layout.Page, error) {
+	pc, err := loadPageContent(ctx, pageNr)
+	if err != nil {
+		return nil, err
+	}
+	box := defaultMediaBox
+	if pc != nil && pc.mediaBox != nil {
+		box = *pc.mediaBox
+	}
+	page := &layout.Page{Width: box.Width(), Height: box.Height()}
+	if pc == nil {
+		return page, nil
+	}
+	var rules []layout.Rect
+	for _, sp := range collectSpans(pc.content, pc.fontMap, pc.xobjMap, &rules) {
+		size := sp.fontSize
+		if size <= 0 {
+			size = defaultFontSize
+		}
+		text := sp.text.String()
+		putSpanBuf(sp.text)
+		// flip the Y axis: device space has its origin in the bottom left corner
+		baseline := box.UR.Y - sp.devY
+		r := layout.Rect{
+			X0: sp.devX - box.LL.X,
+			Y0: baseline - size*ascent,
+			X1: sp.devXEnd - box.LL.X,
+			Y1: baseline + size*descent,
+		}
+		if r.X1 <= r.X0 {
+			// the cursor was not advanced, e.g. due to missing font widths
+			r.X1 = r.X0 + float64(utf8.RuneCountInString(text))*size*0.5
+		}
+		page.Words = append(page.Words, layout.WordsFromSpan(text, r)...)
+	}
+	for _, r := range rules {
+		page.Rules = append(page.Rules, layout.Rect{
+			X0: r.X0 - box.LL.X,
+			Y0: box.UR.Y - r.Y1,
+			X1: r.X1 - box.LL.X,
+			Y1: box.UR.Y - r.Y0,
+		})
+	}
+	return page, nil
+}
@@ -0,0 +1,88 @@
+package pdftextextractor
+
+import (
+	"math"
+
+	"github.com/johbar/text-extraction-service/v4/pkg/layout"
+)
+
+// maxRuleThickness is the maximum thickness of a filled rectangle to be considered a rule.
+const maxRuleThickness = 2.0
+
+// segment is a straight line in device space.
+type segment struct {
+	x0, y0, x1, y1 float64
+}
+
+// pathState collects the straight segments of the current path in device space,
+// so that horizontal and vertical lines can be reported as rules (e.g. table borders)
+// once the path is painted. Curves only move the current point.
+type pathState struct {
+	segments []segment
+	// thin rectangles, reported as rules when filled
+	rects  []layout.Rect
+	cx, cy float64 // current point
+	sx, sy float64 // start of the current subpath
+}
+
+func (p *pathState) moveTo(x, y float64, ctm matrix3) {
+	p.cx, p.cy = ctm.transformPoint(x, y)
+	p.sx, p.sy = p.cx, p.cy
+}
+
+func (p *pathState) lineTo(x, y float64, ctm matrix3) {
+	nx, ny := ctm.transformPoint(x, y)
+	p.segments = append(p.segments, segment{p.cx, p.cy, nx, ny})
+	p.cx, p.cy = nx, ny
+}
+
+func (p *pathState) closePath() {
+	if p.cx != p.sx || p.cy != p.sy {
+		p.segments = append(p.segments, segment{p.cx, p.cy, p.sx, p.sy})
+	}
+	p.cx, p.cy = p.sx, p.sy
+}
+
+// rect appends a closed rectangle subpath (PDF operator re).
+func (p *pathState) rect(x, y, w, h float64, ctm matrix3) {
+	p.moveTo(x, y, ctm)
+	p.lineTo(x+w, y, ctm)
+	p.lineTo(x+w, y+h, ctm)
+	p.lineTo(x, y+h, ctm)
+	p.closePath()
+	n := len(p.segments)
+	// the bounding box of the last four segments
+	r := layout.Rect{X0: math.Inf(1), Y0: math.Inf(1), X1: math.Inf(-1), Y1: math.Inf(-1)}
+	for _, s := range p.segments[n-4:] {
+		r.X0, r.X1 = min(r.X0, s.x0, s.x1), max(r.X1, s.x0, s.x1)
+		r.Y0, r.Y1 = min(r.Y0, s.y0, s.y1), max(r.Y1, s.y0, s.y1)
+	}
+	if min(r.Width(), r.Height()) <= maxRuleThickness {
+		p.rects = append(p.rects, r)
+	}
+}
+
+// paint appends the rules of the current path to rules and starts a new path.
+// Stroked paths contribute their horizontal and vertical segments,
+// filled paths their thin rectangles. The rules are in device space (origin bottom left).
+func (p *pathState) paint(stroke bool, rules *[]layout.Rect) {
+	const tolerance = 0.5
+	if stroke {
+		for _, s := range p.segments {
+			switch {
+			case math.Abs(s.y0-s.y1) < tolerance && s.x0 != s.x1:
+				*rules = append(*rules, layout.Rect{X0: min(s.x0, s.x1), Y0: s.y0 - tolerance, X1: max(s.x0, s.x1), Y1: s.y0 + tolerance})
+			case math.Abs(s.x0-s.x1) < tolerance && s.y0 != s.y1:
+				*rules = append(*rules, layout.Rect{X0: s.x0 - tolerance, Y0: min(s.y0, s.y1), X1: s.x0 + tolerance, Y1: max(s.y0, s.y1)})
+			}
+		}
+	} else {
+		*rules = append(*rules, p.rects...)
+	}
+	p.reset()
+}
+
+func (p *pathState) reset() {
+	p.segments = p.segments[:0]
+	p.rects = p.rects[:0]
+}
@@ -25,6 +25,8 @@ import (
 	"unsafe"
 
 	"github.com/johbar/pdfcpu-lite/pkg/pdfcpu/model"
+	"github.com/johbar/pdfcpu-lite/pkg/pdfcpu/types"
+	"github.com/johbar/text-extraction-service/v4/pkg/layout"
 )
 
 // ---------------------------------------------------------------------------
@@ -73,46 +75,98 @@ func putSpanBuf(b *bytes.Buffer) {
 // The caller interface is identical to extractPageText; only the span-ordering
 // strategy changes when marked-content operators are detected.
 func extractPageTextTaggedOrder(ctx *model.Context, pageNr int) (*bytes.Buffer, error) {
+	pc, err := loadPageContent(ctx, pageNr)
+	if err != nil || pc == nil {
+		return nil, err
+	}
+
+	text, err := extractTextFromContentTagged(pc.content, pc.fontMap, pc.xobjMap)
+	if err != nil {
+		return nil, fmt.Errorf("extractPageTextTaggedOrder: page %d parse: %w", pageNr, err)
+	}
+	return &text, nil
+}
+
+// pageContent holds the decoded content stream of a page and the resources needed to parse it.
+type pageContent struct {
+	content  []byte
+	fontMap  map[string]*pdfFont
+	xobjMap  map[string]xObject
+	mediaBox *types.Rectangle
+}
+
+// loadPageContent returns the content stream and resources of page pageNr (1-based).
+// It returns nil and no error if the page has no content.
+func loadPageContent(ctx *model.Context, pageNr int) (*pageContent, error) {
 	if pageNr < 1 || pageNr > ctx.PageCount {
-		return nil, fmt.Errorf("extractPageTextTaggedOrder: invalid page number %d (document has %d pages)", pageNr, ctx.PageCount)
+		return nil, fmt.Errorf("loadPageContent: invalid page number %d (document has %d pages)", pageNr, ctx.PageCount)
 	}
 	pageDict, _, inhPAttrs, err := ctx.XRefTable.PageDict(pageNr, true /*consolidateRes*/)
 	if err != nil {
-		return nil, fmt.Errorf("extractPageTextTaggedOrder: page %d: %w", pageNr, err)
+		return nil, fmt.Errorf("loadPageContent: page %d: %w", pageNr, err)
 	}
 	if pageDict == nil {
-		return nil, fmt.Errorf("extractPageTextTaggedOrder: page %d not found", pageNr)
+		return nil, fmt.Errorf("loadPageContent: page %d not found", pageNr)
 	}
 	content, err := ctx.XRefTable.PageContent(pageDict, pageNr)
 	if err != nil {
 		if err == model.ErrNoContent {
 			return nil, nil
 		}
-		return nil, fmt.Errorf("extractPageTextTaggedOrder: page %d content: %w", pageNr, err)
-	}
-	fontMap := buildFontMap(ctx.XRefTable, inhPAttrs.Resources)
-	xobjMap := buildXObjMap(ctx.XRefTable, inhPAttrs.Resources)
-
-	text, err := extractTextFromContentTagged(content, fontMap, xobjMap)
-	if err != nil {
-		return nil, fmt.Errorf("extractPageTextTaggedOrder: page %d parse: %w", pageNr, err)
+		return nil, fmt.Errorf("loadPageContent: page %d content: %w", pageNr, err)
 	}
-	return &text, nil
+	return &pageContent{
+		content:  content,
+		fontMap:  buildFontMap(ctx.XRefTable, inhPAttrs.Resources),
+		xobjMap:  buildXObjMap(ctx.XRefTable, inhPAttrs.Resources),
+		mediaBox: inhPAttrs.MediaBox,
+	}, nil
 }
 
 // ---------------------------------------------------------------------------
 // Core extraction logic
 // ---------------------------------------------------------------------------
 
-// extractTextFromContentTagged drives parseContentStreamTagged and joins the
-// resulting spans either in content-stream order (tagged PDFs) or visual
-// reading order (untagged fallback).
+// extractTextFromContentTagged joins the spans returned by collectSpans,
+// inserting whitespace inferred from their device-space coordinates.
 func extractTextFromContentTagged(content []byte, fontMap map[string]*pdfFont, xobjMap map[string]xObject) (bytes.Buffer, error) {
+	spans := collectSpans(content, fontMap, xobjMap, nil)
+
+	// Join spans, inserting whitespace inferred from device-space coordinates.
+	// This logic works correctly in both sorted and stream order because each
+	// span carries its own devX/devY regardless of how they were ordered.
+	var out bytes.Buffer
+	for k, sp := range spans {
+		if k == 0 {
+			out.Write(sp.text.Bytes())
+			putSpanBuf(sp.text)
+			continue
+		}
+		prev := spans[k-1]
+		dy := prev.devY - sp.devY
+		if dy > 1 || dy < -1 {
+			out.WriteByte('\n')
+			// fixed space threshold here because textstate
+			// and font are not available.
+		} else if sp.devX-prev.devXEnd > 1 {
+			out.WriteByte(' ')
+		}
+		out.Write(sp.text.Bytes())
+		putSpanBuf(sp.text)
+	}
+	return out, nil
+}
+
+// collectSpans drives parseContentStreamTagged and returns the resulting spans
+// either in content-stream order (tagged PDFs) or visual reading order
+// (untagged fallback). The caller owns the spans' buffers.
+// If rules is not nil, the straight lines painted on the page are appended to it.
+func collectSpans(content []byte, fontMap map[string]*pdfFont, xobjMap map[string]xObject, rules *[]layout.Rect) []textSpan {
 	spans := make([]textSpan, 0, 64)
 	cur := &textSpan{text: getSpanBuf()}
 	tagged := false
 
-	cursorDevX := parseContentStreamTagged(content, fontMap, xobjMap, newGraphicsState(), &spans, &cur, &tagged)
+	cursorDevX := parseContentStreamTagged(content, fontMap, xobjMap, newGraphicsState(), &spans, &cur, &tagged, rules)
 
 	// Seal whatever the last operator left in the open span.
 	if cur.text.Len() > 0 {
@@ -140,30 +194,7 @@ func extractTextFromContentTagged(content []byte, fontMap map[string]*pdfFont, x
 		})
 	}
 	// When tagged, spans are already in content-stream order; no sort needed.
-
-	// Join spans, inserting whitespace inferred from device-space coordinates.
-	// This logic works correctly in both sorted and stream order because each
-	// span carries its own devX/devY regardless of how they were ordered.
-	var out bytes.Buffer
-	for k, sp := range spans {
-		if k == 0 {
-			out.Write(sp.text.Bytes())
-			putSpanBuf(sp.text)
-			continue
-		}
-		prev := spans[k-1]
-		dy := prev.devY - sp.devY
-		if dy > 1 || dy < -1 {
-			out.WriteByte('\n')
-			// fixed space threshold here because textstate
-			// and font are not available.
-		} else if sp.devX-prev.devXEnd > 1 {
-			out.WriteByte(' ')
-		}
-		out.Write(sp.text.Bytes())
-		putSpanBuf(sp.text)
-	}
-	return out, nil
+	return spans
 }
 
 // parseContentStreamTagged is the tagged variant of parseContentStream.
@@ -189,6 +220,9 @@ func extractTextFromContentTagged(content []byte, fontMap map[string]*pdfFont, x
 // tracking remains accurate after the suppressed run.
 //
 // Form XObjects invoked inside an Artifact run are skipped entirely.
+//
+// If rules is not nil, the path construction and painting operators are
+// tracked as well and painted straight lines are appended to rules (see pathState).
 // It returns the last cursor X position.
 func parseContentStreamTagged(
 	content []byte,
@@ -198,8 +232,10 @@ func parseContentStreamTagged(
 	spans *[]textSpan,
 	cur **textSpan,
 	tagged *bool,
+	rules *[]layout.Rect,
 ) float64 {
 	ts := &textState{fontMap: fontMap}
+	var path pathState
 
 	const winSize = 8
 	const winMask = winSize - 1
@@ -282,6 +318,66 @@ func parseContentStreamTagged(
 				}
 			}
 
+		// -------------------------------------------------------------------
+		// Path construction and painting operators (only tracked for rules)
+		// -------------------------------------------------------------------
+
+		case "m", "l":
+			if rules != nil && pos >= 3 {
+				x, ex := parseFloatBytes(atBack(2))
+				y, ey := parseFloatBytes(atBack(1))
+				if ex == nil && ey == nil {
+					if s == "m" {
+						path.moveTo(x, y, gs.ctm)
+					} else {
+						path.lineTo(x, y, gs.ctm)
+					}
+				}
+			}
+
+		case "c", "v", "y":
+			// curves are never rules, but they move the current point
+			if rules != nil && pos >= 3 {
+				x, ex := parseFloatBytes(atBack(2))
+				y, ey := parseFloatBytes(atBack(1))
+				if ex == nil && ey == nil {
+					path.moveTo(x, y, gs.ctm)
+				}
+			}
+
+		case "re":
+			if rules != nil && pos >= 5 {
+				x, ex := parseFloatBytes(atBack(4))
+				y, ey := parseFloatBytes(atBack(3))
+				w, ew := parseFloatBytes(atBack(2))
+				h, eh := parseFloatBytes(atBack(1))
+				if ex == nil && ey == nil && ew == nil && eh == nil {
+					path.rect(x, y, w, h, gs.ctm)
+				}
+			}
+
+		case "h":
+			path.closePath()
+
+		case "s", "b", "b*":
+			path.closePath()
+			if rules != nil {
+				path.paint(true, rules)
+			}
+
+		case "S", "B", "B*":
+			if rules != nil {
+				path.paint(true, rules)
+			}
+
+		case "f", "F", "f*":
+			if rules != nil {
+				path.paint(false, rules)
+			}
+
+		case "n":
+			path.reset()
+
 		// -------------------------------------------------------------------
 		// Marked-content operators
 		// -------------------------------------------------------------------
@@ -379,7 +475,7 @@ func parseContentStreamTagged(
 						maps.Copy(merged, xobj.fontMap)
 						childFonts = merged
 					}
-					devX := parseContentStreamTagged(xobj.content, childFonts, xobj.xobjMap, childGS, spans, cur, tagged)
+					devX := parseContentStreamTagged(xobj.content, childFonts, xobj.xobjMap, childGS, spans, cur, tagged, rules)
 					// Seal whatever the XObject left so it doesn't bleed into the
 					// parent stream's next span.
 					if (*cur).text.Len() > 0 {
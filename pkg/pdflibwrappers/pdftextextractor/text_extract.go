@@ -860,6 +860,7 @@ type textSpan struct {
 	text       *bytes.Buffer
 	devY, devX float64
 	devXEnd    float64 // cursorDevX after last glyph
+	fontSize   float64 // effective font size when the span was started
 }
 
 // emitGap compares the device-space origin of the next text chunk against the
@@ -885,7 +886,7 @@ func (ts *textState) emitGap(spans *[]textSpan, cur **textSpan, newDevX, newDevY
 	if dy > lineThreshold || dy < -lineThreshold {
 		// Different baseline: seal the current span and open a new one.
 		ts.sealCur(spans, cur, newDevX, newDevY)
-		*cur = &textSpan{devY: newDevY, devX: newDevX, text: getSpanBuf()}
+		*cur = &textSpan{devY: newDevY, devX: newDevX, fontSize: ts.fontSize, text: getSpanBuf()}
 	} else {
 		// Same baseline: emit space only for a genuine forward gap.
 		spaceThreshold := ts.fontSize * 0.2
@@ -913,7 +914,7 @@ func (ts *textState) sealCur(spans *[]textSpan, cur **textSpan, newDevX, newDevY
 		(*cur).devXEnd = ts.cursorDevX
 		*spans = append(*spans, **cur)
 	}
-	*cur = &textSpan{devY: newDevY, devX: newDevX, text: getSpanBuf()}
+	*cur = &textSpan{devY: newDevY, devX: newDevX, fontSize: ts.fontSize, text: getSpanBuf()}
 }
 
 // parseFloatBytes parses a float from a byte slice without allocating a string.
@@ -6,13 +6,17 @@ package poppler_purego
 
 import (
 	"errors"
+	"fmt"
+	"image"
 	"io"
 	"path/filepath"
 	"strconv"
 	"time"
+	"unsafe"
 
 	"github.com/ebitengine/purego"
 	"github.com/johbar/text-extraction-service/v4/internal/unix"
+	"github.com/johbar/text-extraction-service/v4/pkg/layout"
 	"github.com/johbar/text-extraction-service/v4/pkg/pdflibwrappers"
 )
 
@@ -22,6 +26,11 @@ type GError struct {
 	_       int32
 }
 
+// rectangle is a PopplerRectangle. Its origin is the top left corner of the page.
+type rectangle struct {
+	x1, y1, x2, y2 float64
+}
+
 // Page represents a PDF page opened by Poppler
 type Page uintptr
 
@@ -60,12 +69,27 @@ var (
 	poppler_document_get_creation_date     func(doc) int64
 	poppler_document_get_modification_date func(doc) int64
 	// image related
-	g_list_length                   func(glist uintptr) uint32
-	poppler_page_get_image_mapping  func(page Page) uintptr
-	poppler_page_free_image_mapping func(glist uintptr)
+	g_list_length                   func(glist *gList) uint32
+	poppler_page_get_image_mapping  func(page Page) *gList
+	poppler_page_free_image_mapping func(glist *gList)
 
 	poppler_page_get_text func(Page) *byte
-	defaultLibNames       = []string{"libpoppler-glib.so", "libpoppler-glib.so.8", "/opt/homebrew/lib/libpoppler-glib.8.dylib", "/opt/homebrew/lib/libpoppler-glib.dylib", "libpoppler-glib.8.dylib"}
+	// layout related
+	poppler_page_get_size        func(page Page, width, height *float64)
+	poppler_page_get_text_layout func(page Page, rectangles **rectangle, nRectangles *uint32) bool
+	// rendering via cairo, which poppler-glib is linked against
+	poppler_page_render            func(page Page, cr uintptr)
+	cairo_image_surface_create     func(format, width, height int32) uintptr
+	cairo_image_surface_get_data   func(surface uintptr) unsafe.Pointer
+	cairo_image_surface_get_stride func(surface uintptr) int32
+	cairo_surface_flush            func(surface uintptr)
+	cairo_surface_destroy          func(surface uintptr)
+	cairo_create                   func(surface uintptr) uintptr
+	cairo_destroy                  func(cr uintptr)
+	cairo_scale                    func(cr uintptr, sx, sy float64)
+	cairo_set_source_rgb           func(cr uintptr, r, g, b float64)
+	cairo_paint                    func(cr uintptr)
+	defaultLibNames                = []string{"libpoppler-glib.so", "libpoppler-glib.so.8", "/opt/homebrew/lib/libpoppler-glib.8.dylib", "/opt/homebrew/lib/libpoppler-glib.dylib", "libpoppler-glib.8.dylib"}
 )
 
 func InitLib(path string) (string, error) {
@@ -103,6 +127,19 @@ func InitLib(path string) (string, error) {
 	purego.RegisterLibFunc(&g_list_length, lib, "g_list_length")
 	purego.RegisterLibFunc(&poppler_page_get_image_mapping, lib, "poppler_page_get_image_mapping")
 	purego.RegisterLibFunc(&poppler_page_free_image_mapping, lib, "poppler_page_free_image_mapping")
+	purego.RegisterLibFunc(&poppler_page_get_size, lib, "poppler_page_get_size")
+	purego.RegisterLibFunc(&poppler_page_get_text_layout, lib, "poppler_page_get_text_layout")
+	purego.RegisterLibFunc(&poppler_page_render, lib, "poppler_page_render")
+	purego.RegisterLibFunc(&cairo_image_surface_create, lib, "cairo_image_surface_create")
+	purego.RegisterLibFunc(&cairo_image_surface_get_data, lib, "cairo_image_surface_get_data")
+	purego.RegisterLibFunc(&cairo_image_surface_get_stride, lib, "cairo_image_surface_get_stride")
+	purego.RegisterLibFunc(&cairo_surface_flush, lib, "cairo_surface_flush")
+	purego.RegisterLibFunc(&cairo_surface_destroy, lib, "cairo_surface_destroy")
+	purego.RegisterLibFunc(&cairo_create, lib, "cairo_create")
+	purego.RegisterLibFunc(&cairo_destroy, lib, "cairo_destroy")
+	purego.RegisterLibFunc(&cairo_scale, lib, "cairo_scale")
+	purego.RegisterLibFunc(&cairo_set_source_rgb, lib, "cairo_set_source_rgb")
+	purego.RegisterLibFunc(&cairo_paint, lib, "cairo_paint")
 
 	return path, nil
 }
@@ -187,6 +224,77 @@ func (d *Document) Text(pageIndex int) (string, bool) {
 	return txt, images > 0
 }
 
+// PageLayout returns page i's words and their bounding boxes
+func (d *Document) PageLayout(i int) (*layout.Page, error) {
+	p := d.GetPage(i)
+	if p == 0 {
+		return nil, fmt.Errorf("poppler: could not load page %d", i)
+	}
+	defer p.Close()
+	page := &layout.Page{}
+	poppler_page_get_size(p, &page.Width, &page.Height)
+	var rects *rectangle
+	var n uint32
+	if !poppler_page_get_text_layout(p, &rects, &n) {
+		// no text on this page
+		return page, nil
+	}
+	defer free((*byte)(unsafe.Pointer(rects)))
+	// Poppler returns one rectangle per character of the page's text
+	boxes := unsafe.Slice(rects, n)
+	chars := make([]layout.Char, 0, n)
+	for _, r := range p.Text() {
+		if len(chars) == len(boxes) {
+			break
+		}
+		b := boxes[len(chars)]
+		chars = append(chars, layout.Char{Rune: r, Box: layout.Rect{X0: b.x1, Y0: b.y1, X1: b.x2, Y1: b.y2}})
+	}
+	page.Words = layout.WordsFromChars(chars)
+	return page, nil
+}
+
+// RenderPage renders page i at the given resolution as grayscale bitmap, e.g. for OCR
+func (d *Document) RenderPage(i int, dpi float64) (*image.Gray, error) {
+	// CAIRO_FORMAT_RGB24: 32 bits per pixel, the upper 8 bits unused
+	const formatRGB24 = 1
+	p := d.GetPage(i)
+	if p == 0 {
+		return nil, fmt.Errorf("poppler: could not load page %d", i)
+	}
+	defer p.Close()
+	var width, height float64
+	poppler_page_get_size(p, &width, &height)
+	w, h, scale := pdflibwrappers.RenderSize(width, height, dpi)
+	surface := cairo_image_surface_create(formatRGB24, int32(w), int32(h))
+	defer cairo_surface_destroy(surface)
+	cr := cairo_create(surface)
+	cairo_set_source_rgb(cr, 1, 1, 1)
+	cairo_paint(cr)
+	cairo_scale(cr, scale, scale)
+	poppler_page_render(p, cr)
+	cairo_destroy(cr)
+	cairo_surface_flush(surface)
+	data := cairo_image_surface_get_data(surface)
+	if data == nil {
+		return nil, fmt.Errorf("poppler: cannot render page %d with %dx%d pixels", i, w, h)
+	}
+	stride := int(cairo_image_surface_get_stride(surface))
+	buf := unsafe.Slice((*byte)(data), stride*h)
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for y := range h {
+		row := buf[y*stride:]
+		for x := range w {
+			// pixels are native endian uint32 0xXXRRGGBB
+			px := *(*uint32)(unsafe.Pointer(&row[4*x]))
+			r, g, b := (px>>16)&0xff, (px>>8)&0xff, px&0xff
+			// ITU-R BT.601 luma, like color.GrayModel
+			img.Pix[y*img.Stride+x] = uint8((19595*r + 38470*g + 7471*b + 1<<15) >> 16)
+		}
+	}
+	return img, nil
+}
+
 // StreamText writes the document's plain text content to an io.Writer
 func (d *Document) StreamText(w io.Writer) error {
 	for n := 0; n < d.pages; n++ {
@@ -250,6 +358,41 @@ func (p Page) Text() string {
 	return toStr(txtPtr)
 }
 
+// ImageCoverage returns the fraction of page i's area covered by images
+func (d *Document) ImageCoverage(i int) (float64, error) {
+	p := d.GetPage(i)
+	if p == 0 {
+		return 0, fmt.Errorf("poppler: could not load page %d", i)
+	}
+	defer p.Close()
+	var width, height float64
+	poppler_page_get_size(p, &width, &height)
+	return layout.Coverage(layout.Rect{X1: width, Y1: height}, p.imageAreas()), nil
+}
+
+// gList is a node of a doubly linked GList
+type gList struct {
+	data, next, prev unsafe.Pointer
+}
+
+// imageMapping is a PopplerImageMapping
+type imageMapping struct {
+	area    rectangle
+	imageId int32
+}
+
+// imageAreas returns the bounding boxes of the images on page
+func (p Page) imageAreas() []layout.Rect {
+	list := poppler_page_get_image_mapping(p)
+	defer poppler_page_free_image_mapping(list)
+	var areas []layout.Rect
+	for node := list; node != nil; node = (*gList)(node.next) {
+		a := (*imageMapping)(node.data).area
+		areas = append(areas, layout.Rect{X0: min(a.x1, a.x2), Y0: min(a.y1, a.y2), X1: max(a.x1, a.x2), Y1: max(a.y1, a.y2)})
+	}
+	return areas
+}
+
 // countImages returns the number of images on page
 func (p Page) countImages() uint32 {
 	list := poppler_page_get_image_mapping(p)
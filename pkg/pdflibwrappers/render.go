@@ -0,0 +1,19 @@
+package pdflibwrappers
+
+import "math"
+
+// MaxRenderDimension limits the width and height of a rendered page in pixels,
+// protecting against huge page sizes and resolutions.
+const MaxRenderDimension = 10000
+
+// RenderSize returns the size in pixels of a page of width x height points (1/72 inch) rendered at dpi
+// and the scale factor from points to pixels. The longer side is limited to [MaxRenderDimension].
+func RenderSize(width, height, dpi float64) (w, h int, scale float64) {
+	scale = dpi / 72
+	if longest := max(width, height) * scale; longest > MaxRenderDimension {
+		scale *= MaxRenderDimension / longest
+	}
+	w = max(1, int(math.Round(width*scale)))
+	h = max(1, int(math.Round(height*scale)))
+	return w, h, scale
+}
@@ -0,0 +1,21 @@
+package tesswrap
+
+import (
+	"fmt"
+	"image"
+)
+
+// encodePgm encodes img as binary PGM (P5), which Tesseract's image library
+// reads without any compression overhead.
+func encodePgm(img *image.Gray) []byte {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	header := fmt.Sprintf("P5\n%d %d\n255\n", w, h)
+	buf := make([]byte, 0, len(header)+w*h)
+	buf = append(buf, header...)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		i := img.PixOffset(b.Min.X, y)
+		buf = append(buf, img.Pix[i:i+w]...)
+	}
+	return buf
+}
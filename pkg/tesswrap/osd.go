@@ -0,0 +1,137 @@
+package tesswrap
+
+import (
+	"errors"
+	"image"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	// minOrientationConfidence is the confidence Tesseract's orientation detection must reach
+	// for an image to be rotated
+	minOrientationConfidence = 2.0
+	// minScriptConfidence is the confidence Tesseract's script detection must reach
+	// for the languages to be chosen by script
+	minScriptConfidence = 1.0
+)
+
+// osd is the result of Tesseract's orientation and script detection
+type osd struct {
+	// rotate is the clockwise rotation in degrees that turns the image upright
+	rotate          int
+	orientationConf float64
+	script          string
+	scriptConf      float64
+}
+
+// scriptLangs maps the scripts Tesseract's script detection reports to the languages written in them,
+// which are used if the script's own model is not installed. Latin script is left to [Languages].
+var scriptLangs = map[string][]string{
+	"Arabic":     {"ara", "fas", "urd"},
+	"Armenian":   {"hye"},
+	"Bengali":    {"ben", "asm"},
+	"Cyrillic":   {"rus", "ukr", "bel", "bul", "srp", "mkd"},
+	"Devanagari": {"hin", "mar", "nep", "san"},
+	"Ethiopic":   {"amh"},
+	"Fraktur":    {"frk"},
+	"Georgian":   {"kat"},
+	"Greek":      {"ell", "grc"},
+	"Gujarati":   {"guj"},
+	"Gurmukhi":   {"pan"},
+	"Han":        {"chi_sim", "chi_tra"},
+	"HanS":       {"chi_sim"},
+	"HanT":       {"chi_tra"},
+	"Hangul":     {"kor"},
+	"Hebrew":     {"heb"},
+	"Japanese":   {"jpn"},
+	"Kannada":    {"kan"},
+	"Khmer":      {"khm"},
+	"Korean":     {"kor"},
+	"Lao":        {"lao"},
+	"Malayalam":  {"mal"},
+	"Myanmar":    {"mya"},
+	"Oriya":      {"ori"},
+	"Sinhala":    {"sin"},
+	"Tamil":      {"tam"},
+	"Telugu":     {"tel"},
+	"Thai":       {"tha"},
+	"Tibetan":    {"bod"},
+}
+
+// parseOsd reads the output of Tesseract's orientation and script detection:
+//
+//	Page number: 0
+//	Orientation in degrees: 270
+//	Rotate: 90
+//	Orientation confidence: 8.51
+//	Script: Latin
+//	Script confidence: 4.20
+func parseOsd(out string) (osd, error) {
+	result := osd{rotate: -1}
+	for line := range strings.Lines(out) {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch key {
+		case "Rotate":
+			result.rotate, _ = strconv.Atoi(value)
+		case "Orientation confidence":
+			result.orientationConf, _ = strconv.ParseFloat(value, 64)
+		case "Script":
+			result.script = value
+		case "Script confidence":
+			result.scriptConf, _ = strconv.ParseFloat(value, 64)
+		}
+	}
+	if result.rotate < 0 {
+		return osd{}, errors.New("tesseract did not detect the orientation")
+	}
+	return result, nil
+}
+
+// DetectOrientation returns the clockwise rotation in degrees that turns img upright,
+// as found by Tesseract's orientation and script detection. It requires the 'osd' model.
+// It can be used as [imgprep.Options.Orient].
+func DetectOrientation(img *image.Gray) (int, error) {
+	o, err := detectOsd(encodePgm(img))
+	if err != nil || o.orientationConf < minOrientationConfidence {
+		return 0, err
+	}
+	return o.rotate, nil
+}
+
+// detectLang returns the languages matching the script detected in the image: the script's model,
+// if installed, or the installed models of languages written in it. Otherwise, and for Latin script, it returns [Languages].
+func detectLang(data []byte) string {
+	o, err := detectOsd(data)
+	if err != nil || o.scriptConf < minScriptConfidence {
+		return Languages
+	}
+	return langsForScript(o.script)
+}
+
+// langsForScript returns the installed languages for script, see [detectLang]
+func langsForScript(script string) string {
+	if script == "" || script == "Latin" {
+		return Languages
+	}
+	for _, model := range []string{script, "script/" + script} {
+		if slices.Contains(LangsAvailable, model) {
+			return model
+		}
+	}
+	var langs []string
+	for _, l := range scriptLangs[script] {
+		if slices.Contains(LangsAvailable, l) {
+			langs = append(langs, l)
+		}
+	}
+	if len(langs) == 0 {
+		return Languages
+	}
+	return strings.Join(langs, "+")
+}
@@ -0,0 +1,83 @@
+package tesswrap
+
+import (
+	"bytes"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"os"
+
+	"github.com/johbar/text-extraction-service/v4/pkg/imgprep"
+	"github.com/johbar/text-extraction-service/v4/pkg/layout"
+)
+
+// Preprocessing selects the steps applied to images before OCR.
+// The zero value passes images to Tesseract untouched.
+var Preprocessing imgprep.Options
+
+// prepared is an image ready for OCR and the factors it was scaled by during preprocessing
+type prepared struct {
+	data   []byte
+	sx, sy float64
+}
+
+// prepare applies [Preprocessing] to the encoded image and returns the result as PGM.
+// Images Go can't decode, e.g. TIFF or JPEG 2000, are returned unchanged.
+func prepare(data []byte) prepared {
+	if !Preprocessing.Enabled() {
+		return prepared{data, 1, 1}
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return prepared{data, 1, 1}
+	}
+	dpiX, dpiY := imgprep.Resolution(data)
+	return prepareImage(img, dpiX, dpiY)
+}
+
+// prepareImage applies [Preprocessing] to img with the given resolution, 0 if unknown.
+func prepareImage(img image.Image, dpiX, dpiY float64) prepared {
+	if !Preprocessing.Enabled() {
+		return prepared{encodePgm(imgprep.Gray(img)), 1, 1}
+	}
+	b := img.Bounds()
+	sx, sy := Preprocessing.Scale(b.Dx(), b.Dy(), dpiX, dpiY)
+	return prepared{encodePgm(imgprep.Process(img, dpiX, dpiY, Preprocessing)), sx, sy}
+}
+
+// prepareReader reads the image from r and prepares it, if preprocessing is enabled.
+// Otherwise r is returned as it is, so the image is streamed to Tesseract.
+func prepareReader(r io.Reader) (io.Reader, prepared, error) {
+	if !Preprocessing.Enabled() {
+		return r, prepared{sx: 1, sy: 1}, nil
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, prepared{}, err
+	}
+	p := prepare(data)
+	return bytes.NewReader(p.data), p, nil
+}
+
+// prepareFile reads and prepares the image at path. ok is false if preprocessing is disabled
+// and Tesseract should read the file itself.
+func prepareFile(path string) (p prepared, ok bool, err error) {
+	if !Preprocessing.Enabled() {
+		return prepared{}, false, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return prepared{}, false, err
+	}
+	return prepare(data), true, nil
+}
+
+// unscale maps the word boxes recognized on the prepared image back to the pixels of the original image.
+// Boxes on deskewed or rotated images refer to the straightened image.
+func (p prepared) unscale(page *layout.Page) {
+	if page != nil && (p.sx != 1 || p.sy != 1) {
+		page.Scale(1/p.sx, 1/p.sy)
+	}
+}
@@ -0,0 +1,70 @@
+package tesswrap
+
+import (
+	"image"
+	"strings"
+
+	"github.com/johbar/text-extraction-service/v4/pkg/layout"
+)
+
+// Options are the settings of a single OCR run
+type Options struct {
+	// Lang are the Tesseract languages separated by '+', [LangAuto] to choose them by the detected script,
+	// or empty for [Languages]
+	Lang string
+	// MinConfidence drops recognized words with a lower confidence (0 to 100) from words and text
+	MinConfidence float64
+}
+
+// Recognize runs OCR on the encoded image after preprocessing it.
+func Recognize(data []byte, opts Options) (Result, error) {
+	_, r, err := recognize(prepare(data), opts)
+	return r, err
+}
+
+// RecognizeWords runs OCR on the encoded image like [Recognize] and returns the recognized words
+// and their bounding boxes in pixels, too.
+func RecognizeWords(data []byte, opts Options) (*layout.Page, Result, error) {
+	return recognize(prepare(data), opts)
+}
+
+// RecognizeGray runs OCR on a grayscale bitmap with a resolution of dpi, e.g. a rendered PDF page, like [Recognize].
+func RecognizeGray(img *image.Gray, dpi float64, opts Options) (Result, error) {
+	_, r, err := recognize(prepareImage(img, dpi, dpi), opts)
+	return r, err
+}
+
+// RecognizeGrayWords runs OCR on a grayscale bitmap with a resolution of dpi like [RecognizeWords].
+func RecognizeGrayWords(img *image.Gray, dpi float64, opts Options) (*layout.Page, Result, error) {
+	return recognize(prepareImage(img, dpi, dpi), opts)
+}
+
+func recognize(p prepared, opts Options) (*layout.Page, Result, error) {
+	lang := opts.Lang
+	switch lang {
+	case "":
+		lang = Languages
+	case LangAuto:
+		lang = detectLang(p.data)
+	}
+	tsv, meanConf, err := ocrPage(p.data, lang)
+	if err != nil {
+		return nil, Result{Lang: lang}, err
+	}
+	page, text, err := parseTsv(strings.NewReader(tsv))
+	if err != nil {
+		return nil, Result{Lang: lang}, err
+	}
+	r := newResult(text, lang, page.Words)
+	if meanConf >= 0 {
+		r.Confidence = meanConf
+	}
+	if opts.MinConfidence > 0 {
+		// the mean confidence still covers all words
+		page, r.Text, _ = parseTsvMin(strings.NewReader(tsv), opts.MinConfidence)
+		r.Dropped = r.Words - len(page.Words)
+		r.Words = len(page.Words)
+	}
+	p.unscale(page)
+	return page, r, nil
+}
@@ -6,23 +6,36 @@ package tesswrap
 import (
 	"bytes"
 	"errors"
-	"fmt"
 	"io"
+	"os"
 	"os/exec"
-	"slices"
 	"strings"
+
+	"github.com/johbar/text-extraction-service/v4/pkg/layout"
 )
 
-var LangsAvailable []string
+// engineInterface is the way Tesseract is used, see [Engine]
+const engineInterface = "cli"
 
 func init() {
 	if _, err := exec.LookPath("tesseract"); err != nil {
 		Initialized = false
 	} else {
 		LangsAvailable = listLangs()
+		Version = getVersion()
 	}
 }
 
+// getVersion returns the version from the first line of `tesseract --version`, e.g. "tesseract 5.3.4"
+func getVersion() string {
+	output, err := exec.Command("tesseract", "--version").Output()
+	if err != nil {
+		return ""
+	}
+	first, _, _ := strings.Cut(string(output), "\n")
+	return strings.TrimPrefix(strings.TrimSpace(first), "tesseract ")
+}
+
 func listLangs() []string {
 	cmd := exec.Command("tesseract", "--list-langs")
 	output, err := cmd.Output()
@@ -44,27 +57,38 @@ func listLangs() []string {
 // and the configured languages have trained data models.
 // If not, false and a reason phrase reporting the first missing language file are returned.
 func TesseractConfigOk() (ok bool, reason string) {
-	LangSlice := strings.Split(Languages, "+")
-	for _, elem := range LangSlice {
-		if !slices.Contains(LangsAvailable, elem) {
-			return false, fmt.Sprintf("'%s' is not among the installed languages %v", elem, LangsAvailable)
-		}
+	if err := CheckLangs(Languages); err != nil {
+		return false, err.Error()
 	}
 	return Initialized, ""
 }
 
 func ImageBytesToText(imgBytes []byte) (string, error) {
-	r := bytes.NewReader(imgBytes)
-	return ImageReaderToText(r)
+	return ocrText(prepare(imgBytes).data)
 }
 
 func ImageReaderToText(r io.Reader) (string, error) {
 	if r == nil {
 		return "", errors.New("reader is nil")
 	}
-	cmd := exec.Command("tesseract", "-l", Languages, "-", "-")
+	r, _, err := prepareReader(r)
+	if err != nil {
+		return "", err
+	}
+	return readerToText(r)
+}
+
+// ocrText runs OCR on the image without preprocessing it
+func ocrText(data []byte) (string, error) {
+	return readerToText(bytes.NewReader(data))
+}
+
+func readerToText(r io.Reader) (string, error) {
+	cmd := tesseract("-l", Languages, "-", "-")
 	cmd.Stdin = r
+	acquire()
 	result, err := cmd.Output()
+	release()
 	if err != nil {
 		if exitErr, ok := err.(*exec.ExitError); ok {
 			return string(exitErr.Stderr), err
@@ -83,14 +107,113 @@ func ImageReaderToWriter(r io.Reader, w io.Writer) error {
 	if r == nil {
 		return errors.New("reader is nil")
 	}
-	cmd := exec.Command("tesseract", "-l", Languages, "-", "-")
+	r, _, err := prepareReader(r)
+	if err != nil {
+		return err
+	}
+	cmd := tesseract("-l", Languages, "-", "-")
 	cmd.Stdin = r
 	cmd.Stdout = w
+	acquire()
+	defer release()
 	return cmd.Run()
 }
 
+// ImageReaderToWords runs OCR on the image and returns the recognized words and their bounding boxes in pixels
+func ImageReaderToWords(r io.Reader) (*layout.Page, error) {
+	if r == nil {
+		return nil, errors.New("reader is nil")
+	}
+	r, p, err := prepareReader(r)
+	if err != nil {
+		return nil, err
+	}
+	page, err := ocrWords(r)
+	p.unscale(page)
+	return page, err
+}
+
+// ocrWords runs OCR on the image without preprocessing it
+func ocrWords(r io.Reader) (*layout.Page, error) {
+	cmd := tesseract("-l", Languages, "-", "-", "tsv")
+	cmd.Stdin = r
+	return runTsv(cmd)
+}
+
+// ImageToWords runs OCR on the image at path and returns the recognized words and their bounding boxes in pixels
+func ImageToWords(path string) (*layout.Page, error) {
+	p, ok, err := prepareFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return runTsv(tesseract("-l", Languages, path, "-", "tsv"))
+	}
+	page, err := ocrWords(bytes.NewReader(p.data))
+	p.unscale(page)
+	return page, err
+}
+
+func runTsv(cmd *exec.Cmd) (*layout.Page, error) {
+	acquire()
+	result, err := cmd.Output()
+	release()
+	if err != nil {
+		return nil, err
+	}
+	return ParseTsv(bytes.NewReader(result))
+}
+
 func ImageToWriter(path string, w io.Writer) error {
-	cmd := exec.Command("tesseract", "-l", Languages, path, "-")
+	p, ok, err := prepareFile(path)
+	if err != nil {
+		return err
+	}
+	cmd := tesseract("-l", Languages, path, "-")
+	if ok {
+		cmd = tesseract("-l", Languages, "-", "-")
+		cmd.Stdin = bytes.NewReader(p.data)
+	}
 	cmd.Stdout = w
+	acquire()
+	defer release()
 	return cmd.Run()
 }
+
+// ocrPage runs OCR on the image with lang and returns Tesseract's TSV output.
+// The mean confidence is computed from the words' confidences in the TSV output, so -1 is returned for it.
+func ocrPage(data []byte, lang string) (string, float64, error) {
+	cmd := tesseract("-l", lang, "-", "-", "tsv")
+	cmd.Stdin = bytes.NewReader(data)
+	acquire()
+	result, err := cmd.Output()
+	release()
+	if err != nil {
+		return "", -1, err
+	}
+	return string(result), -1, nil
+}
+
+// detectOsd runs Tesseract's orientation and script detection (page segmentation mode 0) on the image
+func detectOsd(data []byte) (osd, error) {
+	cmd := tesseract("--psm", "0", "-", "-")
+	cmd.Stdin = bytes.NewReader(data)
+	acquire()
+	result, err := cmd.Output()
+	release()
+	if err != nil {
+		return osd{}, err
+	}
+	return parseOsd(string(result))
+}
+
+// tesseract returns the command running the Tesseract CLI with args.
+// When several images are OCRed concurrently, each process is limited to a single thread,
+// as Tesseract's own multithreading doesn't pay off then.
+func tesseract(args ...string) *exec.Cmd {
+	cmd := exec.Command("tesseract", args...)
+	if MaxConcurrency() > 1 {
+		cmd.Env = append(os.Environ(), "OMP_THREAD_LIMIT=1")
+	}
+	return cmd
+}
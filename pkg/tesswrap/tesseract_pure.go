@@ -6,10 +6,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"slices"
+	"strings"
 	"sync"
+	"unsafe"
 
 	"github.com/ebitengine/purego"
 	"github.com/johbar/text-extraction-service/v4/internal/unix"
+	"github.com/johbar/text-extraction-service/v4/pkg/layout"
 )
 
 var (
@@ -17,15 +21,16 @@ var (
 	TessBaseAPICreate func() uintptr
 	TessBaseAPIDelete func(handle uintptr)
 	TessBaseAPIInit3  func(baseApiHandle uintptr, datapath *byte, lang *byte) int
-	// This returns a vector, essentially a slice. purego can't deal with that
-	// TessBaseAPIGetAvailableLanguagesAsVector func(baseApiHandle uintptr) *uintptr
 	/*
 		Close down tesseract and free up all memory. End() is equivalent to destructing and reconstructing
 		your TessBaseAPI. Once End() has been used, none of the other API functions may be used other than Init.
 	*/
-	TessBaseAPIEnd            func(handle uintptr)
-	TessBaseAPISetImage2      func(handle uintptr, pix uintptr)
-	TessBaseAPIGetUTF8Text    func(handle uintptr) *byte
+	TessBaseAPIEnd         func(handle uintptr)
+	TessBaseAPISetImage2   func(handle uintptr, pix uintptr)
+	TessBaseAPIGetUTF8Text func(handle uintptr) *byte
+	TessBaseAPIGetTsvText  func(handle uintptr, pageNumber int32) *byte
+	// Returns the (average) confidence value between 0 and 100.
+	TessBaseAPIMeanTextConf   func(handle uintptr) int32
 	TessBaseAPISetPageSegMode func(handle uintptr, mode uint32)
 	/*
 		Free up recognition results and any stored image data,
@@ -33,15 +38,28 @@ var (
 		Afterwards, you must call SetImage or TesseractRect before doing any Recognize or Get* operation.
 	*/
 	TessBaseAPIClear func(handle uintptr)
+	// Detect the orientation of the input image and apparent script (alphabet).
+	// orient_deg is the detected clockwise rotation of the input image in degrees (0, 90, 180, 270).
+	TessBaseAPIDetectOrientationScript func(handle uintptr, orientDeg *int32, orientConf *float32, scriptName **byte, scriptConf *float32) bool
 
 	pixReadMem  func(data []byte, length uint64) uintptr
 	pixRead     func(path string) uintptr
 	pixFreeData func(data uintptr)
 	free        func(*byte)
-	lock        sync.Mutex
-	handle      uintptr
+
+	TessBaseAPIGetAvailableLanguagesAsVector func(handle uintptr) **byte
+	TessDeleteTextArray                      func(arr **byte)
+
+	// poolMtx guards idleHandles, the initialized TessBaseAPI handles not in use
+	poolMtx     sync.Mutex
+	idleHandles []handle
+
+	errNoImage = errors.New("not an image")
 )
 
+// engineInterface is the way Tesseract is used, see [Engine]
+const engineInterface = "libtesseract"
+
 func init() {
 	lib, err := purego.Dlopen("libtesseract.so", purego.RTLD_LAZY)
 	if err != nil {
@@ -56,6 +74,8 @@ func init() {
 	purego.RegisterLibFunc(&TessVersion, lib, "TessVersion")
 	purego.RegisterLibFunc(&TessBaseAPISetImage2, lib, "TessBaseAPISetImage2")
 	purego.RegisterLibFunc(&TessBaseAPIGetUTF8Text, lib, "TessBaseAPIGetUTF8Text")
+	purego.RegisterLibFunc(&TessBaseAPIGetTsvText, lib, "TessBaseAPIGetTsvText")
+	purego.RegisterLibFunc(&TessBaseAPIMeanTextConf, lib, "TessBaseAPIMeanTextConf")
 	purego.RegisterLibFunc(&free, lib, "free")
 	purego.RegisterLibFunc(&pixReadMem, lib, "pixReadMem")
 	purego.RegisterLibFunc(&pixRead, lib, "pixRead")
@@ -64,17 +84,77 @@ func init() {
 
 	purego.RegisterLibFunc(&TessBaseAPISetPageSegMode, lib, "TessBaseAPISetPageSegMode")
 	purego.RegisterLibFunc(&TessBaseAPIClear, lib, "TessBaseAPIClear")
+	purego.RegisterLibFunc(&TessBaseAPIDetectOrientationScript, lib, "TessBaseAPIDetectOrientationScript")
+	purego.RegisterLibFunc(&TessBaseAPIGetAvailableLanguagesAsVector, lib, "TessBaseAPIGetAvailableLanguagesAsVector")
+	purego.RegisterLibFunc(&TessDeleteTextArray, lib, "TessDeleteTextArray")
 
 	Version = getVersion()
 	Initialized = true
 }
 
-func initLib() {
-	handle = TessBaseAPICreate()
-	lang, _ := unix.BytePtrFromString(Languages)
-	if ret := TessBaseAPIInit3(handle, nil, lang); ret != 0 {
-		Initialized = false
+// handle is a TessBaseAPI handle initialized with lang
+type handle struct {
+	ptr  uintptr
+	lang string
+}
+
+// getHandle returns an idle TessBaseAPI handle initialized with lang or creates and initializes a new one.
+// The caller must hold an OCR slot, which limits the number of handles in use to [MaxConcurrency].
+func getHandle(lang string) (handle, error) {
+	poolMtx.Lock()
+	for i := len(idleHandles) - 1; i >= 0; i-- {
+		if h := idleHandles[i]; h.lang == lang {
+			idleHandles = slices.Delete(idleHandles, i, i+1)
+			poolMtx.Unlock()
+			return h, nil
+		}
+	}
+	poolMtx.Unlock()
+	h := TessBaseAPICreate()
+	langPtr, _ := unix.BytePtrFromString(lang)
+	if ret := TessBaseAPIInit3(h, nil, langPtr); ret != 0 {
+		TessBaseAPIDelete(h)
+		return handle{}, fmt.Errorf("tesseract could not be initialized with languages '%s'", lang)
+	}
+	return handle{h, lang}, nil
+}
+
+// putHandle clears the handle's results and returns it to the pool.
+// Initialized handles are kept, as loading the language models is time-consuming.
+// The least recently used handles beyond [MaxConcurrency], e.g. of rarely requested languages, are deleted.
+func putHandle(h handle) {
+	TessBaseAPIClear(h.ptr)
+	poolMtx.Lock()
+	idleHandles = append(idleHandles, h)
+	var evicted []handle
+	if n := len(idleHandles) - MaxConcurrency(); n > 0 {
+		evicted = slices.Clone(idleHandles[:n])
+		idleHandles = slices.Delete(idleHandles, 0, n)
+	}
+	poolMtx.Unlock()
+	for _, h := range evicted {
+		TessBaseAPIEnd(h.ptr)
+		TessBaseAPIDelete(h.ptr)
+	}
+}
+
+// withHandle runs OCR with lang on the image returned by readPix and calls recognize with the handle the image is set on.
+func withHandle(lang string, readPix func() uintptr, recognize func(handle uintptr) error) error {
+	acquire()
+	defer release()
+	h, err := getHandle(lang)
+	if err != nil {
+		return err
 	}
+	defer putHandle(h)
+	TessBaseAPISetPageSegMode(h.ptr, 1) //PSM_AUTO_OSD
+	pix := readPix()
+	if pix == 0 {
+		return errNoImage
+	}
+	defer pixFreeData(pix)
+	TessBaseAPISetImage2(h.ptr, pix)
+	return recognize(h.ptr)
 }
 
 func getVersion() string {
@@ -90,28 +170,19 @@ func ImageReaderToText(r io.Reader) (string, error) {
 }
 
 func ImageBytesToText(data []byte) (string, error) {
-	lock.Lock()
-	defer lock.Unlock()
-	if handle == 0 {
-		// start the tesseract lib if it hasn't been already
-		initLib()
-	}
-	if !Initialized {
-		return "", errors.New("tesseract could not be initialized")
-	}
-	defer TessBaseAPIClear(handle)
+	return ocrText(prepare(data).data)
+}
 
-	TessBaseAPISetPageSegMode(handle, 1) //PSM_AUTO_OSD
-	_pix := pixReadMem(data, uint64(len(data)))
-	if _pix == 0 {
-		return "", errors.New("not an image")
-	}
-	defer pixFreeData(_pix)
-	TessBaseAPISetImage2(handle, _pix)
-	text := TessBaseAPIGetUTF8Text(handle)
-	result := unix.BytePtrToString(text)
-	free(text)
-	return result, nil
+// ocrText runs OCR on the image without preprocessing it
+func ocrText(data []byte) (string, error) {
+	var result string
+	err := withHandle(Languages, func() uintptr { return pixReadMem(data, uint64(len(data))) }, func(handle uintptr) error {
+		text := TessBaseAPIGetUTF8Text(handle)
+		result = unix.BytePtrToString(text)
+		free(text)
+		return nil
+	})
+	return result, err
 }
 
 func ImageReaderToWriter(r io.Reader, w io.Writer) error {
@@ -124,31 +195,143 @@ func ImageReaderToWriter(r io.Reader, w io.Writer) error {
 }
 
 func ImageToWriter(path string, w io.Writer) error {
-	lock.Lock()
-	defer lock.Unlock()
-	if handle == 0 {
-		// start the tesseract lib if it hasn't been already
-		initLib()
+	if p, ok, err := prepareFile(path); err != nil {
+		return err
+	} else if ok {
+		txt, err := ocrText(p.data)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write([]byte(txt))
+		return err
 	}
-	if !Initialized {
-		return errors.New("tesseract could not be initialized")
+	err := withHandle(Languages, func() uintptr { return pixRead(path) }, func(handle uintptr) error {
+		text := TessBaseAPIGetUTF8Text(handle)
+		defer free(text)
+		_, err := w.Write([]byte(unix.BytePtrToString(text)))
+		return err
+	})
+	if errors.Is(err, errNoImage) {
+		return fmt.Errorf("not a supported image type: '%s'", path)
 	}
-	defer TessBaseAPIClear(handle)
+	return err
+}
 
-	TessBaseAPISetPageSegMode(handle, 1) //PSM_AUTO_OSD
-	_pix := pixRead(path)
-	if _pix == 0 {
-		return fmt.Errorf("not a supported image type: '%s'", path)
+// ImageReaderToWords runs OCR on the image and returns the recognized words and their bounding boxes in pixels
+func ImageReaderToWords(r io.Reader) (*layout.Page, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
 	}
-	defer pixFreeData(_pix)
-	TessBaseAPISetImage2(handle, _pix)
-	text := TessBaseAPIGetUTF8Text(handle)
-	defer free(text)
-	result := unix.BytePtrToString(text)
-	w.Write([]byte(result))
-	return nil
+	p := prepare(data)
+	page, err := bytesToWords(p.data)
+	p.unscale(page)
+	return page, err
+}
+
+func bytesToWords(data []byte) (*layout.Page, error) {
+	return pixToWords(func() uintptr { return pixReadMem(data, uint64(len(data))) })
 }
 
+// ImageToWords runs OCR on the image at path and returns the recognized words and their bounding boxes in pixels
+func ImageToWords(path string) (*layout.Page, error) {
+	p, ok, err := prepareFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return pixToWords(func() uintptr { return pixRead(path) })
+	}
+	page, err := bytesToWords(p.data)
+	p.unscale(page)
+	return page, err
+}
+
+// ocrPage runs OCR on the image with lang and returns Tesseract's TSV output and mean confidence.
+// The word confidences in the TSV output are the ones TessBaseAPIAllWordConfidences returns.
+func ocrPage(data []byte, lang string) (string, float64, error) {
+	var (
+		result   string
+		meanConf float64
+	)
+	err := withHandle(lang, func() uintptr { return pixReadMem(data, uint64(len(data))) }, func(handle uintptr) error {
+		tsv := TessBaseAPIGetTsvText(handle, 0)
+		if tsv == nil {
+			return errors.New("tesseract returned no result")
+		}
+		defer free(tsv)
+		result = unix.BytePtrToString(tsv)
+		// recognition has been done by GetTsvText already
+		meanConf = float64(TessBaseAPIMeanTextConf(handle))
+		return nil
+	})
+	return result, meanConf, err
+}
+
+// detectOsd runs Tesseract's orientation and script detection on the image
+func detectOsd(data []byte) (osd, error) {
+	var result osd
+	err := withHandle(Languages, func() uintptr { return pixReadMem(data, uint64(len(data))) }, func(handle uintptr) error {
+		var (
+			deg              int32
+			conf, scriptConf float32
+			script           *byte
+		)
+		if !TessBaseAPIDetectOrientationScript(handle, &deg, &conf, &script, &scriptConf) {
+			return errors.New("tesseract did not detect the orientation")
+		}
+		result = osd{
+			// the image is rotated by deg, turning it back takes the remainder of a full turn
+			rotate:          (360 - int(deg)) % 360,
+			orientationConf: float64(conf),
+			script:          unix.BytePtrToString(script),
+			scriptConf:      float64(scriptConf),
+		}
+		return nil
+	})
+	return result, err
+}
+
+func pixToWords(readPix func() uintptr) (*layout.Page, error) {
+	var page *layout.Page
+	err := withHandle(Languages, readPix, func(handle uintptr) error {
+		tsv := TessBaseAPIGetTsvText(handle, 0)
+		if tsv == nil {
+			return errors.New("tesseract returned no result")
+		}
+		defer free(tsv)
+		var err error
+		page, err = ParseTsv(strings.NewReader(unix.BytePtrToString(tsv)))
+		return err
+	})
+	return page, err
+}
+
+// TesseractConfigOk returns true and an empty string, if Tesseract can be initialized with the configured languages.
+// If not, false and a reason phrase are returned. It fills [LangsAvailable], too.
 func TesseractConfigOk() (ok bool, reason string) {
+	acquire()
+	defer release()
+	h, err := getHandle(Languages)
+	if err != nil {
+		return false, err.Error()
+	}
+	defer putHandle(h)
+	LangsAvailable = listLangs(h.ptr)
 	return true, ""
 }
+
+// listLangs returns the languages the handle's data path has trained data models for
+func listLangs(handle uintptr) []string {
+	arr := TessBaseAPIGetAvailableLanguagesAsVector(handle)
+	if arr == nil {
+		return nil
+	}
+	defer TessDeleteTextArray(arr)
+	var langs []string
+	// the array is terminated by a null pointer
+	for p := arr; *p != nil; p = (**byte)(unsafe.Add(unsafe.Pointer(p), unsafe.Sizeof(p))) {
+		langs = append(langs, unix.BytePtrToString(*p))
+	}
+	return langs
+}
@@ -5,10 +5,91 @@ Alternative interfaces/implementations can be used by supplying build tags.
 */
 package tesswrap
 
+import (
+	"fmt"
+	"runtime"
+	"slices"
+	"strings"
+
+	"github.com/johbar/text-extraction-service/v4/pkg/layout"
+)
+
+// LangAuto selects the languages by the script Tesseract's orientation and script detection finds in an image
+const LangAuto = "auto"
+
 var (
 	// Initialized indicates if this package is usable
 	Initialized bool = true
 	// Languages tesseract shall take into consideration when performing OCR
 	Languages string = "Latin+osd"
 	Version   string
+	// LangsAvailable are the installed trained data models
+	LangsAvailable []string
+	// slots limits the number of images being OCRed concurrently
+	slots = make(chan struct{}, runtime.NumCPU())
 )
+
+// SetMaxConcurrency limits the number of images this process OCRs concurrently.
+// The default is the number of CPUs. It must be called before any OCR is performed.
+func SetMaxConcurrency(n int) {
+	slots = make(chan struct{}, max(n, 1))
+}
+
+// MaxConcurrency returns the number of images this process OCRs concurrently at most
+func MaxConcurrency() int {
+	return cap(slots)
+}
+
+// acquire blocks until an OCR slot is free
+func acquire() {
+	slots <- struct{}{}
+}
+
+// release frees an OCR slot
+func release() {
+	<-slots
+}
+
+// Result is the text recognized in an image
+type Result struct {
+	Text string
+	// Lang are the languages Tesseract used, separated by '+'
+	Lang string
+	// Confidence is Tesseract's mean confidence (0 to 100) in the recognized words, including dropped ones
+	Confidence float64
+	// Words is the number of recognized words
+	Words int
+	// Dropped is the number of words dropped for their low confidence, see [Options.MinConfidence]
+	Dropped int
+}
+
+// Engine returns the OCR engine's name, version and interface, e.g. "tesseract 5.3.4 (cli)"
+func Engine() string {
+	return strings.TrimSpace("tesseract "+Version) + " (" + engineInterface + ")"
+}
+
+// newResult returns the result of recognizing words with lang
+func newResult(text, lang string, words []layout.Word) Result {
+	r := Result{Text: text, Lang: lang, Words: len(words)}
+	for _, w := range words {
+		r.Confidence += w.Confidence
+	}
+	if r.Words > 0 {
+		r.Confidence /= float64(r.Words)
+	}
+	return r
+}
+
+// CheckLangs returns an error if any of the languages separated by '+' has no trained data model installed.
+// [LangAuto] is accepted, too.
+func CheckLangs(lang string) error {
+	if lang == LangAuto {
+		return nil
+	}
+	for l := range strings.SplitSeq(lang, "+") {
+		if !slices.Contains(LangsAvailable, l) {
+			return fmt.Errorf("'%s' is not among the installed languages %v", l, LangsAvailable)
+		}
+	}
+	return nil
+}
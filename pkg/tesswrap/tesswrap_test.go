@@ -1,7 +1,9 @@
 package tesswrap
 
 import (
+	"image"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -25,3 +27,102 @@ func TestImageToText(t *testing.T) {
 	}
 	t.Log(txt)
 }
+
+func TestParseTsv(t *testing.T) {
+	tsv := "level\tpage_num\tblock_num\tpar_num\tline_num\tword_num\tleft\ttop\twidth\theight\tconf\ttext\n" +
+		"1\t1\t0\t0\t0\t0\t0\t0\t640\t480\t-1\t\n" +
+		"4\t1\t1\t1\t1\t0\t10\t20\t200\t30\t-1\t\n" +
+		"5\t1\t1\t1\t1\t1\t10\t20\t90\t30\t96.5\tHello\n" +
+		"5\t1\t1\t1\t1\t2\t110\t20\t100\t30\t91.2\tWorld\n" +
+		"5\t1\t1\t1\t1\t3\t220\t20\t5\t30\t95.0\t \n"
+	page, err := ParseTsv(strings.NewReader(tsv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Width != 640 || page.Height != 480 {
+		t.Errorf("want page size 640x480, got %vx%v", page.Width, page.Height)
+	}
+	if len(page.Words) != 2 {
+		t.Fatalf("want 2 words, got %d", len(page.Words))
+	}
+	if w := page.Words[1]; w.Text != "World" || w.Box.X0 != 110 || w.Box.X1 != 210 || w.Box.Y1 != 50 {
+		t.Errorf("unexpected word %v", w)
+	}
+}
+
+func TestEncodePgm(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 4, 2))
+	for i := range img.Pix {
+		img.Pix[i] = byte(i)
+	}
+	got := encodePgm(img.SubImage(image.Rect(1, 0, 3, 2)).(*image.Gray))
+	want := "P5\n2 2\n255\n\x01\x02\x05\x06"
+	if string(got) != want {
+		t.Errorf("encodePgm() = %q, want %q", got, want)
+	}
+}
+
+func TestParseOsd(t *testing.T) {
+	tests := []struct {
+		out     string
+		want    osd
+		wantErr bool
+	}{
+		{"Page number: 0\nOrientation in degrees: 270\nRotate: 90\nOrientation confidence: 8.51\nScript: Greek\nScript confidence: 4.20\n",
+			osd{rotate: 90, orientationConf: 8.51, script: "Greek", scriptConf: 4.2}, false},
+		{"Too few characters. Skipping this page\n", osd{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseOsd(tt.out)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseOsd(%q): want %+v (error: %v), got %+v (%v)", tt.out, tt.want, tt.wantErr, got, err)
+		}
+	}
+}
+
+func TestParseTsvText(t *testing.T) {
+	tsv := "level\tpage_num\tblock_num\tpar_num\tline_num\tword_num\tleft\ttop\twidth\theight\tconf\ttext\n" +
+		"5\t1\t1\t1\t1\t1\t10\t20\t90\t30\t90\tHello\n" +
+		"5\t1\t1\t1\t1\t2\t110\t20\t100\t30\t80\tWorld\n" +
+		"5\t1\t1\t1\t2\t1\t10\t60\t90\t30\t70\tagain\n" +
+		"5\t1\t2\t1\t1\t1\t10\t120\t90\t30\t60\tBye\n"
+	page, text, err := parseTsv(strings.NewReader(tsv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Hello World\nagain\n\nBye\n\n"; text != want {
+		t.Errorf("want text %q, got %q", want, text)
+	}
+	if r := newResult(text, "eng", page.Words); r.Words != 4 || r.Confidence != 75 {
+		t.Errorf("want 4 words with a mean confidence of 75, got %d with %v", r.Words, r.Confidence)
+	}
+	page, text, err = parseTsvMin(strings.NewReader(tsv), 75)
+	if want := "Hello World\n\n"; err != nil || text != want || len(page.Words) != 2 {
+		t.Errorf("want text %q of 2 words, got %q of %d (%v)", want, text, len(page.Words), err)
+	}
+}
+
+func TestLangsForScript(t *testing.T) {
+	langs, available := Languages, LangsAvailable
+	defer func() { Languages, LangsAvailable = langs, available }()
+	Languages = "deu+pol"
+	LangsAvailable = []string{"deu", "pol", "ell", "rus", "ukr", "script/Arabic", "osd"}
+	tests := map[string]string{
+		"Latin":    "deu+pol",
+		"Greek":    "ell",
+		"Cyrillic": "rus+ukr",
+		"Arabic":   "script/Arabic",
+		"Thai":     "deu+pol",
+	}
+	for script, want := range tests {
+		if got := langsForScript(script); got != want {
+			t.Errorf("%s: want %q, got %q", script, want, got)
+		}
+	}
+	if err := CheckLangs("deu+ell"); err != nil {
+		t.Error(err)
+	}
+	if err := CheckLangs("deu+fra"); err == nil {
+		t.Error("want an error for a missing language")
+	}
+}
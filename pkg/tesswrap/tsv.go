@@ -0,0 +1,96 @@
+package tesswrap
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/johbar/text-extraction-service/v4/pkg/layout"
+)
+
+// Levels of the rows in Tesseract's TSV output
+const (
+	tsvLevelPage = 1
+	tsvLevelWord = 5
+)
+
+// ParseTsv reads Tesseract's TSV output (`tesseract image - tsv`) and returns the recognized words
+// with their bounding boxes in pixels. Only the first page is returned.
+func ParseTsv(r io.Reader) (*layout.Page, error) {
+	page, _, err := parseTsv(r)
+	return page, err
+}
+
+// parseTsv reads Tesseract's TSV output and returns the recognized words along with the text
+// the way Tesseract's text output has it: a line break after every line and an empty line after every paragraph.
+func parseTsv(r io.Reader) (*layout.Page, string, error) {
+	return parseTsvMin(r, 0)
+}
+
+// parseTsvMin works like [parseTsv], but skips words with a confidence below minConf.
+func parseTsvMin(r io.Reader, minConf float64) (*layout.Page, string, error) {
+	page := &layout.Page{}
+	var (
+		text strings.Builder
+		// the block, paragraph and line of the previous word
+		prev [3]string
+	)
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		// level page_num block_num par_num line_num word_num left top width height conf text
+		fields := strings.SplitN(s.Text(), "\t", 12)
+		if len(fields) < 11 {
+			continue
+		}
+		level, err := strconv.Atoi(fields[0])
+		if err != nil {
+			// header
+			continue
+		}
+		if pageNum, _ := strconv.Atoi(fields[1]); pageNum > 1 {
+			break
+		}
+		var box [4]float64
+		for i := range box {
+			box[i], _ = strconv.ParseFloat(fields[6+i], 64)
+		}
+		switch level {
+		case tsvLevelPage:
+			page.Width, page.Height = box[2], box[3]
+		case tsvLevelWord:
+			if len(fields) < 12 {
+				continue
+			}
+			word := strings.TrimSpace(fields[11])
+			if word == "" {
+				continue
+			}
+			conf, _ := strconv.ParseFloat(fields[10], 64)
+			if conf < minConf {
+				continue
+			}
+			page.Words = append(page.Words, layout.Word{
+				Text:       word,
+				Box:        layout.Rect{X0: box[0], Y0: box[1], X1: box[0] + box[2], Y1: box[1] + box[3]},
+				Confidence: conf,
+			})
+			pos := [3]string{fields[2], fields[3], fields[4]}
+			switch {
+			case text.Len() == 0:
+			case pos[0] != prev[0] || pos[1] != prev[1]:
+				text.WriteString("\n\n")
+			case pos[2] != prev[2]:
+				text.WriteByte('\n')
+			default:
+				text.WriteByte(' ')
+			}
+			text.WriteString(word)
+			prev = pos
+		}
+	}
+	if text.Len() > 0 {
+		text.WriteString("\n\n")
+	}
+	return page, text.String(), s.Err()
+}
@@ -0,0 +1,108 @@
+/*
+Package textquality rates extracted text, e.g. to tell whether a PDF page's text layer
+is usable or whether the page should rather be OCRed.
+
+Broken font encodings (missing or wrong ToUnicode maps) typically result in
+replacement characters, private use code points, control characters or
+sequences of valid letters that don't form any known words.
+*/
+package textquality
+
+import (
+	_ "embed"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MinWords is the number of words a text needs to have for its dictionary hit rate to be meaningful.
+const MinWords = 20
+
+//go:embed words.txt
+var wordList string
+
+var dictionary = func() map[string]struct{} {
+	m := make(map[string]struct{})
+	for line := range strings.Lines(wordList) {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			m[line] = struct{}{}
+		}
+	}
+	return m
+}()
+
+// Stats are the counts a text's quality is rated by.
+type Stats struct {
+	// Runes is the number of non-whitespace characters
+	Runes int
+	// Failures is the number of characters that indicate a failed glyph to Unicode mapping:
+	// U+FFFD, non-characters, private use code points and control characters
+	Failures int
+	// Printable is the number of letters, digits, marks, punctuation characters and symbols
+	Printable int
+	// Words is the number of words consisting of two or more latin letters.
+	// Words of other scripts are not counted, as the list of frequent words only covers latin script languages.
+	Words int
+	// Hits is the number of words found in the built-in list of frequent words
+	Hits int
+}
+
+// Analyze counts the characters and words of text.
+func Analyze(text string) Stats {
+	var s Stats
+	for _, r := range text {
+		if unicode.IsSpace(r) {
+			continue
+		}
+		s.Runes++
+		switch {
+		case failed(r):
+			s.Failures++
+		case unicode.In(r, unicode.L, unicode.N, unicode.M, unicode.P, unicode.S):
+			s.Printable++
+		}
+	}
+	for word := range strings.FieldsFuncSeq(text, func(r rune) bool { return !unicode.IsLetter(r) }) {
+		if utf8.RuneCountInString(word) < 2 || strings.ContainsFunc(word, func(r rune) bool { return !unicode.Is(unicode.Latin, r) }) {
+			continue
+		}
+		s.Words++
+		if _, ok := dictionary[strings.ToLower(word)]; ok {
+			s.Hits++
+		}
+	}
+	return s
+}
+
+func failed(r rune) bool {
+	return r == unicode.ReplacementChar ||
+		r&0xFFFE == 0xFFFE ||
+		unicode.Is(unicode.Co, r) ||
+		unicode.IsControl(r)
+}
+
+// FailureRate returns the fraction of characters that could not be mapped to Unicode.
+func (s Stats) FailureRate() float64 {
+	if s.Runes == 0 {
+		return 0
+	}
+	return float64(s.Failures) / float64(s.Runes)
+}
+
+// PrintableRatio returns the fraction of printable characters, 1 for empty texts.
+func (s Stats) PrintableRatio() float64 {
+	if s.Runes == 0 {
+		return 1
+	}
+	return float64(s.Printable) / float64(s.Runes)
+}
+
+// DictionaryHitRate returns the fraction of words found in the list of frequent words
+// and false if the text has less than [MinWords] words.
+func (s Stats) DictionaryHitRate() (float64, bool) {
+	if s.Words < MinWords {
+		return 0, false
+	}
+	return float64(s.Hits) / float64(s.Words), true
+}
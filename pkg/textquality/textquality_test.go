@@ -0,0 +1,40 @@
+package textquality
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAnalyze(t *testing.T) {
+	prose := strings.Repeat("The service extracts the text of documents and runs OCR on the images of scanned pages. ", 3)
+	s := Analyze(prose)
+	if s.FailureRate() != 0 {
+		t.Errorf("prose: FailureRate() = %v, want 0", s.FailureRate())
+	}
+	if s.PrintableRatio() != 1 {
+		t.Errorf("prose: PrintableRatio() = %v, want 1", s.PrintableRatio())
+	}
+	if rate, ok := s.DictionaryHitRate(); !ok || rate < 0.2 {
+		t.Errorf("prose: DictionaryHitRate() = %v, %v, want at least 0.2", rate, ok)
+	}
+
+	// a font without ToUnicode map, whose glyph IDs are taken for character codes
+	garbage := strings.Repeat("Wkh#vhuylfh#h{wudfwv#wkh#wh{w ri grfxphqwv dqg uxqv RFU rq wkh lpdjhv. ", 3)
+	s = Analyze(garbage)
+	if rate, ok := s.DictionaryHitRate(); !ok || rate > 0.1 {
+		t.Errorf("garbage: DictionaryHitRate() = %v, %v, want at most 0.1", rate, ok)
+	}
+
+	cyrillic := strings.Repeat("Сервис извлекает текст документов и распознаёт изображения отсканированных страниц. ", 3)
+	if _, ok := Analyze(cyrillic).DictionaryHitRate(); ok {
+		t.Error("cyrillic: DictionaryHitRate() should not be meaningful for words of other scripts")
+	}
+
+	s = Analyze("\uFFFD\uFFFD\uE001\uE002 ab\x01")
+	if s.Runes != 7 || s.Failures != 5 || s.Printable != 2 {
+		t.Errorf("broken: got %+v, want 7 runes, 5 failures, 2 printable", s)
+	}
+	if _, ok := s.DictionaryHitRate(); ok {
+		t.Error("broken: DictionaryHitRate() should not be meaningful for few words")
+	}
+}